@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/auto-tagging-mds/backfill/runner"
+	"github.com/auto-tagging-mds/database"
+
+	m "github.com/auto-tagging-mds/database/models"
+	u "github.com/auto-tagging-mds/utils"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+type backfillSvc struct {
+	db             database.Database
+	tableName      m.Tables
+	dbCallTimeout  time.Duration
+	logLevel       string
+	workerFunction string
+}
+
+func initSvc() (*backfillSvc, error) {
+	tablesName := u.InitTablesName()
+
+	db, err := database.New(tablesName)
+	if err != nil {
+		fmt.Printf("database connection error : %v\n", err)
+		return nil, err
+	}
+
+	return &backfillSvc{
+		db:             db,
+		dbCallTimeout:  2 * time.Second,
+		workerFunction: os.Getenv("BACKFILL_FUNCTION"),
+	}, nil
+}
+
+// backfillCreate saves a new job, or takes back a failed or stopped one, and starts the
+// worker on it, the job is polled with GET
+func (sc *backfillSvc) backfillCreate(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var svc m.BackfillRequest
+
+	// an empty body starts a real run
+	if request.Body != "" {
+		if err := json.Unmarshal([]byte(request.Body), &svc); err != nil {
+			return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+				ErrorMsg: aws.String(err.Error()),
+			})
+		}
+	}
+
+	job := runner.NewJob(svc.DryRun, u.GetActor(request))
+	if svc.JobID != "" {
+		var err error
+		job, err = sc.db.GetBackfillJob(svc.JobID)
+		if err != nil {
+			return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+				ErrorMsg: aws.String(err.Error()),
+			})
+		}
+
+		if job.JobID == "" {
+			return u.ApiResponse(http.StatusNotFound, u.EmptyStruct{})
+		}
+
+		// a running job is only resumed once its worker stopped holding it
+		if !runner.Resumable(job, time.Now()) {
+			return u.ApiResponse(http.StatusConflict, u.ErrorBody{
+				ErrorMsg: aws.String("backfill job is " + job.Status + ", only a failed or stopped job can be resumed"),
+			})
+		}
+		job.UpdatedBy = u.GetActor(request)
+	}
+
+	// a job resumed twice at once, or taken by a worker since it was read, is only saved once
+	err := runner.Save(sc.db, &job)
+	if errors.Is(err, u.ErrVersionConflict) {
+		return u.ApiResponse(http.StatusConflict, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	err = runner.Invoke(sc.workerFunction, job.JobID)
+	if err != nil {
+		job.Status, job.Error = runner.STATUS_FAILED, err.Error()
+		runner.Save(sc.db, &job)
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	return u.ApiResponse(http.StatusAccepted, job)
+}
+
+func (sc *backfillSvc) handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	events, err := sc.backfillCreate(ctx, request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return events, nil
+}
+
+func main() {
+	// catch run time error
+	defer u.Recover()
+
+	svc, err := initSvc()
+	if err != nil {
+		log.Fatal(err)
+	}
+	lambda.Start(svc.handler)
+}
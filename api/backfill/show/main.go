@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/auto-tagging-mds/database"
+
+	m "github.com/auto-tagging-mds/database/models"
+	u "github.com/auto-tagging-mds/utils"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+type backfillShowSvc struct {
+	db            database.Database
+	tableName     m.Tables
+	dbCallTimeout time.Duration
+	logLevel      string
+}
+
+func initSvc() (*backfillShowSvc, error) {
+	tablesName := u.InitTablesName()
+
+	db, err := database.New(tablesName)
+	if err != nil {
+		fmt.Printf("database connection error : %v\n", err)
+		return nil, err
+	}
+
+	return &backfillShowSvc{
+		db:            db,
+		dbCallTimeout: 2 * time.Second,
+	}, nil
+}
+
+func (sc *backfillShowSvc) backfillShow(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// get path parameter
+	jobID, ok := request.PathParameters["job_id"]
+	if ok != true {
+		return u.ApiResponse(http.StatusBadRequest, u.MissingParameter{ErrorMsg: "parameter required : job_id"})
+	}
+
+	job, err := sc.db.GetBackfillJob(jobID)
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	if job.JobID == "" {
+		return u.ApiResponse(http.StatusNotFound, u.EmptyStruct{})
+	}
+
+	return u.ApiResponse(http.StatusOK, job)
+}
+
+func (sc *backfillShowSvc) handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	events, err := sc.backfillShow(ctx, request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return events, nil
+}
+
+func main() {
+	// catch run time error
+	defer u.Recover()
+
+	svc, err := initSvc()
+	if err != nil {
+		log.Fatal(err)
+	}
+	lambda.Start(svc.handler)
+}
@@ -14,7 +14,6 @@ import (
 	m "github.com/auto-tagging-mds/database/models"
 	u "github.com/auto-tagging-mds/utils"
 
-	"github.com/auto-tagging-mds/database/dynamodb"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
@@ -30,10 +29,9 @@ type companySvc struct {
 func initSvc() (*companySvc, error) {
 	tablesName := u.InitTablesName()
 
-	var db database.Database
-	db, err := dynamodb.New(tablesName)
+	db, err := database.New(tablesName)
 	if err != nil {
-		fmt.Printf("dynamodb connection error : %v\n", err)
+		fmt.Printf("database connection error : %v\n", err)
 		return nil, err
 	}
 
@@ -61,6 +59,7 @@ func (sc *companySvc) companyCreate(ctx context.Context, request events.APIGatew
 		})
 	}
 
+	svc.UpdatedBy = u.GetActor(request)
 	company, err := sc.db.CreateCompany(svc)
 	if err != nil {
 		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
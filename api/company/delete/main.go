@@ -12,7 +12,6 @@ import (
 	m "github.com/auto-tagging-mds/database/models"
 	u "github.com/auto-tagging-mds/utils"
 
-	"github.com/auto-tagging-mds/database/dynamodb"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
@@ -28,10 +27,9 @@ type companySvc struct {
 func initSvc() (*companySvc, error) {
 	tablesName := u.InitTablesName()
 
-	var db database.Database
-	db, err := dynamodb.New(tablesName)
+	db, err := database.New(tablesName)
 	if err != nil {
-		fmt.Printf("dynamodb connection error : %v\n", err)
+		fmt.Printf("database connection error : %v\n", err)
 		return nil, err
 	}
 
@@ -49,7 +47,7 @@ func (sc *companySvc) serviceDelete(ctx context.Context, request events.APIGatew
 		return u.ApiResponse(http.StatusOK, u.MissingParameter{ErrorMsg: "parameter required : company_name"})
 	}
 
-	err := sc.db.DeleteCompany(companyName)
+	err := sc.db.DeleteCompany(companyName, u.GetActor(request))
 	if err != nil {
 		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
 			ErrorMsg: aws.String(err.Error()),
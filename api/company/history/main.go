@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/auto-tagging-mds/database"
+
+	m "github.com/auto-tagging-mds/database/models"
+	u "github.com/auto-tagging-mds/utils"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+type companyHistorySvc struct {
+	db            database.Database
+	tableName     m.Tables
+	dbCallTimeout time.Duration
+	logLevel      string
+}
+
+func initSvc() (*companyHistorySvc, error) {
+	tablesName := u.InitTablesName()
+
+	db, err := database.New(tablesName)
+	if err != nil {
+		fmt.Printf("database connection error : %v\n", err)
+		return nil, err
+	}
+
+	return &companyHistorySvc{
+		db:            db,
+		dbCallTimeout: 2 * time.Second,
+	}, nil
+}
+
+func (sc *companyHistorySvc) companyHistory(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// get path parameter, a company name or the uuid of a deleted company
+	companyName, ok := request.PathParameters["company_name"]
+	if ok != true {
+		return u.ApiResponse(http.StatusBadRequest, u.MissingParameter{ErrorMsg: "parameter required : company_name"})
+	}
+
+	limit, cursor, err := u.GetPageParameters(request.QueryStringParameters)
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	company, err := sc.db.GetCompany(companyName)
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	companyUUID := companyName
+	if company.CompanyUUID != "" {
+		companyUUID = company.CompanyUUID
+	}
+
+	history, next, err := sc.db.GetHistory(companyUUID, limit, cursor)
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	return u.ApiResponse(http.StatusOK, u.ListResponse{Items: history, NextCursor: next})
+}
+
+func (sc *companyHistorySvc) handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	events, err := sc.companyHistory(ctx, request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return events, nil
+}
+
+func main() {
+	// catch run time error
+	defer u.Recover()
+
+	svc, err := initSvc()
+	if err != nil {
+		log.Fatal(err)
+	}
+	lambda.Start(svc.handler)
+}
@@ -12,7 +12,6 @@ import (
 	m "github.com/auto-tagging-mds/database/models"
 	u "github.com/auto-tagging-mds/utils"
 
-	"github.com/auto-tagging-mds/database/dynamodb"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
@@ -28,10 +27,9 @@ type companySvc struct {
 func initSvc() (*companySvc, error) {
 	tablesName := u.InitTablesName()
 
-	var db database.Database
-	db, err := dynamodb.New(tablesName)
+	db, err := database.New(tablesName)
 	if err != nil {
-		fmt.Printf("dynamodb connection error : %v\n", err)
+		fmt.Printf("database connection error : %v\n", err)
 		return nil, err
 	}
 
@@ -43,14 +41,21 @@ func initSvc() (*companySvc, error) {
 
 func (sc *companySvc) serviceIndex(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 
-	services, err := sc.db.GetAllCompanies()
+	limit, cursor, err := u.GetPageParameters(request.QueryStringParameters)
 	if err != nil {
 		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
 			ErrorMsg: aws.String(err.Error()),
 		})
 	}
 
-	return u.ApiResponse(http.StatusOK, services)
+	services, next, err := sc.db.GetAllCompanies(limit, cursor)
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	return u.ApiResponse(http.StatusOK, u.ListResponse{Items: services, NextCursor: next})
 }
 
 func (sc *companySvc) handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
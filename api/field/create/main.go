@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/auto-tagging-mds/database"
+	"github.com/go-playground/validator"
+
+	m "github.com/auto-tagging-mds/database/models"
+	u "github.com/auto-tagging-mds/utils"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+type fieldSvc struct {
+	db            database.Database
+	tableName     m.Tables
+	dbCallTimeout time.Duration
+	logLevel      string
+}
+
+func initSvc() (*fieldSvc, error) {
+	tablesName := u.InitTablesName()
+
+	db, err := database.New(tablesName)
+	if err != nil {
+		fmt.Printf("database connection error : %v\n", err)
+		return nil, err
+	}
+
+	return &fieldSvc{
+		db:            db,
+		dbCallTimeout: 2 * time.Second,
+	}, nil
+}
+
+// fieldCreate declares a custom attribute services can set and rules can test
+func (sc *fieldSvc) fieldCreate(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var svc m.Field
+
+	if err := json.Unmarshal([]byte(request.Body), &svc); err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	validate := validator.New()
+	err := validate.Struct(svc)
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	svc.UpdatedBy = u.GetActor(request)
+	field, err := sc.db.CreateField(svc)
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	return u.ApiResponse(http.StatusCreated, field)
+}
+
+func (sc *fieldSvc) handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	events, err := sc.fieldCreate(ctx, request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return events, nil
+}
+
+func main() {
+	// catch run time error
+	defer u.Recover()
+
+	svc, err := initSvc()
+	if err != nil {
+		log.Fatal(err)
+	}
+	lambda.Start(svc.handler)
+}
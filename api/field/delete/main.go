@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/auto-tagging-mds/database"
+
+	m "github.com/auto-tagging-mds/database/models"
+	u "github.com/auto-tagging-mds/utils"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+type fieldSvc struct {
+	db            database.Database
+	tableName     m.Tables
+	dbCallTimeout time.Duration
+	logLevel      string
+}
+
+func initSvc() (*fieldSvc, error) {
+	tablesName := u.InitTablesName()
+
+	db, err := database.New(tablesName)
+	if err != nil {
+		fmt.Printf("database connection error : %v\n", err)
+		return nil, err
+	}
+
+	return &fieldSvc{
+		db:            db,
+		dbCallTimeout: 2 * time.Second,
+	}, nil
+}
+
+// fieldDelete removes a field, cascade also removes the attribute from the services and deletes the rules testing it
+func (sc *fieldSvc) fieldDelete(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	name, ok := request.PathParameters["name"]
+	if ok != true {
+		return u.ApiResponse(http.StatusBadRequest, u.MissingParameter{ErrorMsg: "parameter required : name"})
+	}
+
+	cascade, err := u.GetCascade(request.QueryStringParameters)
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	err = sc.db.DeleteField(name, cascade, u.GetActor(request))
+	var refErr *u.ReferencedError
+	if errors.As(err, &refErr) {
+		return u.ApiResponse(http.StatusConflict, m.ReferencedResponse{
+			ErrorMsg:   refErr.Error(),
+			References: refErr.References,
+		})
+	}
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	return u.ApiResponse(http.StatusOK, u.EmptyStruct{})
+}
+
+func (sc *fieldSvc) handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	events, err := sc.fieldDelete(ctx, request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return events, nil
+}
+
+func main() {
+	// catch run time error
+	defer u.Recover()
+
+	svc, err := initSvc()
+	if err != nil {
+		log.Fatal(err)
+	}
+	lambda.Start(svc.handler)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/auto-tagging-mds/database"
+	"github.com/go-playground/validator"
+
+	m "github.com/auto-tagging-mds/database/models"
+	u "github.com/auto-tagging-mds/utils"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+type fieldSvc struct {
+	db            database.Database
+	tableName     m.Tables
+	dbCallTimeout time.Duration
+	logLevel      string
+}
+
+func initSvc() (*fieldSvc, error) {
+	tablesName := u.InitTablesName()
+
+	db, err := database.New(tablesName)
+	if err != nil {
+		fmt.Printf("database connection error : %v\n", err)
+		return nil, err
+	}
+
+	return &fieldSvc{
+		db:            db,
+		dbCallTimeout: 2 * time.Second,
+	}, nil
+}
+
+// fieldUpdate replaces the constraints of the field of the path, its name and type stay
+func (sc *fieldSvc) fieldUpdate(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var svc m.Field
+
+	name, ok := request.PathParameters["name"]
+	if ok != true {
+		return u.ApiResponse(http.StatusBadRequest, u.MissingParameter{ErrorMsg: "parameter required : name"})
+	}
+
+	if err := json.Unmarshal([]byte(request.Body), &svc); err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	svc.Name = name
+	validate := validator.New()
+	err := validate.Struct(svc)
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	// If-Match takes precedence over the version in the body
+	version, err := u.GetIfMatchVersion(request.Headers)
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+	if version != 0 {
+		svc.Version = version
+	}
+
+	svc.UpdatedBy = u.GetActor(request)
+	err = sc.db.UpdateField(svc, name)
+	if errors.Is(err, u.ErrFieldNotFound) {
+		return u.ApiResponse(http.StatusNotFound, u.EmptyStruct{})
+	}
+	if errors.Is(err, u.ErrVersionConflict) {
+		return u.ApiResponse(http.StatusPreconditionFailed, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+	var conErr *u.ConstraintError
+	if errors.As(err, &conErr) {
+		return u.ApiResponse(http.StatusConflict, m.ReferencedResponse{
+			ErrorMsg:   conErr.Error(),
+			References: conErr.References,
+		})
+	}
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	field, err := sc.db.GetField(name)
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	return u.ApiResponseWithETag(http.StatusOK, field, field.Version)
+}
+
+func (sc *fieldSvc) handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	events, err := sc.fieldUpdate(ctx, request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return events, nil
+}
+
+func main() {
+	// catch run time error
+	defer u.Recover()
+
+	svc, err := initSvc()
+	if err != nil {
+		log.Fatal(err)
+	}
+	lambda.Start(svc.handler)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -14,7 +15,6 @@ import (
 	m "github.com/auto-tagging-mds/database/models"
 	u "github.com/auto-tagging-mds/utils"
 
-	"github.com/auto-tagging-mds/database/dynamodb"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
@@ -30,10 +30,9 @@ type ruleSvc struct {
 func initSvc() (*ruleSvc, error) {
 	tablesName := u.InitTablesName()
 
-	var db database.Database
-	db, err := dynamodb.New(tablesName)
+	db, err := database.New(tablesName)
 	if err != nil {
-		fmt.Printf("dynamodb connection error : %v\n", err)
+		fmt.Printf("database connection error : %v\n", err)
 		return nil, err
 	}
 
@@ -60,7 +59,12 @@ func (sc *ruleSvc) ruleCreate(ctx context.Context, request events.APIGatewayProx
 		})
 	}
 
+	svc.UpdatedBy = u.GetActor(request)
 	rule, err := sc.db.CreateRule(svc)
+	var valErr *u.ValidationError
+	if errors.As(err, &valErr) {
+		return u.ApiResponse(http.StatusBadRequest, m.ValidationResponse{ErrorMsg: valErr.Error(), Errors: valErr.Errors})
+	}
 	if err != nil {
 		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
 			ErrorMsg: aws.String(err.Error()),
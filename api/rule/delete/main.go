@@ -12,7 +12,6 @@ import (
 	m "github.com/auto-tagging-mds/database/models"
 	u "github.com/auto-tagging-mds/utils"
 
-	"github.com/auto-tagging-mds/database/dynamodb"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
@@ -28,10 +27,9 @@ type ruleSvc struct {
 func initSvc() (*ruleSvc, error) {
 	tablesName := u.InitTablesName()
 
-	var db database.Database
-	db, err := dynamodb.New(tablesName)
+	db, err := database.New(tablesName)
 	if err != nil {
-		fmt.Printf("dynamodb connection error : %v\n", err)
+		fmt.Printf("database connection error : %v\n", err)
 		return nil, err
 	}
 
@@ -48,7 +46,7 @@ func (sc *ruleSvc) ruleDelete(ctx context.Context, request events.APIGatewayProx
 		return u.ApiResponse(http.StatusOK, u.MissingParameter{ErrorMsg: "parameter required : rule uuid"})
 	}
 
-	err := sc.db.DeleteRule(ruleUUID)
+	err := sc.db.DeleteRule(ruleUUID, u.GetActor(request))
 	if err != nil {
 		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
 			ErrorMsg: aws.String(err.Error()),
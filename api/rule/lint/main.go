@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/auto-tagging-mds/database"
+
+	m "github.com/auto-tagging-mds/database/models"
+	u "github.com/auto-tagging-mds/utils"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+type ruleSvc struct {
+	db            database.Database
+	tableName     m.Tables
+	dbCallTimeout time.Duration
+	logLevel      string
+}
+
+func initSvc() (*ruleSvc, error) {
+	tablesName := u.InitTablesName()
+
+	db, err := database.New(tablesName)
+	if err != nil {
+		fmt.Printf("database connection error : %v\n", err)
+		return nil, err
+	}
+
+	return &ruleSvc{
+		db:            db,
+		dbCallTimeout: 2 * time.Second,
+	}, nil
+}
+
+// ruleLint validates every stored rule like a create would and lists the rules with defects
+func (sc *ruleSvc) ruleLint(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	fields, err := sc.db.ListFields()
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	lint := m.RuleLintResponse{Defects: []m.RuleLint{}}
+	cursor := ""
+	for {
+		rules, next, err := sc.db.GetAllRules(u.MAX_PAGE_LIMIT, cursor)
+		if err != nil {
+			return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+				ErrorMsg: aws.String(err.Error()),
+			})
+		}
+
+		lint.RulesScanned += len(rules)
+		lint.Defects = append(lint.Defects, u.LintRules(rules, fields)...)
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	return u.ApiResponse(http.StatusOK, lint)
+}
+
+func (sc *ruleSvc) handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	events, err := sc.ruleLint(ctx, request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return events, nil
+}
+
+func main() {
+	// catch run time error
+	defer u.Recover()
+
+	svc, err := initSvc()
+	if err != nil {
+		log.Fatal(err)
+	}
+	lambda.Start(svc.handler)
+}
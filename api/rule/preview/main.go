@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/auto-tagging-mds/database"
+	"github.com/go-playground/validator"
+
+	m "github.com/auto-tagging-mds/database/models"
+	u "github.com/auto-tagging-mds/utils"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+type ruleSvc struct {
+	db            database.Database
+	tableName     m.Tables
+	dbCallTimeout time.Duration
+	logLevel      string
+}
+
+func initSvc() (*ruleSvc, error) {
+	tablesName := u.InitTablesName()
+
+	db, err := database.New(tablesName)
+	if err != nil {
+		fmt.Printf("database connection error : %v\n", err)
+		return nil, err
+	}
+
+	return &ruleSvc{
+		db:            db,
+		dbCallTimeout: 2 * time.Second,
+	}, nil
+}
+
+// rulePreview evaluates the rule in the body against every service without saving anything
+func (sc *ruleSvc) rulePreview(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var svc m.RuleRequest
+
+	if err := json.Unmarshal([]byte(request.Body), &svc); err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	validate := validator.New()
+	err := validate.Struct(svc)
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	fields, err := sc.db.ListFields()
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	err = u.SetRuleExpression(&svc, fields)
+	var valErr *u.ValidationError
+	if errors.As(err, &valErr) {
+		return u.ApiResponse(http.StatusBadRequest, m.ValidationResponse{ErrorMsg: valErr.Error(), Errors: valErr.Errors})
+	}
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	tags, err := sc.db.ListTags()
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	// like on save an alias or a deprecated tag becomes its canonical tag, and a
+	// service tagged by the rule also gets the ancestors of the tag
+	tree := u.NewTagTree(tags)
+	resolved, err := tree.Resolve(svc.TagKey, svc.TagValue)
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+	svc.TagKey, svc.TagValue = resolved.Key, resolved.Value
+	implied := append([]m.Category{{Key: resolved.Key, Value: resolved.Value}}, tree.Ancestors(resolved.Key, resolved.Value)...)
+
+	rule := m.RuleResponse(svc)
+	preview := m.RulePreviewResponse{
+		Expression:    rule.Expression,
+		WouldGain:     []m.ServicePreview{},
+		AlreadyTagged: []m.ServicePreview{},
+		Failed:        []m.ServicePreview{},
+	}
+
+	// the synonyms and the fields are the same for every service, query them once
+	var synonyms []m.Synonym
+	synonymsLoaded := false
+	listSynonyms := func() ([]m.Synonym, error) {
+		if synonymsLoaded {
+			return synonyms, nil
+		}
+		list, err := sc.db.ListSynonyms()
+		synonyms, synonymsLoaded = list, err == nil
+		return list, err
+	}
+	listFields := func() ([]m.Field, error) {
+		return fields, nil
+	}
+
+	cursor := ""
+	for {
+		services, next, err := sc.db.GetAllServices(u.MAX_PAGE_LIMIT, cursor)
+		if err != nil {
+			return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+				ErrorMsg: aws.String(err.Error()),
+			})
+		}
+
+		for _, service := range services {
+			serviceUUID := service.ServiceUUID
+			env := u.ServiceFields(u.ServiceToStreamDataConversion(service), func() (int, error) {
+				return sc.db.SubscriberCount(serviceUUID)
+			}, listSynonyms, listFields)
+
+			eligible, err := u.RuleMatches(rule, env)
+			if queryErr := u.FailedQuery(env); queryErr != nil {
+				return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+					ErrorMsg: aws.String(queryErr.Error()),
+				})
+			}
+
+			sp := m.ServicePreview{ServiceUUID: service.ServiceUUID, ServiceName: service.ServiceName}
+			// the rule would not tag the services it fails on, they are listed apart
+			if err != nil {
+				sp.Error = err.Error()
+				preview.Failed = append(preview.Failed, sp)
+				continue
+			}
+
+			if !eligible {
+				continue
+			}
+
+			if hasTags(service.Category, implied) {
+				preview.AlreadyTagged = append(preview.AlreadyTagged, sp)
+			} else {
+				preview.WouldGain = append(preview.WouldGain, sp)
+			}
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	return u.ApiResponse(http.StatusOK, preview)
+}
+
+// hasTags reports whether a category list holds every tag of tags
+func hasTags(category []m.Category, tags []m.Category) bool {
+	for _, tag := range tags {
+		if !u.IsTagAlreadyPresent(category, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+func (sc *ruleSvc) handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	events, err := sc.rulePreview(ctx, request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return events, nil
+}
+
+func main() {
+	// catch run time error
+	defer u.Recover()
+
+	svc, err := initSvc()
+	if err != nil {
+		log.Fatal(err)
+	}
+	lambda.Start(svc.handler)
+}
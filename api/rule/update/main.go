@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -13,7 +14,6 @@ import (
 	m "github.com/auto-tagging-mds/database/models"
 	u "github.com/auto-tagging-mds/utils"
 
-	"github.com/auto-tagging-mds/database/dynamodb"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
@@ -29,10 +29,9 @@ type ruleSvc struct {
 func initSvc() (*ruleSvc, error) {
 	tablesName := u.InitTablesName()
 
-	var db database.Database
-	db, err := dynamodb.New(tablesName)
+	db, err := database.New(tablesName)
 	if err != nil {
-		fmt.Printf("dynamodb connection error : %v\n", err)
+		fmt.Printf("database connection error : %v\n", err)
 		return nil, err
 	}
 
@@ -56,7 +55,28 @@ func (sc *ruleSvc) ruleUpdate(ctx context.Context, request events.APIGatewayProx
 		})
 	}
 
-	err := sc.db.UpdateRule(svc, ruleUUID)
+	// If-Match takes precedence over the version in the body
+	version, err := u.GetIfMatchVersion(request.Headers)
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+	if version != 0 {
+		svc.Version = version
+	}
+
+	svc.UpdatedBy = u.GetActor(request)
+	err = sc.db.UpdateRule(svc, ruleUUID)
+	var valErr *u.ValidationError
+	if errors.As(err, &valErr) {
+		return u.ApiResponse(http.StatusBadRequest, m.ValidationResponse{ErrorMsg: valErr.Error(), Errors: valErr.Errors})
+	}
+	if errors.Is(err, u.ErrVersionConflict) {
+		return u.ApiResponse(http.StatusPreconditionFailed, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
 	if err != nil {
 		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
 			ErrorMsg: aws.String(err.Error()),
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,7 +13,6 @@ import (
 	m "github.com/auto-tagging-mds/database/models"
 	u "github.com/auto-tagging-mds/utils"
 
-	"github.com/auto-tagging-mds/database/dynamodb"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
@@ -28,10 +28,9 @@ type serviceDeleteSvc struct {
 func initSvc() (*serviceDeleteSvc, error) {
 	tablesName := u.InitTablesName()
 
-	var db database.Database
-	db, err := dynamodb.New(tablesName)
+	db, err := database.New(tablesName)
 	if err != nil {
-		fmt.Printf("dynamodb connection error : %v\n", err)
+		fmt.Printf("database connection error : %v\n", err)
 		return nil, err
 	}
 
@@ -48,7 +47,21 @@ func (sc *serviceDeleteSvc) serviceDelete(ctx context.Context, request events.AP
 		return u.ApiResponse(http.StatusOK, u.MissingParameter{ErrorMsg: "parameter required : service_name"})
 	}
 
-	err := sc.db.DeleteService(serviceName)
+	cascade, err := u.GetCascade(request.QueryStringParameters)
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	err = sc.db.DeleteService(serviceName, cascade, u.GetActor(request))
+	var refErr *u.ReferencedError
+	if errors.As(err, &refErr) {
+		return u.ApiResponse(http.StatusConflict, m.ReferencedResponse{
+			ErrorMsg:   refErr.Error(),
+			References: refErr.References,
+		})
+	}
 	if err != nil {
 		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
 			ErrorMsg: aws.String(err.Error()),
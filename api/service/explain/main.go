@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/auto-tagging-mds/database"
+
+	m "github.com/auto-tagging-mds/database/models"
+	u "github.com/auto-tagging-mds/utils"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+type serviceExplainSvc struct {
+	db            database.Database
+	tableName     m.Tables
+	dbCallTimeout time.Duration
+	logLevel      string
+}
+
+func initSvc() (*serviceExplainSvc, error) {
+	tablesName := u.InitTablesName()
+
+	db, err := database.New(tablesName)
+	if err != nil {
+		fmt.Printf("database connection error : %v\n", err)
+		return nil, err
+	}
+
+	return &serviceExplainSvc{
+		db:            db,
+		dbCallTimeout: 2 * time.Second,
+	}, nil
+}
+
+// serviceExplain evaluates every rule against the service and returns the outcome of each condition
+func (sc *serviceExplainSvc) serviceExplain(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// get path parameter
+	serviceName, ok := request.PathParameters["service_name"]
+	if ok != true {
+		return u.ApiResponse(http.StatusBadRequest, u.MissingParameter{ErrorMsg: "parameter required : service_name"})
+	}
+
+	service, err := sc.db.GetService(serviceName)
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	if service.ServiceName == "" {
+		return u.ApiResponse(http.StatusNotFound, u.EmptyStruct{})
+	}
+
+	explain := m.ServiceExplainResponse{
+		ServiceUUID: service.ServiceUUID,
+		ServiceName: service.ServiceName,
+		Rules:       []m.RuleExplain{},
+	}
+
+	// one env for all rules, so the subscriber count, the synonyms and the fields are queried at most once
+	env := u.ServiceFields(u.ServiceToStreamDataConversion(service), func() (int, error) {
+		return sc.db.SubscriberCount(service.ServiceUUID)
+	}, sc.db.ListSynonyms, sc.db.ListFields)
+
+	cursor := ""
+	for {
+		rules, next, err := sc.db.GetAllRules(u.MAX_PAGE_LIMIT, cursor)
+		if err != nil {
+			return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+				ErrorMsg: aws.String(err.Error()),
+			})
+		}
+
+		for _, rule := range rules {
+			ruleExplain := u.ExplainRule(rule, env)
+			ruleExplain.HasTag = u.IsTagAlreadyPresent(service.Category, m.Category{Key: rule.TagKey, Value: rule.TagValue})
+			explain.Rules = append(explain.Rules, ruleExplain)
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	return u.ApiResponse(http.StatusOK, explain)
+}
+
+func (sc *serviceExplainSvc) handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	events, err := sc.serviceExplain(ctx, request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return events, nil
+}
+
+func main() {
+	// catch run time error
+	defer u.Recover()
+
+	svc, err := initSvc()
+	if err != nil {
+		log.Fatal(err)
+	}
+	lambda.Start(svc.handler)
+}
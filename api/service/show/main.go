@@ -13,7 +13,6 @@ import (
 	m "github.com/auto-tagging-mds/database/models"
 	u "github.com/auto-tagging-mds/utils"
 
-	"github.com/auto-tagging-mds/database/dynamodb"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
@@ -29,10 +28,9 @@ type serviceShowSvc struct {
 func initSvc() (*serviceShowSvc, error) {
 	tablesName := u.InitTablesName()
 
-	var db database.Database
-	db, err := dynamodb.New(tablesName)
+	db, err := database.New(tablesName)
 	if err != nil {
-		fmt.Printf("dynamodb connection error : %v\n", err)
+		fmt.Printf("database connection error : %v\n", err)
 		return nil, err
 	}
 
@@ -60,7 +58,7 @@ func (sc *serviceShowSvc) serviceShow(ctx context.Context, request events.APIGat
 		return u.ApiResponse(http.StatusNotFound, utils.EmptyStruct{})
 	}
 
-	return u.ApiResponse(http.StatusOK, service)
+	return u.ApiResponseWithETag(http.StatusOK, service, service.Version)
 }
 
 func (sc *serviceShowSvc) handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -13,7 +14,6 @@ import (
 	m "github.com/auto-tagging-mds/database/models"
 	u "github.com/auto-tagging-mds/utils"
 
-	"github.com/auto-tagging-mds/database/dynamodb"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
@@ -29,10 +29,9 @@ type serviceUpdateSvc struct {
 func initSvc() (*serviceUpdateSvc, error) {
 	tablesName := u.InitTablesName()
 
-	var db database.Database
-	db, err := dynamodb.New(tablesName)
+	db, err := database.New(tablesName)
 	if err != nil {
-		fmt.Printf("dynamodb connection error : %v\n", err)
+		fmt.Printf("database connection error : %v\n", err)
 		return nil, err
 	}
 
@@ -56,7 +55,24 @@ func (sc *serviceUpdateSvc) serviceUpdate(ctx context.Context, request events.AP
 		})
 	}
 
-	err := sc.db.UpdateService(svc, serviceUUID)
+	// If-Match takes precedence over the version in the body
+	version, err := u.GetIfMatchVersion(request.Headers)
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+	if version != 0 {
+		svc.Version = version
+	}
+
+	svc.UpdatedBy = u.GetActor(request)
+	err = sc.db.UpdateService(svc, serviceUUID)
+	if errors.Is(err, u.ErrVersionConflict) {
+		return u.ApiResponse(http.StatusPreconditionFailed, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
 	if err != nil {
 		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
 			ErrorMsg: aws.String(err.Error()),
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/auto-tagging-mds/database"
+	"github.com/go-playground/validator"
+
+	m "github.com/auto-tagging-mds/database/models"
+	u "github.com/auto-tagging-mds/utils"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// UPDATE_MARGIN is the time kept to answer with the report of an update stopped
+// before the lambda times out
+const UPDATE_MARGIN = 5 * time.Second
+
+type tagUpdateSvc struct {
+	db            database.Database
+	tableName     m.Tables
+	dbCallTimeout time.Duration
+	logLevel      string
+}
+
+func initSvc() (*tagUpdateSvc, error) {
+	tablesName := u.InitTablesName()
+
+	db, err := database.New(tablesName)
+	if err != nil {
+		fmt.Printf("database connection error : %v\n", err)
+		return nil, err
+	}
+
+	return &tagUpdateSvc{
+		db:            db,
+		dbCallTimeout: 2 * time.Second,
+	}, nil
+}
+
+// tagUpdate renames, merges or moves the tag of the path, RENAME_KEY is sent without tag_value.
+// A rename or merge running out of time answers 202 with the report so far, done is false.
+func (sc *tagUpdateSvc) tagUpdate(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var svc m.TagUpdateRequest
+
+	key, ok := request.PathParameters["tag_key"]
+	if ok != true {
+		return u.ApiResponse(http.StatusBadRequest, u.MissingParameter{ErrorMsg: "parameter required : tag_key"})
+	}
+	value := request.PathParameters["tag_value"]
+
+	if err := json.Unmarshal([]byte(request.Body), &svc); err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	validate := validator.New()
+	err := validate.Struct(svc)
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	svc.UpdatedBy = u.GetActor(request)
+	if svc.Operation == u.TAG_SET_PARENT || svc.Operation == u.TAG_SET_METADATA {
+		return sc.tagSet(key, value, svc)
+	}
+
+	// stop while there is time left to answer, the same request resumes the update
+	stopCtx := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		stopCtx, cancel = context.WithDeadline(ctx, deadline.Add(-UPDATE_MARGIN))
+		defer cancel()
+	}
+
+	report, err := sc.db.UpdateTag(key, value, svc, func(progress m.TagUpdateReport) error {
+		fmt.Printf("tag update %v:%v : %v services scanned, %v updated, %v rules updated\n",
+			key, value, progress.ServicesScanned, progress.ServicesUpdated, progress.RulesUpdated)
+		return stopCtx.Err()
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		return u.ApiResponse(http.StatusAccepted, report)
+	}
+	if errors.Is(err, u.ErrTagNotFound) {
+		return u.ApiResponse(http.StatusNotFound, u.EmptyStruct{})
+	}
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	return u.ApiResponse(http.StatusOK, report)
+}
+
+// tagSet moves the tag below key:value of the body, an empty parent makes it a root,
+// or replaces its metadata
+func (sc *tagUpdateSvc) tagSet(key string, value string, svc m.TagUpdateRequest) (events.APIGatewayProxyResponse, error) {
+	if value == "" {
+		return u.ApiResponse(http.StatusBadRequest, u.MissingParameter{ErrorMsg: "parameter required : tag_value"})
+	}
+
+	var err error
+	if svc.Operation == u.TAG_SET_PARENT {
+		err = sc.db.SetTagParent(key, value, svc.Key, svc.Value, svc.UpdatedBy)
+	} else {
+		err = sc.db.SetTagMetadata(key, value, svc.TagMetadata, svc.UpdatedBy)
+	}
+	if errors.Is(err, u.ErrTagNotFound) {
+		return u.ApiResponse(http.StatusNotFound, u.EmptyStruct{})
+	}
+	if errors.Is(err, u.ErrVersionConflict) {
+		return u.ApiResponse(http.StatusPreconditionFailed, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	tag, err := sc.db.GetTag(key, value)
+	if err != nil {
+		return u.ApiResponse(http.StatusBadRequest, u.ErrorBody{
+			ErrorMsg: aws.String(err.Error()),
+		})
+	}
+
+	return u.ApiResponse(http.StatusOK, tag)
+}
+
+func (sc *tagUpdateSvc) handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	events, err := sc.tagUpdate(ctx, request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return events, nil
+}
+
+func main() {
+	// catch run time error
+	defer u.Recover()
+
+	svc, err := initSvc()
+	if err != nil {
+		log.Fatal(err)
+	}
+	lambda.Start(svc.handler)
+}
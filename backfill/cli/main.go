@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/auto-tagging-mds/backfill/runner"
+	"github.com/auto-tagging-mds/database"
+	"github.com/auto-tagging-mds/database/models"
+	"github.com/auto-tagging-mds/utils"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "report the tag changes without applying them")
+	concurrency := flag.Int("concurrency", 8, "services evaluated at the same time")
+	batchSize := flag.Int("batch-size", 100, "services per batch, the checkpoint is saved after every batch")
+	resume := flag.String("resume", "", "job id of an interrupted or failed run to continue from its checkpoint")
+	flag.Parse()
+
+	db, err := database.New(utils.InitTablesName())
+	if err != nil {
+		log.Fatalf("database connection error : %v", err)
+	}
+
+	job := runner.NewJob(*dryRun, "cli:"+os.Getenv("USER"))
+	if *resume != "" {
+		job, err = db.GetBackfillJob(*resume)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if job.JobID == "" {
+			log.Fatalf("backfill job not found : %v", *resume)
+		}
+		if job.Status == runner.STATUS_RUNNING && !runner.Stopped(job, time.Now()) {
+			log.Fatalf("backfill job %v is running until %v, resume it once its runner stopped", job.JobID, job.LeaseUntil)
+		}
+	}
+
+	// stop after the current batch on interrupt, the job can be resumed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	r := runner.New(db, *concurrency, *batchSize)
+	r.OnChange = func(change models.BackfillChange) {
+		fmt.Printf("%v %v\n", change.ServiceName, diffString(change))
+	}
+
+	fmt.Printf("backfill job %v : dry run : %v\n", job.JobID, job.DryRun)
+	err = r.Run(ctx, &job)
+	fmt.Printf("backfill job %v : %v : %v services processed, %v changed\n", job.JobID, job.Status, job.Processed, job.Changed)
+	if err != nil {
+		log.Fatalf("backfill job %v stopped, continue with --resume %v : %v", job.JobID, job.JobID, err)
+	}
+}
+
+// diffString formats a change as +key:value for added and -key:value for removed tags
+func diffString(change models.BackfillChange) string {
+	parts := make([]string, 0, len(change.Added)+len(change.Removed))
+	for _, cat := range change.Added {
+		parts = append(parts, "+"+cat.Key+":"+cat.Value)
+	}
+	for _, cat := range change.Removed {
+		parts = append(parts, "-"+cat.Key+":"+cat.Value)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/auto-tagging-mds/backfill/runner"
+	"github.com/auto-tagging-mds/database"
+
+	u "github.com/auto-tagging-mds/utils"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// backfillEvent is the payload of runner.Invoke
+type backfillEvent struct {
+	JobID string `json:"job_id"`
+}
+
+type backfillSvc struct {
+	db     database.Database
+	runner *runner.Runner
+}
+
+func initSvc() (*backfillSvc, error) {
+	db, err := database.New(u.InitTablesName())
+	if err != nil {
+		fmt.Printf("database connection error : %v\n", err)
+		return nil, err
+	}
+
+	return &backfillSvc{
+		db:     db,
+		runner: runner.New(db, 8, 100),
+	}, nil
+}
+
+// handler runs the job until a minute before the lambda times out, then
+// hands the rest over to a new invocation which resumes from the checkpoint
+func (bf *backfillSvc) handler(ctx context.Context, event backfillEvent) error {
+	job, err := bf.db.GetBackfillJob(event.JobID)
+	if err != nil {
+		return err
+	}
+
+	if job.JobID == "" {
+		return errors.New("backfill job not found : " + event.JobID)
+	}
+
+	runCtx := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithDeadline(ctx, deadline.Add(-time.Minute))
+		defer cancel()
+	}
+
+	err = bf.runner.Run(runCtx, &job)
+	if err == context.DeadlineExceeded {
+		fmt.Printf("backfill job %v : continuing after %v services\n", job.JobID, job.Processed)
+		return runner.Invoke(lambdacontext.FunctionName, job.JobID)
+	}
+	return err
+}
+
+func main() {
+	// catch run time error
+	defer u.Recover()
+
+	svc, err := initSvc()
+	if err != nil {
+		log.Fatal(err)
+	}
+	lambda.Start(svc.handler)
+}
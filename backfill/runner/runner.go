@@ -0,0 +1,297 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/auto-tagging-mds/database"
+	"github.com/auto-tagging-mds/database/models"
+	"github.com/auto-tagging-mds/utils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+const (
+	STATUS_PENDING = "pending"
+	STATUS_RUNNING = "running"
+	STATUS_DONE    = "done"
+	STATUS_FAILED  = "failed"
+)
+
+// MAX_REPORTED_CHANGES bounds the dry run diff kept on the job, Changed counts all of them
+const MAX_REPORTED_CHANGES = 1000
+
+// LEASE is how long a running job stays held after each save. The runner saves it after every
+// batch, so a running job not saved for longer was stopped without saving, e.g. its lambda was
+// killed, and can be resumed. It is the longest a lambda runs.
+const LEASE = 15 * time.Minute
+
+// Runner re-evaluates every rule against every service, a page of services
+// at a time, and recomputes the rule-derived tags of the services the same
+// way the stream processor does.
+type Runner struct {
+	db          database.Database
+	concurrency int
+	batchSize   int
+
+	// OnChange, when set, is called with the diff of every changed service
+	OnChange func(models.BackfillChange)
+}
+
+func New(db database.Database, concurrency int, batchSize int) *Runner {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if batchSize < 1 || batchSize > utils.MAX_PAGE_LIMIT {
+		batchSize = utils.MAX_PAGE_LIMIT
+	}
+	return &Runner{db: db, concurrency: concurrency, batchSize: batchSize}
+}
+
+func NewJob(dryRun bool, actor string) models.BackfillJob {
+	datetime := utils.DateString("datetime")
+	return models.BackfillJob{
+		JobID:     utils.GetUUID(),
+		Status:    STATUS_PENDING,
+		DryRun:    dryRun,
+		CreatedAt: datetime,
+		UpdatedAt: datetime,
+		UpdatedBy: actor,
+	}
+}
+
+// Run processes the job from its checkpoint, saving it after every batch.
+// When ctx is done between two batches it returns ctx.Err() with the job
+// still running and its lease released, a later Run resumes it. A finished
+// job is left as it is, and a running one is only taken over once stopped.
+// Every save expects the version it loaded or last saved, so when another
+// runner claimed the job first Run stops with utils.ErrVersionConflict.
+func (r *Runner) Run(ctx context.Context, job *models.BackfillJob) error {
+	if job.Status == STATUS_DONE {
+		return nil
+	}
+
+	if job.Status == STATUS_RUNNING && !Stopped(*job, time.Now()) {
+		return fmt.Errorf("backfill job %v is held by another runner until %v", job.JobID, job.LeaseUntil)
+	}
+
+	rules, err := r.allRules()
+	if err != nil {
+		return r.fail(job, err)
+	}
+
+	tags, err := r.db.ListTags()
+	if err != nil {
+		return r.fail(job, err)
+	}
+	tree := utils.NewTagTree(tags)
+
+	// claims the job, only one of the runners which loaded it gets it
+	job.Status, job.Error = STATUS_RUNNING, ""
+	err = r.save(job)
+	if err != nil {
+		return err
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			r.release(job)
+			return err
+		}
+
+		services, next, err := r.db.GetAllServices(r.batchSize, job.Cursor)
+		if err != nil {
+			return r.fail(job, err)
+		}
+
+		changes, err := r.processBatch(services, rules, tree, job.DryRun)
+		if err != nil {
+			return r.fail(job, err)
+		}
+
+		job.Processed += len(services)
+		job.Changed += len(changes)
+		for _, change := range changes {
+			if job.DryRun && len(job.Changes) < MAX_REPORTED_CHANGES {
+				job.Changes = append(job.Changes, change)
+			}
+			if r.OnChange != nil {
+				r.OnChange(change)
+			}
+		}
+
+		// the batch is applied, move the checkpoint past it
+		job.Cursor = next
+		if next == "" {
+			job.Status = STATUS_DONE
+		}
+
+		err = r.save(job)
+		if err != nil || next == "" {
+			return err
+		}
+	}
+}
+
+// processBatch handles the services of one page, at most concurrency at a time
+func (r *Runner) processBatch(services []models.ServiceResponse, rules []models.RuleResponse, tree utils.TagTree, dryRun bool) ([]models.BackfillChange, error) {
+	results := make([]*models.BackfillChange, len(services))
+	errs := make([]error, len(services))
+
+	sem := make(chan struct{}, r.concurrency)
+	var wg sync.WaitGroup
+	for i := range services {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i], errs[i] = r.processService(services[i], rules, tree, dryRun)
+		}(i)
+	}
+	wg.Wait()
+
+	changes := make([]models.BackfillChange, 0)
+	for i := range services {
+		if errs[i] != nil {
+			return changes, errs[i]
+		}
+		if results[i] != nil {
+			changes = append(changes, *results[i])
+		}
+	}
+	return changes, nil
+}
+
+// processService returns the tag diff of a service, nil when its tags are up to date
+func (r *Runner) processService(service models.ServiceResponse, rules []models.RuleResponse, tree utils.TagTree, dryRun bool) (*models.BackfillChange, error) {
+	// also indexes services stored before the search indexes existed
+	if !dryRun {
+		err := r.db.IndexServiceTags(service.ServiceUUID, nil)
+		if err != nil {
+			return nil, err
+		}
+		err = r.db.IndexServiceTerms(service.ServiceUUID, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	matched, err := r.db.MatchingRules(utils.ServiceToStreamDataConversion(service), rules)
+	if err != nil {
+		return nil, err
+	}
+
+	category, changed := utils.SyncServiceTags(service.Category, matched, tree)
+	if !changed {
+		return nil, nil
+	}
+
+	// the matches are only applied to the service they were evaluated on, and
+	// applying them again is a no-op, so a batch redone after a crash is safe
+	if !dryRun {
+		err := r.db.ApplyRuleTags(service, matched)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	added, removed := utils.TagDiff(service.Category, category)
+	if len(added) == 0 && len(removed) == 0 {
+		// only the applying rule of a tag changed
+		return nil, nil
+	}
+	return &models.BackfillChange{ServiceUUID: service.ServiceUUID, ServiceName: service.ServiceName, Added: added, Removed: removed}, nil
+}
+
+func (r *Runner) allRules() ([]models.RuleResponse, error) {
+	rules := []models.RuleResponse{}
+	cursor := ""
+	for {
+		page, next, err := r.db.GetAllRules(utils.MAX_PAGE_LIMIT, cursor)
+		if err != nil {
+			return rules, err
+		}
+		rules = append(rules, page...)
+
+		if next == "" {
+			return rules, nil
+		}
+		cursor = next
+	}
+}
+
+// save checkpoints the job, renewing the lease of a running one. It fails with
+// utils.ErrVersionConflict when the job was saved by someone else since it was loaded.
+func (r *Runner) save(job *models.BackfillJob) error {
+	job.LeaseUntil = ""
+	if job.Status == STATUS_RUNNING {
+		job.LeaseUntil = time.Now().UTC().Add(LEASE).Format(time.RFC3339)
+	}
+	job.UpdatedAt = utils.DateString("datetime")
+	return Save(r.db, job)
+}
+
+// Save stores the job and moves it to the version it was stored at
+func Save(db database.Database, job *models.BackfillJob) error {
+	err := db.PutBackfillJob(*job)
+	if err != nil {
+		return err
+	}
+	job.Version++
+	return nil
+}
+
+// release gives up the lease of a job stopped at its checkpoint, so that it can be resumed at once
+func (r *Runner) release(job *models.BackfillJob) {
+	job.LeaseUntil = ""
+	if err := Save(r.db, job); err != nil {
+		fmt.Printf("backfill job %v : save error : %v\n", job.JobID, err)
+	}
+}
+
+// Stopped reports whether a running job is no longer held by a runner: its lease was
+// released or has expired. Jobs saved before leases existed have none.
+func Stopped(job models.BackfillJob, now time.Time) bool {
+	if job.Status != STATUS_RUNNING {
+		return false
+	}
+
+	until, err := time.Parse(time.RFC3339, job.LeaseUntil)
+	return err != nil || now.After(until)
+}
+
+// Resumable reports whether a job may be handed to Run again, a failed or a stopped one
+func Resumable(job models.BackfillJob, now time.Time) bool {
+	return job.Status == STATUS_FAILED || Stopped(job, now)
+}
+
+// fail records err on the job, the checkpoint is kept so that it can be resumed
+func (r *Runner) fail(job *models.BackfillJob, err error) error {
+	job.Status, job.Error = STATUS_FAILED, err.Error()
+	if saveErr := r.save(job); saveErr != nil {
+		fmt.Printf("backfill job %v : save error : %v\n", job.JobID, saveErr)
+	}
+	return err
+}
+
+// Invoke starts the backfill worker lambda on a job without waiting for it
+func Invoke(functionName string, jobID string) error {
+	payload, err := json.Marshal(map[string]string{"job_id": jobID})
+	if err != nil {
+		return err
+	}
+
+	client := lambda.New(session.Must(session.NewSession()))
+	_, err = client.Invoke(&lambda.InvokeInput{
+		FunctionName:   aws.String(functionName),
+		InvocationType: aws.String(lambda.InvocationTypeEvent),
+		Payload:        payload,
+	})
+	return err
+}
@@ -0,0 +1,84 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/auto-tagging-mds/database/memory"
+	"github.com/auto-tagging-mds/database/models"
+	"github.com/auto-tagging-mds/utils"
+)
+
+func TestTwoRunnersClaimOneJob(t *testing.T) {
+	db, err := memory.New(models.Tables{MDSTable: "mds"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateTag(models.TagCreateRequest{Key: "deployment", Value: "cloud"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alpha", "beta", "gamma"} {
+		if _, err := db.CreateService(models.ServiceRequest{ServiceName: name, Description: "runs on aws"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.CreateRule(models.RuleRequest{Operation: utils.CONTAIN, TagKey: "deployment", TagValue: "cloud",
+		MetadataField: utils.DESCRIPTION, Keyword: "aws"}); err != nil {
+		t.Fatal(err)
+	}
+
+	job := NewJob(false, "tester")
+	if err := Save(db, &job); err != nil {
+		t.Fatal(err)
+	}
+
+	// both runners load the job before either claims it
+	jobs := make([]models.BackfillJob, 2)
+	for i := range jobs {
+		jobs[i], err = db.GetBackfillJob(job.JobID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errs := make([]error, len(jobs))
+	var wg sync.WaitGroup
+	for i := range jobs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = New(db, 1, 1).Run(context.Background(), &jobs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	ran := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			ran++
+		case !errors.Is(err, utils.ErrVersionConflict):
+			t.Fatalf("the other runner stopped with %v, want a version conflict", err)
+		}
+	}
+	if ran != 1 {
+		t.Fatalf("%v runners ran the job, want 1 : %v", ran, errs)
+	}
+
+	stored, err := db.GetBackfillJob(job.JobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != STATUS_DONE || stored.Processed != 3 || stored.Changed != 3 {
+		t.Fatalf("job is %v with %v processed and %v changed, want done with 3 and 3", stored.Status, stored.Processed, stored.Changed)
+	}
+
+	// a runner holding an older copy can't save over it either
+	stale := job
+	stale.Status = STATUS_FAILED
+	if err := New(db, 1, 1).Run(context.Background(), &stale); !errors.Is(err, utils.ErrVersionConflict) {
+		t.Fatalf("stale runner got %v, want a version conflict", err)
+	}
+}
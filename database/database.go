@@ -2,31 +2,116 @@ package database
 
 import "github.com/auto-tagging-mds/database/models"
 
+// Database is implemented by every storage backend.
+// GetAll* return one page of at most limit items and the cursor of the next
+// page, an empty cursor means the last page was reached.
+// The Delete methods record actor on the REMOVE records of the stream, the
+// ones of cascaded deletes included.
 type Database interface {
 	CreateService(models.ServiceRequest) (models.ServiceRequest, error)
-	GetAllServices() ([]models.ServiceResponse, error)
+	GetAllServices(limit int, cursor string) ([]models.ServiceResponse, string, error)
+	// SearchServices returns a page of the services matching search, ordered like GetAllServices
+	SearchServices(search models.ServiceSearch, limit int, cursor string) ([]models.ServiceResponse, string, error)
+	// IndexServiceTags brings the tag index of a service in line with its stored
+	// tags, oldCategory holds the tags it may still be indexed under
+	IndexServiceTags(serviceUUID string, oldCategory []models.Category) error
+	// IndexServiceTerms brings the full-text index of a service in line with its stored
+	// description and more_about, oldTerms holds the terms it may still be indexed under
+	IndexServiceTerms(serviceUUID string, oldTerms []string) error
+	// GetServiceTerms returns the full-text index entries of term, or of every term
+	// starting with term when prefix is set
+	GetServiceTerms(term string, prefix bool) ([]models.ServiceTerm, error)
 	GetService(name string) (models.ServiceResponse, error)
 	UpdateService(models.ServiceRequest, string) error
-	DeleteService(name string) error
+	// DeleteService returns a *utils.ReferencedError while companies subscribe to
+	// the service, unless cascade drops it from their service lists in the same write
+	DeleteService(name string, cascade bool, actor string) error
 
 	CreateCompany(models.CompanyRequest) (models.CompanyRequest, error)
-	GetAllCompanies() ([]models.CompanyResponse, error)
+	GetAllCompanies(limit int, cursor string) ([]models.CompanyResponse, string, error)
 	GetCompany(name string) (models.CompanyResponse, error)
 	UpdateCompany(models.CompanyRequest, string) error
-	DeleteCompany(name string) error
+	DeleteCompany(name string, actor string) error
 
 	CreateTag(models.TagCreateRequest) (models.TagCreateRequest, error)
-	GetAllTags() ([]models.TagListResponse, error)
-	DeleteTag(key string, value string) error
+	GetAllTags(limit int, cursor string) ([]models.TagListResponse, string, error)
+	// DeleteTag returns a *utils.ReferencedError while services carry the tag, rules
+	// assign it or tags are below or replaced by it, unless cascade untags the services,
+	// deletes the rules, makes the child tags roots and clears the replacements
+	DeleteTag(key string, value string, cascade bool, actor string) error
 	GetTag(key string, value string) (models.TagListResponse, error)
+	// ListTags returns every stored tag with its parent and metadata
+	ListTags() ([]models.TagResponse, error)
+	// SetTagParent moves a tag below parentKey:parentValue, rejecting cycles.
+	// An empty parent makes the tag a root.
+	SetTagParent(key string, value string, parentKey string, parentValue string, actor string) error
+	// SetTagMetadata replaces the description, label, color, aliases and deprecation of a tag
+	SetTagMetadata(key string, value string, meta models.TagMetadata, actor string) error
+	// UpdateTag renames or merges tags, rewriting the tag items, the service
+	// categories and the rule tags. progress is called after each batch, an error
+	// it returns stops the update with it. Repeating a stopped update resumes it.
+	UpdateTag(key string, value string, update models.TagUpdateRequest, progress func(models.TagUpdateReport) error) (models.TagUpdateReport, error)
 
 	CreateRule(models.RuleRequest) (models.RuleRequest, error)
-	GetAllRules() ([]models.RuleResponse, error)
+	GetAllRules(limit int, cursor string) ([]models.RuleResponse, string, error)
 	GetRule(ruleUUID string) (models.RuleResponse, error)
 	UpdateRule(models.RuleRequest, string) error
-	DeleteRule(ruleUUID string) error
+	DeleteRule(ruleUUID string, actor string) error
+
+	// A synonym group makes rules match its words alike, it is keyed by its term.
+	// CreateSynonym and UpdateSynonym reject a word already in another group.
+	CreateSynonym(models.Synonym) (models.Synonym, error)
+	GetAllSynonyms(limit int, cursor string) ([]models.Synonym, string, error)
+	// ListSynonyms returns the whole dictionary, read when rules are evaluated
+	ListSynonyms() ([]models.Synonym, error)
+	GetSynonym(term string) (models.Synonym, error)
+	// UpdateSynonym replaces the synonyms of term, utils.ErrSynonymNotFound when it has none
+	UpdateSynonym(models.Synonym, string) error
+	DeleteSynonym(term string, actor string) error
+
+	// A field declares a custom service attribute, it is keyed by its name.
+	// CreateService and UpdateService validate the attributes against the declared fields.
+	CreateField(models.Field) (models.Field, error)
+	GetAllFields(limit int, cursor string) ([]models.Field, string, error)
+	// ListFields returns every declared field, read when rules are saved or evaluated
+	ListFields() ([]models.Field, error)
+	GetField(name string) (models.Field, error)
+	// UpdateField replaces the constraints of a field, utils.ErrFieldNotFound when none is declared.
+	// It returns a *utils.ConstraintError with the services whose attribute the new constraints break.
+	UpdateField(models.Field, string) error
+	// DeleteField returns a *utils.ReferencedError while services have the attribute or rules
+	// test the field, unless cascade removes the attribute from the services and deletes the rules
+	DeleteField(name string, cascade bool, actor string) error
 
 	AttachTagWithService(service models.StreamData, rules []models.RuleResponse) error
 	ProcessRuleForServices(models.StreamData, []models.ServiceResponse) error
 	UpdateServiceTagForSubscriberCount(streamData models.StreamData, rules []models.RuleResponse) error
+	// SyncRuleTags adds the tags of the rules a service matches and removes
+	// the rule-derived tags of rules it no longer matches
+	SyncRuleTags(serviceUUID string, rules []models.RuleResponse) error
+	// ApplyRuleTags is SyncRuleTags with the rules MatchingRules returned for service. Nothing
+	// is written when the stored service changed since, the stream record of the change syncs it.
+	ApplyRuleTags(service models.ServiceResponse, matched []models.RuleResponse) error
+	// MatchingRules evaluates rules on a service and returns those it matches. The
+	// subscriber count, the synonyms and the fields are queried once for all rules,
+	// the subscriber count only when an expression reads it.
+	MatchingRules(streamData models.StreamData, rules []models.RuleResponse) ([]models.RuleResponse, error)
+	// SubscriberCount returns the number of companies subscribed to a service
+	SubscriberCount(serviceUUID string) (int, error)
+
+	// RemoveServiceReferences drops a service from the service_list of every
+	// company, RemoveTagReferences drops a tag from every service, deletes the
+	// rules applying it and unlinks the tags below or replaced by it. Both are idempotent.
+	RemoveServiceReferences(serviceUUID string) error
+	RemoveTagReferences(key string, value string) error
+
+	// History is keyed by the entity uuid, or for tags utils.GetTagHistoryId
+	AddHistory(models.History) error
+	GetHistory(entityUUID string, limit int, cursor string) ([]models.History, string, error)
+	IsUUIDInUse(uuid string) (bool, error)
+
+	// PutBackfillJob saves a job with its checkpoint at job.Version+1. The stored job must
+	// still be at job.Version, 0 for a new one, otherwise utils.ErrVersionConflict is returned
+	PutBackfillJob(models.BackfillJob) error
+	GetBackfillJob(jobID string) (models.BackfillJob, error)
 }
@@ -4,11 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sort"
+	"strconv"
 
 	"github.com/auto-tagging-mds/database/models"
 	"github.com/auto-tagging-mds/utils"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
@@ -41,7 +44,105 @@ func New(tablesName models.Tables) (*Database, error) {
 	return &db, nil
 }
 
+var (
+	errKeyTaken    = errors.New("key already taken")
+	errItemChanged = errors.New("item changed")
+)
+
+// isConditionalCheckFailed reports whether a write was rejected by its condition expression
+func isConditionalCheckFailed(err error) bool {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+	}
+	return false
+}
+
+// versionCondition matches an item still at version. Items written before
+// versioning have no version attribute and match version 0.
+func versionCondition(version int) (string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+	condition := "#version = :version"
+	if version == 0 {
+		condition = "(attribute_not_exists(#version) OR #version = :version)"
+	}
+	names := map[string]*string{"#version": aws.String("version")}
+	values := map[string]*dynamodb.AttributeValue{":version": {N: aws.String(strconv.Itoa(version))}}
+	return condition, names, values
+}
+
+// replaceItem writes av in place of the item stored under oldSK in one transaction.
+// The old item must still carry uuid and be at oldVersion, otherwise errItemChanged is returned.
+// When the range key changes (a rename) the old item is deleted and the new
+// key must be free, otherwise errKeyTaken is returned and nothing is written.
+func (d *Database) replaceItem(av map[string]*dynamodb.AttributeValue, oldSK string, uuid string, oldVersion int) error {
+	pkName := utils.GetPartitionKeyName()
+	skName := utils.GetRangeKeyName()
+	pk := av[pkName]
+	newSK := aws.StringValue(av[skName].S)
+
+	condition, names, values := versionCondition(oldVersion)
+	sameEntity := aws.String("#uuid = :uuid AND " + condition)
+	names["#uuid"] = aws.String("uuid")
+	values[":uuid"] = &dynamodb.AttributeValue{S: aws.String(uuid)}
+
+	items := make([]*dynamodb.TransactWriteItem, 0, 2)
+	if oldSK == newSK {
+		items = append(items, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName:                 aws.String(d.tableName.MDSTable),
+				Item:                      av,
+				ConditionExpression:       sameEntity,
+				ExpressionAttributeNames:  names,
+				ExpressionAttributeValues: values,
+			},
+		})
+	} else {
+		items = append(items, &dynamodb.TransactWriteItem{
+			Delete: &dynamodb.Delete{
+				TableName: aws.String(d.tableName.MDSTable),
+				Key: map[string]*dynamodb.AttributeValue{
+					pkName: pk,
+					skName: {S: aws.String(oldSK)},
+				},
+				ConditionExpression:       sameEntity,
+				ExpressionAttributeNames:  names,
+				ExpressionAttributeValues: values,
+			},
+		}, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName:                aws.String(d.tableName.MDSTable),
+				Item:                     av,
+				ConditionExpression:      aws.String("attribute_not_exists(#pk)"),
+				ExpressionAttributeNames: map[string]*string{"#pk": aws.String(pkName)},
+			},
+		})
+	}
+
+	_, err := d.db.TransactWriteItems(&dynamodb.TransactWriteItemsInput{TransactItems: items})
+
+	var canceled *dynamodb.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		for i, reason := range canceled.CancellationReasons {
+			if aws.StringValue(reason.Code) != "ConditionalCheckFailed" {
+				continue
+			}
+			// the last item is the put of the new key when renaming
+			if i == 1 {
+				return errKeyTaken
+			}
+			return errItemChanged
+		}
+	}
+	return err
+}
+
 func (d *Database) IsTagValid(key, value string) (bool, error) {
+	tag, err := d.getTagItem(key, value)
+	return tag.Key != "", err
+}
+
+// getTagItem reads one tag, an empty tag when it does not exist
+func (d *Database) getTagItem(key, value string) (models.TagResponse, error) {
 
 	pkName := utils.GetPartitionKeyName()
 	pk := utils.GetPartitionKey(utils.TAG)
@@ -61,62 +162,82 @@ func (d *Database) IsTagValid(key, value string) (bool, error) {
 		TableName: aws.String(d.tableName.MDSTable),
 	}
 
+	tag := models.TagResponse{}
 	result, err := d.db.GetItem(input)
 	if err != nil {
-		return false, err
+		return tag, err
 	}
 
-	tag := models.TagResponse{}
 	err = dynamodbattribute.UnmarshalMap(result.Item, &tag)
-	if err != nil {
-		return false, err
-	}
-
-	if tag.Key != "" {
-		return true, nil
-	}
-
-	return false, nil
+	return tag, err
 }
 
-func (d *Database) VerifyTag(category []models.Category) error {
+// VerifyTag returns the category list with aliases and deprecated tags resolved.
+// All tags are only read when a tag is not stored as given or is deprecated.
+func (d *Database) VerifyTag(category []models.Category) ([]models.Category, error) {
+	found := []models.TagResponse{}
 	for _, cat := range category {
-		valid, err := d.IsTagValid(cat.Key, cat.Value)
+		tag, err := d.getTagItem(cat.Key, cat.Value)
 		if err != nil {
-			return err
+			return category, err
 		}
-		if !valid {
-			return errors.New(fmt.Sprintf("Invalid tag : (%v:%v)", cat.Key, cat.Value))
+
+		if tag.Key == "" || tag.Deprecated {
+			tags, err := d.ListTags()
+			if err != nil {
+				return category, err
+			}
+			return utils.ResolveTags(category, utils.NewTagTree(tags))
 		}
+		found = append(found, tag)
+	}
+	return utils.ResolveTags(category, utils.NewTagTree(found))
+}
+
+func (d *Database) verifyRuleTag(rule *models.RuleRequest) error {
+	tags, err := d.VerifyTag([]models.Category{{Key: rule.TagKey, Value: rule.TagValue}})
+	if err != nil {
+		return err
 	}
+	rule.TagKey, rule.TagValue = tags[0].Key, tags[0].Value
 	return nil
 }
 
 func (d *Database) CreateService(service models.ServiceRequest) (models.ServiceRequest, error) {
 
-	// if its a fresh entry
-	if service.ServiceUUID == "" {
-		// check if the service already exists
-		existService, err := d.GetService(service.ServiceName)
-		if err != nil {
-			return service, err
-		}
+	// check if the service already exists
+	existService, err := d.GetService(service.ServiceName)
+	if err != nil {
+		return service, err
+	}
 
-		if existService.ServiceName != "" {
-			return service, errors.New("Service already exist")
-		}
+	if existService.ServiceName != "" {
+		return service, errors.New("Service already exist")
+	}
 
-		service.ServiceUUID = utils.GetUUID()
-		datetime := utils.DateString("datetime")
-		service.CreatedAt, service.UpdatedAt = datetime, datetime
-		service.PK = utils.GetPartitionKey(utils.SERVICE)
-		service.SK = utils.GetRangeKey(utils.SERVICE, service.ServiceName, blank, blank)
+	// always a new service, a uuid or version sent with it is ignored
+	service.ServiceUUID = utils.GetUUID()
+	service.Version = 1
+	datetime := utils.DateString("datetime")
+	service.CreatedAt, service.UpdatedAt = datetime, datetime
+	service.Category = utils.StampCategories(service.Category, nil, datetime)
+	service.PK = utils.GetPartitionKey(utils.SERVICE)
+	service.SK = utils.GetRangeKey(utils.SERVICE, service.ServiceName, blank, blank)
+
+	fields, err := d.ListFields()
+	if err != nil {
+		return service, err
+	}
+	err = utils.CheckAttributes(service.Attributes, fields)
+	if err != nil {
+		return service, err
 	}
 
-	err := d.VerifyTag(service.Category)
+	category, err := d.VerifyTag(service.Category)
 	if err != nil {
 		return service, err
 	}
+	service.Category = category
 
 	av, err := dynamodbattribute.MarshalMap(service)
 	if err != nil {
@@ -126,12 +247,18 @@ func (d *Database) CreateService(service models.ServiceRequest) (models.ServiceR
 		av = utils.NilToEmptySlice(av, "category")
 	}
 
+	// a concurrent create of the same name may have happened since the check above
 	input := &dynamodb.PutItemInput{
-		Item:      av,
-		TableName: aws.String(d.tableName.MDSTable),
+		Item:                     av,
+		TableName:                aws.String(d.tableName.MDSTable),
+		ConditionExpression:      aws.String("attribute_not_exists(#pk)"),
+		ExpressionAttributeNames: map[string]*string{"#pk": aws.String(utils.GetPartitionKeyName())},
 	}
 
 	_, err = d.db.PutItem(input)
+	if isConditionalCheckFailed(err) {
+		return service, errors.New("Service already exist")
+	}
 	if err != nil {
 		return service, err
 	}
@@ -139,17 +266,22 @@ func (d *Database) CreateService(service models.ServiceRequest) (models.ServiceR
 	return service, nil
 }
 
-func (d *Database) GetAllServices() ([]models.ServiceResponse, error) {
+// queryPage returns one page of the items of an entity partition
+func (d *Database) queryPage(entity int, limit int, cursor string) ([]map[string]*dynamodb.AttributeValue, string, error) {
 
-	services := []models.ServiceResponse{}
 	pkName := utils.GetPartitionKeyName()
-	pkPrefix := utils.GetPartitionKey(utils.SERVICE)
+	pkPrefix := utils.GetPartitionKey(entity)
+
+	startKey, err := utils.DecodeCursor(cursor, pkPrefix)
+	if err != nil {
+		return nil, "", err
+	}
 
 	keyCond := expression.Key(pkName).Equal(expression.Value(pkPrefix))
 
 	expr, err := expression.NewBuilder().WithKeyCondition(keyCond).Build()
 	if err != nil {
-		return services, err
+		return nil, "", err
 	}
 
 	input := &dynamodb.QueryInput{
@@ -157,21 +289,246 @@ func (d *Database) GetAllServices() ([]models.ServiceResponse, error) {
 		TableName:                 aws.String(d.tableName.MDSTable),
 		ExpressionAttributeNames:  expr.Names(),
 		ExpressionAttributeValues: expr.Values(),
+		ExclusiveStartKey:         startKey,
+		Limit:                     aws.Int64(int64(limit)),
 	}
 
 	result, err := d.db.Query(input)
 	if err != nil {
-		return services, err
+		return nil, "", err
 	}
 
-	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &services)
+	return result.Items, utils.EncodeCursor(result.LastEvaluatedKey), nil
+}
+
+func (d *Database) GetAllServices(limit int, cursor string) ([]models.ServiceResponse, string, error) {
+
+	services := []models.ServiceResponse{}
+
+	items, next, err := d.queryPage(utils.SERVICE, limit, cursor)
+	if err != nil {
+		return services, "", err
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &services)
+	if err != nil {
+		return services, "", err
+	}
+
+	return services, next, nil
+}
+
+// SearchServices reads the candidates of a tag or keyword search from the index items,
+// other searches scan the services page by page until the page is filled
+func (d *Database) SearchServices(search models.ServiceSearch, limit int, cursor string) ([]models.ServiceResponse, string, error) {
+	sks, indexed, err := utils.SearchCandidates(search, d.serviceTagEntries, func(term string) ([]models.ServiceTerm, error) {
+		return d.GetServiceTerms(term, false)
+	})
+	if err != nil {
+		return []models.ServiceResponse{}, "", err
+	}
+	if !indexed {
+		return d.scanServices(search, limit, cursor)
+	}
+
+	services, err := d.getServicesBySK(sks)
+	if err != nil {
+		return services, "", err
+	}
+	return utils.SearchPage(services, search, limit, cursor)
+}
+
+func (d *Database) scanServices(search models.ServiceSearch, limit int, cursor string) ([]models.ServiceResponse, string, error) {
+	matched := []models.ServiceResponse{}
+	for {
+		page, next, err := d.GetAllServices(utils.MAX_PAGE_LIMIT, cursor)
+		if err != nil {
+			return matched, "", err
+		}
+
+		for _, service := range page {
+			if !utils.ServiceMatches(service, search) {
+				continue
+			}
+			matched = append(matched, service)
+			if len(matched) == limit {
+				return matched, utils.CursorFor(utils.GetPartitionKey(utils.SERVICE), service.SK), nil
+			}
+		}
+
+		if next == "" {
+			return matched, "", nil
+		}
+		cursor = next
+	}
+}
+
+// serviceTagEntries reads the tag index items of key:value
+func (d *Database) serviceTagEntries(key string, value string) ([]models.ServiceTag, error) {
+	entries := []models.ServiceTag{}
+	err := d.queryPrefix(utils.SERVICE_TAG, utils.GetRangeKey(utils.SERVICE_TAG, key, value, blank), func(items []map[string]*dynamodb.AttributeValue) error {
+		page := []models.ServiceTag{}
+		err := dynamodbattribute.UnmarshalListOfMaps(items, &page)
+		entries = append(entries, page...)
+		return err
+	})
+	return entries, err
+}
+
+func (d *Database) GetServiceTerms(term string, prefix bool) ([]models.ServiceTerm, error) {
+	entries := []models.ServiceTerm{}
+	err := d.queryPrefix(utils.SERVICE_TERM, utils.TermRangeKey(term, prefix), func(items []map[string]*dynamodb.AttributeValue) error {
+		page := []models.ServiceTerm{}
+		err := dynamodbattribute.UnmarshalListOfMaps(items, &page)
+		entries = append(entries, page...)
+		return err
+	})
+	return entries, err
+}
+
+// queryPrefix hands every page of the items of entity whose range key starts with prefix to read
+func (d *Database) queryPrefix(entity int, prefix string, read func([]map[string]*dynamodb.AttributeValue) error) error {
+	pkName := utils.GetPartitionKeyName()
+	pk := utils.GetPartitionKey(entity)
+	skName := utils.GetRangeKeyName()
+
+	keyCond := expression.Key(pkName).Equal(expression.Value(pk)).
+		And(expression.Key(skName).BeginsWith(prefix))
+
+	expr, err := expression.NewBuilder().WithKeyCondition(keyCond).Build()
+	if err != nil {
+		return err
+	}
+
+	input := &dynamodb.QueryInput{
+		KeyConditionExpression:    expr.KeyCondition(),
+		TableName:                 aws.String(d.tableName.MDSTable),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}
+
+	var readErr error
+	err = d.db.QueryPages(input, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		readErr = read(page.Items)
+		return readErr == nil
+	})
 	if err != nil {
-		return services, err
+		return err
 	}
+	return readErr
+}
+
+// getServicesBySK batch reads services, a deleted one is left out
+func (d *Database) getServicesBySK(sks []string) ([]models.ServiceResponse, error) {
+	services := []models.ServiceResponse{}
+	pkName := utils.GetPartitionKeyName()
+	pk := utils.GetPartitionKey(utils.SERVICE)
+	skName := utils.GetRangeKeyName()
+
+	// BatchGetItem reads at most 100 keys
+	for start := 0; start < len(sks); start += 100 {
+		end := start + 100
+		if end > len(sks) {
+			end = len(sks)
+		}
+
+		keys := []map[string]*dynamodb.AttributeValue{}
+		for _, sk := range sks[start:end] {
+			keys = append(keys, map[string]*dynamodb.AttributeValue{
+				pkName: {S: aws.String(pk)},
+				skName: {S: aws.String(sk)},
+			})
+		}
 
+		request := map[string]*dynamodb.KeysAndAttributes{
+			d.tableName.MDSTable: {Keys: keys},
+		}
+		for len(request) > 0 {
+			result, err := d.db.BatchGetItem(&dynamodb.BatchGetItemInput{RequestItems: request})
+			if err != nil {
+				return services, err
+			}
+
+			items := []models.ServiceResponse{}
+			err = dynamodbattribute.UnmarshalListOfMaps(result.Responses[d.tableName.MDSTable], &items)
+			if err != nil {
+				return services, err
+			}
+			services = append(services, items...)
+			request = result.UnprocessedKeys
+		}
+	}
 	return services, nil
 }
 
+// IndexServiceTags writes the tag index items of the stored service and deletes
+// the ones of oldCategory it no longer has
+func (d *Database) IndexServiceTags(serviceUUID string, oldCategory []models.Category) error {
+	service, err := d.GetServiceByUUID(serviceUUID, nil)
+	if err != nil {
+		return err
+	}
+
+	entries, stale := utils.ServiceTagEntries(service, serviceUUID, oldCategory)
+	items := make([]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		items = append(items, entry)
+	}
+	return d.writeIndex(utils.SERVICE_TAG, items, stale)
+}
+
+// IndexServiceTerms writes the full-text index items of the stored service and
+// deletes the ones of oldTerms it no longer has
+func (d *Database) IndexServiceTerms(serviceUUID string, oldTerms []string) error {
+	service, err := d.GetServiceByUUID(serviceUUID, nil)
+	if err != nil {
+		return err
+	}
+
+	entries, stale := utils.ServiceTermEntries(service, serviceUUID, oldTerms)
+	items := make([]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		items = append(items, entry)
+	}
+	return d.writeIndex(utils.SERVICE_TERM, items, stale)
+}
+
+// writeIndex deletes the stale index items of entity and puts the current ones
+func (d *Database) writeIndex(entity int, entries []interface{}, stale []string) error {
+	for _, sk := range stale {
+		input := &dynamodb.DeleteItemInput{
+			Key: map[string]*dynamodb.AttributeValue{
+				utils.GetPartitionKeyName(): {
+					S: aws.String(utils.GetPartitionKey(entity)),
+				},
+				utils.GetRangeKeyName(): {
+					S: aws.String(sk),
+				},
+			},
+			TableName: aws.String(d.tableName.MDSTable),
+		}
+		if _, err := d.db.DeleteItem(input); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		av, err := dynamodbattribute.MarshalMap(entry)
+		if err != nil {
+			return err
+		}
+
+		input := &dynamodb.PutItemInput{
+			Item:      av,
+			TableName: aws.String(d.tableName.MDSTable),
+		}
+		if _, err := d.db.PutItem(input); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (d *Database) GetService(name string) (models.ServiceResponse, error) {
 
 	service := models.ServiceResponse{}
@@ -255,16 +612,28 @@ func (d *Database) UpdateService(updatedService models.ServiceRequest, serviceUU
 		return errors.New("service not found")
 	}
 
-	oldServiceName := utils.GetRangeKey(utils.SERVICE, oldService.ServiceName, blank, blank)
-	newServiceName := utils.GetRangeKey(utils.SERVICE, updatedService.ServiceName, blank, blank)
+	// Version carries the If-Match version, 0 when the client sent none
+	if !utils.VersionMatches(updatedService.Version, oldService.Version) {
+		return utils.ErrVersionConflict
+	}
 
-	// if service name is changed, delete old entry and create new one
-	if oldServiceName != newServiceName {
-		err := d.DeleteService(oldService.ServiceName)
-		if err != nil {
-			return err
-		}
+	fields, err := d.ListFields()
+	if err != nil {
+		return err
+	}
+	err = utils.CheckAttributes(updatedService.Attributes, fields)
+	if err != nil {
+		return err
+	}
+
+	updatedService.Category, err = d.VerifyTag(updatedService.Category)
+	if err != nil {
+		return err
 	}
+	updatedService.Category = utils.StampCategories(updatedService.Category, oldService.Category, utils.DateString("datetime"))
+
+	updatedService.ServiceUUID = serviceUUID
+	updatedService.Version = oldService.Version + 1
 	// old created at
 	updatedService.CreatedAt = oldService.CreatedAt
 	// new updated at
@@ -272,46 +641,54 @@ func (d *Database) UpdateService(updatedService models.ServiceRequest, serviceUU
 	updatedService.PK = utils.GetPartitionKey(utils.SERVICE)
 	updatedService.SK = utils.GetRangeKey(utils.SERVICE, updatedService.ServiceName, blank, blank)
 
-	err = d.VerifyTag(updatedService.Category)
+	av, err := dynamodbattribute.MarshalMap(updatedService)
 	if err != nil {
 		return err
 	}
-
-	_, err = d.CreateService(updatedService)
-	if err != nil {
-		// TODO: restore old entry in case of error
-		return err
+	if len(updatedService.Category) == 0 {
+		av = utils.NilToEmptySlice(av, "category")
 	}
 
-	return nil
+	err = d.replaceItem(av, oldService.SK, serviceUUID, oldService.Version)
+	switch err {
+	case errKeyTaken:
+		return errors.New("Service already exist")
+	case errItemChanged:
+		return utils.ErrVersionConflict
+	}
+	return err
 }
 
-func (d *Database) DeleteService(name string) error {
+// DeleteService checks and detaches the subscriptions before deleting, a company
+// subscribing in between is cleaned up by the stream processor. The companies and
+// the service are written in transactions, the service last, see transactWrites.
+func (d *Database) DeleteService(name string, cascade bool, actor string) error {
 
-	pkName := utils.GetPartitionKeyName()
-	pk := utils.GetPartitionKey(utils.SERVICE)
+	service, err := d.GetService(name)
+	if err != nil || service.ServiceName == "" {
+		return err
+	}
 
-	skName := utils.GetRangeKeyName()
-	sk := utils.GetRangeKey(utils.SERVICE, name, blank, blank)
+	companies, err := d.companiesWithService(service.ServiceUUID)
+	if err != nil {
+		return err
+	}
 
-	input := &dynamodb.DeleteItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			pkName: {
-				S: aws.String(pk),
-			},
-			skName: {
-				S: aws.String(sk),
-			},
-		},
-		TableName: aws.String(d.tableName.MDSTable),
+	if !cascade && len(companies) > 0 {
+		return &utils.ReferencedError{Entity: "service " + name, References: utils.ServiceReferences(companies, service.ServiceUUID)}
 	}
 
-	// GetItem from dynamodb table
-	_, err := d.db.DeleteItem(input)
+	writes, err := d.detachServiceWrites(companies, service.ServiceUUID)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	exists, err := d.markDeleted(service.PK, service.SK, actor)
+	if err != nil || !exists {
+		return err
+	}
+	writes = append(writes, d.deleteWrite(service.PK, service.SK, "service "+name))
+	return d.transactWrites(writes, "deleting service "+name)
 }
 
 func (d *Database) VerifyService(serviceList []string) (bool, error) {
@@ -330,25 +707,24 @@ func (d *Database) VerifyService(serviceList []string) (bool, error) {
 
 func (d *Database) CreateCompany(company models.CompanyRequest) (models.CompanyRequest, error) {
 
-	// if its a fresh entry
-	if company.CompanyUUID == "" {
-		// check if companyalready exist
-		existCompany, err := d.GetCompany(company.CompanyName)
-		if err != nil {
-			return company, err
-		}
-
-		if existCompany.CompanyName != "" {
-			return company, errors.New("Company already exist")
-		}
+	// check if companyalready exist
+	existCompany, err := d.GetCompany(company.CompanyName)
+	if err != nil {
+		return company, err
+	}
 
-		company.CompanyUUID = utils.GetUUID()
-		datetime := utils.DateString("datetime")
-		company.CreatedAt, company.UpdatedAt = datetime, datetime
-		company.PK = utils.GetPartitionKey(utils.COMPANY)
-		company.SK = utils.GetRangeKey(utils.COMPANY, company.CompanyName, blank, blank)
+	if existCompany.CompanyName != "" {
+		return company, errors.New("Company already exist")
 	}
 
+	// always a new company, a uuid or version sent with it is ignored
+	company.CompanyUUID = utils.GetUUID()
+	company.Version = 1
+	datetime := utils.DateString("datetime")
+	company.CreatedAt, company.UpdatedAt = datetime, datetime
+	company.PK = utils.GetPartitionKey(utils.COMPANY)
+	company.SK = utils.GetRangeKey(utils.COMPANY, company.CompanyName, blank, blank)
+
 	valid, err := d.VerifyService(company.ServiceList)
 	if err != nil {
 		return company, err
@@ -367,12 +743,18 @@ func (d *Database) CreateCompany(company models.CompanyRequest) (models.CompanyR
 		av = utils.NilToEmptySlice(av, "service_list")
 	}
 
+	// a concurrent create of the same name may have happened since the check above
 	input := &dynamodb.PutItemInput{
-		Item:      av,
-		TableName: aws.String(d.tableName.MDSTable),
+		Item:                     av,
+		TableName:                aws.String(d.tableName.MDSTable),
+		ConditionExpression:      aws.String("attribute_not_exists(#pk)"),
+		ExpressionAttributeNames: map[string]*string{"#pk": aws.String(utils.GetPartitionKeyName())},
 	}
 
 	_, err = d.db.PutItem(input)
+	if isConditionalCheckFailed(err) {
+		return company, errors.New("Company already exist")
+	}
 	if err != nil {
 		return company, err
 	}
@@ -380,36 +762,19 @@ func (d *Database) CreateCompany(company models.CompanyRequest) (models.CompanyR
 	return company, nil
 }
 
-func (d *Database) GetAllCompanies() ([]models.CompanyResponse, error) {
+func (d *Database) GetAllCompanies(limit int, cursor string) ([]models.CompanyResponse, string, error) {
 
 	companies := make([]models.CompanyResponse, 0)
 	companiesTemp := []models.Company{}
 
-	pkName := utils.GetPartitionKeyName()
-	pkPrefix := utils.GetPartitionKey(utils.COMPANY)
-
-	keyCond := expression.Key(pkName).Equal(expression.Value(pkPrefix))
-
-	expr, err := expression.NewBuilder().WithKeyCondition(keyCond).Build()
-	if err != nil {
-		return companies, err
-	}
-
-	input := &dynamodb.QueryInput{
-		KeyConditionExpression:    expr.KeyCondition(),
-		TableName:                 aws.String(d.tableName.MDSTable),
-		ExpressionAttributeNames:  expr.Names(),
-		ExpressionAttributeValues: expr.Values(),
-	}
-
-	result, err := d.db.Query(input)
+	items, next, err := d.queryPage(utils.COMPANY, limit, cursor)
 	if err != nil {
-		return companies, err
+		return companies, "", err
 	}
 
-	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &companiesTemp)
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &companiesTemp)
 	if err != nil {
-		return companies, err
+		return companies, "", err
 	}
 
 	projection := aws.String("service_name")
@@ -430,10 +795,12 @@ func (d *Database) GetAllCompanies() ([]models.CompanyResponse, error) {
 		temp.UpdatedAt = company.UpdatedAt
 		temp.Description = company.Description
 		temp.ServiceList = s
+		temp.Version = company.Version
+		temp.UpdatedBy = company.UpdatedBy
 		companies = append(companies, temp)
 	}
 
-	return companies, nil
+	return companies, next, nil
 }
 
 func (d *Database) GetCompany(name string) (models.CompanyResponse, error) {
@@ -484,13 +851,16 @@ func (d *Database) GetCompany(name string) (models.CompanyResponse, error) {
 	company.UpdatedAt = companyTemp.UpdatedAt
 	company.Description = companyTemp.Description
 	company.ServiceList = s
+	company.Version = companyTemp.Version
+	company.UpdatedBy = companyTemp.UpdatedBy
 
 	return company, nil
 }
 
-func (d *Database) GetCompanyByUUID(uuid string) (models.CompanyResponse, error) {
+func (d *Database) GetCompanyByUUID(uuid string) (models.Company, error) {
 
-	companies := []models.CompanyResponse{}
+	// stored items hold service uuids, unmarshal them as such
+	companies := []models.Company{}
 
 	input := &dynamodb.QueryInput{
 		TableName:              aws.String(d.tableName.MDSTable),
@@ -508,19 +878,19 @@ func (d *Database) GetCompanyByUUID(uuid string) (models.CompanyResponse, error)
 
 	result, err := d.db.Query(input)
 	if err != nil {
-		return models.CompanyResponse{}, err
+		return models.Company{}, err
 	}
 
 	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &companies)
 	if err != nil {
-		return models.CompanyResponse{}, err
+		return models.Company{}, err
 	}
 
 	if len(result.Items) > 0 {
 		return companies[0], nil
 	}
 
-	return models.CompanyResponse{}, nil
+	return models.Company{}, nil
 }
 
 func (d *Database) UpdateCompany(updatedCompany models.CompanyRequest, companyUUID string) error {
@@ -534,22 +904,10 @@ func (d *Database) UpdateCompany(updatedCompany models.CompanyRequest, companyUU
 		return errors.New("company not found")
 	}
 
-	oldCompanyName := utils.GetRangeKey(utils.COMPANY, oldCompany.CompanyName, blank, blank)
-	newCompanyName := utils.GetRangeKey(utils.COMPANY, updatedCompany.CompanyName, blank, blank)
-
-	// if company name is changed, delete old entry and create new one
-	if oldCompanyName != newCompanyName {
-		err := d.DeleteCompany(oldCompany.CompanyName)
-		if err != nil {
-			return err
-		}
+	// Version carries the If-Match version, 0 when the client sent none
+	if !utils.VersionMatches(updatedCompany.Version, oldCompany.Version) {
+		return utils.ErrVersionConflict
 	}
-	// old created at
-	updatedCompany.CreatedAt = oldCompany.CreatedAt
-	// new updated at
-	updatedCompany.UpdatedAt = utils.DateString("datetime")
-	updatedCompany.PK = utils.GetPartitionKey(utils.COMPANY)
-	updatedCompany.SK = utils.GetRangeKey(utils.COMPANY, updatedCompany.CompanyName, blank, blank)
 
 	valid, err := d.VerifyService(updatedCompany.ServiceList)
 	if err != nil {
@@ -560,41 +918,36 @@ func (d *Database) UpdateCompany(updatedCompany models.CompanyRequest, companyUU
 		return err
 	}
 
-	_, err = d.CreateCompany(updatedCompany)
+	updatedCompany.CompanyUUID = companyUUID
+	updatedCompany.Version = oldCompany.Version + 1
+	// old created at
+	updatedCompany.CreatedAt = oldCompany.CreatedAt
+	// new updated at
+	updatedCompany.UpdatedAt = utils.DateString("datetime")
+	updatedCompany.PK = utils.GetPartitionKey(utils.COMPANY)
+	updatedCompany.SK = utils.GetRangeKey(utils.COMPANY, updatedCompany.CompanyName, blank, blank)
+
+	av, err := dynamodbattribute.MarshalMap(updatedCompany)
 	if err != nil {
-		// TODO: restore old entry in case of error
 		return err
 	}
-
-	return nil
-}
-
-func (d *Database) DeleteCompany(name string) error {
-
-	pkName := utils.GetPartitionKeyName()
-	pk := utils.GetPartitionKey(utils.COMPANY)
-
-	skName := utils.GetRangeKeyName()
-	sk := utils.GetRangeKey(utils.COMPANY, name, blank, blank)
-
-	input := &dynamodb.DeleteItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			pkName: {
-				S: aws.String(pk),
-			},
-			skName: {
-				S: aws.String(sk),
-			},
-		},
-		TableName: aws.String(d.tableName.MDSTable),
+	if len(updatedCompany.ServiceList) == 0 {
+		av = utils.NilToEmptySlice(av, "service_list")
 	}
 
-	// GetItem from dynamodb table
-	_, err := d.db.DeleteItem(input)
-	if err != nil {
-		return err
+	oldSK := utils.GetRangeKey(utils.COMPANY, oldCompany.CompanyName, blank, blank)
+	err = d.replaceItem(av, oldSK, companyUUID, oldCompany.Version)
+	switch err {
+	case errKeyTaken:
+		return errors.New("Company already exist")
+	case errItemChanged:
+		return utils.ErrVersionConflict
 	}
-	return nil
+	return err
+}
+
+func (d *Database) DeleteCompany(name string, actor string) error {
+	return d.deleteItem(utils.GetPartitionKey(utils.COMPANY), utils.GetRangeKey(utils.COMPANY, name, blank, blank), actor)
 }
 
 // In DB
@@ -613,8 +966,114 @@ func (d *Database) CreateTag(tag models.TagCreateRequest) (models.TagCreateReque
 		return tag, errors.New("Tag already exist")
 	}
 
+	tags, err := d.ListTags()
+	if err != nil {
+		return tag, err
+	}
+
+	tree := utils.NewTagTree(tags)
+	err = tree.CheckParent(tag.Key, tag.Value, tag.ParentKey, tag.ParentValue)
+	if err != nil {
+		return tag, err
+	}
+
+	err = tree.CheckMetadata(tag.Key, tag.Value, tag.TagMetadata)
+	if err != nil {
+		return tag, err
+	}
+
+	return d.putTag(tag)
+}
+
+// ListTags reads every page of tags
+func (d *Database) ListTags() ([]models.TagResponse, error) {
+	tags := []models.TagResponse{}
+	cursor := ""
+	for {
+		items, next, err := d.queryPage(utils.TAG, utils.MAX_PAGE_LIMIT, cursor)
+		if err != nil {
+			return tags, err
+		}
+
+		page := []models.TagResponse{}
+		err = dynamodbattribute.UnmarshalListOfMaps(items, &page)
+		if err != nil {
+			return tags, err
+		}
+		tags = append(tags, page...)
+
+		if next == "" {
+			return tags, nil
+		}
+		cursor = next
+	}
+}
+
+// SetTagParent checks the tree read before the write, two concurrent moves
+// can still form a cycle, which Ancestors stops at
+func (d *Database) SetTagParent(key string, value string, parentKey string, parentValue string, actor string) error {
+	tags, err := d.ListTags()
+	if err != nil {
+		return err
+	}
+
+	tree := utils.NewTagTree(tags)
+	tag, ok := tree.Get(key, value)
+	if !ok {
+		return utils.ErrTagNotFound
+	}
+
+	err = tree.CheckParent(tag.Key, tag.Value, parentKey, parentValue)
+	if err != nil {
+		return err
+	}
+
+	tag.ParentKey, tag.ParentValue = parentKey, parentValue
+	return d.putTagFields(tag, actor)
+}
+
+// SetTagMetadata checks aliases and replacements against the tags read before the
+// write, the version condition only guards the tag itself
+func (d *Database) SetTagMetadata(key string, value string, meta models.TagMetadata, actor string) error {
+	tags, err := d.ListTags()
+	if err != nil {
+		return err
+	}
+
+	tree := utils.NewTagTree(tags)
+	tag, ok := tree.Get(key, value)
+	if !ok {
+		return utils.ErrTagNotFound
+	}
+
+	err = tree.CheckMetadata(tag.Key, tag.Value, meta)
+	if err != nil {
+		return err
+	}
+
+	tag.TagMetadata = meta
+	return d.putTagFields(tag, actor)
+}
+
+// putTagFields rewrites the parent and the metadata of a stored tag
+func (d *Database) putTagFields(tag models.TagResponse, actor string) error {
+	attrs, err := utils.TagFieldAttributes(tag)
+	if err != nil {
+		return err
+	}
+
+	err = d.setAttributes(utils.GetPartitionKey(utils.TAG), utils.GetRangeKey(utils.TAG, tag.Key, tag.Value, blank), tag.Version, actor, attrs)
+	if isConditionalCheckFailed(err) {
+		return utils.ErrVersionConflict
+	}
+	return err
+}
+
+// putTag stores a new tag, the caller checked it does not exist
+func (d *Database) putTag(tag models.TagCreateRequest) (models.TagCreateRequest, error) {
 	datetime := utils.DateString("datetime")
 	tag.CreatedAt, tag.UpdatedAt = datetime, datetime
+	tag.Version = 1
 	tag.PK = utils.GetPartitionKey(utils.TAG)
 	tag.SK = utils.GetRangeKey(utils.TAG, tag.Key, tag.Value, blank)
 
@@ -636,93 +1095,226 @@ func (d *Database) CreateTag(tag models.TagCreateRequest) (models.TagCreateReque
 	return tag, nil
 }
 
-func (d *Database) GetAllTags() ([]models.TagListResponse, error) {
+func (d *Database) GetAllTags(limit int, cursor string) ([]models.TagListResponse, string, error) {
 
-	tags := []models.TagResponse{}
+	tags := []models.TagCreateRequest{}
 	tagList := make([]models.TagListResponse, 0)
 
-	pkName := utils.GetPartitionKeyName()
-	pkPrefix := utils.GetPartitionKey(utils.TAG)
-
-	keyCond := expression.Key(pkName).Equal(expression.Value(pkPrefix))
+	items, next, err := d.queryPage(utils.TAG, limit, cursor)
+	if err != nil {
+		return tagList, "", err
+	}
 
-	expr, err := expression.NewBuilder().WithKeyCondition(keyCond).Build()
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &tags)
 	if err != nil {
-		return tagList, err
+		return tagList, "", err
 	}
 
-	input := &dynamodb.QueryInput{
-		KeyConditionExpression:    expr.KeyCondition(),
-		TableName:                 aws.String(d.tableName.MDSTable),
-		ExpressionAttributeNames:  expr.Names(),
-		ExpressionAttributeValues: expr.Values(),
+	// keep all values of a key on the same page
+	if next != "" {
+		kept := utils.TrimPartialTagGroup(tags)
+		if len(kept) < len(tags) {
+			tags = kept
+			next = utils.CursorFor(utils.GetPartitionKey(utils.TAG), tags[len(tags)-1].SK)
+		}
 	}
 
-	result, err := d.db.Query(input)
+	return utils.CreateTagResponse(utils.TagCreateToTagResponse(tags), tagList), next, nil
+}
+
+// DeleteTag checks and detaches the references before deleting, a reference
+// added in between is cleaned up by the stream processor. The references and
+// the tag are written in transactions, the tag last, see transactWrites.
+func (d *Database) DeleteTag(key string, value string, cascade bool, actor string) error {
+
+	services, rules, dependents, err := d.tagReferences(key, value)
 	if err != nil {
-		return tagList, err
+		return err
 	}
 
-	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &tags)
+	if !cascade && len(services)+len(rules)+len(dependents) > 0 {
+		return &utils.ReferencedError{Entity: "tag " + key + ":" + value, References: utils.TagReferences(services, rules, dependents, key, value)}
+	}
+
+	writes, err := d.detachTagWrites(services, rules, dependents, key, value, actor)
 	if err != nil {
-		return tagList, err
+		return err
 	}
 
-	return createTagResponse(tags, tagList), nil
+	pk, sk := utils.GetPartitionKey(utils.TAG), utils.GetRangeKey(utils.TAG, key, value, blank)
+	exists, err := d.markDeleted(pk, sk, actor)
+	if err != nil || !exists {
+		return err
+	}
+	writes = append(writes, d.deleteWrite(pk, sk, "tag "+key+":"+value))
+	return d.transactWrites(writes, "deleting tag "+key+":"+value)
 }
 
-func createTagResponse(tags []models.TagResponse, tagList []models.TagListResponse) []models.TagListResponse {
-	tagMap := make(map[string][]string, 0)
-	createdAt := ""
-	updatedAt := ""
+// UpdateTag creates the new tags, rewrites the services and rules page by page
+// and deletes the old tags last, so nothing points at a missing tag meanwhile.
+// Items changed concurrently are read again. The new tags are marked as renamed
+// from the old ones until each old tag is deleted, in the same transaction, so a
+// rename stopped on the way is resumed by repeating it.
+func (d *Database) UpdateTag(key string, value string, update models.TagUpdateRequest, progress func(models.TagUpdateReport) error) (models.TagUpdateReport, error) {
+	report := models.TagUpdateReport{Operation: update.Operation}
+
+	tags, err := d.ListTags()
+	if err != nil {
+		return report, err
+	}
 
-	for _, tag := range tags {
-		tagMap[tag.Key] = append(tagMap[tag.Key], tag.Value)
-		// TODO: create logic to get oldest created_at and latest updated_at
-		createdAt = tag.CreatedAt
-		updatedAt = tag.UpdatedAt
+	renames, err := utils.TagRenames(tags, key, value, update)
+	if err != nil {
+		return report, err
 	}
+	report.Renames = renames
 
-	for key, value := range tagMap {
-		temp := models.TagListResponse{
-			Key:       key,
-			Values:    value,
-			CreatedAt: createdAt,
-			UpdatedAt: updatedAt,
+	created, reparented := utils.RenameTagItems(tags, renames, update.Operation == utils.TAG_MERGE)
+	for _, tag := range created {
+		_, err := d.putTag(models.TagCreateRequest{Key: tag.Key, Value: tag.Value, ParentKey: tag.ParentKey, ParentValue: tag.ParentValue,
+			RenamedFromKey: tag.RenamedFromKey, RenamedFromValue: tag.RenamedFromValue, TagMetadata: tag.TagMetadata, UpdatedBy: update.UpdatedBy})
+		if err != nil {
+			return report, err
+		}
+	}
+	for _, tag := range reparented {
+		err := d.putTagFields(tag, update.UpdatedBy)
+		if err != nil {
+			return report, err
 		}
-		tagList = append(tagList, temp)
 	}
 
-	return tagList
-}
+	cursor := ""
+	for {
+		services, next, err := d.GetAllServices(utils.MAX_PAGE_LIMIT, cursor)
+		if err != nil {
+			return report, err
+		}
 
-func (d *Database) DeleteTag(key string, value string) error {
+		for _, service := range services {
+			report.ServicesScanned++
+			changed, err := d.renameServiceTags(service, renames, update.UpdatedBy)
+			if err != nil {
+				return report, err
+			}
+			if changed {
+				report.ServicesUpdated++
+			}
+		}
+		if err := progress(report); err != nil {
+			return report, err
+		}
 
-	pkName := utils.GetPartitionKeyName()
-	pk := utils.GetPartitionKey(utils.TAG)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
 
-	skName := utils.GetRangeKeyName()
-	sk := utils.GetRangeKey(utils.TAG, key, value, blank)
+	rules := []models.RuleResponse{}
+	cursor = ""
+	for {
+		page, next, err := d.GetAllRules(utils.MAX_PAGE_LIMIT, cursor)
+		if err != nil {
+			return report, err
+		}
+		rules = append(rules, page...)
 
-	fmt.Println("DeleteTag sk :", sk)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
 
-	input := &dynamodb.DeleteItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			pkName: {
-				S: aws.String(pk),
-			},
-			skName: {
-				S: aws.String(sk),
-			},
-		},
-		TableName: aws.String(d.tableName.MDSTable),
+	fields, err := d.ListFields()
+	if err != nil {
+		return report, err
+	}
+
+	updated, duplicates := utils.RenameRules(rules, renames, fields)
+	for _, rule := range updated {
+		err := d.setAttributes(rule.PK, rule.SK, rule.Version, update.UpdatedBy, map[string]*dynamodb.AttributeValue{
+			"tag_key":   {S: aws.String(rule.TagKey)},
+			"tag_value": {S: aws.String(rule.TagValue)},
+		})
+		if isConditionalCheckFailed(err) {
+			return report, errors.New("rule changed while renaming its tag : " + rule.RuleUUID)
+		}
+		if err != nil {
+			return report, err
+		}
+		report.RulesUpdated++
+	}
+	for _, rule := range duplicates {
+		err := d.DeleteRule(rule.RuleUUID, update.UpdatedBy)
+		if err != nil {
+			return report, err
+		}
+		report.RulesDeleted++
+	}
+	if err := progress(report); err != nil {
+		return report, err
 	}
 
-	_, err := d.db.DeleteItem(input)
+	tags, err = d.ListTags()
 	if err != nil {
-		return err
+		return report, err
 	}
-	return nil
+	renamed := utils.NewTagTree(utils.RenamedTags(tags, renames))
+
+	for _, rename := range renames {
+		pk, sk := utils.GetPartitionKey(utils.TAG), utils.GetRangeKey(utils.TAG, rename.FromKey, rename.FromValue, blank)
+		exists, err := d.markDeleted(pk, sk, update.UpdatedBy)
+		if err != nil {
+			return report, err
+		}
+
+		writes := []transactWrite{}
+		if tag, ok := renamed.Get(rename.ToKey, rename.ToValue); ok {
+			writes = append(writes, transactWrite{
+				item: &dynamodb.TransactWriteItem{Update: d.attributesUpdate(pk, utils.GetRangeKey(utils.TAG, tag.Key, tag.Value, blank), tag.Version,
+					update.UpdatedBy, map[string]*dynamodb.AttributeValue{"renamed_from_key": nil, "renamed_from_value": nil})},
+				name: "tag " + tag.Key + ":" + tag.Value,
+			})
+		}
+		if exists {
+			writes = append(writes, d.deleteWrite(pk, sk, "tag "+rename.FromKey+":"+rename.FromValue))
+		}
+		err = d.transactWrites(writes, "renaming tag "+rename.FromKey+":"+rename.FromValue)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	report.Done = true
+	return report, nil
+}
+
+// renameServiceTags rewrites the category of one service, reading it again
+// when it changed since it was listed
+func (d *Database) renameServiceTags(service models.ServiceResponse, renames []models.TagRename, actor string) (bool, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		category, changed := utils.RenameCategory(service.Category, renames)
+		if !changed {
+			return false, nil
+		}
+
+		catAv, err := dynamodbattribute.Marshal(category)
+		if err != nil {
+			return false, err
+		}
+
+		err = d.setAttributes(service.PK, service.SK, service.Version, actor, map[string]*dynamodb.AttributeValue{"category": catAv})
+		if !isConditionalCheckFailed(err) {
+			return err == nil, err
+		}
+
+		service, err = d.GetServiceByUUID(service.ServiceUUID, nil)
+		if err != nil || service.ServiceName == "" {
+			return false, err
+		}
+	}
+	return false, errors.New("service kept changing while renaming its tags : " + service.ServiceName)
 }
 
 func (d *Database) GetTag(key string, value string) (models.TagListResponse, error) {
@@ -767,9 +1359,9 @@ func (d *Database) GetTag(key string, value string) (models.TagListResponse, err
 		return dummy, err
 	}
 
-	resp := createTagResponse(tags, resultTag)
+	resp := utils.CreateTagResponse(tags, resultTag)
 	if len(resp) > 0 {
-		return createTagResponse(tags, resultTag)[0], nil
+		return utils.CreateTagResponse(tags, resultTag)[0], nil
 	}
 
 	return dummy, nil
@@ -789,6 +1381,14 @@ func (d *Database) IsDuplicateRule(rule models.RuleRequest) (bool, error) {
 		And(expression.Name("corule_keyword").Equal(expression.Value(rule.CoRuleKeyword))).
 		And(expression.Name("tag_value").Equal(expression.Value(rule.TagValue)))
 
+	// rules stored before expressions existed have none, their legacy fields decide
+	// and they match substrings without synonyms or conditions
+	sameExpression := expression.Name("expression").Equal(expression.Value(rule.Expression))
+	if utils.PlainKeywordRule(rule) {
+		sameExpression = sameExpression.Or(expression.AttributeNotExists(expression.Name("expression")))
+	}
+	filter1 = filter1.And(sameExpression)
+
 	expr, err := expression.NewBuilder().WithFilter(filter1).WithKeyCondition(keyCond).Build()
 	if err != nil {
 		fmt.Printf("Expression builder error : %v\n", err)
@@ -824,6 +1424,21 @@ func (d *Database) IsDuplicateRule(rule models.RuleRequest) (bool, error) {
 }
 
 func (d *Database) CreateRule(rule models.RuleRequest) (models.RuleRequest, error) {
+	fields, err := d.ListFields()
+	if err != nil {
+		return rule, err
+	}
+	err = utils.SetRuleExpression(&rule, fields)
+	if err != nil {
+		return rule, err
+	}
+
+	// an alias or deprecated tag is saved as its canonical tag, compared with the stored rules
+	err = d.verifyRuleTag(&rule)
+	if err != nil {
+		return rule, err
+	}
+
 	// check if rule already exist
 	isDuplicateRule, err := d.IsDuplicateRule(rule)
 	if err != nil {
@@ -835,19 +1450,13 @@ func (d *Database) CreateRule(rule models.RuleRequest) (models.RuleRequest, erro
 	}
 
 	rule.RuleUUID = utils.GetUUID()
+	rule.Version = 1
 	datetime := utils.DateString("datetime")
 	rule.CreatedAt, rule.UpdatedAt = datetime, datetime
 	rule.PK = utils.GetPartitionKey(utils.RULE)
 	rule.SK = utils.GetRangeKey(utils.RULE, blank, blank, rule.RuleUUID)
 
-	cat := make([]models.Category, 0)
-	cat = append(cat, models.Category{Key: rule.TagKey, Value: rule.TagValue})
-	err = d.VerifyTag(cat)
-	if err != nil {
-		return rule, err
-	}
-
-	err = d.insertRule(rule)
+	err = d.insertRule(rule, true, 0)
 	if err != nil {
 		return rule, err
 	}
@@ -855,7 +1464,9 @@ func (d *Database) CreateRule(rule models.RuleRequest) (models.RuleRequest, erro
 	return rule, nil
 }
 
-func (d *Database) insertRule(rule models.RuleRequest) error {
+// insertRule puts the rule. A new rule must not exist yet, an existing rule
+// must still be at oldVersion, otherwise utils.ErrVersionConflict is returned.
+func (d *Database) insertRule(rule models.RuleRequest, isNew bool, oldVersion int) error {
 	av, err := dynamodbattribute.MarshalMap(rule)
 	if err != nil {
 		return err
@@ -866,44 +1477,42 @@ func (d *Database) insertRule(rule models.RuleRequest) error {
 		TableName: aws.String(d.tableName.MDSTable),
 	}
 
+	if isNew {
+		input.ConditionExpression = aws.String("attribute_not_exists(#pk)")
+		input.ExpressionAttributeNames = map[string]*string{"#pk": aws.String(utils.GetPartitionKeyName())}
+	} else {
+		condition, names, values := versionCondition(oldVersion)
+		input.ConditionExpression = aws.String("attribute_exists(#pk) AND " + condition)
+		names["#pk"] = aws.String(utils.GetPartitionKeyName())
+		input.ExpressionAttributeNames = names
+		input.ExpressionAttributeValues = values
+	}
+
 	_, err = d.db.PutItem(input)
+	if isConditionalCheckFailed(err) {
+		return utils.ErrVersionConflict
+	}
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (d *Database) GetAllRules() ([]models.RuleResponse, error) {
+func (d *Database) GetAllRules(limit int, cursor string) ([]models.RuleResponse, string, error) {
 
 	rules := []models.RuleResponse{}
-	pkName := utils.GetPartitionKeyName()
-	pkPrefix := utils.GetPartitionKey(utils.RULE)
-
-	keyCond := expression.Key(pkName).Equal(expression.Value(pkPrefix))
-
-	expr, err := expression.NewBuilder().WithKeyCondition(keyCond).Build()
-	if err != nil {
-		return rules, err
-	}
-
-	input := &dynamodb.QueryInput{
-		KeyConditionExpression:    expr.KeyCondition(),
-		TableName:                 aws.String(d.tableName.MDSTable),
-		ExpressionAttributeNames:  expr.Names(),
-		ExpressionAttributeValues: expr.Values(),
-	}
 
-	result, err := d.db.Query(input)
+	items, next, err := d.queryPage(utils.RULE, limit, cursor)
 	if err != nil {
-		return rules, err
+		return rules, "", err
 	}
 
-	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &rules)
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &rules)
 	if err != nil {
-		return rules, err
+		return rules, "", err
 	}
 
-	return rules, nil
+	return rules, next, nil
 }
 
 func (d *Database) GetRule(ruleUUID string) (models.RuleResponse, error) {
@@ -942,6 +1551,15 @@ func (d *Database) GetRule(ruleUUID string) (models.RuleResponse, error) {
 // send both values togather
 func (d *Database) UpdateRule(updatedRule models.RuleRequest, ruleUUID string) error {
 
+	fields, err := d.ListFields()
+	if err != nil {
+		return err
+	}
+	err = utils.SetRuleExpression(&updatedRule, fields)
+	if err != nil {
+		return err
+	}
+
 	oldRule, err := d.GetRule(ruleUUID)
 	if err != nil {
 		return err
@@ -951,21 +1569,26 @@ func (d *Database) UpdateRule(updatedRule models.RuleRequest, ruleUUID string) e
 		return errors.New("rule not found")
 	}
 
-	// old created at
+	// Version carries the If-Match version, 0 when the client sent none
+	if !utils.VersionMatches(updatedRule.Version, oldRule.Version) {
+		return utils.ErrVersionConflict
+	}
+
 	updatedRule.PK = oldRule.PK
 	updatedRule.SK = oldRule.SK
+	updatedRule.RuleUUID = oldRule.RuleUUID
+	updatedRule.Version = oldRule.Version + 1
+	// old created at
 	updatedRule.CreatedAt = oldRule.CreatedAt
 	// new updated at
 	updatedRule.UpdatedAt = utils.DateString("datetime")
 
-	cat := make([]models.Category, 0)
-	cat = append(cat, models.Category{Key: updatedRule.TagKey, Value: updatedRule.TagValue})
-	err = d.VerifyTag(cat)
+	err = d.verifyRuleTag(&updatedRule)
 	if err != nil {
 		return err
 	}
 
-	err = d.insertRule(updatedRule)
+	err = d.insertRule(updatedRule, false, oldRule.Version)
 	if err != nil {
 		return err
 	}
@@ -973,108 +1596,449 @@ func (d *Database) UpdateRule(updatedRule models.RuleRequest, ruleUUID string) e
 	return nil
 }
 
-func (d *Database) DeleteRule(ruleUUID string) error {
+func (d *Database) DeleteRule(ruleUUID string, actor string) error {
+	return d.deleteItem(utils.GetPartitionKey(utils.RULE), utils.GetRangeKey(utils.RULE, blank, blank, ruleUUID), actor)
+}
 
-	pkName := utils.GetPartitionKeyName()
-	pk := utils.GetPartitionKey(utils.RULE)
+func (d *Database) CreateSynonym(synonym models.Synonym) (models.Synonym, error) {
+	groups, err := d.ListSynonyms()
+	if err != nil {
+		return synonym, err
+	}
+	for _, group := range groups {
+		// by term, groups stored before keys were normalized keep their key
+		if utils.GetRangeKey(utils.SYNONYM, group.Term, blank, blank) == utils.GetRangeKey(utils.SYNONYM, synonym.Term, blank, blank) {
+			return synonym, errors.New("Synonym already exist")
+		}
+	}
 
-	skName := utils.GetRangeKeyName()
-	sk := utils.GetRangeKey(utils.RULE, blank, blank, ruleUUID)
+	err = utils.CheckSynonym(synonym, groups)
+	if err != nil {
+		return synonym, err
+	}
 
-	input := &dynamodb.DeleteItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			pkName: {
-				S: aws.String(pk),
-			},
-			skName: {
-				S: aws.String(sk),
+	synonym.SynonymUUID = utils.GetUUID()
+	synonym.Version = 1
+	datetime := utils.DateString("datetime")
+	synonym.CreatedAt, synonym.UpdatedAt = datetime, datetime
+	synonym.PK = utils.GetPartitionKey(utils.SYNONYM)
+	synonym.SK = utils.GetRangeKey(utils.SYNONYM, synonym.Term, blank, blank)
+
+	// a concurrent create of the same term fails the condition
+	err = d.putSynonym(synonym, true, 0)
+	if errors.Is(err, utils.ErrVersionConflict) {
+		return synonym, errors.New("Synonym already exist")
+	}
+	return synonym, err
+}
+
+// putSynonym puts the group, with the conditions insertRule puts a rule with
+func (d *Database) putSynonym(synonym models.Synonym, isNew bool, oldVersion int) error {
+	av, err := dynamodbattribute.MarshalMap(synonym)
+	if err != nil {
+		return err
+	}
+
+	input := &dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(d.tableName.MDSTable),
+	}
+
+	if isNew {
+		input.ConditionExpression = aws.String("attribute_not_exists(#pk)")
+		input.ExpressionAttributeNames = map[string]*string{"#pk": aws.String(utils.GetPartitionKeyName())}
+	} else {
+		condition, names, values := versionCondition(oldVersion)
+		input.ConditionExpression = aws.String("attribute_exists(#pk) AND " + condition)
+		names["#pk"] = aws.String(utils.GetPartitionKeyName())
+		input.ExpressionAttributeNames = names
+		input.ExpressionAttributeValues = values
+	}
+
+	_, err = d.db.PutItem(input)
+	if isConditionalCheckFailed(err) {
+		return utils.ErrVersionConflict
+	}
+	return err
+}
+
+func (d *Database) GetAllSynonyms(limit int, cursor string) ([]models.Synonym, string, error) {
+	synonyms := []models.Synonym{}
+
+	items, next, err := d.queryPage(utils.SYNONYM, limit, cursor)
+	if err != nil {
+		return synonyms, "", err
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &synonyms)
+	return synonyms, next, err
+}
+
+// ListSynonyms reads every page of the synonym dictionary
+func (d *Database) ListSynonyms() ([]models.Synonym, error) {
+	synonyms := []models.Synonym{}
+	cursor := ""
+	for {
+		page, next, err := d.GetAllSynonyms(utils.MAX_PAGE_LIMIT, cursor)
+		if err != nil {
+			return synonyms, err
+		}
+		synonyms = append(synonyms, page...)
+
+		if next == "" {
+			return synonyms, nil
+		}
+		cursor = next
+	}
+}
+
+func (d *Database) GetSynonym(term string) (models.Synonym, error) {
+	synonym := models.Synonym{}
+
+	input := &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			utils.GetPartitionKeyName(): {
+				S: aws.String(utils.GetPartitionKey(utils.SYNONYM)),
+			},
+			utils.GetRangeKeyName(): {
+				S: aws.String(utils.GetRangeKey(utils.SYNONYM, term, blank, blank)),
 			},
 		},
 		TableName: aws.String(d.tableName.MDSTable),
 	}
+	result, err := d.db.GetItem(input)
+	if err != nil {
+		return synonym, err
+	}
+
+	err = dynamodbattribute.UnmarshalMap(result.Item, &synonym)
+	return synonym, err
+}
+
+// UpdateSynonym checks the dictionary read before the write, two concurrent
+// updates can still put a word in two groups, it then expands to both
+func (d *Database) UpdateSynonym(updatedSynonym models.Synonym, term string) error {
+	old, err := d.GetSynonym(term)
+	if err != nil {
+		return err
+	}
+	if old.Term == "" {
+		return utils.ErrSynonymNotFound
+	}
+
+	// Version carries the If-Match version, 0 when the client sent none
+	if !utils.VersionMatches(updatedSynonym.Version, old.Version) {
+		return utils.ErrVersionConflict
+	}
 
-	_, err := d.db.DeleteItem(input)
+	synonym := old
+	synonym.Synonyms = updatedSynonym.Synonyms
+	synonym.UpdatedBy = updatedSynonym.UpdatedBy
+	groups, err := d.ListSynonyms()
 	if err != nil {
 		return err
 	}
-	return nil
+	err = utils.CheckSynonym(synonym, groups)
+	if err != nil {
+		return err
+	}
+
+	synonym.Version++
+	synonym.UpdatedAt = utils.DateString("datetime")
+	return d.putSynonym(synonym, false, old.Version)
 }
 
-func (d *Database) IsServiceEligibleForTag(streamData models.StreamData, rule models.RuleResponse) (bool, error) {
+func (d *Database) DeleteSynonym(term string, actor string) error {
+	return d.deleteItem(utils.GetPartitionKey(utils.SYNONYM), utils.GetRangeKey(utils.SYNONYM, term, blank, blank), actor)
+}
 
-	keyCond := expression.Key(utils.GetPartitionKeyName()).Equal(expression.Value(utils.GetPartitionKey(utils.COMPANY)))
-	filter := expression.Contains(expression.Name("service_list"), streamData.UUID)
+func (d *Database) CreateField(field models.Field) (models.Field, error) {
+	old, err := d.GetField(field.Name)
+	if err != nil {
+		return field, err
+	}
+	if old.Name != "" {
+		return field, errors.New("Field already exist")
+	}
 
-	expr, err := expression.NewBuilder().WithFilter(filter).WithKeyCondition(keyCond).Build()
+	err = utils.CheckField(&field)
 	if err != nil {
-		fmt.Printf("Expression builder error : %v\n", err)
-		return false, err
+		return field, err
 	}
 
-	// input for GetItem
-	input := &dynamodb.QueryInput{
-		KeyConditionExpression:    expr.KeyCondition(),
-		TableName:                 aws.String(d.tableName.MDSTable),
-		ExpressionAttributeNames:  expr.Names(),
-		ExpressionAttributeValues: expr.Values(),
-		FilterExpression:          expr.Filter(),
-		ProjectionExpression:      aws.String("company_name"),
+	field.FieldUUID = utils.GetUUID()
+	field.Version = 1
+	datetime := utils.DateString("datetime")
+	field.CreatedAt, field.UpdatedAt = datetime, datetime
+	field.PK = utils.GetPartitionKey(utils.FIELD)
+	field.SK = utils.GetRangeKey(utils.FIELD, field.Name, blank, blank)
+
+	// a concurrent create of the same name fails the condition
+	err = d.putField(field, true, 0)
+	if errors.Is(err, utils.ErrVersionConflict) {
+		return field, errors.New("Field already exist")
 	}
+	return field, err
+}
 
-	// GetItem from dynamodb table
-	result, err := d.db.Query(input)
+// putField puts the field, with the conditions putSynonym puts a group with
+func (d *Database) putField(field models.Field, isNew bool, oldVersion int) error {
+	av, err := dynamodbattribute.MarshalMap(field)
 	if err != nil {
-		return false, err
+		return err
 	}
 
-	item := []models.CompanyResponse{}
-	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &item)
+	input := &dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(d.tableName.MDSTable),
+	}
+
+	if isNew {
+		input.ConditionExpression = aws.String("attribute_not_exists(#pk)")
+		input.ExpressionAttributeNames = map[string]*string{"#pk": aws.String(utils.GetPartitionKeyName())}
+	} else {
+		condition, names, values := versionCondition(oldVersion)
+		input.ConditionExpression = aws.String("attribute_exists(#pk) AND " + condition)
+		names["#pk"] = aws.String(utils.GetPartitionKeyName())
+		input.ExpressionAttributeNames = names
+		input.ExpressionAttributeValues = values
+	}
+
+	_, err = d.db.PutItem(input)
+	if isConditionalCheckFailed(err) {
+		return utils.ErrVersionConflict
+	}
+	return err
+}
+
+func (d *Database) GetAllFields(limit int, cursor string) ([]models.Field, string, error) {
+	fields := []models.Field{}
+
+	items, next, err := d.queryPage(utils.FIELD, limit, cursor)
 	if err != nil {
-		return false, err
+		return fields, "", err
 	}
 
-	fmt.Println("No of companies : ", len(item))
-	fmt.Println("SubscriptionCount : ", rule.SubscriptionCount)
-	if rule.SubscriptionCount < len(item) {
-		return true, nil
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &fields)
+	return fields, next, err
+}
+
+// ListFields reads every page of the declared fields
+func (d *Database) ListFields() ([]models.Field, error) {
+	fields := []models.Field{}
+	cursor := ""
+	for {
+		page, next, err := d.GetAllFields(utils.MAX_PAGE_LIMIT, cursor)
+		if err != nil {
+			return fields, err
+		}
+		fields = append(fields, page...)
+
+		if next == "" {
+			return fields, nil
+		}
+		cursor = next
 	}
-	return false, err
 }
 
-// execute when new service is created, here streamData contains service data
-func (d *Database) AttachTagWithService(streamData models.StreamData, rules []models.RuleResponse) error {
+func (d *Database) GetField(name string) (models.Field, error) {
+	field := models.Field{}
+
+	input := &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			utils.GetPartitionKeyName(): {
+				S: aws.String(utils.GetPartitionKey(utils.FIELD)),
+			},
+			utils.GetRangeKeyName(): {
+				S: aws.String(utils.GetRangeKey(utils.FIELD, name, blank, blank)),
+			},
+		},
+		TableName: aws.String(d.tableName.MDSTable),
+	}
+	result, err := d.db.GetItem(input)
+	if err != nil {
+		return field, err
+	}
+
+	err = dynamodbattribute.UnmarshalMap(result.Item, &field)
+	return field, err
+}
+
+func (d *Database) UpdateField(updatedField models.Field, name string) error {
+	old, err := d.GetField(name)
+	if err != nil {
+		return err
+	}
+	if old.Name == "" {
+		return utils.ErrFieldNotFound
+	}
+
+	// Version carries the If-Match version, 0 when the client sent none
+	if !utils.VersionMatches(updatedField.Version, old.Version) {
+		return utils.ErrVersionConflict
+	}
+
+	field, err := utils.UpdatedField(old, updatedField)
+	if err != nil {
+		return err
+	}
+
+	// not atomic, a service saved between this check and the write below was validated with the old constraints
+	refs, err := d.brokenConstraints(old, field)
+	if err != nil {
+		return err
+	}
+	if len(refs) > 0 {
+		return &utils.ConstraintError{Field: name, References: refs}
+	}
+
+	field.Version++
+	field.UpdatedAt = utils.DateString("datetime")
+	return d.putField(field, false, old.Version)
+}
 
-	for i, rule := range rules {
-		fmt.Printf("rule number : %v : key : %v : value : %v\n", i+1, rule.TagKey, rule.TagValue)
-		updateDb := false
-		var err error
+// brokenConstraints pages through the services for the ones the update of old to field breaks
+func (d *Database) brokenConstraints(old, field models.Field) ([]models.Reference, error) {
+	refs := []models.Reference{}
+	cursor := ""
+	for {
+		services, next, err := d.GetAllServices(utils.MAX_PAGE_LIMIT, cursor)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, utils.BrokenConstraints(services, old, field)...)
 
-		switch rule.Operation {
-		case utils.CONTAIN:
-			fallthrough
+		if next == "" {
+			return refs, nil
+		}
+		cursor = next
+	}
+}
 
-		case utils.RELATION:
-			updateDb = utils.IsServiceEligibleForTag(streamData, rules[i])
-			fmt.Println("IsServiceEligibleForTag :", updateDb)
+func (d *Database) DeleteField(name string, cascade bool, actor string) error {
+	services, rules, err := d.fieldReferences(name)
+	if err != nil {
+		return err
+	}
+
+	if !cascade && len(services)+len(rules) > 0 {
+		return &utils.ReferencedError{Entity: "field " + name, References: utils.FieldReferences(services, rules, name)}
+	}
 
-		case utils.SUBSCRIPTION_COUNT:
-			// check if this service is subscribe for more than subscription threshold
-			updateDb, err = d.IsServiceEligibleForTag(streamData, rule)
+	for _, service := range services {
+		delete(service.Attributes, name)
+		var attrAv *dynamodb.AttributeValue
+		if len(service.Attributes) > 0 {
+			attrAv, err = dynamodbattribute.Marshal(service.Attributes)
 			if err != nil {
 				return err
 			}
-			fmt.Println("IsServiceEligibleForTag :", updateDb)
 		}
 
-		if updateDb {
-			d.UpdateTagToService(streamData, rule)
+		err = d.setAttributes(service.PK, service.SK, service.Version, utils.SYSTEM_ACTOR, map[string]*dynamodb.AttributeValue{"attributes": attrAv})
+		if isConditionalCheckFailed(err) {
+			return errors.New("service changed while removing attribute " + name + " : " + service.ServiceName)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range rules {
+		err := d.DeleteRule(rule.RuleUUID, actor)
+		if err != nil {
+			return err
+		}
+	}
+
+	return d.deleteItem(utils.GetPartitionKey(utils.FIELD), utils.GetRangeKey(utils.FIELD, name, blank, blank), actor)
+}
+
+// fieldReferences pages through services and rules for the ones having the attribute name or testing it
+func (d *Database) fieldReferences(name string) ([]models.ServiceResponse, []models.RuleResponse, error) {
+	having := []models.ServiceResponse{}
+	cursor := ""
+	for {
+		services, next, err := d.GetAllServices(utils.MAX_PAGE_LIMIT, cursor)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, service := range services {
+			if _, ok := service.Attributes[name]; ok {
+				having = append(having, service)
+			}
+		}
+
+		if next == "" {
+			break
 		}
+		cursor = next
+	}
+
+	testing := []models.RuleResponse{}
+	cursor = ""
+	for {
+		rules, next, err := d.GetAllRules(utils.MAX_PAGE_LIMIT, cursor)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, rule := range rules {
+			if utils.ContainsField(rule, name) {
+				testing = append(testing, rule)
+			}
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	return having, testing, nil
+}
+
+// MatchingRules evaluates the rule expressions on one env, the subscriber count is only queried when one reads it
+func (d *Database) MatchingRules(streamData models.StreamData, rules []models.RuleResponse) ([]models.RuleResponse, error) {
+	env := utils.ServiceFields(streamData, func() (int, error) {
+		return d.SubscriberCount(streamData.UUID)
+	}, d.ListSynonyms, d.ListFields)
+	return utils.MatchingRules(rules, env)
+}
+
+// SubscriberCount returns the number of companies having serviceUUID in their service_list
+func (d *Database) SubscriberCount(serviceUUID string) (int, error) {
+	companies, err := d.companiesWithService(serviceUUID)
+	if err != nil {
+		return 0, err
+	}
+
+	fmt.Println("No of companies : ", len(companies))
+	return len(companies), nil
+}
+
+// execute when new service is created, here streamData contains service data
+func (d *Database) AttachTagWithService(streamData models.StreamData, rules []models.RuleResponse) error {
+
+	matched, err := d.MatchingRules(streamData, rules)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range matched {
+		fmt.Printf("rule matched : key : %v : value : %v\n", rule.TagKey, rule.TagValue)
+		d.UpdateTagToService(streamData, rule)
 	}
 	return nil
 }
 
 func (d *Database) AppendTagToService(cat models.Category, streamData models.StreamData) error {
 
+	catAv, err := dynamodbattribute.MarshalMap(cat)
+	if err != nil {
+		return err
+	}
+
 	// construct the UpdateItemInput struct
 	updateInput := &dynamodb.UpdateItemInput{
 		TableName: aws.String(d.tableName.MDSTable),
@@ -1086,33 +2050,31 @@ func (d *Database) AppendTagToService(cat models.Category, streamData models.Str
 				S: aws.String(streamData.SK),
 			},
 		},
-		UpdateExpression: aws.String("SET #attr = list_append(#attr, :val)"),
+		// bump the version so that edits based on the untagged service get a conflict
+		UpdateExpression: aws.String("SET #attr = list_append(#attr, :val), #by = :by ADD #version :one"),
 		ExpressionAttributeNames: map[string]*string{
-			"#attr": aws.String("category"),
+			"#attr":    aws.String("category"),
+			"#by":      aws.String("updated_by"),
+			"#version": aws.String("version"),
 		},
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one": {N: aws.String("1")},
+			":by":  {S: aws.String(utils.SYSTEM_ACTOR)},
 			":val": {
-				L: []*dynamodb.AttributeValue{
-					{
-						M: map[string]*dynamodb.AttributeValue{
-							"key":   {S: aws.String(cat.Key)},
-							"value": {S: aws.String(cat.Value)},
-						},
-					},
-				},
+				L: []*dynamodb.AttributeValue{{M: catAv}},
 			},
 		},
 	}
 
 	// call the UpdateItem method to update the item in the table
-	_, err := d.db.UpdateItem(updateInput)
+	_, err = d.db.UpdateItem(updateInput)
 
 	return err
 }
 
 // here streamData contains service data
 func (d *Database) UpdateTagToService(streamData models.StreamData, rule models.RuleResponse) error {
-	cat := models.Category{Key: rule.TagKey, Value: rule.TagValue}
+	cat := utils.RuleCategory(rule, utils.DateString("datetime"))
 	if isPresent := utils.IsTagAlreadyPresent(streamData.Category, cat); isPresent {
 		fmt.Printf("tag already present : key : %v : value : %v\n", cat.Key, cat.Value)
 		return nil
@@ -1133,17 +2095,6 @@ func (d *Database) ProcessRuleForServices(streamData models.StreamData, services
 	for _, service := range services {
 		stData := utils.ServiceToStreamDataConversion(service)
 
-		if rule.Operation == utils.SUBSCRIPTION_COUNT {
-			// check if this service is subscribe for more than subscription threshold
-			updateDb, err := d.IsServiceEligibleForTag(stData, rule)
-			if err != nil {
-				return err
-			}
-			if updateDb {
-				d.UpdateTagToService(streamData, rule)
-			}
-		}
-
 		err := d.AttachTagWithService(stData, rules)
 		if err != nil {
 			return err
@@ -1155,24 +2106,553 @@ func (d *Database) ProcessRuleForServices(streamData models.StreamData, services
 // here stream data contains company data
 func (d *Database) UpdateServiceTagForSubscriberCount(streamData models.StreamData, rules []models.RuleResponse) error {
 
-	serviceStreamData := models.StreamData{}
+	subscriptionRules := make([]models.RuleResponse, 0)
 	for _, rule := range rules {
 		if rule.Operation == utils.SUBSCRIPTION_COUNT {
+			subscriptionRules = append(subscriptionRules, rule)
+		}
+	}
 
-			for _, serviceUUID := range streamData.ServiceList {
-				serviceStreamData.UUID = serviceUUID
-				// check if this service is subscribe for more than subscription threshold
-				updateDb, err := d.IsServiceEligibleForTag(serviceStreamData, rule)
-				if err != nil {
-					return err
-				}
-				fmt.Println("IsServiceEligibleForTag :", updateDb)
+	if len(subscriptionRules) == 0 {
+		return nil
+	}
+
+	for _, serviceUUID := range streamData.ServiceList {
+		// check if this service is subscribe for more than subscription threshold
+		matched, err := d.MatchingRules(models.StreamData{UUID: serviceUUID}, subscriptionRules)
+		if err != nil {
+			return err
+		}
+
+		for _, rule := range matched {
+			d.UpdateTagToService(streamData, rule)
+		}
+	}
+	return nil
+}
+
+func (d *Database) SyncRuleTags(serviceUUID string, rules []models.RuleResponse) error {
+
+	service, err := d.GetServiceByUUID(serviceUUID, nil)
+	if err != nil || service.ServiceName == "" {
+		return err
+	}
 
-				if updateDb {
-					d.UpdateTagToService(streamData, rule)
+	matched, err := d.MatchingRules(utils.ServiceToStreamDataConversion(service), rules)
+	if err != nil {
+		return err
+	}
+	return d.ApplyRuleTags(service, matched)
+}
+
+func (d *Database) ApplyRuleTags(service models.ServiceResponse, matched []models.RuleResponse) error {
+	tags, err := d.ListTags()
+	if err != nil {
+		return err
+	}
+
+	category, changed := utils.SyncServiceTags(service.Category, matched, utils.NewTagTree(tags))
+	if !changed {
+		return nil
+	}
+
+	catAv, err := dynamodbattribute.Marshal(category)
+	if err != nil {
+		return err
+	}
+
+	// only replace the list read above, a concurrent write brings its own stream record
+	err = d.setAttributes(service.PK, service.SK, service.Version, utils.SYSTEM_ACTOR, map[string]*dynamodb.AttributeValue{"category": catAv})
+	if isConditionalCheckFailed(err) {
+		fmt.Printf("service changed while syncing tags : %v\n", service.ServiceUUID)
+		return nil
+	}
+	return err
+}
+
+// deleteItem deletes an item as actor. The stream only carries the stored image of a
+// removed item, so the actor is written on it first together with deleted, which the
+// stream processor does not record as an update. A missing item is not an error.
+func (d *Database) deleteItem(pk string, sk string, actor string) error {
+	exists, err := d.markDeleted(pk, sk, actor)
+	if err != nil || !exists {
+		return err
+	}
+
+	_, err = d.db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(d.tableName.MDSTable),
+		Key:       itemKey(pk, sk),
+	})
+	return err
+}
+
+// markDeleted writes the actor of the delete of an item on it, see deleteItem. A transaction
+// cannot write an item twice, the delete of a marked item is written in one of its own.
+// It reports false for a missing item.
+func (d *Database) markDeleted(pk string, sk string, actor string) (bool, error) {
+	_, err := d.db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(d.tableName.MDSTable),
+		Key:                 itemKey(pk, sk),
+		UpdateExpression:    aws.String("SET #by = :by, #deleted = :deleted"),
+		ConditionExpression: aws.String("attribute_exists(#pk)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#pk":      aws.String(utils.GetPartitionKeyName()),
+			"#by":      aws.String("updated_by"),
+			"#deleted": aws.String("deleted"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":by":      {S: aws.String(actor)},
+			":deleted": {BOOL: aws.Bool(true)},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// deleteWrite is the delete of a marked item in a transaction
+func (d *Database) deleteWrite(pk string, sk string, name string) transactWrite {
+	return transactWrite{
+		item: &dynamodb.TransactWriteItem{
+			Delete: &dynamodb.Delete{
+				TableName: aws.String(d.tableName.MDSTable),
+				Key:       itemKey(pk, sk),
+			},
+		},
+		name: name,
+	}
+}
+
+func itemKey(pk string, sk string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		utils.GetPartitionKeyName(): {S: aws.String(pk)},
+		utils.GetRangeKeyName():     {S: aws.String(sk)},
+	}
+}
+
+// setAttributes overwrites attributes of an item still at version as one write of actor
+// and bumps the version, a nil attribute is removed. A changed or deleted item fails the condition.
+func (d *Database) setAttributes(pk string, sk string, version int, actor string, attrs map[string]*dynamodb.AttributeValue) error {
+	update := d.attributesUpdate(pk, sk, version, actor, attrs)
+	_, err := d.db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 update.TableName,
+		Key:                       update.Key,
+		UpdateExpression:          update.UpdateExpression,
+		ConditionExpression:       update.ConditionExpression,
+		ExpressionAttributeNames:  update.ExpressionAttributeNames,
+		ExpressionAttributeValues: update.ExpressionAttributeValues,
+	})
+	return err
+}
+
+// attributesUpdate is the write of setAttributes, for a transaction
+func (d *Database) attributesUpdate(pk string, sk string, version int, actor string, attrs map[string]*dynamodb.AttributeValue) *dynamodb.Update {
+	condition, names, values := versionCondition(version)
+	condition = "attribute_exists(#pk) AND " + condition
+	names["#pk"] = aws.String(utils.GetPartitionKeyName())
+	names["#by"] = aws.String("updated_by")
+	values[":by"] = &dynamodb.AttributeValue{S: aws.String(actor)}
+	values[":one"] = &dynamodb.AttributeValue{N: aws.String("1")}
+
+	// sorted so the expression is stable
+	attrNames := make([]string, 0, len(attrs))
+	for name := range attrs {
+		attrNames = append(attrNames, name)
+	}
+	sort.Strings(attrNames)
+
+	set, remove := "", ""
+	for i, name := range attrNames {
+		n, v := "#a"+strconv.Itoa(i), ":a"+strconv.Itoa(i)
+		names[n] = aws.String(name)
+		if attrs[name] == nil {
+			remove += ", " + n
+			continue
+		}
+		values[v] = attrs[name]
+		set += n + " = " + v + ", "
+	}
+	if remove != "" {
+		remove = " REMOVE" + remove[1:]
+	}
+
+	return &dynamodb.Update{
+		TableName: aws.String(d.tableName.MDSTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			utils.GetPartitionKeyName(): {S: aws.String(pk)},
+			utils.GetRangeKeyName():     {S: aws.String(sk)},
+		},
+		UpdateExpression:          aws.String("SET " + set + "#by = :by ADD #version :one" + remove),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}
+}
+
+// MAX_TRANSACT_ITEMS is the most items DynamoDB writes in one transaction
+const MAX_TRANSACT_ITEMS = 100
+
+// transactWrite is one item of transactWrites, name describes it in errors
+type transactWrite struct {
+	item *dynamodb.TransactWriteItem
+	name string
+}
+
+// transactWrites applies writes in order, in transactions of at most MAX_TRANSACT_ITEMS.
+// Each transaction is all or nothing, but when one fails the earlier ones stay applied:
+// the error names the item whose condition failed and how many writes were applied,
+// the caller puts the entity it is removing last so that it is only gone once all
+// its references are.
+func (d *Database) transactWrites(writes []transactWrite, action string) error {
+	for start := 0; start < len(writes); start += MAX_TRANSACT_ITEMS {
+		end := start + MAX_TRANSACT_ITEMS
+		if end > len(writes) {
+			end = len(writes)
+		}
+
+		items := make([]*dynamodb.TransactWriteItem, 0, end-start)
+		for _, write := range writes[start:end] {
+			items = append(items, write.item)
+		}
+
+		_, err := d.db.TransactWriteItems(&dynamodb.TransactWriteItemsInput{TransactItems: items})
+
+		var canceled *dynamodb.TransactionCanceledException
+		if errors.As(err, &canceled) {
+			for i, reason := range canceled.CancellationReasons {
+				if aws.StringValue(reason.Code) == "ConditionalCheckFailed" {
+					return fmt.Errorf("%v changed while %v, %v of %v writes applied", writes[start+i].name, action, start, len(writes))
 				}
 			}
 		}
+		if err != nil {
+			return fmt.Errorf("%v : %v, %v of %v writes applied", action, err, start, len(writes))
+		}
 	}
 	return nil
 }
+
+// companiesWithService returns every company having serviceUUID in its service_list
+func (d *Database) companiesWithService(serviceUUID string) ([]models.Company, error) {
+	companies := []models.Company{}
+
+	keyCond := expression.Key(utils.GetPartitionKeyName()).Equal(expression.Value(utils.GetPartitionKey(utils.COMPANY)))
+	filter := expression.Contains(expression.Name("service_list"), serviceUUID)
+
+	expr, err := expression.NewBuilder().WithFilter(filter).WithKeyCondition(keyCond).Build()
+	if err != nil {
+		fmt.Printf("Expression builder error : %v\n", err)
+		return companies, err
+	}
+
+	input := &dynamodb.QueryInput{
+		KeyConditionExpression:    expr.KeyCondition(),
+		TableName:                 aws.String(d.tableName.MDSTable),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+	}
+
+	err = d.db.QueryPages(input, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		items := []models.Company{}
+		err = dynamodbattribute.UnmarshalListOfMaps(page.Items, &items)
+		if err != nil {
+			return false
+		}
+		companies = append(companies, items...)
+		return true
+	})
+	return companies, err
+}
+
+// RemoveServiceReferences drops a deleted service from every company service list
+func (d *Database) RemoveServiceReferences(serviceUUID string) error {
+	companies, err := d.companiesWithService(serviceUUID)
+	if err != nil {
+		return err
+	}
+	return d.detachService(companies, serviceUUID)
+}
+
+// detachService drops the service from the service lists of companies. A company
+// changed in between fails the call, the stream record or the delete is retried.
+func (d *Database) detachService(companies []models.Company, serviceUUID string) error {
+	writes, err := d.detachServiceWrites(companies, serviceUUID)
+	if err != nil {
+		return err
+	}
+	return d.transactWrites(writes, "removing service "+serviceUUID)
+}
+
+func (d *Database) detachServiceWrites(companies []models.Company, serviceUUID string) ([]transactWrite, error) {
+	writes := []transactWrite{}
+	for _, company := range companies {
+		serviceList, changed := utils.RemoveServiceUUID(company.ServiceList, serviceUUID)
+		if !changed {
+			continue
+		}
+
+		listAv := &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{}}
+		if len(serviceList) > 0 {
+			var err error
+			listAv, err = dynamodbattribute.Marshal(serviceList)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		update := d.attributesUpdate(company.PK, company.SK, company.Version, utils.SYSTEM_ACTOR, map[string]*dynamodb.AttributeValue{"service_list": listAv})
+		writes = append(writes, transactWrite{item: &dynamodb.TransactWriteItem{Update: update}, name: "company " + company.CompanyName})
+	}
+	return writes, nil
+}
+
+// RemoveTagReferences drops a deleted tag from every service, deletes the rules assigning it
+// and unlinks the tags below or replaced by it
+func (d *Database) RemoveTagReferences(key string, value string) error {
+	services, rules, dependents, err := d.tagReferences(key, value)
+	if err != nil {
+		return err
+	}
+	return d.detachTag(services, rules, dependents, key, value, utils.SYSTEM_ACTOR)
+}
+
+// tagReferences pages through services and rules for the ones carrying or assigning key:value
+// and reads the tags below or replaced by key:value
+func (d *Database) tagReferences(key string, value string) ([]models.ServiceResponse, []models.RuleResponse, []models.TagResponse, error) {
+	tags, err := d.ListTags()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	dependents := utils.NewTagTree(tags).Dependents(key, value)
+
+	tagged := []models.ServiceResponse{}
+	cursor := ""
+	for {
+		services, next, err := d.GetAllServices(utils.MAX_PAGE_LIMIT, cursor)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		for _, service := range services {
+			if _, found := utils.RemoveCategory(service.Category, key, value); found {
+				tagged = append(tagged, service)
+			}
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	assigning := []models.RuleResponse{}
+	cursor = ""
+	for {
+		rules, next, err := d.GetAllRules(utils.MAX_PAGE_LIMIT, cursor)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		for _, rule := range rules {
+			if utils.IsSameTag(models.Category{Key: rule.TagKey, Value: rule.TagValue}, key, value) {
+				assigning = append(assigning, rule)
+			}
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	return tagged, assigning, dependents, nil
+}
+
+// detachTag unlinks the dependent tags, untags the services and deletes the rules found by tagReferences
+func (d *Database) detachTag(services []models.ServiceResponse, rules []models.RuleResponse, dependents []models.TagResponse, key string, value string, actor string) error {
+	writes, err := d.detachTagWrites(services, rules, dependents, key, value, actor)
+	if err != nil {
+		return err
+	}
+	return d.transactWrites(writes, "removing tag "+key+":"+value)
+}
+
+// detachTagWrites returns the writes of detachTag, the rules are marked deleted by actor first
+func (d *Database) detachTagWrites(services []models.ServiceResponse, rules []models.RuleResponse, dependents []models.TagResponse, key string, value string, actor string) ([]transactWrite, error) {
+	writes := []transactWrite{}
+	for _, tag := range dependents {
+		attrs, err := utils.TagFieldAttributes(tag)
+		if err != nil {
+			return nil, err
+		}
+
+		update := d.attributesUpdate(utils.GetPartitionKey(utils.TAG), utils.GetRangeKey(utils.TAG, tag.Key, tag.Value, blank), tag.Version, utils.SYSTEM_ACTOR, attrs)
+		writes = append(writes, transactWrite{item: &dynamodb.TransactWriteItem{Update: update}, name: "tag " + tag.Key + ":" + tag.Value})
+	}
+
+	for _, service := range services {
+		category, _ := utils.RemoveCategory(service.Category, key, value)
+		catAv, err := dynamodbattribute.Marshal(category)
+		if err != nil {
+			return nil, err
+		}
+
+		update := d.attributesUpdate(service.PK, service.SK, service.Version, utils.SYSTEM_ACTOR, map[string]*dynamodb.AttributeValue{"category": catAv})
+		writes = append(writes, transactWrite{item: &dynamodb.TransactWriteItem{Update: update}, name: "service " + service.ServiceName})
+	}
+
+	for _, rule := range rules {
+		exists, err := d.markDeleted(rule.PK, rule.SK, actor)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			writes = append(writes, d.deleteWrite(rule.PK, rule.SK, "rule "+rule.RuleUUID))
+		}
+	}
+	return writes, nil
+}
+
+// IsUUIDInUse reports whether a service, company or rule is stored under uuid
+func (d *Database) IsUUIDInUse(uuid string) (bool, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(d.tableName.MDSTable),
+		IndexName:              aws.String("uuid-index"),
+		KeyConditionExpression: aws.String("#key = :value"),
+		ExpressionAttributeNames: map[string]*string{
+			"#key": aws.String("uuid"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":value": {
+				S: aws.String(uuid),
+			},
+		},
+		Limit: aws.Int64(1),
+	}
+
+	result, err := d.db.Query(input)
+	if err != nil {
+		return false, err
+	}
+	return len(result.Items) > 0, nil
+}
+
+// AddHistory stores a history item. The key is derived from the entity and the
+// stream sequence, so a redelivered stream record overwrites its own item.
+func (d *Database) AddHistory(history models.History) error {
+	history.PK = utils.GetPartitionKey(utils.HISTORY)
+	history.SK = utils.GetRangeKey(utils.HISTORY, history.EntityUUID, history.Sequence, blank)
+
+	av, err := dynamodbattribute.MarshalMap(history)
+	if err != nil {
+		return err
+	}
+
+	input := &dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(d.tableName.MDSTable),
+	}
+
+	_, err = d.db.PutItem(input)
+	return err
+}
+
+// GetHistory returns one page of the history of an entity, oldest change first
+func (d *Database) GetHistory(entityUUID string, limit int, cursor string) ([]models.History, string, error) {
+
+	history := []models.History{}
+
+	pkName := utils.GetPartitionKeyName()
+	pk := utils.GetPartitionKey(utils.HISTORY)
+
+	skName := utils.GetRangeKeyName()
+	prefix := utils.GetRangeKey(utils.HISTORY, entityUUID, blank, blank)
+
+	startKey, err := utils.DecodeCursor(cursor, pk)
+	if err != nil {
+		return history, "", err
+	}
+
+	keyCond := expression.Key(pkName).Equal(expression.Value(pk)).
+		And(expression.Key(skName).BeginsWith(prefix))
+
+	expr, err := expression.NewBuilder().WithKeyCondition(keyCond).Build()
+	if err != nil {
+		return history, "", err
+	}
+
+	input := &dynamodb.QueryInput{
+		KeyConditionExpression:    expr.KeyCondition(),
+		TableName:                 aws.String(d.tableName.MDSTable),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ExclusiveStartKey:         startKey,
+		Limit:                     aws.Int64(int64(limit)),
+	}
+
+	result, err := d.db.Query(input)
+	if err != nil {
+		return history, "", err
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &history)
+	if err != nil {
+		return history, "", err
+	}
+
+	return history, utils.EncodeCursor(result.LastEvaluatedKey), nil
+}
+
+func (d *Database) PutBackfillJob(job models.BackfillJob) error {
+	job.PK = utils.GetPartitionKey(utils.BACKFILL)
+	job.SK = utils.GetRangeKey(utils.BACKFILL, blank, blank, job.JobID)
+
+	// two runners loading the same job can't both save it
+	condition, names, values := versionCondition(job.Version)
+	job.Version++
+
+	av, err := dynamodbattribute.MarshalMap(job)
+	if err != nil {
+		return err
+	}
+
+	input := &dynamodb.PutItemInput{
+		Item:                      av,
+		TableName:                 aws.String(d.tableName.MDSTable),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}
+
+	_, err = d.db.PutItem(input)
+	if isConditionalCheckFailed(err) {
+		return utils.ErrVersionConflict
+	}
+	return err
+}
+
+func (d *Database) GetBackfillJob(jobID string) (models.BackfillJob, error) {
+
+	job := models.BackfillJob{}
+
+	input := &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			utils.GetPartitionKeyName(): {
+				S: aws.String(utils.GetPartitionKey(utils.BACKFILL)),
+			},
+			utils.GetRangeKeyName(): {
+				S: aws.String(utils.GetRangeKey(utils.BACKFILL, blank, blank, jobID)),
+			},
+		},
+		TableName: aws.String(d.tableName.MDSTable),
+	}
+
+	result, err := d.db.GetItem(input)
+	if err != nil {
+		return job, err
+	}
+
+	err = dynamodbattribute.UnmarshalMap(result.Item, &job)
+	return job, err
+}
@@ -0,0 +1,28 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/auto-tagging-mds/database/dynamodb"
+	"github.com/auto-tagging-mds/database/memory"
+	"github.com/auto-tagging-mds/database/models"
+	"github.com/auto-tagging-mds/database/sqldb"
+)
+
+// New returns the backend selected by the DB_BACKEND environment variable:
+// dynamodb (default), memory, postgres or sqlite. SQL backends connect to DB_DSN.
+func New(tablesName models.Tables) (Database, error) {
+	backend := os.Getenv("DB_BACKEND")
+
+	switch backend {
+	case "", "dynamodb":
+		return dynamodb.New(tablesName)
+	case "memory":
+		return memory.New(tablesName)
+	case "postgres", "sqlite":
+		return sqldb.New(backend, os.Getenv("DB_DSN"))
+	}
+	return nil, errors.New(fmt.Sprintf("unknown database backend : %v", backend))
+}
@@ -0,0 +1,1955 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/auto-tagging-mds/database/models"
+	"github.com/auto-tagging-mds/utils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// item is a single row of the table, kept in the same attribute value
+// representation DynamoDB uses so stream images match the real thing.
+type item map[string]*dynamodb.AttributeValue
+
+// Database is an in-memory implementation of database.Database.
+// Items are stored by PK and SK exactly as the dynamodb package writes them,
+// and uuid-index is maintained alongside. Every write is recorded as a
+// synthetic stream record which can be drained with StreamEvent.
+type Database struct {
+	mu        sync.Mutex
+	tableName models.Tables
+	items     map[string]map[string]item
+	uuidIndex map[string]map[string]string // uuid -> SK -> PK
+	records   []models.DynamoDBEventRecord
+	sequence  int64
+}
+
+var blank string = ""
+
+func New(tablesName models.Tables) (*Database, error) {
+	var db Database
+	db.tableName = tablesName
+	db.items = make(map[string]map[string]item)
+	db.uuidIndex = make(map[string]map[string]string)
+
+	return &db, nil
+}
+
+// StreamEvent returns all stream records produced since the last call,
+// in write order, in the shape the stream processor receives from DynamoDB.
+func (d *Database) StreamEvent() models.DynamoDBEvent {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	event := models.DynamoDBEvent{Records: d.records}
+	d.records = nil
+	return event
+}
+
+func attributeString(it item, name string) string {
+	if av, ok := it[name]; ok && av != nil && av.S != nil {
+		return *av.S
+	}
+	return ""
+}
+
+func (d *Database) get(pk, sk string) item {
+	if partition, ok := d.items[pk]; ok {
+		return partition[sk]
+	}
+	return nil
+}
+
+// put stores a copy of it, the caller and the stream images share no attribute
+// values with the table
+func (d *Database) put(it item) {
+	it = copyItem(it)
+	pk := attributeString(it, utils.GetPartitionKeyName())
+	sk := attributeString(it, utils.GetRangeKeyName())
+
+	partition, ok := d.items[pk]
+	if !ok {
+		partition = make(map[string]item)
+		d.items[pk] = partition
+	}
+
+	old := partition[sk]
+	if old != nil {
+		d.unindex(old, pk, sk)
+	}
+	partition[sk] = it
+	d.index(it, pk, sk)
+
+	eventName := "INSERT"
+	if old != nil {
+		eventName = "MODIFY"
+	}
+	d.record(eventName, pk, sk, it, old)
+}
+
+func (d *Database) remove(pk, sk string) {
+	partition, ok := d.items[pk]
+	if !ok {
+		return
+	}
+
+	old, ok := partition[sk]
+	if !ok {
+		return
+	}
+	delete(partition, sk)
+	d.unindex(old, pk, sk)
+	d.record("REMOVE", pk, sk, nil, old)
+}
+
+// deleteItem removes an entity as actor like the dynamodb backend does: actor and
+// deleted are written on the item first, so the REMOVE record carries them
+func (d *Database) deleteItem(pk, sk, actor string) {
+	it := d.get(pk, sk)
+	if it == nil {
+		return
+	}
+
+	tombstone := make(item, len(it)+2)
+	for name, av := range it {
+		tombstone[name] = av
+	}
+	tombstone["updated_by"] = &dynamodb.AttributeValue{S: aws.String(actor)}
+	tombstone["deleted"] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+	d.put(tombstone)
+	d.remove(pk, sk)
+}
+
+// copyItem deep copies an item, lists, maps and sets included
+func copyItem(it item) item {
+	if it == nil {
+		return nil
+	}
+	copied := make(item, len(it))
+	for name, av := range it {
+		copied[name] = copyAttribute(av)
+	}
+	return copied
+}
+
+func copyAttribute(av *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if av == nil {
+		return nil
+	}
+	copied := *av
+	if av.S != nil {
+		copied.S = aws.String(*av.S)
+	}
+	if av.N != nil {
+		copied.N = aws.String(*av.N)
+	}
+	if av.BOOL != nil {
+		copied.BOOL = aws.Bool(*av.BOOL)
+	}
+	if av.NULL != nil {
+		copied.NULL = aws.Bool(*av.NULL)
+	}
+	if av.L != nil {
+		copied.L = make([]*dynamodb.AttributeValue, len(av.L))
+		for i, element := range av.L {
+			copied.L[i] = copyAttribute(element)
+		}
+	}
+	if av.M != nil {
+		copied.M = copyItem(av.M)
+	}
+	if av.SS != nil {
+		copied.SS = aws.StringSlice(aws.StringValueSlice(av.SS))
+	}
+	if av.NS != nil {
+		copied.NS = aws.StringSlice(aws.StringValueSlice(av.NS))
+	}
+	if av.BS != nil {
+		copied.BS = make([][]byte, len(av.BS))
+		for i, b := range av.BS {
+			copied.BS[i] = append([]byte{}, b...)
+		}
+	}
+	if av.B != nil {
+		copied.B = append([]byte{}, av.B...)
+	}
+	return &copied
+}
+
+func (d *Database) index(it item, pk, sk string) {
+	uuid := attributeString(it, "uuid")
+	if uuid == "" {
+		return
+	}
+	if _, ok := d.uuidIndex[uuid]; !ok {
+		d.uuidIndex[uuid] = make(map[string]string)
+	}
+	d.uuidIndex[uuid][sk] = pk
+}
+
+func (d *Database) unindex(it item, pk, sk string) {
+	uuid := attributeString(it, "uuid")
+	if keys, ok := d.uuidIndex[uuid]; ok {
+		delete(keys, sk)
+		if len(keys) == 0 {
+			delete(d.uuidIndex, uuid)
+		}
+	}
+}
+
+func (d *Database) record(eventName, pk, sk string, newImage, oldImage item) {
+	d.sequence++
+	rec := models.DynamoDBEventRecord{
+		EventID:     strconv.FormatInt(d.sequence, 10),
+		EventName:   eventName,
+		EventSource: "aws:dynamodb",
+		Change: models.DynamoDBStreamRecord{
+			Keys: map[string]*dynamodb.AttributeValue{
+				utils.GetPartitionKeyName(): {S: aws.String(pk)},
+				utils.GetRangeKeyName():     {S: aws.String(sk)},
+			},
+			NewImage:       copyItem(newImage),
+			OldImage:       copyItem(oldImage),
+			SequenceNumber: fmt.Sprintf("%021d", d.sequence),
+			StreamViewType: "NEW_AND_OLD_IMAGES",
+		},
+	}
+	d.records = append(d.records, rec)
+}
+
+// query returns the items of a partition whose SK begins with prefix,
+// ordered by SK as a DynamoDB Query would return them.
+func (d *Database) query(pk, prefix string) []item {
+	partition := d.items[pk]
+	keys := make([]string, 0, len(partition))
+	for sk := range partition {
+		if strings.HasPrefix(sk, prefix) {
+			keys = append(keys, sk)
+		}
+	}
+	sort.Strings(keys)
+
+	result := make([]item, 0, len(keys))
+	for _, sk := range keys {
+		result = append(result, partition[sk])
+	}
+	return result
+}
+
+// queryPage returns at most limit items of an entity partition following the
+// cursor, and the cursor of the next page when more items exist
+func (d *Database) queryPage(entity int, limit int, cursor string) ([]item, string, error) {
+	return d.queryPrefixPage(utils.GetPartitionKey(entity), blank, limit, cursor)
+}
+
+func (d *Database) queryPrefixPage(pk, prefix string, limit int, cursor string) ([]item, string, error) {
+	after, err := utils.CursorRangeKey(cursor, pk)
+	if err != nil {
+		return nil, "", err
+	}
+
+	page := make([]item, 0, limit)
+	for _, it := range d.query(pk, prefix) {
+		if attributeString(it, utils.GetRangeKeyName()) <= after {
+			continue
+		}
+		if len(page) == limit {
+			last := page[len(page)-1]
+			return page, utils.CursorFor(pk, attributeString(last, utils.GetRangeKeyName())), nil
+		}
+		page = append(page, it)
+	}
+	return page, "", nil
+}
+
+func (d *Database) queryUUID(uuid string) []item {
+	keys := d.uuidIndex[uuid]
+	sks := make([]string, 0, len(keys))
+	for sk := range keys {
+		sks = append(sks, sk)
+	}
+	sort.Strings(sks)
+
+	result := make([]item, 0, len(sks))
+	for _, sk := range sks {
+		result = append(result, d.get(keys[sk], sk))
+	}
+	return result
+}
+
+// verifyTag returns the category list with aliases and deprecated tags resolved
+func (d *Database) verifyTag(category []models.Category) ([]models.Category, error) {
+	tags, err := d.listTags()
+	if err != nil {
+		return category, err
+	}
+	return utils.ResolveTags(category, utils.NewTagTree(tags))
+}
+
+func (d *Database) CreateService(service models.ServiceRequest) (models.ServiceRequest, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// always a new service, a uuid or version sent with it is ignored
+	service.ServiceUUID, service.Version = "", 0
+
+	return d.createService(service)
+}
+
+func (d *Database) createService(service models.ServiceRequest) (models.ServiceRequest, error) {
+
+	// if its a fresh entry
+	if service.ServiceUUID == "" {
+		// check if the service already exists
+		existService, err := d.getService(service.ServiceName)
+		if err != nil {
+			return service, err
+		}
+
+		if existService.ServiceName != "" {
+			return service, errors.New("Service already exist")
+		}
+
+		service.ServiceUUID = utils.GetUUID()
+		service.Version = 1
+		datetime := utils.DateString("datetime")
+		service.CreatedAt, service.UpdatedAt = datetime, datetime
+		service.Category = utils.StampCategories(service.Category, nil, datetime)
+		service.PK = utils.GetPartitionKey(utils.SERVICE)
+		service.SK = utils.GetRangeKey(utils.SERVICE, service.ServiceName, blank, blank)
+	}
+
+	fields, err := d.listFields()
+	if err != nil {
+		return service, err
+	}
+	err = utils.CheckAttributes(service.Attributes, fields)
+	if err != nil {
+		return service, err
+	}
+
+	category, err := d.verifyTag(service.Category)
+	if err != nil {
+		return service, err
+	}
+	service.Category = category
+
+	av, err := dynamodbattribute.MarshalMap(service)
+	if err != nil {
+		return service, err
+	}
+	if len(service.Category) == 0 {
+		av = utils.NilToEmptySlice(av, "category")
+	}
+
+	d.put(av)
+	return service, nil
+}
+
+func (d *Database) GetAllServices(limit int, cursor string) ([]models.ServiceResponse, string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	services := []models.ServiceResponse{}
+	items, next, err := d.queryPage(utils.SERVICE, limit, cursor)
+	if err != nil {
+		return services, "", err
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(toMaps(items), &services)
+	return services, next, err
+}
+
+// SearchServices reads the candidates of a tag or keyword search from the indexes,
+// other searches go through all services
+func (d *Database) SearchServices(search models.ServiceSearch, limit int, cursor string) ([]models.ServiceResponse, string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	services := []models.ServiceResponse{}
+	sks, indexed, err := utils.SearchCandidates(search, func(key, value string) ([]models.ServiceTag, error) {
+		entries := []models.ServiceTag{}
+		items := d.query(utils.GetPartitionKey(utils.SERVICE_TAG), utils.GetRangeKey(utils.SERVICE_TAG, key, value, blank))
+		err := dynamodbattribute.UnmarshalListOfMaps(toMaps(items), &entries)
+		return entries, err
+	}, func(term string) ([]models.ServiceTerm, error) {
+		return d.getServiceTerms(term, false)
+	})
+	if err != nil {
+		return services, "", err
+	}
+
+	if !indexed {
+		err := dynamodbattribute.UnmarshalListOfMaps(toMaps(d.query(utils.GetPartitionKey(utils.SERVICE), blank)), &services)
+		if err != nil {
+			return services, "", err
+		}
+		return utils.SearchPage(services, search, limit, cursor)
+	}
+
+	for _, sk := range sks {
+		service := models.ServiceResponse{}
+		err := dynamodbattribute.UnmarshalMap(d.get(utils.GetPartitionKey(utils.SERVICE), sk), &service)
+		if err != nil {
+			return services, "", err
+		}
+		if service.ServiceName != "" {
+			services = append(services, service)
+		}
+	}
+	return utils.SearchPage(services, search, limit, cursor)
+}
+
+func (d *Database) IndexServiceTags(serviceUUID string, oldCategory []models.Category) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	service, err := d.getServiceByUUID(serviceUUID)
+	if err != nil {
+		return err
+	}
+
+	entries, stale := utils.ServiceTagEntries(service, serviceUUID, oldCategory)
+	for _, sk := range stale {
+		d.remove(utils.GetPartitionKey(utils.SERVICE_TAG), sk)
+	}
+	for _, entry := range entries {
+		av, err := dynamodbattribute.MarshalMap(entry)
+		if err != nil {
+			return err
+		}
+		d.put(av)
+	}
+	return nil
+}
+
+func (d *Database) IndexServiceTerms(serviceUUID string, oldTerms []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	service, err := d.getServiceByUUID(serviceUUID)
+	if err != nil {
+		return err
+	}
+
+	entries, stale := utils.ServiceTermEntries(service, serviceUUID, oldTerms)
+	for _, sk := range stale {
+		d.remove(utils.GetPartitionKey(utils.SERVICE_TERM), sk)
+	}
+	for _, entry := range entries {
+		av, err := dynamodbattribute.MarshalMap(entry)
+		if err != nil {
+			return err
+		}
+		d.put(av)
+	}
+	return nil
+}
+
+func (d *Database) GetServiceTerms(term string, prefix bool) ([]models.ServiceTerm, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.getServiceTerms(term, prefix)
+}
+
+func (d *Database) getServiceTerms(term string, prefix bool) ([]models.ServiceTerm, error) {
+	entries := []models.ServiceTerm{}
+	items := d.query(utils.GetPartitionKey(utils.SERVICE_TERM), utils.TermRangeKey(term, prefix))
+	err := dynamodbattribute.UnmarshalListOfMaps(toMaps(items), &entries)
+	return entries, err
+}
+
+func (d *Database) GetService(name string) (models.ServiceResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.getService(name)
+}
+
+func (d *Database) getService(name string) (models.ServiceResponse, error) {
+	service := models.ServiceResponse{}
+	it := d.get(utils.GetPartitionKey(utils.SERVICE), utils.GetRangeKey(utils.SERVICE, name, blank, blank))
+
+	err := dynamodbattribute.UnmarshalMap(it, &service)
+	return service, err
+}
+
+func (d *Database) GetServiceByUUID(uuid string) (models.ServiceResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.getServiceByUUID(uuid)
+}
+
+func (d *Database) getServiceByUUID(uuid string) (models.ServiceResponse, error) {
+	for _, it := range d.queryUUID(uuid) {
+		if attributeString(it, utils.GetPartitionKeyName()) != utils.GetPartitionKey(utils.SERVICE) {
+			continue
+		}
+		service := models.ServiceResponse{}
+		err := dynamodbattribute.UnmarshalMap(it, &service)
+		return service, err
+	}
+	return models.ServiceResponse{}, nil
+}
+
+func (d *Database) UpdateService(updatedService models.ServiceRequest, serviceUUID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	oldService, err := d.getServiceByUUID(serviceUUID)
+	if err != nil {
+		return err
+	}
+
+	if oldService.ServiceName == "" {
+		return errors.New("service not found")
+	}
+
+	// Version carries the If-Match version, 0 when the client sent none
+	if !utils.VersionMatches(updatedService.Version, oldService.Version) {
+		return utils.ErrVersionConflict
+	}
+
+	updatedService.Category, err = d.verifyTag(updatedService.Category)
+	if err != nil {
+		return err
+	}
+	updatedService.Category = utils.StampCategories(updatedService.Category, oldService.Category, utils.DateString("datetime"))
+
+	oldServiceName := utils.GetRangeKey(utils.SERVICE, oldService.ServiceName, blank, blank)
+	newServiceName := utils.GetRangeKey(utils.SERVICE, updatedService.ServiceName, blank, blank)
+
+	// if service name is changed, delete old entry and create new one
+	if oldServiceName != newServiceName {
+		if d.get(utils.GetPartitionKey(utils.SERVICE), newServiceName) != nil {
+			return errors.New("Service already exist")
+		}
+		d.remove(utils.GetPartitionKey(utils.SERVICE), oldServiceName)
+	}
+	updatedService.ServiceUUID = serviceUUID
+	updatedService.Version = oldService.Version + 1
+	// old created at
+	updatedService.CreatedAt = oldService.CreatedAt
+	// new updated at
+	updatedService.UpdatedAt = utils.DateString("datetime")
+	updatedService.PK = utils.GetPartitionKey(utils.SERVICE)
+	updatedService.SK = newServiceName
+
+	_, err = d.createService(updatedService)
+	return err
+}
+
+func (d *Database) DeleteService(name string, cascade bool, actor string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	service, err := d.getService(name)
+	if err != nil || service.ServiceName == "" {
+		return err
+	}
+
+	if !cascade {
+		companies := []models.Company{}
+		err := dynamodbattribute.UnmarshalListOfMaps(toMaps(d.query(utils.GetPartitionKey(utils.COMPANY), blank)), &companies)
+		if err != nil {
+			return err
+		}
+
+		if refs := utils.ServiceReferences(companies, service.ServiceUUID); len(refs) > 0 {
+			return &utils.ReferencedError{Entity: "service " + name, References: refs}
+		}
+	}
+
+	err = d.removeServiceReferences(service.ServiceUUID)
+	if err != nil {
+		return err
+	}
+
+	d.deleteItem(service.PK, service.SK, actor)
+	return nil
+}
+
+func (d *Database) verifyService(serviceList []string) error {
+	for _, serviceId := range serviceList {
+		s, err := d.getServiceByUUID(serviceId)
+		if err != nil {
+			return err
+		}
+		if s.ServiceName == "" {
+			return errors.New(fmt.Sprintf("Service %s not found", serviceId))
+		}
+	}
+	return nil
+}
+
+func (d *Database) CreateCompany(company models.CompanyRequest) (models.CompanyRequest, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// always a new company, a uuid or version sent with it is ignored
+	company.CompanyUUID, company.Version = "", 0
+
+	return d.createCompany(company)
+}
+
+func (d *Database) createCompany(company models.CompanyRequest) (models.CompanyRequest, error) {
+
+	// if its a fresh entry
+	if company.CompanyUUID == "" {
+		// check if company already exist
+		existCompany := d.get(utils.GetPartitionKey(utils.COMPANY), utils.GetRangeKey(utils.COMPANY, company.CompanyName, blank, blank))
+		if existCompany != nil {
+			return company, errors.New("Company already exist")
+		}
+
+		company.CompanyUUID = utils.GetUUID()
+		company.Version = 1
+		datetime := utils.DateString("datetime")
+		company.CreatedAt, company.UpdatedAt = datetime, datetime
+		company.PK = utils.GetPartitionKey(utils.COMPANY)
+		company.SK = utils.GetRangeKey(utils.COMPANY, company.CompanyName, blank, blank)
+	}
+
+	err := d.verifyService(company.ServiceList)
+	if err != nil {
+		return company, err
+	}
+
+	av, err := dynamodbattribute.MarshalMap(company)
+	if err != nil {
+		return company, err
+	}
+	if len(company.ServiceList) == 0 {
+		av = utils.NilToEmptySlice(av, "service_list")
+	}
+
+	d.put(av)
+	return company, nil
+}
+
+// companyResponse resolves the service uuids of a stored company to the
+// latest service names, as the dynamodb implementation does.
+func (d *Database) companyResponse(company models.Company) models.CompanyResponse {
+	s := make([]models.Services, 0)
+	for _, srvId := range company.ServiceList {
+		service, err := d.getServiceByUUID(srvId)
+		if err == nil {
+			s = append(s, models.Services{ServiceUUID: srvId, ServiceName: service.ServiceName})
+		}
+	}
+
+	return models.CompanyResponse{
+		CompanyUUID: company.CompanyUUID,
+		CompanyName: company.CompanyName,
+		Description: company.Description,
+		ServiceList: s,
+		CreatedAt:   company.CreatedAt,
+		UpdatedAt:   company.UpdatedAt,
+		Version:     company.Version,
+		UpdatedBy:   company.UpdatedBy,
+	}
+}
+
+func (d *Database) GetAllCompanies(limit int, cursor string) ([]models.CompanyResponse, string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	companies := make([]models.CompanyResponse, 0)
+	companiesTemp := []models.Company{}
+
+	items, next, err := d.queryPage(utils.COMPANY, limit, cursor)
+	if err != nil {
+		return companies, "", err
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(toMaps(items), &companiesTemp)
+	if err != nil {
+		return companies, "", err
+	}
+
+	for _, company := range companiesTemp {
+		companies = append(companies, d.companyResponse(company))
+	}
+	return companies, next, nil
+}
+
+func (d *Database) GetCompany(name string) (models.CompanyResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	companyTemp := models.Company{}
+	it := d.get(utils.GetPartitionKey(utils.COMPANY), utils.GetRangeKey(utils.COMPANY, name, blank, blank))
+
+	err := dynamodbattribute.UnmarshalMap(it, &companyTemp)
+	if err != nil {
+		return models.CompanyResponse{}, err
+	}
+
+	return d.companyResponse(companyTemp), nil
+}
+
+func (d *Database) getCompanyByUUID(uuid string) (models.Company, error) {
+	for _, it := range d.queryUUID(uuid) {
+		if attributeString(it, utils.GetPartitionKeyName()) != utils.GetPartitionKey(utils.COMPANY) {
+			continue
+		}
+		company := models.Company{}
+		err := dynamodbattribute.UnmarshalMap(it, &company)
+		return company, err
+	}
+	return models.Company{}, nil
+}
+
+func (d *Database) UpdateCompany(updatedCompany models.CompanyRequest, companyUUID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	oldCompany, err := d.getCompanyByUUID(companyUUID)
+	if err != nil {
+		return err
+	}
+
+	if oldCompany.CompanyName == "" {
+		return errors.New("company not found")
+	}
+
+	// Version carries the If-Match version, 0 when the client sent none
+	if !utils.VersionMatches(updatedCompany.Version, oldCompany.Version) {
+		return utils.ErrVersionConflict
+	}
+
+	err = d.verifyService(updatedCompany.ServiceList)
+	if err != nil {
+		return err
+	}
+
+	oldCompanyName := utils.GetRangeKey(utils.COMPANY, oldCompany.CompanyName, blank, blank)
+	newCompanyName := utils.GetRangeKey(utils.COMPANY, updatedCompany.CompanyName, blank, blank)
+
+	// if company name is changed, delete old entry and create new one
+	if oldCompanyName != newCompanyName {
+		if d.get(utils.GetPartitionKey(utils.COMPANY), newCompanyName) != nil {
+			return errors.New("Company already exist")
+		}
+		d.remove(utils.GetPartitionKey(utils.COMPANY), oldCompanyName)
+	}
+	updatedCompany.CompanyUUID = companyUUID
+	updatedCompany.Version = oldCompany.Version + 1
+	// old created at
+	updatedCompany.CreatedAt = oldCompany.CreatedAt
+	// new updated at
+	updatedCompany.UpdatedAt = utils.DateString("datetime")
+	updatedCompany.PK = utils.GetPartitionKey(utils.COMPANY)
+	updatedCompany.SK = newCompanyName
+
+	_, err = d.createCompany(updatedCompany)
+	return err
+}
+
+func (d *Database) DeleteCompany(name string, actor string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.deleteItem(utils.GetPartitionKey(utils.COMPANY), utils.GetRangeKey(utils.COMPANY, name, blank, blank), actor)
+	return nil
+}
+
+func (d *Database) CreateTag(tag models.TagCreateRequest) (models.TagCreateRequest, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// check if the tag already exists
+	existTag, err := d.getTag(tag.Key, tag.Value)
+	if err != nil {
+		return tag, err
+	}
+
+	if existTag.Key != "" {
+		return tag, errors.New("Tag already exist")
+	}
+
+	tags, err := d.listTags()
+	if err != nil {
+		return tag, err
+	}
+
+	tree := utils.NewTagTree(tags)
+	err = tree.CheckParent(tag.Key, tag.Value, tag.ParentKey, tag.ParentValue)
+	if err != nil {
+		return tag, err
+	}
+
+	err = tree.CheckMetadata(tag.Key, tag.Value, tag.TagMetadata)
+	if err != nil {
+		return tag, err
+	}
+
+	return d.putTag(tag)
+}
+
+// ListTags returns every stored tag with its parent and metadata
+func (d *Database) ListTags() ([]models.TagResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.listTags()
+}
+
+func (d *Database) listTags() ([]models.TagResponse, error) {
+	tags := []models.TagResponse{}
+	err := dynamodbattribute.UnmarshalListOfMaps(toMaps(d.query(utils.GetPartitionKey(utils.TAG), blank)), &tags)
+	return tags, err
+}
+
+func (d *Database) SetTagParent(key string, value string, parentKey string, parentValue string, actor string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tags, err := d.listTags()
+	if err != nil {
+		return err
+	}
+
+	tree := utils.NewTagTree(tags)
+	tag, ok := tree.Get(key, value)
+	if !ok {
+		return utils.ErrTagNotFound
+	}
+
+	err = tree.CheckParent(tag.Key, tag.Value, parentKey, parentValue)
+	if err != nil {
+		return err
+	}
+
+	tag.ParentKey, tag.ParentValue = parentKey, parentValue
+	return d.putTagFields(tag, actor)
+}
+
+func (d *Database) SetTagMetadata(key string, value string, meta models.TagMetadata, actor string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tags, err := d.listTags()
+	if err != nil {
+		return err
+	}
+
+	tree := utils.NewTagTree(tags)
+	tag, ok := tree.Get(key, value)
+	if !ok {
+		return utils.ErrTagNotFound
+	}
+
+	err = tree.CheckMetadata(tag.Key, tag.Value, meta)
+	if err != nil {
+		return err
+	}
+
+	tag.TagMetadata = meta
+	return d.putTagFields(tag, actor)
+}
+
+// putTagFields rewrites the parent and the metadata of a stored tag
+func (d *Database) putTagFields(tag models.TagResponse, actor string) error {
+	attrs, err := utils.TagFieldAttributes(tag)
+	if err != nil {
+		return err
+	}
+
+	d.putAttributes(utils.GetPartitionKey(utils.TAG), utils.GetRangeKey(utils.TAG, tag.Key, tag.Value, blank), tag.Version, actor, attrs)
+	return nil
+}
+
+func (d *Database) GetAllTags(limit int, cursor string) ([]models.TagListResponse, string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tags := []models.TagCreateRequest{}
+	tagList := make([]models.TagListResponse, 0)
+
+	items, next, err := d.queryPage(utils.TAG, limit, cursor)
+	if err != nil {
+		return tagList, "", err
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(toMaps(items), &tags)
+	if err != nil {
+		return tagList, "", err
+	}
+
+	// keep all values of a key on the same page
+	if next != "" {
+		kept := utils.TrimPartialTagGroup(tags)
+		if len(kept) < len(tags) {
+			tags = kept
+			next = utils.CursorFor(utils.GetPartitionKey(utils.TAG), tags[len(tags)-1].SK)
+		}
+	}
+
+	return utils.CreateTagResponse(utils.TagCreateToTagResponse(tags), tagList), next, nil
+}
+
+func (d *Database) DeleteTag(key string, value string, cascade bool, actor string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !cascade {
+		services := []models.ServiceResponse{}
+		err := dynamodbattribute.UnmarshalListOfMaps(toMaps(d.query(utils.GetPartitionKey(utils.SERVICE), blank)), &services)
+		if err != nil {
+			return err
+		}
+
+		rules, err := d.getAllRules()
+		if err != nil {
+			return err
+		}
+
+		tags, err := d.listTags()
+		if err != nil {
+			return err
+		}
+
+		dependents := utils.NewTagTree(tags).Dependents(key, value)
+		if refs := utils.TagReferences(services, rules, dependents, key, value); len(refs) > 0 {
+			return &utils.ReferencedError{Entity: "tag " + key + ":" + value, References: refs}
+		}
+	}
+
+	err := d.removeTagReferences(key, value, actor)
+	if err != nil {
+		return err
+	}
+
+	d.deleteItem(utils.GetPartitionKey(utils.TAG), utils.GetRangeKey(utils.TAG, key, value, blank), actor)
+	return nil
+}
+
+func (d *Database) UpdateTag(key string, value string, update models.TagUpdateRequest, progress func(models.TagUpdateReport) error) (models.TagUpdateReport, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	report := models.TagUpdateReport{Operation: update.Operation}
+
+	tags, err := d.listTags()
+	if err != nil {
+		return report, err
+	}
+
+	report.Renames, err = utils.TagRenames(tags, key, value, update)
+	if err != nil {
+		return report, err
+	}
+
+	// the new tags exist before anything points at them
+	created, reparented := utils.RenameTagItems(tags, report.Renames, update.Operation == utils.TAG_MERGE)
+	for _, tag := range created {
+		_, err := d.putTag(models.TagCreateRequest{Key: tag.Key, Value: tag.Value, ParentKey: tag.ParentKey, ParentValue: tag.ParentValue,
+			RenamedFromKey: tag.RenamedFromKey, RenamedFromValue: tag.RenamedFromValue, TagMetadata: tag.TagMetadata, UpdatedBy: update.UpdatedBy})
+		if err != nil {
+			return report, err
+		}
+	}
+	for _, tag := range reparented {
+		err := d.putTagFields(tag, update.UpdatedBy)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	services := []models.ServiceResponse{}
+	err = dynamodbattribute.UnmarshalListOfMaps(toMaps(d.query(utils.GetPartitionKey(utils.SERVICE), blank)), &services)
+	if err != nil {
+		return report, err
+	}
+
+	for _, service := range services {
+		report.ServicesScanned++
+		category, changed := utils.RenameCategory(service.Category, report.Renames)
+		if !changed {
+			continue
+		}
+
+		catAv, err := dynamodbattribute.Marshal(category)
+		if err != nil {
+			return report, err
+		}
+
+		d.putAttributes(service.PK, service.SK, service.Version, update.UpdatedBy, item{"category": catAv})
+		report.ServicesUpdated++
+	}
+	if err := progress(report); err != nil {
+		return report, err
+	}
+
+	rules, err := d.getAllRules()
+	if err != nil {
+		return report, err
+	}
+
+	fields, err := d.listFields()
+	if err != nil {
+		return report, err
+	}
+
+	updated, duplicates := utils.RenameRules(rules, report.Renames, fields)
+	for _, rule := range updated {
+		d.putAttributes(rule.PK, rule.SK, rule.Version, update.UpdatedBy, item{
+			"tag_key":   {S: aws.String(rule.TagKey)},
+			"tag_value": {S: aws.String(rule.TagValue)},
+		})
+		report.RulesUpdated++
+	}
+	for _, rule := range duplicates {
+		d.deleteItem(rule.PK, rule.SK, update.UpdatedBy)
+		report.RulesDeleted++
+	}
+	if err := progress(report); err != nil {
+		return report, err
+	}
+
+	tags, err = d.listTags()
+	if err != nil {
+		return report, err
+	}
+
+	for _, rename := range report.Renames {
+		d.deleteItem(utils.GetPartitionKey(utils.TAG), utils.GetRangeKey(utils.TAG, rename.FromKey, rename.FromValue, blank), update.UpdatedBy)
+	}
+	for _, tag := range utils.RenamedTags(tags, report.Renames) {
+		d.putAttributes(utils.GetPartitionKey(utils.TAG), utils.GetRangeKey(utils.TAG, tag.Key, tag.Value, blank), tag.Version, update.UpdatedBy,
+			item{"renamed_from_key": nil, "renamed_from_value": nil})
+	}
+
+	report.Done = true
+	return report, nil
+}
+
+// putTag stores a new tag, the caller checked it does not exist
+func (d *Database) putTag(tag models.TagCreateRequest) (models.TagCreateRequest, error) {
+	datetime := utils.DateString("datetime")
+	tag.CreatedAt, tag.UpdatedAt = datetime, datetime
+	tag.Version = 1
+	tag.PK = utils.GetPartitionKey(utils.TAG)
+	tag.SK = utils.GetRangeKey(utils.TAG, tag.Key, tag.Value, blank)
+
+	av, err := dynamodbattribute.MarshalMap(tag)
+	if err != nil {
+		return tag, err
+	}
+
+	d.put(av)
+	return tag, nil
+}
+
+func (d *Database) GetTag(key string, value string) (models.TagListResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.getTag(key, value)
+}
+
+func (d *Database) getTag(key string, value string) (models.TagListResponse, error) {
+	tags := []models.TagResponse{}
+	resultTag := []models.TagListResponse{}
+
+	items := d.query(utils.GetPartitionKey(utils.TAG), utils.GetRangeKey(utils.TAG, key, value, blank))
+	err := dynamodbattribute.UnmarshalListOfMaps(toMaps(items), &tags)
+	if err != nil {
+		return models.TagListResponse{}, err
+	}
+
+	resp := utils.CreateTagResponse(tags, resultTag)
+	if len(resp) > 0 {
+		return resp[0], nil
+	}
+	return models.TagListResponse{}, nil
+}
+
+func (d *Database) isDuplicateRule(rule models.RuleRequest) (bool, error) {
+	rules, err := d.getAllRules()
+	if err != nil {
+		return false, err
+	}
+
+	for _, r := range rules {
+		if r.Operation == rule.Operation &&
+			r.TagKey == rule.TagKey &&
+			r.TagValue == rule.TagValue &&
+			r.MetadataField == rule.MetadataField &&
+			r.Keyword == rule.Keyword &&
+			r.KeywordOperator == rule.KeywordOperator &&
+			r.RelationalOperator == rule.RelationalOperator &&
+			r.SubscriptionCount == rule.SubscriptionCount &&
+			r.Operand == rule.Operand &&
+			r.CoRuleMetadataField == rule.CoRuleMetadataField &&
+			r.CoRuleKeyword == rule.CoRuleKeyword &&
+			// rules stored before expressions existed have none, their legacy fields decide
+			// and they match substrings without synonyms or conditions
+			(r.Expression == rule.Expression || r.Expression == "" && utils.PlainKeywordRule(rule)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (d *Database) CreateRule(rule models.RuleRequest) (models.RuleRequest, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fields, err := d.listFields()
+	if err != nil {
+		return rule, err
+	}
+	err = utils.SetRuleExpression(&rule, fields)
+	if err != nil {
+		return rule, err
+	}
+
+	// an alias or deprecated tag is saved as its canonical tag, compared with the stored rules
+	err = d.verifyRuleTag(&rule)
+	if err != nil {
+		return rule, err
+	}
+
+	// check if rule already exist
+	isDuplicateRule, err := d.isDuplicateRule(rule)
+	if err != nil {
+		return rule, err
+	}
+
+	if isDuplicateRule {
+		return rule, errors.New("Rule already exist")
+	}
+
+	rule.RuleUUID = utils.GetUUID()
+	rule.Version = 1
+	datetime := utils.DateString("datetime")
+	rule.CreatedAt, rule.UpdatedAt = datetime, datetime
+	rule.PK = utils.GetPartitionKey(utils.RULE)
+	rule.SK = utils.GetRangeKey(utils.RULE, blank, blank, rule.RuleUUID)
+
+	err = d.insertRule(rule)
+	if err != nil {
+		return rule, err
+	}
+
+	return rule, nil
+}
+
+func (d *Database) verifyRuleTag(rule *models.RuleRequest) error {
+	tags, err := d.verifyTag([]models.Category{{Key: rule.TagKey, Value: rule.TagValue}})
+	if err != nil {
+		return err
+	}
+	rule.TagKey, rule.TagValue = tags[0].Key, tags[0].Value
+	return nil
+}
+
+func (d *Database) insertRule(rule models.RuleRequest) error {
+	av, err := dynamodbattribute.MarshalMap(rule)
+	if err != nil {
+		return err
+	}
+
+	d.put(av)
+	return nil
+}
+
+func (d *Database) GetAllRules(limit int, cursor string) ([]models.RuleResponse, string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rules := []models.RuleResponse{}
+	items, next, err := d.queryPage(utils.RULE, limit, cursor)
+	if err != nil {
+		return rules, "", err
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(toMaps(items), &rules)
+	return rules, next, err
+}
+
+func (d *Database) getAllRules() ([]models.RuleResponse, error) {
+	rules := []models.RuleResponse{}
+	items := d.query(utils.GetPartitionKey(utils.RULE), blank)
+
+	err := dynamodbattribute.UnmarshalListOfMaps(toMaps(items), &rules)
+	return rules, err
+}
+
+func (d *Database) GetRule(ruleUUID string) (models.RuleResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.getRule(ruleUUID)
+}
+
+func (d *Database) getRule(ruleUUID string) (models.RuleResponse, error) {
+	rule := models.RuleResponse{}
+	it := d.get(utils.GetPartitionKey(utils.RULE), utils.GetRangeKey(utils.RULE, blank, blank, ruleUUID))
+
+	err := dynamodbattribute.UnmarshalMap(it, &rule)
+	return rule, err
+}
+
+func (d *Database) UpdateRule(updatedRule models.RuleRequest, ruleUUID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	oldRule, err := d.getRule(ruleUUID)
+	if err != nil {
+		return err
+	}
+
+	if oldRule.Operation == "" {
+		return errors.New("rule not found")
+	}
+
+	// Version carries the If-Match version, 0 when the client sent none
+	if !utils.VersionMatches(updatedRule.Version, oldRule.Version) {
+		return utils.ErrVersionConflict
+	}
+
+	updatedRule.PK = oldRule.PK
+	updatedRule.SK = oldRule.SK
+	updatedRule.RuleUUID = oldRule.RuleUUID
+	updatedRule.Version = oldRule.Version + 1
+	// old created at
+	updatedRule.CreatedAt = oldRule.CreatedAt
+	// new updated at
+	updatedRule.UpdatedAt = utils.DateString("datetime")
+
+	fields, err := d.listFields()
+	if err != nil {
+		return err
+	}
+	err = utils.SetRuleExpression(&updatedRule, fields)
+	if err != nil {
+		return err
+	}
+
+	err = d.verifyRuleTag(&updatedRule)
+	if err != nil {
+		return err
+	}
+
+	return d.insertRule(updatedRule)
+}
+
+func (d *Database) DeleteRule(ruleUUID string, actor string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.deleteItem(utils.GetPartitionKey(utils.RULE), utils.GetRangeKey(utils.RULE, blank, blank, ruleUUID), actor)
+	return nil
+}
+
+func (d *Database) CreateSynonym(synonym models.Synonym) (models.Synonym, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	old, err := d.getSynonym(synonym.Term)
+	if err != nil {
+		return synonym, err
+	}
+	if old.Term != "" {
+		return synonym, errors.New("Synonym already exist")
+	}
+
+	groups, err := d.listSynonyms()
+	if err != nil {
+		return synonym, err
+	}
+	err = utils.CheckSynonym(synonym, groups)
+	if err != nil {
+		return synonym, err
+	}
+
+	synonym.SynonymUUID = utils.GetUUID()
+	synonym.Version = 1
+	datetime := utils.DateString("datetime")
+	synonym.CreatedAt, synonym.UpdatedAt = datetime, datetime
+	synonym.PK = utils.GetPartitionKey(utils.SYNONYM)
+	synonym.SK = utils.GetRangeKey(utils.SYNONYM, synonym.Term, blank, blank)
+
+	return synonym, d.putSynonym(synonym)
+}
+
+func (d *Database) putSynonym(synonym models.Synonym) error {
+	av, err := dynamodbattribute.MarshalMap(synonym)
+	if err != nil {
+		return err
+	}
+
+	d.put(av)
+	return nil
+}
+
+func (d *Database) GetAllSynonyms(limit int, cursor string) ([]models.Synonym, string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	synonyms := []models.Synonym{}
+	items, next, err := d.queryPage(utils.SYNONYM, limit, cursor)
+	if err != nil {
+		return synonyms, "", err
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(toMaps(items), &synonyms)
+	return synonyms, next, err
+}
+
+func (d *Database) ListSynonyms() ([]models.Synonym, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.listSynonyms()
+}
+
+func (d *Database) listSynonyms() ([]models.Synonym, error) {
+	synonyms := []models.Synonym{}
+	err := dynamodbattribute.UnmarshalListOfMaps(toMaps(d.query(utils.GetPartitionKey(utils.SYNONYM), blank)), &synonyms)
+	return synonyms, err
+}
+
+func (d *Database) GetSynonym(term string) (models.Synonym, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.getSynonym(term)
+}
+
+func (d *Database) getSynonym(term string) (models.Synonym, error) {
+	synonym := models.Synonym{}
+	it := d.get(utils.GetPartitionKey(utils.SYNONYM), utils.GetRangeKey(utils.SYNONYM, term, blank, blank))
+
+	err := dynamodbattribute.UnmarshalMap(it, &synonym)
+	return synonym, err
+}
+
+func (d *Database) UpdateSynonym(updatedSynonym models.Synonym, term string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	old, err := d.getSynonym(term)
+	if err != nil {
+		return err
+	}
+	if old.Term == "" {
+		return utils.ErrSynonymNotFound
+	}
+
+	// Version carries the If-Match version, 0 when the client sent none
+	if !utils.VersionMatches(updatedSynonym.Version, old.Version) {
+		return utils.ErrVersionConflict
+	}
+
+	old.Synonyms = updatedSynonym.Synonyms
+	old.UpdatedBy = updatedSynonym.UpdatedBy
+	groups, err := d.listSynonyms()
+	if err != nil {
+		return err
+	}
+	err = utils.CheckSynonym(old, groups)
+	if err != nil {
+		return err
+	}
+
+	old.Version++
+	old.UpdatedAt = utils.DateString("datetime")
+	return d.putSynonym(old)
+}
+
+func (d *Database) DeleteSynonym(term string, actor string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.deleteItem(utils.GetPartitionKey(utils.SYNONYM), utils.GetRangeKey(utils.SYNONYM, term, blank, blank), actor)
+	return nil
+}
+
+func (d *Database) CreateField(field models.Field) (models.Field, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	old, err := d.getField(field.Name)
+	if err != nil {
+		return field, err
+	}
+	if old.Name != "" {
+		return field, errors.New("Field already exist")
+	}
+
+	err = utils.CheckField(&field)
+	if err != nil {
+		return field, err
+	}
+
+	field.FieldUUID = utils.GetUUID()
+	field.Version = 1
+	datetime := utils.DateString("datetime")
+	field.CreatedAt, field.UpdatedAt = datetime, datetime
+	field.PK = utils.GetPartitionKey(utils.FIELD)
+	field.SK = utils.GetRangeKey(utils.FIELD, field.Name, blank, blank)
+
+	return field, d.putField(field)
+}
+
+func (d *Database) putField(field models.Field) error {
+	av, err := dynamodbattribute.MarshalMap(field)
+	if err != nil {
+		return err
+	}
+
+	d.put(av)
+	return nil
+}
+
+func (d *Database) GetAllFields(limit int, cursor string) ([]models.Field, string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fields := []models.Field{}
+	items, next, err := d.queryPage(utils.FIELD, limit, cursor)
+	if err != nil {
+		return fields, "", err
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(toMaps(items), &fields)
+	return fields, next, err
+}
+
+func (d *Database) ListFields() ([]models.Field, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.listFields()
+}
+
+func (d *Database) listFields() ([]models.Field, error) {
+	fields := []models.Field{}
+	err := dynamodbattribute.UnmarshalListOfMaps(toMaps(d.query(utils.GetPartitionKey(utils.FIELD), blank)), &fields)
+	return fields, err
+}
+
+func (d *Database) GetField(name string) (models.Field, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.getField(name)
+}
+
+func (d *Database) getField(name string) (models.Field, error) {
+	field := models.Field{}
+	it := d.get(utils.GetPartitionKey(utils.FIELD), utils.GetRangeKey(utils.FIELD, name, blank, blank))
+
+	err := dynamodbattribute.UnmarshalMap(it, &field)
+	return field, err
+}
+
+func (d *Database) UpdateField(updatedField models.Field, name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	old, err := d.getField(name)
+	if err != nil {
+		return err
+	}
+	if old.Name == "" {
+		return utils.ErrFieldNotFound
+	}
+
+	// Version carries the If-Match version, 0 when the client sent none
+	if !utils.VersionMatches(updatedField.Version, old.Version) {
+		return utils.ErrVersionConflict
+	}
+
+	field, err := utils.UpdatedField(old, updatedField)
+	if err != nil {
+		return err
+	}
+
+	services := []models.ServiceResponse{}
+	err = dynamodbattribute.UnmarshalListOfMaps(toMaps(d.query(utils.GetPartitionKey(utils.SERVICE), blank)), &services)
+	if err != nil {
+		return err
+	}
+	if refs := utils.BrokenConstraints(services, old, field); len(refs) > 0 {
+		return &utils.ConstraintError{Field: name, References: refs}
+	}
+
+	field.Version++
+	field.UpdatedAt = utils.DateString("datetime")
+	return d.putField(field)
+}
+
+func (d *Database) DeleteField(name string, cascade bool, actor string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	old, err := d.getField(name)
+	if err != nil || old.Name == "" {
+		return err
+	}
+
+	services := []models.ServiceResponse{}
+	err = dynamodbattribute.UnmarshalListOfMaps(toMaps(d.query(utils.GetPartitionKey(utils.SERVICE), blank)), &services)
+	if err != nil {
+		return err
+	}
+
+	rules, err := d.getAllRules()
+	if err != nil {
+		return err
+	}
+
+	refs := utils.FieldReferences(services, rules, name)
+	if !cascade && len(refs) > 0 {
+		return &utils.ReferencedError{Entity: "field " + name, References: refs}
+	}
+
+	for _, service := range services {
+		if _, ok := service.Attributes[name]; !ok {
+			continue
+		}
+		delete(service.Attributes, name)
+
+		var av *dynamodb.AttributeValue
+		if len(service.Attributes) > 0 {
+			av, err = dynamodbattribute.Marshal(service.Attributes)
+			if err != nil {
+				return err
+			}
+		}
+		d.putAttributes(service.PK, service.SK, service.Version, utils.SYSTEM_ACTOR, item{"attributes": av})
+	}
+
+	for _, rule := range rules {
+		if utils.ContainsField(rule, name) {
+			d.deleteItem(rule.PK, rule.SK, actor)
+		}
+	}
+
+	d.deleteItem(utils.GetPartitionKey(utils.FIELD), utils.GetRangeKey(utils.FIELD, name, blank, blank), actor)
+	return nil
+}
+
+func (d *Database) SubscriberCount(serviceUUID string) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.subscriberCount(serviceUUID)
+}
+
+// subscriberCount returns the number of companies having serviceUUID in their service_list
+func (d *Database) subscriberCount(serviceUUID string) (int, error) {
+	companies := []models.Company{}
+	items := d.query(utils.GetPartitionKey(utils.COMPANY), blank)
+
+	err := dynamodbattribute.UnmarshalListOfMaps(toMaps(items), &companies)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, company := range companies {
+		for _, id := range company.ServiceList {
+			if id == serviceUUID {
+				count++
+				break
+			}
+		}
+	}
+	return count, nil
+}
+
+func (d *Database) MatchingRules(streamData models.StreamData, rules []models.RuleResponse) ([]models.RuleResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.matchingRules(streamData, rules)
+}
+
+// matchingRules evaluates the rule expressions on one env, the subscriber count is only queried when one reads it
+func (d *Database) matchingRules(streamData models.StreamData, rules []models.RuleResponse) ([]models.RuleResponse, error) {
+	env := utils.ServiceFields(streamData, func() (int, error) {
+		return d.subscriberCount(streamData.UUID)
+	}, d.listSynonyms, d.listFields)
+	return utils.MatchingRules(rules, env)
+}
+
+// execute when new service is created, here streamData contains service data
+func (d *Database) AttachTagWithService(streamData models.StreamData, rules []models.RuleResponse) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.attachTagWithService(streamData, rules)
+}
+
+func (d *Database) attachTagWithService(streamData models.StreamData, rules []models.RuleResponse) error {
+	matched, err := d.matchingRules(streamData, rules)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range matched {
+		err = d.updateTagToService(streamData.UUID, rule)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateTagToService appends the rule tag to the stored service unless it is already present
+func (d *Database) updateTagToService(serviceUUID string, rule models.RuleResponse) error {
+	service, err := d.getServiceByUUID(serviceUUID)
+	if err != nil {
+		return err
+	}
+
+	if service.ServiceName == "" {
+		return nil
+	}
+
+	cat := utils.RuleCategory(rule, utils.DateString("datetime"))
+	if utils.IsTagAlreadyPresent(service.Category, cat) {
+		return nil
+	}
+
+	return d.putServiceCategory(service, append(service.Category, cat))
+}
+
+// putServiceCategory replaces the category list of a stored service as the stream processor
+func (d *Database) putServiceCategory(service models.ServiceResponse, category []models.Category) error {
+	catAv, err := dynamodbattribute.Marshal(category)
+	if err != nil {
+		return err
+	}
+
+	d.putAttributes(service.PK, service.SK, service.Version, utils.SYSTEM_ACTOR, item{"category": catAv})
+	return nil
+}
+
+// putAttributes overwrites attributes of a stored item as one write of actor, bumping its
+// version. A nil attribute is removed.
+func (d *Database) putAttributes(pk, sk string, version int, actor string, attrs item) {
+	it := d.get(pk, sk)
+	updated := make(item, len(it)+len(attrs))
+	for name, av := range it {
+		updated[name] = av
+	}
+	for name, av := range attrs {
+		if av == nil {
+			delete(updated, name)
+			continue
+		}
+		updated[name] = av
+	}
+
+	updated["version"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(version + 1))}
+	updated["updated_by"] = &dynamodb.AttributeValue{S: aws.String(actor)}
+	d.put(updated)
+}
+
+func (d *Database) SyncRuleTags(serviceUUID string, rules []models.RuleResponse) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	service, err := d.getServiceByUUID(serviceUUID)
+	if err != nil || service.ServiceName == "" {
+		return err
+	}
+
+	matched, err := d.matchingRules(utils.ServiceToStreamDataConversion(service), rules)
+	if err != nil {
+		return err
+	}
+	return d.applyRuleTags(service, matched)
+}
+
+func (d *Database) ApplyRuleTags(service models.ServiceResponse, matched []models.RuleResponse) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stored, err := d.getServiceByUUID(service.ServiceUUID)
+	if err != nil || stored.ServiceName == "" {
+		return err
+	}
+
+	if stored.Version != service.Version {
+		fmt.Printf("service changed while syncing tags : %v\n", service.ServiceUUID)
+		return nil
+	}
+	return d.applyRuleTags(stored, matched)
+}
+
+func (d *Database) applyRuleTags(service models.ServiceResponse, matched []models.RuleResponse) error {
+	tags, err := d.listTags()
+	if err != nil {
+		return err
+	}
+
+	category, changed := utils.SyncServiceTags(service.Category, matched, utils.NewTagTree(tags))
+	if !changed {
+		return nil
+	}
+	return d.putServiceCategory(service, category)
+}
+
+// execute when new rule is created, here streamData contains rule
+func (d *Database) ProcessRuleForServices(streamData models.StreamData, services []models.ServiceResponse) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rule := utils.StreamDataToRuleConversion(streamData)
+	rules := []models.RuleResponse{rule}
+
+	for _, service := range services {
+		err := d.attachTagWithService(utils.ServiceToStreamDataConversion(service), rules)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// here stream data contains company data
+func (d *Database) UpdateServiceTagForSubscriberCount(streamData models.StreamData, rules []models.RuleResponse) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	subscriptionRules := make([]models.RuleResponse, 0)
+	for _, rule := range rules {
+		if rule.Operation == utils.SUBSCRIPTION_COUNT {
+			subscriptionRules = append(subscriptionRules, rule)
+		}
+	}
+
+	if len(subscriptionRules) == 0 {
+		return nil
+	}
+
+	for _, serviceUUID := range streamData.ServiceList {
+		// check if this service is subscribe for more than subscription threshold
+		matched, err := d.matchingRules(models.StreamData{UUID: serviceUUID}, subscriptionRules)
+		if err != nil {
+			return err
+		}
+
+		for _, rule := range matched {
+			err = d.updateTagToService(serviceUUID, rule)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *Database) RemoveServiceReferences(serviceUUID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.removeServiceReferences(serviceUUID)
+}
+
+func (d *Database) removeServiceReferences(serviceUUID string) error {
+	companies := []models.Company{}
+	items := d.query(utils.GetPartitionKey(utils.COMPANY), blank)
+	err := dynamodbattribute.UnmarshalListOfMaps(toMaps(items), &companies)
+	if err != nil {
+		return err
+	}
+
+	for i, company := range companies {
+		serviceList, changed := utils.RemoveServiceUUID(company.ServiceList, serviceUUID)
+		if !changed {
+			continue
+		}
+
+		updated := make(item, len(items[i]))
+		for name, av := range items[i] {
+			updated[name] = av
+		}
+
+		listAv, err := dynamodbattribute.Marshal(serviceList)
+		if err != nil {
+			return err
+		}
+
+		updated["service_list"] = listAv
+		updated["version"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(company.Version + 1))}
+		updated["updated_by"] = &dynamodb.AttributeValue{S: aws.String(utils.SYSTEM_ACTOR)}
+		if len(serviceList) == 0 {
+			updated = utils.NilToEmptySlice(updated, "service_list")
+		}
+		d.put(updated)
+	}
+	return nil
+}
+
+func (d *Database) RemoveTagReferences(key string, value string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.removeTagReferences(key, value, utils.SYSTEM_ACTOR)
+}
+
+func (d *Database) removeTagReferences(key string, value string, actor string) error {
+	services := []models.ServiceResponse{}
+	err := dynamodbattribute.UnmarshalListOfMaps(toMaps(d.query(utils.GetPartitionKey(utils.SERVICE), blank)), &services)
+	if err != nil {
+		return err
+	}
+
+	for _, service := range services {
+		category, changed := utils.RemoveCategory(service.Category, key, value)
+		if !changed {
+			continue
+		}
+
+		err := d.putServiceCategory(service, category)
+		if err != nil {
+			return err
+		}
+	}
+
+	rules, err := d.getAllRules()
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		if utils.IsSameTag(models.Category{Key: rule.TagKey, Value: rule.TagValue}, key, value) {
+			d.deleteItem(rule.PK, rule.SK, actor)
+		}
+	}
+
+	tags, err := d.listTags()
+	if err != nil {
+		return err
+	}
+
+	// the children become roots and the tags it replaced lose their replacement
+	for _, tag := range utils.NewTagTree(tags).Dependents(key, value) {
+		err := d.putTagFields(tag, utils.SYSTEM_ACTOR)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsUUIDInUse reports whether a service, company or rule is stored under uuid
+func (d *Database) IsUUIDInUse(uuid string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.uuidIndex[uuid]) > 0, nil
+}
+
+// AddHistory stores a history item. History items are not entity changes,
+// so no stream record is produced for them.
+func (d *Database) AddHistory(history models.History) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	history.PK = utils.GetPartitionKey(utils.HISTORY)
+	history.SK = utils.GetRangeKey(utils.HISTORY, history.EntityUUID, history.Sequence, blank)
+
+	av, err := dynamodbattribute.MarshalMap(history)
+	if err != nil {
+		return err
+	}
+
+	partition, ok := d.items[history.PK]
+	if !ok {
+		partition = make(map[string]item)
+		d.items[history.PK] = partition
+	}
+	partition[history.SK] = av
+	return nil
+}
+
+func (d *Database) GetHistory(entityUUID string, limit int, cursor string) ([]models.History, string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	history := []models.History{}
+
+	prefix := utils.GetRangeKey(utils.HISTORY, entityUUID, blank, blank)
+	items, next, err := d.queryPrefixPage(utils.GetPartitionKey(utils.HISTORY), prefix, limit, cursor)
+	if err != nil {
+		return history, "", err
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(toMaps(items), &history)
+	if err != nil {
+		return history, "", err
+	}
+	return history, next, nil
+}
+
+func toMaps(items []item) []map[string]*dynamodb.AttributeValue {
+	maps := make([]map[string]*dynamodb.AttributeValue, 0, len(items))
+	for _, it := range items {
+		maps = append(maps, it)
+	}
+	return maps
+}
+
+func (d *Database) PutBackfillJob(job models.BackfillJob) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	job.PK = utils.GetPartitionKey(utils.BACKFILL)
+	job.SK = utils.GetRangeKey(utils.BACKFILL, blank, blank, job.JobID)
+
+	stored := models.BackfillJob{}
+	err := dynamodbattribute.UnmarshalMap(d.get(job.PK, job.SK), &stored)
+	if err != nil {
+		return err
+	}
+	if stored.Version != job.Version {
+		return utils.ErrVersionConflict
+	}
+	job.Version++
+
+	av, err := dynamodbattribute.MarshalMap(job)
+	if err != nil {
+		return err
+	}
+
+	// like history, jobs are not part of the stream
+	partition, ok := d.items[job.PK]
+	if !ok {
+		partition = make(map[string]item)
+		d.items[job.PK] = partition
+	}
+	partition[job.SK] = av
+	return nil
+}
+
+func (d *Database) GetBackfillJob(jobID string) (models.BackfillJob, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	job := models.BackfillJob{}
+	it := d.get(utils.GetPartitionKey(utils.BACKFILL), utils.GetRangeKey(utils.BACKFILL, blank, blank, jobID))
+
+	err := dynamodbattribute.UnmarshalMap(it, &job)
+	return job, err
+}
@@ -0,0 +1,169 @@
+package memory
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/auto-tagging-mds/database/models"
+	"github.com/auto-tagging-mds/utils"
+)
+
+func newDatabase(t *testing.T) *Database {
+	t.Helper()
+	db, err := New(models.Tables{MDSTable: "mds"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateTag(models.TagCreateRequest{Key: "deployment", Value: "cloud"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateService(models.ServiceRequest{ServiceName: "alpha", Description: "runs on aws",
+		Category: []models.Category{{Key: "deployment", Value: "cloud"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestStreamImagesAreCopies(t *testing.T) {
+	db := newDatabase(t)
+
+	for _, record := range db.StreamEvent().Records {
+		if category := record.Change.NewImage["category"]; category != nil {
+			*category.L[0].M["value"].S = "changed"
+			category.L = nil
+		}
+	}
+
+	service, err := db.GetService("alpha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(service.Category) != 1 || service.Category[0].Value != "cloud" {
+		t.Errorf("category %v, want deployment:cloud", service.Category)
+	}
+}
+
+func TestUpdateKeepsOldImage(t *testing.T) {
+	db := newDatabase(t)
+	service, err := db.GetService("alpha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.StreamEvent()
+
+	err = db.UpdateService(models.ServiceRequest{ServiceUUID: service.ServiceUUID, ServiceName: "alpha",
+		Description: "runs on azure"}, service.ServiceUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := db.StreamEvent().Records
+	if len(records) == 0 {
+		t.Fatal("no stream record")
+	}
+	change := records[0].Change
+	if *change.OldImage["description"].S != "runs on aws" || *change.NewImage["description"].S != "runs on azure" {
+		t.Errorf("old %v, new %v", change.OldImage["description"], change.NewImage["description"])
+	}
+	if len(change.OldImage["category"].L) != 1 || len(change.NewImage["category"].L) != 0 {
+		t.Errorf("old category %v, new category %v", change.OldImage["category"], change.NewImage["category"])
+	}
+}
+
+func TestDeleteTagReferenced(t *testing.T) {
+	db := newDatabase(t)
+
+	err := db.DeleteTag("deployment", "cloud", false, "tester")
+	var referenced *utils.ReferencedError
+	if !errors.As(err, &referenced) || len(referenced.References) != 1 {
+		t.Fatalf("error %v, want the service referencing the tag", err)
+	}
+
+	err = db.DeleteTag("deployment", "cloud", true, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := db.GetService("alpha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(service.Category) != 0 {
+		t.Errorf("category %v, want none", service.Category)
+	}
+}
+
+func TestUpdateTagResumes(t *testing.T) {
+	db := newDatabase(t)
+	rule, err := db.CreateRule(models.RuleRequest{Operation: utils.CONTAIN, TagKey: "deployment", TagValue: "cloud",
+		MetadataField: utils.DESCRIPTION, Keyword: "aws"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stopped once the services are rewritten, before the rules
+	stop := errors.New("stopped")
+	rename := models.TagUpdateRequest{Operation: utils.TAG_RENAME_VALUE, Value: "hosted", UpdatedBy: "tester"}
+	report, err := db.UpdateTag("deployment", "cloud", rename, func(models.TagUpdateReport) error { return stop })
+	if err != stop || report.Done || report.ServicesUpdated != 1 {
+		t.Fatalf("report %+v error %v, want the update stopped after the services", report, err)
+	}
+
+	report, err = db.UpdateTag("deployment", "cloud", rename, func(models.TagUpdateReport) error { return nil })
+	if err != nil || !report.Done || report.RulesUpdated != 1 {
+		t.Fatalf("report %+v error %v, want the update resumed and done", report, err)
+	}
+
+	old, err := db.GetTag("deployment", "cloud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.Key != "" {
+		t.Errorf("tag deployment:cloud is still there")
+	}
+	tags, err := db.ListTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0].Value != "hosted" || tags[0].RenamedFromKey != "" {
+		t.Errorf("tags %+v, want deployment:hosted without its renamed-from marker", tags)
+	}
+	stored, err := db.GetRule(rule.RuleUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.TagValue != "hosted" {
+		t.Errorf("rule assigns %v, want hosted", stored.TagValue)
+	}
+}
+
+func TestCreateIgnoresUUIDAndVersion(t *testing.T) {
+	db := newDatabase(t)
+	stored, err := db.GetService("alpha")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the uuid of a stored service does not turn a create into an overwrite
+	_, err = db.CreateService(models.ServiceRequest{ServiceUUID: stored.ServiceUUID, Version: 7, ServiceName: "alpha"})
+	if err == nil {
+		t.Fatal("created a service named like a stored one")
+	}
+
+	created, err := db.CreateService(models.ServiceRequest{ServiceUUID: stored.ServiceUUID, Version: 7, ServiceName: "beta"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ServiceUUID == stored.ServiceUUID || created.Version != 1 {
+		t.Errorf("created %v at version %v, want a new uuid at version 1", created.ServiceUUID, created.Version)
+	}
+
+	company, err := db.CreateCompany(models.CompanyRequest{CompanyUUID: "chosen", Version: 7, CompanyName: "acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if company.CompanyUUID == "chosen" || company.Version != 1 {
+		t.Errorf("created %v at version %v, want a new uuid at version 1", company.CompanyUUID, company.Version)
+	}
+}
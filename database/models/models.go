@@ -54,49 +54,58 @@ type Service struct {
 }
 
 type Category struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Source    string `json:"source,omitempty"`    // manual|rule|ancestor
+	RuleUUID  string `json:"rule_uuid,omitempty"` // rule which applied the tag, empty for a manual tag
+	AppliedAt string `json:"applied_at,omitempty"`
 }
 
 // ServiceUUID auto generated and used to update service data.
 // If service name is updated by user, we will not be able to update it in DB.
 // So we will delete onld entry and insert updated entry with same uuid
 type ServiceRequest struct {
-	PK            string     `json:"PK"`   //auto generated by BE
-	SK            string     `json:"SK"`   //auto generated by BE
-	ServiceUUID   string     `json:"uuid"` //auto generated by BE for create, sent by FE for update
-	ServiceName   string     `json:"service_name" validate:"min=1,required"`
-	Description   string     `json:"description"`
-	MoreAbout     string     `json:"more_about"`
-	Category      []Category `json:"category"`
-	Like          int        `json:"like"`
-	Stage         string     `json:"stage"`
-	TargetSegment string     `json:"target_segment"`
-	Deployment    string     `json:"deployment"`
-	BusinessModel string     `json:"business_model"`
-	Pricing       string     `json:"pricing"`
-	Location      string     `json:"location"`
-	CreatedAt     string     `json:"created_at"`
-	UpdatedAt     string     `json:"updated_at"`
+	PK            string                 `json:"PK"`   //auto generated by BE
+	SK            string                 `json:"SK"`   //auto generated by BE
+	ServiceUUID   string                 `json:"uuid"` //auto generated by BE for create, sent by FE for update
+	ServiceName   string                 `json:"service_name" validate:"min=1,required"`
+	Description   string                 `json:"description"`
+	MoreAbout     string                 `json:"more_about"`
+	Category      []Category             `json:"category"`
+	Like          int                    `json:"like"`
+	Stage         string                 `json:"stage"`
+	TargetSegment string                 `json:"target_segment"`
+	Deployment    string                 `json:"deployment"`
+	BusinessModel string                 `json:"business_model"`
+	Pricing       string                 `json:"pricing"`
+	Location      string                 `json:"location"`
+	Attributes    map[string]interface{} `json:"attributes,omitempty"` // values of the fields declared under /api/v1/fields
+	CreatedAt     string                 `json:"created_at"`
+	UpdatedAt     string                 `json:"updated_at"`
+	Version       int                    `json:"version"`    // incremented on every write, sent back as ETag
+	UpdatedBy     string                 `json:"updated_by"` // actor of the last write, set by the API
 }
 
 type ServiceResponse struct {
-	PK            string     `json:"PK"` //auto generated by BE
-	SK            string     `json:"SK"` //auto generated by BE
-	ServiceUUID   string     `json:"uuid"`
-	ServiceName   string     `json:"service_name"`
-	Description   string     `json:"description"`
-	MoreAbout     string     `json:"more_about"`
-	Category      []Category `json:"category"`
-	Like          int        `json:"like"`
-	Stage         string     `json:"stage"`
-	TargetSegment string     `json:"target_segment"`
-	Deployment    string     `json:"deployment"`
-	BusinessModel string     `json:"business_model"`
-	Pricing       string     `json:"pricing"`
-	Location      string     `json:"location"`
-	CreatedAt     string     `json:"created_at"`
-	UpdatedAt     string     `json:"updated_at"`
+	PK            string                 `json:"PK"` //auto generated by BE
+	SK            string                 `json:"SK"` //auto generated by BE
+	ServiceUUID   string                 `json:"uuid"`
+	ServiceName   string                 `json:"service_name"`
+	Description   string                 `json:"description"`
+	MoreAbout     string                 `json:"more_about"`
+	Category      []Category             `json:"category"`
+	Like          int                    `json:"like"`
+	Stage         string                 `json:"stage"`
+	TargetSegment string                 `json:"target_segment"`
+	Deployment    string                 `json:"deployment"`
+	BusinessModel string                 `json:"business_model"`
+	Pricing       string                 `json:"pricing"`
+	Location      string                 `json:"location"`
+	Attributes    map[string]interface{} `json:"attributes,omitempty"`
+	CreatedAt     string                 `json:"created_at"`
+	UpdatedAt     string                 `json:"updated_at"`
+	Version       int                    `json:"version"` // incremented on every write, sent back as ETag
+	UpdatedBy     string                 `json:"updated_by"`
 }
 
 type Company struct {
@@ -108,6 +117,8 @@ type Company struct {
 	ServiceList []string `json:"service_list"` // holds service uuid
 	CreatedAt   string   `json:"created_at"`
 	UpdatedAt   string   `json:"updated_at"`
+	Version     int      `json:"version"`
+	UpdatedBy   string   `json:"updated_by"`
 }
 
 type CompanyRequest struct {
@@ -119,6 +130,8 @@ type CompanyRequest struct {
 	ServiceList []string `json:"service_list"` // FE sends only service uuid list
 	CreatedAt   string   `json:"created_at"`
 	UpdatedAt   string   `json:"updated_at"`
+	Version     int      `json:"version"`
+	UpdatedBy   string   `json:"updated_by"`
 }
 
 type CompanyResponse struct {
@@ -128,6 +141,8 @@ type CompanyResponse struct {
 	ServiceList []Services `json:"service_list"`
 	CreatedAt   string     `json:"created_at"`
 	UpdatedAt   string     `json:"updated_at"`
+	Version     int        `json:"version"`
+	UpdatedBy   string     `json:"updated_by"`
 }
 
 type Services struct {
@@ -145,26 +160,54 @@ type TagRequest struct {
 }
 
 type TagCreateRequest struct {
-	PK        string `json:"PK"`                              //auto generated
-	SK        string `json:"SK"`                              //auto generated by BE
-	Key       string `json:"key" validate:"min=1,required"`   // need(1/2)
-	Value     string `json:"value" validate:"min=1,required"` // need(2/2), add 1 at a time
-	CreatedAt string `json:"created_at"`
-	UpdatedAt string `json:"updated_at"`
+	PK          string `json:"PK"`                                         //auto generated
+	SK          string `json:"SK"`                                         //auto generated by BE
+	Key         string `json:"key" validate:"min=1,required,excludes=#"`   // need(1/2), # separates the parts of range keys
+	Value       string `json:"value" validate:"min=1,required,excludes=#"` // need(2/2), add 1 at a time
+	ParentKey   string `json:"parent_key,omitempty"`                       // optional parent tag, services with the tag also get its ancestors
+	ParentValue string `json:"parent_value,omitempty"`
+	// the tag renamed into this one, set until the rename is done so that a repeated rename resumes it
+	RenamedFromKey   string `json:"renamed_from_key,omitempty"`
+	RenamedFromValue string `json:"renamed_from_value,omitempty"`
+	CreatedAt        string `json:"created_at"`
+	UpdatedAt        string `json:"updated_at"`
+	Version          int    `json:"version"`
+	UpdatedBy        string `json:"updated_by"`
+	TagMetadata
 }
 
 type TagResponse struct {
-	Key       string `json:"key"`
-	Value     string `json:"value"`
-	CreatedAt string `json:"created_at"`
-	UpdatedAt string `json:"updated_at"`
+	Key              string `json:"key"`
+	Value            string `json:"value"`
+	ParentKey        string `json:"parent_key,omitempty"`
+	ParentValue      string `json:"parent_value,omitempty"`
+	RenamedFromKey   string `json:"renamed_from_key,omitempty"`
+	RenamedFromValue string `json:"renamed_from_value,omitempty"`
+	CreatedAt        string `json:"created_at"`
+	UpdatedAt        string `json:"updated_at"`
+	Version          int    `json:"version"`
+	UpdatedBy        string `json:"updated_by"`
+	TagMetadata
+}
+
+// TagMetadata describes a tag to the UI. Aliases are other values of the tag key
+// that resolve to the tag, a deprecated tag resolves to its replacement if it has one.
+type TagMetadata struct {
+	Description     string   `json:"description,omitempty"`
+	Label           string   `json:"label,omitempty"`
+	Color           string   `json:"color,omitempty" validate:"omitempty,hexcolor"`
+	Aliases         []string `json:"aliases,omitempty"`
+	Deprecated      bool     `json:"deprecated,omitempty"`
+	ReplacedByKey   string   `json:"replaced_by_key,omitempty"`
+	ReplacedByValue string   `json:"replaced_by_value,omitempty"`
 }
 
 type TagListResponse struct {
-	Key       string   `json:"key"`
-	Values    []string `json:"values"`
-	CreatedAt string   `json:"created_at"`
-	UpdatedAt string   `json:"updated_at"`
+	Key       string        `json:"key"`
+	Values    []string      `json:"values"`
+	Tags      []TagResponse `json:"tags"` // the values with their metadata
+	CreatedAt string        `json:"created_at"`
+	UpdatedAt string        `json:"updated_at"`
 }
 
 type Tags struct {
@@ -191,71 +234,337 @@ type Rule struct {
 }
 
 type RuleRequest struct {
-	PK                  string `json:"PK"` //auto generated
-	SK                  string `json:"SK"` //auto generated by BE
-	RuleUUID            string `json:"uuid"`
-	Operation           string `json:"operation" validate:"required"` //CONTAIN|RELATION|SUBSCRIPTION_COUNT
-	TagKey              string `json:"tag_key" validate:"min=1"`
-	TagValue            string `json:"tag_value" validate:"min=1"`
-	MetadataField       string `json:"metadata_field"`
-	Keyword             string `json:"keyword"`
-	KeywordOperator     string `json:"keyword_operator"`    //AND|OR
-	RelationalOperator  string `json:"relational_operator"` //GREATER_THAN|LESSER_THAN|EQUAL|GREATER_THAN_EQUAL|LESSER_THAN_EQUAL
-	Operand             int    `json:"relational_operand"`
-	SubscriptionCount   int    `json:"subscription_count"`
-	CoRuleMetadataField string `json:"corule_metadata_field"`
-	CoRuleKeyword       string `json:"corule_keyword"`
-	CreatedAt           string `json:"created_at"`
-	UpdatedAt           string `json:"updated_at"`
+	PK                  string          `json:"PK"` //auto generated
+	SK                  string          `json:"SK"` //auto generated by BE
+	RuleUUID            string          `json:"uuid"`
+	Operation           string          `json:"operation" validate:"required"` //CONTAIN|RELATION|SUBSCRIPTION_COUNT|EXPRESSION
+	TagKey              string          `json:"tag_key" validate:"min=1"`
+	TagValue            string          `json:"tag_value" validate:"min=1"`
+	MetadataField       string          `json:"metadata_field"`
+	Keyword             string          `json:"keyword"`
+	KeywordOperator     string          `json:"keyword_operator"`          //AND|OR
+	MatchMode           string          `json:"match_mode"`                //SUBSTRING|WORD|PHRASE|PREFIX|REGEX, empty for SUBSTRING
+	Synonyms            []string        `json:"synonyms,omitempty"`        // other keywords the rule matches like its own
+	FuzzyThreshold      float64         `json:"fuzzy_threshold,omitempty"` // also match words this similar to a keyword, 0 disables it
+	ConditionMode       string          `json:"condition_mode,omitempty"`  //ALL|ANY|NONE, empty for ALL
+	Conditions          []RuleCondition `json:"conditions,omitempty"`      // instead of metadata_field, keyword and the co-rule
+	RelationalOperator  string          `json:"relational_operator"`       //GREATER_THAN|LESSER_THAN|EQUAL|GREATER_THAN_EQUAL|LESSER_THAN_EQUAL|BETWEEN|IN
+	Operand             float64         `json:"relational_operand"`
+	RelationalValues    []interface{}   `json:"relational_values,omitempty"` // numbers or dates, instead of relational_operand: two for BETWEEN, any for IN
+	SubscriptionCount   int             `json:"subscription_count"`
+	CoRuleMetadataField string          `json:"corule_metadata_field"`
+	CoRuleKeyword       string          `json:"corule_keyword"`
+	Expression          string          `json:"expression"`
+	CreatedAt           string          `json:"created_at"`
+	UpdatedAt           string          `json:"updated_at"`
+	Version             int             `json:"version"`
+	UpdatedBy           string          `json:"updated_by"`
 }
 
 type RuleResponse struct {
-	PK                  string `json:"PK"` //auto generated
-	SK                  string `json:"SK"` //auto generated by BE
-	RuleUUID            string `json:"uuid"`
-	Operation           string `json:"operation"`
-	TagKey              string `json:"tag_key"`
-	TagValue            string `json:"tag_value"`
-	MetadataField       string `json:"metadata_field"`
-	Keyword             string `json:"keyword"`
-	KeywordOperator     string `json:"keyword_operator"`
-	RelationalOperator  string `json:"relational_operator"`
-	Operand             int    `json:"relational_operand"`
-	SubscriptionCount   int    `json:"subscription_count"`
-	CoRuleMetadataField string `json:"corule_metadata_field"`
-	CoRuleKeyword       string `json:"corule_keyword"`
-	CreatedAt           string `json:"created_at"`
-	UpdatedAt           string `json:"updated_at"`
+	PK                  string          `json:"PK"` //auto generated
+	SK                  string          `json:"SK"` //auto generated by BE
+	RuleUUID            string          `json:"uuid"`
+	Operation           string          `json:"operation"`
+	TagKey              string          `json:"tag_key"`
+	TagValue            string          `json:"tag_value"`
+	MetadataField       string          `json:"metadata_field"`
+	Keyword             string          `json:"keyword"`
+	KeywordOperator     string          `json:"keyword_operator"`
+	MatchMode           string          `json:"match_mode"` //SUBSTRING|WORD|PHRASE|PREFIX|REGEX, empty for SUBSTRING
+	Synonyms            []string        `json:"synonyms,omitempty"`
+	FuzzyThreshold      float64         `json:"fuzzy_threshold,omitempty"`
+	ConditionMode       string          `json:"condition_mode,omitempty"`
+	Conditions          []RuleCondition `json:"conditions,omitempty"`
+	RelationalOperator  string          `json:"relational_operator"`
+	Operand             float64         `json:"relational_operand"`
+	RelationalValues    []interface{}   `json:"relational_values,omitempty"`
+	SubscriptionCount   int             `json:"subscription_count"`
+	CoRuleMetadataField string          `json:"corule_metadata_field"`
+	CoRuleKeyword       string          `json:"corule_keyword"`
+	Expression          string          `json:"expression"`
+	CreatedAt           string          `json:"created_at"`
+	UpdatedAt           string          `json:"updated_at"`
+	Version             int             `json:"version"`
+	UpdatedBy           string          `json:"updated_by"`
+}
+
+// RuleCondition is one condition of a CONTAIN or RELATION rule, tested like the
+// keyword of metadata_field and reversed by Negate
+type RuleCondition struct {
+	MetadataField      string        `json:"metadata_field"`
+	Keyword            string        `json:"keyword"`
+	RelationalOperator string        `json:"relational_operator"` //GREATER_THAN|LESSER_THAN|EQUAL|GREATER_THAN_EQUAL|LESSER_THAN_EQUAL|BETWEEN|IN, for number and date fields
+	Operand            float64       `json:"relational_operand"`
+	RelationalValues   []interface{} `json:"relational_values,omitempty"`
+	Negate             bool          `json:"negate"`
+}
+
+// RulePreviewResponse lists the services a rule would tag, split into the
+// ones gaining the tag and the ones already having it, and the services the
+// rule can't be evaluated on
+type RulePreviewResponse struct {
+	Expression    string           `json:"expression"`
+	WouldGain     []ServicePreview `json:"would_gain"`
+	AlreadyTagged []ServicePreview `json:"already_tagged"`
+	Failed        []ServicePreview `json:"failed"`
+}
+
+type ServicePreview struct {
+	ServiceUUID string `json:"uuid"`
+	ServiceName string `json:"service_name"`
+	Error       string `json:"error,omitempty"` // why the rule failed on the service
+}
+
+// ServiceExplainResponse tells for every rule whether a service matches it and why
+type ServiceExplainResponse struct {
+	ServiceUUID string        `json:"uuid"`
+	ServiceName string        `json:"service_name"`
+	Rules       []RuleExplain `json:"rules"`
+}
+
+type RuleExplain struct {
+	RuleUUID   string             `json:"rule_uuid"`
+	TagKey     string             `json:"tag_key"`
+	TagValue   string             `json:"tag_value"`
+	Expression string             `json:"expression"`
+	Matched    bool               `json:"matched"`
+	HasTag     bool               `json:"has_tag"` // the service currently carries the rule tag
+	Conditions []ConditionExplain `json:"conditions"`
+	Error      string             `json:"error,omitempty"`
+}
+
+// ConditionExplain is one comparison of a rule expression, Value is what the service holds
+type ConditionExplain struct {
+	Field    string      `json:"field"`
+	Value    interface{} `json:"value"`
+	Operator string      `json:"operator"`
+	Operand  interface{} `json:"operand"`
+	Result   bool        `json:"result"`
+}
+
+// BackfillJob re-evaluates every rule against every service. Cursor is the
+// checkpoint, the services page following the last completed batch.
+type BackfillJob struct {
+	PK         string           `json:"PK"` //auto generated by BE
+	SK         string           `json:"SK"` //auto generated by BE
+	JobID      string           `json:"job_id"`
+	Status     string           `json:"status"` // pending|running|done|failed
+	DryRun     bool             `json:"dry_run"`
+	Cursor     string           `json:"cursor"`
+	Processed  int              `json:"processed"`
+	Changed    int              `json:"changed"`
+	Changes    []BackfillChange `json:"changes,omitempty"` // diff of a dry run
+	Error      string           `json:"error,omitempty"`
+	LeaseUntil string           `json:"lease_until,omitempty"` // RFC 3339, a running job not saved again by then was stopped
+	CreatedAt  string           `json:"created_at"`
+	UpdatedAt  string           `json:"updated_at"`
+	Version    int              `json:"version"` // incremented on every save, a save of an older version is rejected
+	UpdatedBy  string           `json:"updated_by"`
+}
+
+type BackfillRequest struct {
+	DryRun bool   `json:"dry_run"`
+	JobID  string `json:"job_id"` // resumes a failed or stopped job instead of starting one
+}
+
+// BackfillChange is the tag diff of one service
+type BackfillChange struct {
+	ServiceUUID string     `json:"uuid"`
+	ServiceName string     `json:"service_name"`
+	Added       []Category `json:"added"`
+	Removed     []Category `json:"removed"`
 }
 
 type StreamData struct {
-	PK                  string     `json:"PK"`
-	SK                  string     `json:"SK"`
-	UUID                string     `json:"uuid,omitempty"`
-	Operation           string     `json:"operation,omitempty"`
-	TagKey              string     `json:"tag_key,omitempty"`
-	TagValue            string     `json:"tag_value,omitempty"`
-	MetadataField       string     `json:"metadata_field,omitempty"`
-	Keyword             string     `json:"keyword,omitempty"`
-	KeywordOperator     string     `json:"keyword_operator,omitempty"`
-	RelationalOperator  string     `json:"relational_operator,omitempty"`
-	Operand             int        `json:"relational_operand,omitempty"`
-	SubscriptionCount   int        `json:"subscription_count,omitempty"`
-	CoRuleMetadataField string     `json:"corule_metadata_field"`
-	CoRuleKeyword       string     `json:"corule_keyword"`
-	Key                 string     `json:"key,omitempty"`
-	Value               string     `json:"value,omitempty"`
-	CompanyName         string     `json:"company_name,omitempty"`
-	Description         string     `json:"description,omitempty"`
-	ServiceList         []string   `json:"service_list,omitempty"`
-	ServiceName         string     `json:"service_name,omitempty"`
-	MoreAbout           string     `json:"more_about,omitempty"`
-	Category            []Category `json:"category,omitempty"`
-	Like                int        `json:"like,omitempty"`
-	Stage               string     `json:"stage,omitempty"`
-	TargetSegment       string     `json:"target_segment,omitempty"`
-	Deployment          string     `json:"deployment,omitempty"`
-	BusinessModel       string     `json:"business_model,omitempty"`
-	Pricing             string     `json:"pricing,omitempty"`
-	Location            string     `json:"location,omitempty"`
+	PK                  string                 `json:"PK"`
+	SK                  string                 `json:"SK"`
+	UUID                string                 `json:"uuid,omitempty"`
+	Operation           string                 `json:"operation,omitempty"`
+	TagKey              string                 `json:"tag_key,omitempty"`
+	TagValue            string                 `json:"tag_value,omitempty"`
+	MetadataField       string                 `json:"metadata_field,omitempty"`
+	Keyword             string                 `json:"keyword,omitempty"`
+	KeywordOperator     string                 `json:"keyword_operator,omitempty"`
+	RelationalOperator  string                 `json:"relational_operator,omitempty"`
+	Operand             float64                `json:"relational_operand,omitempty"`
+	RelationalValues    []interface{}          `json:"relational_values,omitempty"`
+	SubscriptionCount   int                    `json:"subscription_count,omitempty"`
+	CoRuleMetadataField string                 `json:"corule_metadata_field"`
+	CoRuleKeyword       string                 `json:"corule_keyword"`
+	Expression          string                 `json:"expression,omitempty"`
+	Key                 string                 `json:"key,omitempty"`
+	Value               string                 `json:"value,omitempty"`
+	ParentKey           string                 `json:"parent_key,omitempty"`
+	ParentValue         string                 `json:"parent_value,omitempty"`
+	CompanyName         string                 `json:"company_name,omitempty"`
+	Description         string                 `json:"description,omitempty"`
+	ServiceList         []string               `json:"service_list,omitempty"`
+	ServiceName         string                 `json:"service_name,omitempty"`
+	MoreAbout           string                 `json:"more_about,omitempty"`
+	Category            []Category             `json:"category,omitempty"`
+	Like                int                    `json:"like,omitempty"`
+	Stage               string                 `json:"stage,omitempty"`
+	TargetSegment       string                 `json:"target_segment,omitempty"`
+	Deployment          string                 `json:"deployment,omitempty"`
+	BusinessModel       string                 `json:"business_model,omitempty"`
+	Pricing             string                 `json:"pricing,omitempty"`
+	Location            string                 `json:"location,omitempty"`
+	Attributes          map[string]interface{} `json:"attributes,omitempty"`
+	CreatedAt           string                 `json:"created_at,omitempty"`
+	UpdatedAt           string                 `json:"updated_at,omitempty"`
+	Version             int                    `json:"version,omitempty"`
+	UpdatedBy           string                 `json:"updated_by,omitempty"`
+	Deleted             bool                   `json:"deleted,omitempty"` // set with the actor of a delete just before the item is removed
+}
+
+// History is an append-only record of one change of an entity. Before is
+// empty for a create and After for a delete.
+type History struct {
+	PK         string                 `json:"PK"` //auto generated by BE
+	SK         string                 `json:"SK"` //auto generated by BE
+	EntityUUID string                 `json:"entity_uuid"`
+	Entity     string                 `json:"entity"`    // service|company|tag|rule|synonym
+	Operation  string                 `json:"operation"` // create|update|delete
+	Actor      string                 `json:"actor"`
+	Timestamp  string                 `json:"timestamp"`
+	Sequence   string                 `json:"sequence"` // orders the changes of an entity
+	Before     map[string]interface{} `json:"before,omitempty"`
+	After      map[string]interface{} `json:"after,omitempty"`
+}
+
+// Synonym is a group of words rules treat as the same keyword, Term names the group
+type Synonym struct {
+	PK          string   `json:"PK"` //auto generated by BE
+	SK          string   `json:"SK"` //auto generated by BE
+	SynonymUUID string   `json:"uuid"`
+	Term        string   `json:"term" validate:"min=1,required"`
+	Synonyms    []string `json:"synonyms" validate:"min=1,required"`
+	CreatedAt   string   `json:"created_at"`
+	UpdatedAt   string   `json:"updated_at"`
+	Version     int      `json:"version"`
+	UpdatedBy   string   `json:"updated_by"`
+}
+
+// Field declares a custom service attribute. Services store its value under
+// attributes and rules test it by name like a built-in field.
+type Field struct {
+	PK          string   `json:"PK"` //auto generated by BE
+	SK          string   `json:"SK"` //auto generated by BE
+	FieldUUID   string   `json:"uuid"`
+	Name        string   `json:"name" validate:"min=1,required"`
+	Type        string   `json:"type" validate:"required"` //string|number|enum|list|url
+	Description string   `json:"description"`
+	Required    bool     `json:"required"`
+	Values      []string `json:"values,omitempty"`  // allowed values of an enum, or of the items of a list
+	Pattern     string   `json:"pattern,omitempty"` // RE2 expression a string, url or list item must match
+	Min         *float64 `json:"min,omitempty"`     // bounds of a number
+	Max         *float64 `json:"max,omitempty"`
+	CreatedAt   string   `json:"created_at"`
+	UpdatedAt   string   `json:"updated_at"`
+	Version     int      `json:"version"`
+	UpdatedBy   string   `json:"updated_by"`
+}
+
+// Reference is an entity pointing at a tag or service, blocking its delete
+type Reference struct {
+	Entity string `json:"entity"`         // service|company|rule|tag
+	UUID   string `json:"uuid,omitempty"` // empty for tags
+	Name   string `json:"name,omitempty"` // empty for rules
+}
+
+// ReferencedResponse is the 409 body of a delete refused because of references
+type ReferencedResponse struct {
+	ErrorMsg   string      `json:"error"`
+	References []Reference `json:"references"`
+}
+
+// FieldError is a defect of one field of a request body, named like its json key
+type FieldError struct {
+	Field   string `json:"field"` // conditions[1].keyword for a field of a condition
+	Message string `json:"message"`
+}
+
+// ValidationResponse is the 400 body of a rule failing validation
+type ValidationResponse struct {
+	ErrorMsg string       `json:"error"`
+	Errors   []FieldError `json:"errors"`
+}
+
+// RuleLint lists the defects of a stored rule
+type RuleLint struct {
+	RuleUUID  string       `json:"rule_uuid"`
+	Operation string       `json:"operation"`
+	TagKey    string       `json:"tag_key"`
+	TagValue  string       `json:"tag_value"`
+	Errors    []FieldError `json:"errors"`
+}
+
+// RuleLintResponse reports the stored rules which would fail validation today
+type RuleLintResponse struct {
+	RulesScanned int        `json:"rules_scanned"`
+	Defects      []RuleLint `json:"defects"`
+}
+
+// TagNode is a tag of the tag tree with the tags below it
+type TagNode struct {
+	Key      string    `json:"key"`
+	Value    string    `json:"value"`
+	Children []TagNode `json:"children,omitempty"`
+	TagMetadata
+}
+
+// TagUpdateRequest renames, merges, moves or describes the tag of the path
+type TagUpdateRequest struct {
+	Operation string `json:"operation" validate:"required"` //RENAME_VALUE|RENAME_KEY|MERGE|SET_PARENT|SET_METADATA
+	Key       string `json:"key"`                           // new key of RENAME_KEY, key merged into by MERGE, parent key of SET_PARENT
+	Value     string `json:"value"`                         // new value of RENAME_VALUE, value merged into by MERGE, parent value of SET_PARENT
+	UpdatedBy string `json:"updated_by"`
+	// SET_METADATA replaces the metadata of the tag with these fields
+	TagMetadata
+}
+
+// TagRename is one tag rewritten by a tag update
+type TagRename struct {
+	FromKey   string `json:"from_key"`
+	FromValue string `json:"from_value"`
+	ToKey     string `json:"to_key"`
+	ToValue   string `json:"to_value"`
+}
+
+// TagUpdateReport tells how far a tag update got, it is also reported while
+// the services and rules are rewritten
+type TagUpdateReport struct {
+	Operation       string      `json:"operation"`
+	Renames         []TagRename `json:"renames"`
+	ServicesScanned int         `json:"services_scanned"`
+	ServicesUpdated int         `json:"services_updated"`
+	RulesUpdated    int         `json:"rules_updated"`
+	RulesDeleted    int         `json:"rules_deleted"` // duplicates of a rule already assigning the merged tag
+	Done            bool        `json:"done"`
+}
+
+// ServiceSearch filters GET /services, a service has to match every filter given
+type ServiceSearch struct {
+	Tags    []Category        `json:"tags,omitempty"`
+	TagMode string            `json:"tag_mode,omitempty"` // AND|OR, whether a service needs all or any of Tags
+	Fields  map[string]string `json:"fields,omitempty"`   // service field name to its exact value
+	Query   string            `json:"q,omitempty"`        // terms all found in description or more_about
+}
+
+// ServiceTag indexes a service under one of its tags for the tag search
+type ServiceTag struct {
+	PK          string `json:"PK"`
+	SK          string `json:"SK"`
+	ServiceUUID string `json:"service_uuid"`
+	ServiceSK   string `json:"service_sk"` // range key of the service item
+}
+
+// ServiceTerm indexes a service under one word of its description or more_about
+type ServiceTerm struct {
+	PK          string `json:"PK"`
+	SK          string `json:"SK"`
+	Term        string `json:"term"`
+	ServiceUUID string `json:"service_uuid"`
+	ServiceSK   string `json:"service_sk"` // range key of the service item
 }
@@ -0,0 +1,256 @@
+package sqldb
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// migrations are applied in order and recorded in schema_migrations.
+// {{serial}} is replaced by the auto increment primary key of the dialect.
+// A dialect without ALTER COLUMN records such a statement without running it.
+// Append new statements at the end, never edit an applied one.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS services (
+		sk             TEXT PRIMARY KEY,
+		uuid           TEXT NOT NULL,
+		service_name   TEXT NOT NULL,
+		description    TEXT NOT NULL DEFAULT '',
+		more_about     TEXT NOT NULL DEFAULT '',
+		like_count     INTEGER NOT NULL DEFAULT 0,
+		stage          TEXT NOT NULL DEFAULT '',
+		target_segment TEXT NOT NULL DEFAULT '',
+		deployment     TEXT NOT NULL DEFAULT '',
+		business_model TEXT NOT NULL DEFAULT '',
+		pricing        TEXT NOT NULL DEFAULT '',
+		location       TEXT NOT NULL DEFAULT '',
+		created_at     TEXT NOT NULL DEFAULT '',
+		updated_at     TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS services_uuid ON services (uuid)`,
+
+	`CREATE TABLE IF NOT EXISTS companies (
+		sk           TEXT PRIMARY KEY,
+		uuid         TEXT NOT NULL,
+		company_name TEXT NOT NULL,
+		description  TEXT NOT NULL DEFAULT '',
+		created_at   TEXT NOT NULL DEFAULT '',
+		updated_at   TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS companies_uuid ON companies (uuid)`,
+
+	`CREATE TABLE IF NOT EXISTS tags (
+		sk         TEXT PRIMARY KEY,
+		tag_key    TEXT NOT NULL,
+		tag_value  TEXT NOT NULL,
+		created_at TEXT NOT NULL DEFAULT '',
+		updated_at TEXT NOT NULL DEFAULT ''
+	)`,
+
+	`CREATE TABLE IF NOT EXISTS rules (
+		uuid                  TEXT PRIMARY KEY,
+		operation             TEXT NOT NULL,
+		tag_key               TEXT NOT NULL DEFAULT '',
+		tag_value             TEXT NOT NULL DEFAULT '',
+		metadata_field        TEXT NOT NULL DEFAULT '',
+		keyword               TEXT NOT NULL DEFAULT '',
+		keyword_operator      TEXT NOT NULL DEFAULT '',
+		relational_operator   TEXT NOT NULL DEFAULT '',
+		relational_operand    INTEGER NOT NULL DEFAULT 0,
+		subscription_count    INTEGER NOT NULL DEFAULT 0,
+		corule_metadata_field TEXT NOT NULL DEFAULT '',
+		corule_keyword        TEXT NOT NULL DEFAULT '',
+		created_at            TEXT NOT NULL DEFAULT '',
+		updated_at            TEXT NOT NULL DEFAULT ''
+	)`,
+
+	// service <-> tag relation, holds the service category list
+	`CREATE TABLE IF NOT EXISTS service_tags (
+		service_uuid TEXT NOT NULL,
+		position     INTEGER NOT NULL,
+		tag_key      TEXT NOT NULL,
+		tag_value    TEXT NOT NULL,
+		PRIMARY KEY (service_uuid, position)
+	)`,
+	`CREATE INDEX IF NOT EXISTS service_tags_tag ON service_tags (tag_key, tag_value)`,
+
+	// company <-> service relation, holds the company service_list
+	`CREATE TABLE IF NOT EXISTS company_services (
+		company_uuid TEXT NOT NULL,
+		position     INTEGER NOT NULL,
+		service_uuid TEXT NOT NULL,
+		PRIMARY KEY (company_uuid, position)
+	)`,
+	`CREATE INDEX IF NOT EXISTS company_services_service ON company_services (service_uuid)`,
+
+	// change feed, written in the same transaction as the change itself
+	`CREATE TABLE IF NOT EXISTS changes (
+		id         {{serial}},
+		event_name TEXT NOT NULL,
+		pk         TEXT NOT NULL,
+		sk         TEXT NOT NULL,
+		new_image  TEXT,
+		old_image  TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS change_checkpoints (
+		consumer TEXT PRIMARY KEY,
+		last_id  BIGINT NOT NULL
+	)`,
+
+	// optimistic concurrency, rows written before have version 0
+	`ALTER TABLE services ADD COLUMN version INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE companies ADD COLUMN version INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE tags ADD COLUMN version INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE rules ADD COLUMN version INTEGER NOT NULL DEFAULT 0`,
+
+	// audit history, written by the change feed consumer
+	`ALTER TABLE services ADD COLUMN updated_by TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE companies ADD COLUMN updated_by TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE tags ADD COLUMN updated_by TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE rules ADD COLUMN updated_by TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE IF NOT EXISTS history (
+		entity_uuid  TEXT NOT NULL,
+		sequence     TEXT NOT NULL,
+		entity       TEXT NOT NULL,
+		operation    TEXT NOT NULL,
+		actor        TEXT NOT NULL DEFAULT '',
+		changed_at   TEXT NOT NULL DEFAULT '',
+		before_image TEXT,
+		after_image  TEXT,
+		PRIMARY KEY (entity_uuid, sequence)
+	)`,
+
+	// rule which applied a service tag, empty for a manual tag
+	`ALTER TABLE service_tags ADD COLUMN rule_uuid TEXT NOT NULL DEFAULT ''`,
+
+	// tag provenance
+	`ALTER TABLE service_tags ADD COLUMN source TEXT NOT NULL DEFAULT 'manual'`,
+	`ALTER TABLE service_tags ADD COLUMN applied_at TEXT NOT NULL DEFAULT ''`,
+	`UPDATE service_tags SET source = 'rule' WHERE rule_uuid <> ''`,
+
+	// rule expression, empty for rules created before expressions which are converted when evaluated
+	`ALTER TABLE rules ADD COLUMN expression TEXT NOT NULL DEFAULT ''`,
+
+	`CREATE TABLE IF NOT EXISTS backfill_jobs (
+		job_id     TEXT PRIMARY KEY,
+		status     TEXT NOT NULL,
+		dry_run    BOOLEAN NOT NULL DEFAULT FALSE,
+		checkpoint TEXT NOT NULL DEFAULT '',
+		processed  INTEGER NOT NULL DEFAULT 0,
+		changed    INTEGER NOT NULL DEFAULT 0,
+		changes    TEXT,
+		error      TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT '',
+		updated_at TEXT NOT NULL DEFAULT '',
+		updated_by TEXT NOT NULL DEFAULT ''
+	)`,
+
+	// tag hierarchy, empty for a root tag
+	`ALTER TABLE tags ADD COLUMN parent_key TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE tags ADD COLUMN parent_value TEXT NOT NULL DEFAULT ''`,
+
+	// tag metadata, aliases is a JSON array of values
+	`ALTER TABLE tags ADD COLUMN description TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE tags ADD COLUMN label TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE tags ADD COLUMN color TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE tags ADD COLUMN aliases TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE tags ADD COLUMN deprecated BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE tags ADD COLUMN replaced_by_key TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE tags ADD COLUMN replaced_by_value TEXT NOT NULL DEFAULT ''`,
+
+	// service search by tag compares ignoring case
+	`CREATE INDEX IF NOT EXISTS service_tags_tag_lower ON service_tags (LOWER(tag_key), LOWER(tag_value))`,
+
+	// full-text index of description and more_about, written by the change feed consumer
+	`CREATE TABLE IF NOT EXISTS service_terms (
+		service_uuid TEXT NOT NULL,
+		term         TEXT NOT NULL,
+		PRIMARY KEY (service_uuid, term)
+	)`,
+	`CREATE INDEX IF NOT EXISTS service_terms_term ON service_terms (term)`,
+
+	// keyword match mode of CONTAIN and RELATION rules, empty for substrings
+	`ALTER TABLE rules ADD COLUMN match_mode TEXT NOT NULL DEFAULT ''`,
+
+	// rule synonyms as a JSON array, and the similarity of fuzzy keyword matches, 0 when off
+	`ALTER TABLE rules ADD COLUMN synonyms TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE rules ADD COLUMN fuzzy_threshold DOUBLE PRECISION NOT NULL DEFAULT 0`,
+
+	// synonym dictionary, synonyms is a JSON array of the words grouped with term
+	`CREATE TABLE IF NOT EXISTS synonyms (
+		sk         TEXT PRIMARY KEY,
+		uuid       TEXT NOT NULL,
+		term       TEXT NOT NULL,
+		synonyms   TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT '',
+		updated_at TEXT NOT NULL DEFAULT '',
+		version    INTEGER NOT NULL DEFAULT 0,
+		updated_by TEXT NOT NULL DEFAULT ''
+	)`,
+
+	// condition list of CONTAIN and RELATION rules as a JSON array, empty mode for ALL
+	`ALTER TABLE rules ADD COLUMN condition_mode TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE rules ADD COLUMN conditions TEXT NOT NULL DEFAULT ''`,
+
+	// float operands of RELATION rules, and the operands of BETWEEN and IN as a JSON array
+	`ALTER TABLE rules ALTER COLUMN relational_operand TYPE DOUBLE PRECISION`,
+	`ALTER TABLE rules ADD COLUMN relational_values TEXT NOT NULL DEFAULT ''`,
+
+	// declared custom fields, values is a JSON array, min and max are NULL when unbounded
+	`CREATE TABLE IF NOT EXISTS fields (
+		sk           TEXT PRIMARY KEY,
+		uuid         TEXT NOT NULL,
+		name         TEXT NOT NULL,
+		type         TEXT NOT NULL,
+		description  TEXT NOT NULL DEFAULT '',
+		required     BOOLEAN NOT NULL DEFAULT FALSE,
+		field_values TEXT NOT NULL DEFAULT '',
+		pattern      TEXT NOT NULL DEFAULT '',
+		min_value    DOUBLE PRECISION,
+		max_value    DOUBLE PRECISION,
+		created_at   TEXT NOT NULL DEFAULT '',
+		updated_at   TEXT NOT NULL DEFAULT '',
+		version      INTEGER NOT NULL DEFAULT 0,
+		updated_by   TEXT NOT NULL DEFAULT ''
+	)`,
+
+	// custom attributes of services as a JSON object
+	`ALTER TABLE services ADD COLUMN attributes TEXT NOT NULL DEFAULT ''`,
+
+	// time until which a running backfill job is held by its runner
+	`ALTER TABLE backfill_jobs ADD COLUMN lease_until TEXT NOT NULL DEFAULT ''`,
+
+	// incremented on every save of a backfill job, so two runners can't both save it
+	`ALTER TABLE backfill_jobs ADD COLUMN version INTEGER NOT NULL DEFAULT 0`,
+}
+
+func (d *Database) migrate() error {
+	_, err := d.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+
+	applied := 0
+	err = d.db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied)
+	if err != nil {
+		return err
+	}
+
+	for version := applied; version < len(migrations); version++ {
+		stmt := strings.ReplaceAll(migrations[version], "{{serial}}", d.dialect.serial)
+		skip := !d.dialect.alterColumn && strings.Contains(stmt, " ALTER COLUMN ")
+		err := d.withTx(func(tx *sql.Tx) error {
+			if !skip {
+				if _, err := tx.Exec(stmt); err != nil {
+					return fmt.Errorf("migration %v : %v", version, err)
+				}
+			}
+			_, err := tx.Exec(d.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), version)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,2317 @@
+package sqldb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/auto-tagging-mds/database/models"
+	"github.com/auto-tagging-mds/utils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+type dialect struct {
+	driver      string
+	serial      string // auto increment primary key column type
+	numbered    bool   // $1, $2 placeholders instead of ?
+	alterColumn bool   // column types can be changed, sqlite column types are only affinities
+	lockChanges string // holds off other change feed writers until commit, sqlite has a single writer
+}
+
+var dialects = map[string]dialect{
+	"postgres": {driver: "postgres", serial: "BIGSERIAL PRIMARY KEY", numbered: true, alterColumn: true,
+		lockChanges: `LOCK TABLE changes IN EXCLUSIVE MODE`},
+	"sqlite": {driver: "sqlite", serial: "INTEGER PRIMARY KEY AUTOINCREMENT"},
+}
+
+// Database implements database.Database on top of database/sql.
+// Every write also appends a record to the changes table in the same
+// transaction; ChangeEvent turns those records into the stream events the
+// DynamoDB stream delivers, so the same processor drives the tagging.
+type Database struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+var blank string = ""
+
+// New opens a connection for driver (postgres or sqlite) and applies the schema.
+func New(driver, dsn string) (*Database, error) {
+	dl, ok := dialects[driver]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unsupported sql driver : %v", driver))
+	}
+
+	conn, err := sql.Open(dl.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if driver == "sqlite" {
+		// sqlite allows one writer, and an in-memory database lives in a single connection
+		conn.SetMaxOpenConns(1)
+	}
+
+	db := &Database{db: conn, dialect: dl}
+	err = db.migrate()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func (d *Database) Close() error {
+	return d.db.Close()
+}
+
+// rebind converts ? placeholders to the placeholder style of the dialect
+func (d *Database) rebind(query string) string {
+	if !d.dialect.numbered {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (d *Database) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// recordChange appends a change feed record, images are stored as JSON of the models.
+// The writers of the feed are serialized so that ids are committed in order: a
+// transaction committing an id below one ChangeEvent already returned would be skipped.
+func (d *Database) recordChange(q queryer, eventName, pk, sk string, newImage, oldImage interface{}) error {
+	newJson, err := imageJson(newImage)
+	if err != nil {
+		return err
+	}
+
+	oldJson, err := imageJson(oldImage)
+	if err != nil {
+		return err
+	}
+
+	if d.dialect.lockChanges != "" {
+		_, err = q.Exec(d.dialect.lockChanges)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = q.Exec(d.rebind(`INSERT INTO changes (event_name, pk, sk, new_image, old_image) VALUES (?, ?, ?, ?, ?)`),
+		eventName, pk, sk, newJson, oldJson)
+	return err
+}
+
+// recordRemove records the REMOVE of an entity by actor, its old image carries the
+// actor and deleted as the dynamodb backend writes them before deleting
+func (d *Database) recordRemove(q queryer, pk, sk string, old interface{}, actor string) error {
+	b, err := json.Marshal(old)
+	if err != nil {
+		return err
+	}
+
+	image := map[string]interface{}{}
+	err = json.Unmarshal(b, &image)
+	if err != nil {
+		return err
+	}
+	image["updated_by"] = actor
+	image["deleted"] = true
+	return d.recordChange(q, "REMOVE", pk, sk, nil, image)
+}
+
+func imageJson(image interface{}) (sql.NullString, error) {
+	if image == nil {
+		return sql.NullString{}, nil
+	}
+
+	b, err := json.Marshal(image)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
+func imageAttributes(image sql.NullString) (map[string]*dynamodb.AttributeValue, error) {
+	if !image.Valid {
+		return nil, nil
+	}
+
+	m := map[string]interface{}{}
+	err := json.Unmarshal([]byte(image.String), &m)
+	if err != nil {
+		return nil, err
+	}
+	return dynamodbattribute.MarshalMap(m)
+}
+
+// ChangeEvent returns up to limit change feed records with id greater than after,
+// in the shape of a DynamoDB stream event, and the id of the last returned record.
+func (d *Database) ChangeEvent(after int64, limit int) (models.DynamoDBEvent, int64, error) {
+	event := models.DynamoDBEvent{}
+
+	rows, err := d.db.Query(d.rebind(`SELECT id, event_name, pk, sk, new_image, old_image FROM changes WHERE id > ? ORDER BY id LIMIT ?`), after, limit)
+	if err != nil {
+		return event, after, err
+	}
+	defer rows.Close()
+
+	last := after
+	for rows.Next() {
+		var id int64
+		var eventName, pk, sk string
+		var newImage, oldImage sql.NullString
+
+		err := rows.Scan(&id, &eventName, &pk, &sk, &newImage, &oldImage)
+		if err != nil {
+			return event, after, err
+		}
+
+		rec := models.DynamoDBEventRecord{
+			EventID:     strconv.FormatInt(id, 10),
+			EventName:   eventName,
+			EventSource: "sql:changes",
+		}
+		rec.Change.Keys = map[string]*dynamodb.AttributeValue{
+			utils.GetPartitionKeyName(): {S: aws.String(pk)},
+			utils.GetRangeKeyName():     {S: aws.String(sk)},
+		}
+		rec.Change.SequenceNumber = fmt.Sprintf("%021d", id)
+		rec.Change.StreamViewType = "NEW_AND_OLD_IMAGES"
+
+		rec.Change.NewImage, err = imageAttributes(newImage)
+		if err != nil {
+			return event, after, err
+		}
+		rec.Change.OldImage, err = imageAttributes(oldImage)
+		if err != nil {
+			return event, after, err
+		}
+
+		event.Records = append(event.Records, rec)
+		last = id
+	}
+
+	return event, last, rows.Err()
+}
+
+// Checkpoint returns the last change feed id processed by consumer
+func (d *Database) Checkpoint(consumer string) (int64, error) {
+	var last int64
+	err := d.db.QueryRow(d.rebind(`SELECT last_id FROM change_checkpoints WHERE consumer = ?`), consumer).Scan(&last)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return last, err
+}
+
+func (d *Database) SaveCheckpoint(consumer string, last int64) error {
+	_, err := d.db.Exec(d.rebind(`INSERT INTO change_checkpoints (consumer, last_id) VALUES (?, ?)
+		ON CONFLICT (consumer) DO UPDATE SET last_id = excluded.last_id`), consumer, last)
+	return err
+}
+
+// verifyTag returns the category list with aliases and deprecated tags resolved
+func (d *Database) verifyTag(q queryer, category []models.Category) ([]models.Category, error) {
+	tags, err := d.listTags(q)
+	if err != nil {
+		return category, err
+	}
+	return utils.ResolveTags(category, utils.NewTagTree(tags))
+}
+
+func (d *Database) verifyRuleTag(q queryer, rule *models.RuleRequest) error {
+	tags, err := d.verifyTag(q, []models.Category{{Key: rule.TagKey, Value: rule.TagValue}})
+	if err != nil {
+		return err
+	}
+	rule.TagKey, rule.TagValue = tags[0].Key, tags[0].Value
+	return nil
+}
+
+const serviceColumns = `uuid, sk, service_name, description, more_about, like_count, stage, target_segment,
+	deployment, business_model, pricing, location, created_at, updated_at, version, updated_by, attributes`
+
+func (d *Database) queryServices(q queryer, where string, args ...interface{}) ([]models.ServiceResponse, error) {
+	services := []models.ServiceResponse{}
+
+	rows, err := q.Query(d.rebind(`SELECT `+serviceColumns+` FROM services `+where), args...)
+	if err != nil {
+		return services, err
+	}
+
+	for rows.Next() {
+		s := models.ServiceResponse{PK: utils.GetPartitionKey(utils.SERVICE)}
+		attributes := ""
+		err := rows.Scan(&s.ServiceUUID, &s.SK, &s.ServiceName, &s.Description, &s.MoreAbout, &s.Like, &s.Stage,
+			&s.TargetSegment, &s.Deployment, &s.BusinessModel, &s.Pricing, &s.Location, &s.CreatedAt, &s.UpdatedAt, &s.Version, &s.UpdatedBy, &attributes)
+		if err == nil {
+			err = parseList(attributes, &s.Attributes)
+		}
+		if err != nil {
+			rows.Close()
+			return services, err
+		}
+		services = append(services, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return services, err
+	}
+
+	for i := range services {
+		services[i].Category, err = d.serviceCategory(q, services[i].ServiceUUID)
+		if err != nil {
+			return services, err
+		}
+	}
+	return services, nil
+}
+
+func (d *Database) serviceCategory(q queryer, serviceUUID string) ([]models.Category, error) {
+	category := make([]models.Category, 0)
+
+	rows, err := q.Query(d.rebind(`SELECT tag_key, tag_value, source, rule_uuid, applied_at FROM service_tags WHERE service_uuid = ? ORDER BY position`), serviceUUID)
+	if err != nil {
+		return category, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		cat := models.Category{}
+		if err := rows.Scan(&cat.Key, &cat.Value, &cat.Source, &cat.RuleUUID, &cat.AppliedAt); err != nil {
+			return category, err
+		}
+		category = append(category, cat)
+	}
+	return category, rows.Err()
+}
+
+func (d *Database) getServiceBySK(q queryer, sk string) (models.ServiceResponse, error) {
+	services, err := d.queryServices(q, `WHERE sk = ?`, sk)
+	if err != nil || len(services) == 0 {
+		return models.ServiceResponse{}, err
+	}
+	return services[0], nil
+}
+
+func (d *Database) getServiceByUUID(q queryer, uuid string) (models.ServiceResponse, error) {
+	services, err := d.queryServices(q, `WHERE uuid = ?`, uuid)
+	if err != nil || len(services) == 0 {
+		return models.ServiceResponse{}, err
+	}
+	return services[0], nil
+}
+
+// putService replaces the service stored under the same SK, like a PutItem
+func (d *Database) putService(q queryer, service models.ServiceResponse) error {
+	old, err := d.getServiceBySK(q, service.SK)
+	if err != nil {
+		return err
+	}
+
+	eventName := "INSERT"
+	var oldImage interface{}
+	if old.ServiceName != "" {
+		eventName, oldImage = "MODIFY", old
+		if err := d.deleteServiceRows(q, old); err != nil {
+			return err
+		}
+	}
+
+	attributes, err := attributesJson(service.Attributes)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec(d.rebind(`INSERT INTO services (`+serviceColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		service.ServiceUUID, service.SK, service.ServiceName, service.Description, service.MoreAbout, service.Like, service.Stage,
+		service.TargetSegment, service.Deployment, service.BusinessModel, service.Pricing, service.Location, service.CreatedAt, service.UpdatedAt,
+		service.Version, service.UpdatedBy, attributes)
+	if err != nil {
+		return err
+	}
+
+	if service.Category == nil {
+		service.Category = make([]models.Category, 0)
+	}
+	for i, cat := range service.Category {
+		_, err := q.Exec(d.rebind(`INSERT INTO service_tags (service_uuid, position, tag_key, tag_value, source, rule_uuid, applied_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`), service.ServiceUUID, i, cat.Key, cat.Value, cat.Source, cat.RuleUUID, cat.AppliedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return d.recordChange(q, eventName, service.PK, service.SK, service, oldImage)
+}
+
+func (d *Database) deleteServiceRows(q queryer, service models.ServiceResponse) error {
+	_, err := q.Exec(d.rebind(`DELETE FROM service_tags WHERE service_uuid = ?`), service.ServiceUUID)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(d.rebind(`DELETE FROM services WHERE sk = ?`), service.SK)
+	return err
+}
+
+func (d *Database) removeService(q queryer, sk string, actor string) error {
+	old, err := d.getServiceBySK(q, sk)
+	if err != nil || old.ServiceName == "" {
+		return err
+	}
+
+	if err := d.deleteServiceRows(q, old); err != nil {
+		return err
+	}
+	return d.recordRemove(q, old.PK, old.SK, old, actor)
+}
+
+func (d *Database) CreateService(service models.ServiceRequest) (models.ServiceRequest, error) {
+	// always a new service, a uuid or version sent with it is ignored
+	service.ServiceUUID, service.Version = "", 0
+
+	err := d.withTx(func(tx *sql.Tx) error {
+		var err error
+		service, err = d.createService(tx, service)
+		return err
+	})
+	return service, err
+}
+
+func (d *Database) createService(q queryer, service models.ServiceRequest) (models.ServiceRequest, error) {
+
+	// if its a fresh entry
+	if service.ServiceUUID == "" {
+		// check if the service already exists
+		existService, err := d.getServiceBySK(q, utils.GetRangeKey(utils.SERVICE, service.ServiceName, blank, blank))
+		if err != nil {
+			return service, err
+		}
+
+		if existService.ServiceName != "" {
+			return service, errors.New("Service already exist")
+		}
+
+		service.ServiceUUID = utils.GetUUID()
+		service.Version = 1
+		datetime := utils.DateString("datetime")
+		service.CreatedAt, service.UpdatedAt = datetime, datetime
+		service.Category = utils.StampCategories(service.Category, nil, datetime)
+		service.PK = utils.GetPartitionKey(utils.SERVICE)
+		service.SK = utils.GetRangeKey(utils.SERVICE, service.ServiceName, blank, blank)
+	}
+
+	fields, err := d.listFields(q)
+	if err != nil {
+		return service, err
+	}
+	err = utils.CheckAttributes(service.Attributes, fields)
+	if err != nil {
+		return service, err
+	}
+
+	category, err := d.verifyTag(q, service.Category)
+	if err != nil {
+		return service, err
+	}
+	service.Category = category
+
+	return service, d.putService(q, models.ServiceResponse(service))
+}
+
+func (d *Database) GetAllServices(limit int, cursor string) ([]models.ServiceResponse, string, error) {
+	after, err := utils.CursorRangeKey(cursor, utils.GetPartitionKey(utils.SERVICE))
+	if err != nil {
+		return []models.ServiceResponse{}, "", err
+	}
+
+	// one extra row tells whether a next page exists
+	services, err := d.queryServices(d.db, `WHERE sk > ? ORDER BY sk LIMIT ?`, after, limit+1)
+	if err != nil || len(services) <= limit {
+		return services, "", err
+	}
+
+	services = services[:limit]
+	return services, utils.CursorFor(utils.GetPartitionKey(utils.SERVICE), services[limit-1].SK), nil
+}
+
+// SearchServices filters services in SQL, tag and keyword filters go through service_tags and service_terms
+func (d *Database) SearchServices(search models.ServiceSearch, limit int, cursor string) ([]models.ServiceResponse, string, error) {
+	after, err := utils.CursorRangeKey(cursor, utils.GetPartitionKey(utils.SERVICE))
+	if err != nil {
+		return []models.ServiceResponse{}, "", err
+	}
+
+	where := []string{`sk > ?`}
+	args := []interface{}{after}
+
+	const tagged = `LOWER(tag_key) = LOWER(?) AND LOWER(tag_value) = LOWER(?)`
+	if search.TagMode == utils.OR && len(search.Tags) > 0 {
+		conds := []string{}
+		for _, tag := range search.Tags {
+			conds = append(conds, `(`+tagged+`)`)
+			args = append(args, tag.Key, tag.Value)
+		}
+		where = append(where, `uuid IN (SELECT service_uuid FROM service_tags WHERE `+strings.Join(conds, ` OR `)+`)`)
+	} else {
+		for _, tag := range search.Tags {
+			where = append(where, `uuid IN (SELECT service_uuid FROM service_tags WHERE `+tagged+`)`)
+			args = append(args, tag.Key, tag.Value)
+		}
+	}
+
+	// map iteration order does not matter, the conditions are ANDed
+	for field, value := range search.Fields {
+		where = append(where, `LOWER(`+field+`) = LOWER(?)`)
+		args = append(args, value)
+	}
+
+	for _, term := range utils.Tokenize(search.Query) {
+		where = append(where, `uuid IN (SELECT service_uuid FROM service_terms WHERE term = ?)`)
+		args = append(args, term)
+	}
+
+	// one extra row tells whether a next page exists
+	args = append(args, limit+1)
+	services, err := d.queryServices(d.db, `WHERE `+strings.Join(where, ` AND `)+` ORDER BY sk LIMIT ?`, args...)
+	if err != nil || len(services) <= limit {
+		return services, "", err
+	}
+
+	services = services[:limit]
+	return services, utils.CursorFor(utils.GetPartitionKey(utils.SERVICE), services[limit-1].SK), nil
+}
+
+// IndexServiceTags has nothing to do, service_tags is written with the service
+func (d *Database) IndexServiceTags(serviceUUID string, oldCategory []models.Category) error {
+	return nil
+}
+
+// IndexServiceTerms rewrites the service_terms rows of a service from its stored text
+func (d *Database) IndexServiceTerms(serviceUUID string, oldTerms []string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		service, err := d.getServiceByUUID(tx, serviceUUID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(d.rebind(`DELETE FROM service_terms WHERE service_uuid = ?`), serviceUUID)
+		if err != nil || service.ServiceName == "" {
+			return err
+		}
+
+		for _, term := range utils.ServiceTerms(service.Description, service.MoreAbout) {
+			_, err := tx.Exec(d.rebind(`INSERT INTO service_terms (service_uuid, term) VALUES (?, ?)`), serviceUUID, term)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *Database) GetServiceTerms(term string, prefix bool) ([]models.ServiceTerm, error) {
+	entries := []models.ServiceTerm{}
+
+	cond, arg := `t.term = ?`, term
+	if prefix {
+		// terms are letters and digits only, nothing to escape
+		cond, arg = `t.term LIKE ?`, term+"%"
+	}
+	rows, err := d.db.Query(d.rebind(`SELECT t.term, t.service_uuid, s.sk FROM service_terms t
+		JOIN services s ON s.uuid = t.service_uuid WHERE `+cond+` ORDER BY t.term, t.service_uuid`), arg)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry := models.ServiceTerm{PK: utils.GetPartitionKey(utils.SERVICE_TERM)}
+		if err := rows.Scan(&entry.Term, &entry.ServiceUUID, &entry.ServiceSK); err != nil {
+			return entries, err
+		}
+		entry.SK = utils.GetRangeKey(utils.SERVICE_TERM, entry.Term, blank, entry.ServiceUUID)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (d *Database) GetService(name string) (models.ServiceResponse, error) {
+	return d.getServiceBySK(d.db, utils.GetRangeKey(utils.SERVICE, name, blank, blank))
+}
+
+func (d *Database) UpdateService(updatedService models.ServiceRequest, serviceUUID string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		oldService, err := d.getServiceByUUID(tx, serviceUUID)
+		if err != nil {
+			return err
+		}
+
+		if oldService.ServiceName == "" {
+			return errors.New("service not found")
+		}
+
+		// Version carries the If-Match version, 0 when the client sent none
+		if !utils.VersionMatches(updatedService.Version, oldService.Version) {
+			return utils.ErrVersionConflict
+		}
+
+		updatedService.Category, err = d.verifyTag(tx, updatedService.Category)
+		if err != nil {
+			return err
+		}
+		updatedService.Category = utils.StampCategories(updatedService.Category, oldService.Category, utils.DateString("datetime"))
+
+		newServiceName := utils.GetRangeKey(utils.SERVICE, updatedService.ServiceName, blank, blank)
+
+		// if service name is changed, delete old entry and create new one
+		if oldService.SK != newServiceName {
+			existService, err := d.getServiceBySK(tx, newServiceName)
+			if err != nil {
+				return err
+			}
+			if existService.ServiceName != "" {
+				return errors.New("Service already exist")
+			}
+			if err := d.removeService(tx, oldService.SK, updatedService.UpdatedBy); err != nil {
+				return err
+			}
+		}
+		updatedService.ServiceUUID = serviceUUID
+		updatedService.Version = oldService.Version + 1
+		// old created at
+		updatedService.CreatedAt = oldService.CreatedAt
+		// new updated at
+		updatedService.UpdatedAt = utils.DateString("datetime")
+		updatedService.PK = utils.GetPartitionKey(utils.SERVICE)
+		updatedService.SK = newServiceName
+
+		_, err = d.createService(tx, updatedService)
+		return err
+	})
+}
+
+func (d *Database) DeleteService(name string, cascade bool, actor string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		sk := utils.GetRangeKey(utils.SERVICE, name, blank, blank)
+		service, err := d.getServiceBySK(tx, sk)
+		if err != nil || service.ServiceName == "" {
+			return err
+		}
+
+		companies, err := d.subscribedCompanies(tx, service.ServiceUUID)
+		if err != nil {
+			return err
+		}
+
+		if !cascade && len(companies) > 0 {
+			return &utils.ReferencedError{Entity: "service " + name, References: utils.ServiceReferences(companies, service.ServiceUUID)}
+		}
+
+		err = d.detachService(tx, companies, service.ServiceUUID)
+		if err != nil {
+			return err
+		}
+		return d.removeService(tx, sk, actor)
+	})
+}
+
+func (d *Database) verifyService(q queryer, serviceList []string) error {
+	for _, serviceId := range serviceList {
+		s, err := d.getServiceByUUID(q, serviceId)
+		if err != nil {
+			return err
+		}
+		if s.ServiceName == "" {
+			return errors.New(fmt.Sprintf("Service %s not found", serviceId))
+		}
+	}
+	return nil
+}
+
+func (d *Database) queryCompanies(q queryer, where string, args ...interface{}) ([]models.Company, error) {
+	companies := []models.Company{}
+
+	rows, err := q.Query(d.rebind(`SELECT uuid, sk, company_name, description, created_at, updated_at, version, updated_by FROM companies `+where), args...)
+	if err != nil {
+		return companies, err
+	}
+
+	for rows.Next() {
+		c := models.Company{PK: utils.GetPartitionKey(utils.COMPANY)}
+		err := rows.Scan(&c.CompanyUUID, &c.SK, &c.CompanyName, &c.Description, &c.CreatedAt, &c.UpdatedAt, &c.Version, &c.UpdatedBy)
+		if err != nil {
+			rows.Close()
+			return companies, err
+		}
+		companies = append(companies, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return companies, err
+	}
+
+	for i := range companies {
+		companies[i].ServiceList, err = d.companyServiceList(q, companies[i].CompanyUUID)
+		if err != nil {
+			return companies, err
+		}
+	}
+	return companies, nil
+}
+
+func (d *Database) companyServiceList(q queryer, companyUUID string) ([]string, error) {
+	serviceList := make([]string, 0)
+
+	rows, err := q.Query(d.rebind(`SELECT service_uuid FROM company_services WHERE company_uuid = ? ORDER BY position`), companyUUID)
+	if err != nil {
+		return serviceList, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return serviceList, err
+		}
+		serviceList = append(serviceList, id)
+	}
+	return serviceList, rows.Err()
+}
+
+func (d *Database) getCompanyBySK(q queryer, sk string) (models.Company, error) {
+	companies, err := d.queryCompanies(q, `WHERE sk = ?`, sk)
+	if err != nil || len(companies) == 0 {
+		return models.Company{}, err
+	}
+	return companies[0], nil
+}
+
+func (d *Database) getCompanyByUUID(q queryer, uuid string) (models.Company, error) {
+	companies, err := d.queryCompanies(q, `WHERE uuid = ?`, uuid)
+	if err != nil || len(companies) == 0 {
+		return models.Company{}, err
+	}
+	return companies[0], nil
+}
+
+// putCompany replaces the company stored under the same SK, like a PutItem
+func (d *Database) putCompany(q queryer, company models.Company) error {
+	old, err := d.getCompanyBySK(q, company.SK)
+	if err != nil {
+		return err
+	}
+
+	eventName := "INSERT"
+	var oldImage interface{}
+	if old.CompanyName != "" {
+		eventName, oldImage = "MODIFY", old
+		if err := d.deleteCompanyRows(q, old); err != nil {
+			return err
+		}
+	}
+
+	_, err = q.Exec(d.rebind(`INSERT INTO companies (uuid, sk, company_name, description, created_at, updated_at, version, updated_by) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		company.CompanyUUID, company.SK, company.CompanyName, company.Description, company.CreatedAt, company.UpdatedAt, company.Version, company.UpdatedBy)
+	if err != nil {
+		return err
+	}
+
+	if company.ServiceList == nil {
+		company.ServiceList = make([]string, 0)
+	}
+	for i, serviceUUID := range company.ServiceList {
+		_, err := q.Exec(d.rebind(`INSERT INTO company_services (company_uuid, position, service_uuid) VALUES (?, ?, ?)`),
+			company.CompanyUUID, i, serviceUUID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return d.recordChange(q, eventName, company.PK, company.SK, company, oldImage)
+}
+
+func (d *Database) deleteCompanyRows(q queryer, company models.Company) error {
+	_, err := q.Exec(d.rebind(`DELETE FROM company_services WHERE company_uuid = ?`), company.CompanyUUID)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(d.rebind(`DELETE FROM companies WHERE sk = ?`), company.SK)
+	return err
+}
+
+func (d *Database) removeCompany(q queryer, sk string, actor string) error {
+	old, err := d.getCompanyBySK(q, sk)
+	if err != nil || old.CompanyName == "" {
+		return err
+	}
+
+	if err := d.deleteCompanyRows(q, old); err != nil {
+		return err
+	}
+	return d.recordRemove(q, old.PK, old.SK, old, actor)
+}
+
+// companyResponse resolves the service uuids of a company to the latest service names
+func (d *Database) companyResponse(q queryer, company models.Company) models.CompanyResponse {
+	s := make([]models.Services, 0)
+	for _, srvId := range company.ServiceList {
+		service, err := d.getServiceByUUID(q, srvId)
+		if err == nil {
+			s = append(s, models.Services{ServiceUUID: srvId, ServiceName: service.ServiceName})
+		}
+	}
+
+	return models.CompanyResponse{
+		CompanyUUID: company.CompanyUUID,
+		CompanyName: company.CompanyName,
+		Description: company.Description,
+		ServiceList: s,
+		CreatedAt:   company.CreatedAt,
+		UpdatedAt:   company.UpdatedAt,
+		Version:     company.Version,
+		UpdatedBy:   company.UpdatedBy,
+	}
+}
+
+func (d *Database) CreateCompany(company models.CompanyRequest) (models.CompanyRequest, error) {
+	// always a new company, a uuid or version sent with it is ignored
+	company.CompanyUUID, company.Version = "", 0
+
+	err := d.withTx(func(tx *sql.Tx) error {
+		var err error
+		company, err = d.createCompany(tx, company)
+		return err
+	})
+	return company, err
+}
+
+func (d *Database) createCompany(q queryer, company models.CompanyRequest) (models.CompanyRequest, error) {
+
+	// if its a fresh entry
+	if company.CompanyUUID == "" {
+		// check if company already exist
+		existCompany, err := d.getCompanyBySK(q, utils.GetRangeKey(utils.COMPANY, company.CompanyName, blank, blank))
+		if err != nil {
+			return company, err
+		}
+
+		if existCompany.CompanyName != "" {
+			return company, errors.New("Company already exist")
+		}
+
+		company.CompanyUUID = utils.GetUUID()
+		company.Version = 1
+		datetime := utils.DateString("datetime")
+		company.CreatedAt, company.UpdatedAt = datetime, datetime
+		company.PK = utils.GetPartitionKey(utils.COMPANY)
+		company.SK = utils.GetRangeKey(utils.COMPANY, company.CompanyName, blank, blank)
+	}
+
+	err := d.verifyService(q, company.ServiceList)
+	if err != nil {
+		return company, err
+	}
+
+	return company, d.putCompany(q, models.Company(company))
+}
+
+func (d *Database) GetAllCompanies(limit int, cursor string) ([]models.CompanyResponse, string, error) {
+	companies := make([]models.CompanyResponse, 0)
+
+	after, err := utils.CursorRangeKey(cursor, utils.GetPartitionKey(utils.COMPANY))
+	if err != nil {
+		return companies, "", err
+	}
+
+	companiesTemp, err := d.queryCompanies(d.db, `WHERE sk > ? ORDER BY sk LIMIT ?`, after, limit+1)
+	if err != nil {
+		return companies, "", err
+	}
+
+	next := ""
+	if len(companiesTemp) > limit {
+		companiesTemp = companiesTemp[:limit]
+		next = utils.CursorFor(utils.GetPartitionKey(utils.COMPANY), companiesTemp[limit-1].SK)
+	}
+
+	for _, company := range companiesTemp {
+		companies = append(companies, d.companyResponse(d.db, company))
+	}
+	return companies, next, nil
+}
+
+func (d *Database) GetCompany(name string) (models.CompanyResponse, error) {
+	company, err := d.getCompanyBySK(d.db, utils.GetRangeKey(utils.COMPANY, name, blank, blank))
+	if err != nil {
+		return models.CompanyResponse{}, err
+	}
+
+	return d.companyResponse(d.db, company), nil
+}
+
+func (d *Database) UpdateCompany(updatedCompany models.CompanyRequest, companyUUID string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		oldCompany, err := d.getCompanyByUUID(tx, companyUUID)
+		if err != nil {
+			return err
+		}
+
+		if oldCompany.CompanyName == "" {
+			return errors.New("company not found")
+		}
+
+		// Version carries the If-Match version, 0 when the client sent none
+		if !utils.VersionMatches(updatedCompany.Version, oldCompany.Version) {
+			return utils.ErrVersionConflict
+		}
+
+		err = d.verifyService(tx, updatedCompany.ServiceList)
+		if err != nil {
+			return err
+		}
+
+		newCompanyName := utils.GetRangeKey(utils.COMPANY, updatedCompany.CompanyName, blank, blank)
+
+		// if company name is changed, delete old entry and create new one
+		if oldCompany.SK != newCompanyName {
+			existCompany, err := d.getCompanyBySK(tx, newCompanyName)
+			if err != nil {
+				return err
+			}
+			if existCompany.CompanyName != "" {
+				return errors.New("Company already exist")
+			}
+			if err := d.removeCompany(tx, oldCompany.SK, updatedCompany.UpdatedBy); err != nil {
+				return err
+			}
+		}
+		updatedCompany.CompanyUUID = companyUUID
+		updatedCompany.Version = oldCompany.Version + 1
+		// old created at
+		updatedCompany.CreatedAt = oldCompany.CreatedAt
+		// new updated at
+		updatedCompany.UpdatedAt = utils.DateString("datetime")
+		updatedCompany.PK = utils.GetPartitionKey(utils.COMPANY)
+		updatedCompany.SK = newCompanyName
+
+		_, err = d.createCompany(tx, updatedCompany)
+		return err
+	})
+}
+
+func (d *Database) DeleteCompany(name string, actor string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		return d.removeCompany(tx, utils.GetRangeKey(utils.COMPANY, name, blank, blank), actor)
+	})
+}
+
+const tagColumns = `sk, tag_key, tag_value, parent_key, parent_value, description, label, color, aliases, deprecated,
+	replaced_by_key, replaced_by_value, created_at, updated_at, version, updated_by`
+
+func (d *Database) queryTags(q queryer, where string, args ...interface{}) ([]models.TagCreateRequest, error) {
+	tags := []models.TagCreateRequest{}
+
+	rows, err := q.Query(d.rebind(`SELECT `+tagColumns+` FROM tags `+where), args...)
+	if err != nil {
+		return tags, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t := models.TagCreateRequest{PK: utils.GetPartitionKey(utils.TAG)}
+		aliases := ""
+		if err := rows.Scan(&t.SK, &t.Key, &t.Value, &t.ParentKey, &t.ParentValue, &t.Description, &t.Label, &t.Color, &aliases,
+			&t.Deprecated, &t.ReplacedByKey, &t.ReplacedByValue, &t.CreatedAt, &t.UpdatedAt, &t.Version, &t.UpdatedBy); err != nil {
+			return tags, err
+		}
+		if err := parseList(aliases, &t.Aliases); err != nil {
+			return tags, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// listJson stores an empty list, such as no aliases, as an empty string
+func listJson(list []string) (string, error) {
+	if len(list) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(list)
+	return string(b), err
+}
+
+// conditionsJson stores no conditions as an empty string
+func conditionsJson(conditions []models.RuleCondition) (string, error) {
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(conditions)
+	return string(b), err
+}
+
+// valuesJson stores no relational values as an empty string
+func valuesJson(values []interface{}) (string, error) {
+	if len(values) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(values)
+	return string(b), err
+}
+
+// attributesJson stores no custom attributes as an empty string
+func attributesJson(attributes map[string]interface{}) (string, error) {
+	if len(attributes) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(attributes)
+	return string(b), err
+}
+
+// parseList reads a list stored by listJson, conditionsJson or valuesJson, and
+// the attributes stored by attributesJson
+func parseList(s string, list interface{}) error {
+	if s == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(s), list)
+}
+
+func (d *Database) CreateTag(tag models.TagCreateRequest) (models.TagCreateRequest, error) {
+	err := d.withTx(func(tx *sql.Tx) error {
+		// check if the tag already exists
+		existTag, err := d.getTag(tx, tag.Key, tag.Value)
+		if err != nil {
+			return err
+		}
+
+		if existTag.Key != "" {
+			return errors.New("Tag already exist")
+		}
+
+		tags, err := d.listTags(tx)
+		if err != nil {
+			return err
+		}
+
+		tree := utils.NewTagTree(tags)
+		err = tree.CheckParent(tag.Key, tag.Value, tag.ParentKey, tag.ParentValue)
+		if err != nil {
+			return err
+		}
+
+		err = tree.CheckMetadata(tag.Key, tag.Value, tag.TagMetadata)
+		if err != nil {
+			return err
+		}
+
+		tag, err = d.insertTag(tx, tag)
+		return err
+	})
+	return tag, err
+}
+
+func (d *Database) ListTags() ([]models.TagResponse, error) {
+	return d.listTags(d.db)
+}
+
+func (d *Database) listTags(q queryer) ([]models.TagResponse, error) {
+	tags, err := d.queryTags(q, `ORDER BY sk`)
+	return utils.TagCreateToTagResponse(tags), err
+}
+
+func (d *Database) SetTagParent(key string, value string, parentKey string, parentValue string, actor string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		tags, err := d.listTags(tx)
+		if err != nil {
+			return err
+		}
+
+		tree := utils.NewTagTree(tags)
+		tag, ok := tree.Get(key, value)
+		if !ok {
+			return utils.ErrTagNotFound
+		}
+
+		err = tree.CheckParent(tag.Key, tag.Value, parentKey, parentValue)
+		if err != nil {
+			return err
+		}
+
+		tag.ParentKey, tag.ParentValue = parentKey, parentValue
+		return d.putTagFields(tx, tag, actor)
+	})
+}
+
+func (d *Database) SetTagMetadata(key string, value string, meta models.TagMetadata, actor string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		tags, err := d.listTags(tx)
+		if err != nil {
+			return err
+		}
+
+		tree := utils.NewTagTree(tags)
+		tag, ok := tree.Get(key, value)
+		if !ok {
+			return utils.ErrTagNotFound
+		}
+
+		err = tree.CheckMetadata(tag.Key, tag.Value, meta)
+		if err != nil {
+			return err
+		}
+
+		tag.TagMetadata = meta
+		return d.putTagFields(tx, tag, actor)
+	})
+}
+
+// putTagFields rewrites the parent and the metadata of a stored tag
+func (d *Database) putTagFields(q queryer, tag models.TagResponse, actor string) error {
+	sk := utils.GetRangeKey(utils.TAG, tag.Key, tag.Value, blank)
+	old, err := d.queryTags(q, `WHERE sk = ?`, sk)
+	if err != nil || len(old) == 0 {
+		return err
+	}
+
+	updated := old[0]
+	updated.ParentKey, updated.ParentValue, updated.TagMetadata = tag.ParentKey, tag.ParentValue, tag.TagMetadata
+	updated.Version++
+	updated.UpdatedBy = actor
+
+	aliases, err := listJson(updated.Aliases)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec(d.rebind(`UPDATE tags SET parent_key = ?, parent_value = ?, description = ?, label = ?, color = ?, aliases = ?,
+		deprecated = ?, replaced_by_key = ?, replaced_by_value = ?, version = ?, updated_by = ? WHERE sk = ?`),
+		updated.ParentKey, updated.ParentValue, updated.Description, updated.Label, updated.Color, aliases,
+		updated.Deprecated, updated.ReplacedByKey, updated.ReplacedByValue, updated.Version, updated.UpdatedBy, sk)
+	if err != nil {
+		return err
+	}
+	return d.recordChange(q, "MODIFY", updated.PK, updated.SK, updated, old[0])
+}
+
+// insertTag stores a new tag, the caller checked it does not exist
+func (d *Database) insertTag(q queryer, tag models.TagCreateRequest) (models.TagCreateRequest, error) {
+	datetime := utils.DateString("datetime")
+	tag.CreatedAt, tag.UpdatedAt = datetime, datetime
+	tag.Version = 1
+	tag.PK = utils.GetPartitionKey(utils.TAG)
+	tag.SK = utils.GetRangeKey(utils.TAG, tag.Key, tag.Value, blank)
+
+	aliases, err := listJson(tag.Aliases)
+	if err != nil {
+		return tag, err
+	}
+
+	_, err = q.Exec(d.rebind(`INSERT INTO tags (`+tagColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		tag.SK, tag.Key, tag.Value, tag.ParentKey, tag.ParentValue, tag.Description, tag.Label, tag.Color, aliases,
+		tag.Deprecated, tag.ReplacedByKey, tag.ReplacedByValue, tag.CreatedAt, tag.UpdatedAt, tag.Version, tag.UpdatedBy)
+	if err != nil {
+		return tag, err
+	}
+
+	return tag, d.recordChange(q, "INSERT", tag.PK, tag.SK, tag, nil)
+}
+
+// UpdateTag rewrites everything in one transaction, progress is reported before it commits
+// and an update it stops is rolled back. A rename is never left half done, so the new tags
+// are not stored with the renamed-from marker.
+func (d *Database) UpdateTag(key string, value string, update models.TagUpdateRequest, progress func(models.TagUpdateReport) error) (models.TagUpdateReport, error) {
+	report := models.TagUpdateReport{Operation: update.Operation}
+
+	err := d.withTx(func(tx *sql.Tx) error {
+		tags, err := d.listTags(tx)
+		if err != nil {
+			return err
+		}
+
+		report.Renames, err = utils.TagRenames(tags, key, value, update)
+		if err != nil {
+			return err
+		}
+
+		// the new tags exist before anything points at them
+		created, reparented := utils.RenameTagItems(tags, report.Renames, update.Operation == utils.TAG_MERGE)
+		for _, tag := range created {
+			_, err := d.insertTag(tx, models.TagCreateRequest{Key: tag.Key, Value: tag.Value, ParentKey: tag.ParentKey, ParentValue: tag.ParentValue,
+				TagMetadata: tag.TagMetadata, UpdatedBy: update.UpdatedBy})
+			if err != nil {
+				return err
+			}
+		}
+		for _, tag := range reparented {
+			err := d.putTagFields(tx, tag, update.UpdatedBy)
+			if err != nil {
+				return err
+			}
+		}
+
+		services, err := d.queryServices(tx, ``)
+		if err != nil {
+			return err
+		}
+
+		for _, service := range services {
+			report.ServicesScanned++
+			category, changed := utils.RenameCategory(service.Category, report.Renames)
+			if !changed {
+				continue
+			}
+
+			service.Category = category
+			service.Version++
+			service.UpdatedBy = update.UpdatedBy
+			err := d.putService(tx, service)
+			if err != nil {
+				return err
+			}
+			report.ServicesUpdated++
+		}
+		if err := progress(report); err != nil {
+			return err
+		}
+
+		rules, err := d.queryRules(tx, ``)
+		if err != nil {
+			return err
+		}
+
+		fields, err := d.listFields(tx)
+		if err != nil {
+			return err
+		}
+
+		updated, duplicates := utils.RenameRules(rules, report.Renames, fields)
+		for _, rule := range updated {
+			rule.Version++
+			rule.UpdatedBy = update.UpdatedBy
+			err := d.putRule(tx, models.RuleRequest(rule))
+			if err != nil {
+				return err
+			}
+			report.RulesUpdated++
+		}
+		for _, rule := range duplicates {
+			err := d.removeRule(tx, rule.RuleUUID, update.UpdatedBy)
+			if err != nil {
+				return err
+			}
+			report.RulesDeleted++
+		}
+		if err := progress(report); err != nil {
+			return err
+		}
+
+		for _, rename := range report.Renames {
+			err := d.removeTag(tx, utils.GetRangeKey(utils.TAG, rename.FromKey, rename.FromValue, blank), update.UpdatedBy)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// rolled back, nothing was rewritten
+		return models.TagUpdateReport{Operation: update.Operation, Renames: report.Renames}, err
+	}
+
+	report.Done = true
+	return report, nil
+}
+
+func (d *Database) GetAllTags(limit int, cursor string) ([]models.TagListResponse, string, error) {
+	tagList := make([]models.TagListResponse, 0)
+
+	after, err := utils.CursorRangeKey(cursor, utils.GetPartitionKey(utils.TAG))
+	if err != nil {
+		return tagList, "", err
+	}
+
+	tags, err := d.queryTags(d.db, `WHERE sk > ? ORDER BY sk LIMIT ?`, after, limit+1)
+	if err != nil {
+		return tagList, "", err
+	}
+
+	next := ""
+	if len(tags) > limit {
+		// keep all values of a key on the same page
+		if tags[limit].Key == tags[limit-1].Key {
+			tags = utils.TrimPartialTagGroup(tags[:limit])
+		} else {
+			tags = tags[:limit]
+		}
+		next = utils.CursorFor(utils.GetPartitionKey(utils.TAG), tags[len(tags)-1].SK)
+	}
+
+	return utils.CreateTagResponse(utils.TagCreateToTagResponse(tags), tagList), next, nil
+}
+
+func (d *Database) DeleteTag(key string, value string, cascade bool, actor string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		services, rules, children, err := d.tagReferences(tx, key, value)
+		if err != nil {
+			return err
+		}
+
+		if !cascade && len(services)+len(rules)+len(children) > 0 {
+			return &utils.ReferencedError{Entity: "tag " + key + ":" + value, References: utils.TagReferences(services, rules, children, key, value)}
+		}
+
+		err = d.detachTag(tx, services, rules, children, key, value, actor)
+		if err != nil {
+			return err
+		}
+
+		return d.removeTag(tx, utils.GetRangeKey(utils.TAG, key, value, blank), actor)
+	})
+}
+
+func (d *Database) removeTag(q queryer, sk string, actor string) error {
+	tags, err := d.queryTags(q, `WHERE sk = ?`, sk)
+	if err != nil || len(tags) == 0 {
+		return err
+	}
+
+	_, err = q.Exec(d.rebind(`DELETE FROM tags WHERE sk = ?`), sk)
+	if err != nil {
+		return err
+	}
+	return d.recordRemove(q, tags[0].PK, tags[0].SK, tags[0], actor)
+}
+
+func (d *Database) GetTag(key string, value string) (models.TagListResponse, error) {
+	return d.getTag(d.db, key, value)
+}
+
+// getTag matches tags whose SK begins with the key (and value), like the dynamodb query
+func (d *Database) getTag(q queryer, key string, value string) (models.TagListResponse, error) {
+	resultTag := []models.TagListResponse{}
+
+	all, err := d.queryTags(q, `ORDER BY sk`)
+	if err != nil {
+		return models.TagListResponse{}, err
+	}
+
+	prefix := utils.GetRangeKey(utils.TAG, key, value, blank)
+	tags := []models.TagCreateRequest{}
+	for _, t := range all {
+		if strings.HasPrefix(t.SK, prefix) {
+			tags = append(tags, t)
+		}
+	}
+
+	resp := utils.CreateTagResponse(utils.TagCreateToTagResponse(tags), resultTag)
+	if len(resp) > 0 {
+		return resp[0], nil
+	}
+	return models.TagListResponse{}, nil
+}
+
+const ruleColumns = `uuid, operation, tag_key, tag_value, metadata_field, keyword, keyword_operator, relational_operator,
+	relational_operand, subscription_count, corule_metadata_field, corule_keyword, created_at, updated_at, version, updated_by, expression,
+	match_mode, synonyms, fuzzy_threshold, condition_mode, conditions, relational_values`
+
+func (d *Database) queryRules(q queryer, where string, args ...interface{}) ([]models.RuleResponse, error) {
+	rules := []models.RuleResponse{}
+
+	rows, err := q.Query(d.rebind(`SELECT `+ruleColumns+` FROM rules `+where), args...)
+	if err != nil {
+		return rules, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r := models.RuleResponse{PK: utils.GetPartitionKey(utils.RULE)}
+		synonyms, conditions, values := "", "", ""
+		err := rows.Scan(&r.RuleUUID, &r.Operation, &r.TagKey, &r.TagValue, &r.MetadataField, &r.Keyword, &r.KeywordOperator,
+			&r.RelationalOperator, &r.Operand, &r.SubscriptionCount, &r.CoRuleMetadataField, &r.CoRuleKeyword, &r.CreatedAt, &r.UpdatedAt, &r.Version, &r.UpdatedBy,
+			&r.Expression, &r.MatchMode, &synonyms, &r.FuzzyThreshold, &r.ConditionMode, &conditions, &values)
+		if err != nil {
+			return rules, err
+		}
+		if err := parseList(values, &r.RelationalValues); err != nil {
+			return rules, err
+		}
+		if err := parseList(synonyms, &r.Synonyms); err != nil {
+			return rules, err
+		}
+		if err := parseList(conditions, &r.Conditions); err != nil {
+			return rules, err
+		}
+		r.SK = utils.GetRangeKey(utils.RULE, blank, blank, r.RuleUUID)
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func (d *Database) getRule(q queryer, ruleUUID string) (models.RuleResponse, error) {
+	rules, err := d.queryRules(q, `WHERE uuid = ?`, ruleUUID)
+	if err != nil || len(rules) == 0 {
+		return models.RuleResponse{}, err
+	}
+	return rules[0], nil
+}
+
+func (d *Database) isDuplicateRule(q queryer, rule models.RuleRequest) (bool, error) {
+	// rules stored before expressions have none and match plain keywords
+	count, legacy := 0, utils.PlainKeywordRule(rule)
+	err := q.QueryRow(d.rebind(`SELECT COUNT(*) FROM rules WHERE operation = ? AND tag_key = ? AND tag_value = ?
+		AND metadata_field = ? AND keyword = ? AND keyword_operator = ? AND relational_operator = ? AND relational_operand = ?
+		AND subscription_count = ? AND corule_metadata_field = ? AND corule_keyword = ? AND (expression = ? OR expression = '' AND ?)`),
+		rule.Operation, rule.TagKey, rule.TagValue, rule.MetadataField, rule.Keyword, rule.KeywordOperator, rule.RelationalOperator,
+		rule.Operand, rule.SubscriptionCount, rule.CoRuleMetadataField, rule.CoRuleKeyword, rule.Expression, legacy).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// putRule replaces the rule stored under the same uuid, like a PutItem
+func (d *Database) putRule(q queryer, rule models.RuleRequest) error {
+	old, err := d.getRule(q, rule.RuleUUID)
+	if err != nil {
+		return err
+	}
+
+	eventName := "INSERT"
+	var oldImage interface{}
+	if old.Operation != "" {
+		eventName, oldImage = "MODIFY", old
+		_, err := q.Exec(d.rebind(`DELETE FROM rules WHERE uuid = ?`), rule.RuleUUID)
+		if err != nil {
+			return err
+		}
+	}
+
+	synonyms, err := listJson(rule.Synonyms)
+	if err != nil {
+		return err
+	}
+	conditions, err := conditionsJson(rule.Conditions)
+	if err != nil {
+		return err
+	}
+	values, err := valuesJson(rule.RelationalValues)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec(d.rebind(`INSERT INTO rules (`+ruleColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		rule.RuleUUID, rule.Operation, rule.TagKey, rule.TagValue, rule.MetadataField, rule.Keyword, rule.KeywordOperator,
+		rule.RelationalOperator, rule.Operand, rule.SubscriptionCount, rule.CoRuleMetadataField, rule.CoRuleKeyword, rule.CreatedAt, rule.UpdatedAt,
+		rule.Version, rule.UpdatedBy, rule.Expression, rule.MatchMode, synonyms, rule.FuzzyThreshold, rule.ConditionMode, conditions, values)
+	if err != nil {
+		return err
+	}
+
+	return d.recordChange(q, eventName, rule.PK, rule.SK, rule, oldImage)
+}
+
+func (d *Database) CreateRule(rule models.RuleRequest) (models.RuleRequest, error) {
+	err := d.withTx(func(tx *sql.Tx) error {
+		fields, err := d.listFields(tx)
+		if err != nil {
+			return err
+		}
+		err = utils.SetRuleExpression(&rule, fields)
+		if err != nil {
+			return err
+		}
+
+		// an alias or deprecated tag is saved as its canonical tag, compared with the stored rules
+		err = d.verifyRuleTag(tx, &rule)
+		if err != nil {
+			return err
+		}
+
+		// check if rule already exist
+		isDuplicateRule, err := d.isDuplicateRule(tx, rule)
+		if err != nil {
+			return err
+		}
+
+		if isDuplicateRule {
+			return errors.New("Rule already exist")
+		}
+
+		rule.RuleUUID = utils.GetUUID()
+		rule.Version = 1
+		datetime := utils.DateString("datetime")
+		rule.CreatedAt, rule.UpdatedAt = datetime, datetime
+		rule.PK = utils.GetPartitionKey(utils.RULE)
+		rule.SK = utils.GetRangeKey(utils.RULE, blank, blank, rule.RuleUUID)
+
+		return d.putRule(tx, rule)
+	})
+	return rule, err
+}
+
+func (d *Database) GetAllRules(limit int, cursor string) ([]models.RuleResponse, string, error) {
+	after, err := utils.CursorRangeKey(cursor, utils.GetPartitionKey(utils.RULE))
+	if err != nil {
+		return []models.RuleResponse{}, "", err
+	}
+
+	// rules are keyed by RL#uuid, so ordering by uuid follows the range key
+	rules, err := d.queryRules(d.db, `WHERE uuid > ? ORDER BY uuid LIMIT ?`, strings.TrimPrefix(after, "RL#"), limit+1)
+	if err != nil || len(rules) <= limit {
+		return rules, "", err
+	}
+
+	rules = rules[:limit]
+	return rules, utils.CursorFor(utils.GetPartitionKey(utils.RULE), rules[limit-1].SK), nil
+}
+
+func (d *Database) GetRule(ruleUUID string) (models.RuleResponse, error) {
+	return d.getRule(d.db, ruleUUID)
+}
+
+func (d *Database) UpdateRule(updatedRule models.RuleRequest, ruleUUID string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		fields, err := d.listFields(tx)
+		if err != nil {
+			return err
+		}
+		err = utils.SetRuleExpression(&updatedRule, fields)
+		if err != nil {
+			return err
+		}
+
+		oldRule, err := d.getRule(tx, ruleUUID)
+		if err != nil {
+			return err
+		}
+
+		if oldRule.Operation == "" {
+			return errors.New("rule not found")
+		}
+
+		// Version carries the If-Match version, 0 when the client sent none
+		if !utils.VersionMatches(updatedRule.Version, oldRule.Version) {
+			return utils.ErrVersionConflict
+		}
+
+		updatedRule.PK = oldRule.PK
+		updatedRule.SK = oldRule.SK
+		updatedRule.RuleUUID = oldRule.RuleUUID
+		updatedRule.Version = oldRule.Version + 1
+		// old created at
+		updatedRule.CreatedAt = oldRule.CreatedAt
+		// new updated at
+		updatedRule.UpdatedAt = utils.DateString("datetime")
+
+		err = d.verifyRuleTag(tx, &updatedRule)
+		if err != nil {
+			return err
+		}
+
+		return d.putRule(tx, updatedRule)
+	})
+}
+
+func (d *Database) DeleteRule(ruleUUID string, actor string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		return d.removeRule(tx, ruleUUID, actor)
+	})
+}
+
+func (d *Database) removeRule(q queryer, ruleUUID string, actor string) error {
+	old, err := d.getRule(q, ruleUUID)
+	if err != nil || old.Operation == "" {
+		return err
+	}
+
+	_, err = q.Exec(d.rebind(`DELETE FROM rules WHERE uuid = ?`), ruleUUID)
+	if err != nil {
+		return err
+	}
+	return d.recordRemove(q, old.PK, old.SK, old, actor)
+}
+
+const synonymColumns = `sk, uuid, term, synonyms, created_at, updated_at, version, updated_by`
+
+func (d *Database) querySynonyms(q queryer, where string, args ...interface{}) ([]models.Synonym, error) {
+	synonyms := []models.Synonym{}
+
+	rows, err := q.Query(d.rebind(`SELECT `+synonymColumns+` FROM synonyms `+where), args...)
+	if err != nil {
+		return synonyms, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		s := models.Synonym{PK: utils.GetPartitionKey(utils.SYNONYM)}
+		words := ""
+		if err := rows.Scan(&s.SK, &s.SynonymUUID, &s.Term, &words, &s.CreatedAt, &s.UpdatedAt, &s.Version, &s.UpdatedBy); err != nil {
+			return synonyms, err
+		}
+		if err := parseList(words, &s.Synonyms); err != nil {
+			return synonyms, err
+		}
+		synonyms = append(synonyms, s)
+	}
+	return synonyms, rows.Err()
+}
+
+func (d *Database) getSynonym(q queryer, term string) (models.Synonym, error) {
+	synonyms, err := d.querySynonyms(q, `WHERE sk = ?`, utils.GetRangeKey(utils.SYNONYM, term, blank, blank))
+	if err != nil || len(synonyms) == 0 {
+		return models.Synonym{}, err
+	}
+	return synonyms[0], nil
+}
+
+func (d *Database) listSynonyms(q queryer) ([]models.Synonym, error) {
+	return d.querySynonyms(q, `ORDER BY sk`)
+}
+
+// putSynonym replaces the group stored under the same term
+func (d *Database) putSynonym(q queryer, synonym models.Synonym, old models.Synonym) error {
+	words, err := listJson(synonym.Synonyms)
+	if err != nil {
+		return err
+	}
+
+	eventName := "INSERT"
+	var oldImage interface{}
+	if old.Term != "" {
+		eventName, oldImage = "MODIFY", old
+		_, err := q.Exec(d.rebind(`DELETE FROM synonyms WHERE sk = ?`), old.SK)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = q.Exec(d.rebind(`INSERT INTO synonyms (`+synonymColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		synonym.SK, synonym.SynonymUUID, synonym.Term, words, synonym.CreatedAt, synonym.UpdatedAt, synonym.Version, synonym.UpdatedBy)
+	if err != nil {
+		return err
+	}
+	return d.recordChange(q, eventName, synonym.PK, synonym.SK, synonym, oldImage)
+}
+
+func (d *Database) CreateSynonym(synonym models.Synonym) (models.Synonym, error) {
+	err := d.withTx(func(tx *sql.Tx) error {
+		old, err := d.getSynonym(tx, synonym.Term)
+		if err != nil {
+			return err
+		}
+		if old.Term != "" {
+			return errors.New("Synonym already exist")
+		}
+
+		groups, err := d.listSynonyms(tx)
+		if err != nil {
+			return err
+		}
+		err = utils.CheckSynonym(synonym, groups)
+		if err != nil {
+			return err
+		}
+
+		synonym.SynonymUUID = utils.GetUUID()
+		synonym.Version = 1
+		datetime := utils.DateString("datetime")
+		synonym.CreatedAt, synonym.UpdatedAt = datetime, datetime
+		synonym.PK = utils.GetPartitionKey(utils.SYNONYM)
+		synonym.SK = utils.GetRangeKey(utils.SYNONYM, synonym.Term, blank, blank)
+
+		return d.putSynonym(tx, synonym, old)
+	})
+	return synonym, err
+}
+
+func (d *Database) GetAllSynonyms(limit int, cursor string) ([]models.Synonym, string, error) {
+	pk := utils.GetPartitionKey(utils.SYNONYM)
+	after, err := utils.CursorRangeKey(cursor, pk)
+	if err != nil {
+		return []models.Synonym{}, "", err
+	}
+
+	synonyms, err := d.querySynonyms(d.db, `WHERE sk > ? ORDER BY sk LIMIT ?`, after, limit+1)
+	if err != nil || len(synonyms) <= limit {
+		return synonyms, "", err
+	}
+
+	synonyms = synonyms[:limit]
+	return synonyms, utils.CursorFor(pk, synonyms[limit-1].SK), nil
+}
+
+func (d *Database) ListSynonyms() ([]models.Synonym, error) {
+	return d.listSynonyms(d.db)
+}
+
+func (d *Database) GetSynonym(term string) (models.Synonym, error) {
+	return d.getSynonym(d.db, term)
+}
+
+func (d *Database) UpdateSynonym(updatedSynonym models.Synonym, term string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		old, err := d.getSynonym(tx, term)
+		if err != nil {
+			return err
+		}
+		if old.Term == "" {
+			return utils.ErrSynonymNotFound
+		}
+
+		// Version carries the If-Match version, 0 when the client sent none
+		if !utils.VersionMatches(updatedSynonym.Version, old.Version) {
+			return utils.ErrVersionConflict
+		}
+
+		synonym := old
+		synonym.Synonyms = updatedSynonym.Synonyms
+		synonym.UpdatedBy = updatedSynonym.UpdatedBy
+		groups, err := d.listSynonyms(tx)
+		if err != nil {
+			return err
+		}
+		err = utils.CheckSynonym(synonym, groups)
+		if err != nil {
+			return err
+		}
+
+		synonym.Version++
+		synonym.UpdatedAt = utils.DateString("datetime")
+		return d.putSynonym(tx, synonym, old)
+	})
+}
+
+func (d *Database) DeleteSynonym(term string, actor string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		old, err := d.getSynonym(tx, term)
+		if err != nil || old.Term == "" {
+			return err
+		}
+
+		_, err = tx.Exec(d.rebind(`DELETE FROM synonyms WHERE sk = ?`), old.SK)
+		if err != nil {
+			return err
+		}
+		return d.recordRemove(tx, old.PK, old.SK, old, actor)
+	})
+}
+
+const fieldColumns = `sk, uuid, name, type, description, required, field_values, pattern, min_value, max_value,
+	created_at, updated_at, version, updated_by`
+
+func (d *Database) queryFields(q queryer, where string, args ...interface{}) ([]models.Field, error) {
+	fields := []models.Field{}
+
+	rows, err := q.Query(d.rebind(`SELECT `+fieldColumns+` FROM fields `+where), args...)
+	if err != nil {
+		return fields, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		f := models.Field{PK: utils.GetPartitionKey(utils.FIELD)}
+		values := ""
+		if err := rows.Scan(&f.SK, &f.FieldUUID, &f.Name, &f.Type, &f.Description, &f.Required, &values, &f.Pattern, &f.Min, &f.Max,
+			&f.CreatedAt, &f.UpdatedAt, &f.Version, &f.UpdatedBy); err != nil {
+			return fields, err
+		}
+		if err := parseList(values, &f.Values); err != nil {
+			return fields, err
+		}
+		fields = append(fields, f)
+	}
+	return fields, rows.Err()
+}
+
+func (d *Database) getField(q queryer, name string) (models.Field, error) {
+	fields, err := d.queryFields(q, `WHERE sk = ?`, utils.GetRangeKey(utils.FIELD, name, blank, blank))
+	if err != nil || len(fields) == 0 {
+		return models.Field{}, err
+	}
+	return fields[0], nil
+}
+
+func (d *Database) listFields(q queryer) ([]models.Field, error) {
+	return d.queryFields(q, `ORDER BY sk`)
+}
+
+// putField replaces the field declared under the same name
+func (d *Database) putField(q queryer, field models.Field, old models.Field) error {
+	values, err := listJson(field.Values)
+	if err != nil {
+		return err
+	}
+
+	eventName := "INSERT"
+	var oldImage interface{}
+	if old.Name != "" {
+		eventName, oldImage = "MODIFY", old
+		_, err := q.Exec(d.rebind(`DELETE FROM fields WHERE sk = ?`), old.SK)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = q.Exec(d.rebind(`INSERT INTO fields (`+fieldColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		field.SK, field.FieldUUID, field.Name, field.Type, field.Description, field.Required, values, field.Pattern, field.Min, field.Max,
+		field.CreatedAt, field.UpdatedAt, field.Version, field.UpdatedBy)
+	if err != nil {
+		return err
+	}
+	return d.recordChange(q, eventName, field.PK, field.SK, field, oldImage)
+}
+
+func (d *Database) CreateField(field models.Field) (models.Field, error) {
+	err := d.withTx(func(tx *sql.Tx) error {
+		old, err := d.getField(tx, field.Name)
+		if err != nil {
+			return err
+		}
+		if old.Name != "" {
+			return errors.New("Field already exist")
+		}
+
+		err = utils.CheckField(&field)
+		if err != nil {
+			return err
+		}
+
+		field.FieldUUID = utils.GetUUID()
+		field.Version = 1
+		datetime := utils.DateString("datetime")
+		field.CreatedAt, field.UpdatedAt = datetime, datetime
+		field.PK = utils.GetPartitionKey(utils.FIELD)
+		field.SK = utils.GetRangeKey(utils.FIELD, field.Name, blank, blank)
+
+		return d.putField(tx, field, old)
+	})
+	return field, err
+}
+
+func (d *Database) GetAllFields(limit int, cursor string) ([]models.Field, string, error) {
+	pk := utils.GetPartitionKey(utils.FIELD)
+	after, err := utils.CursorRangeKey(cursor, pk)
+	if err != nil {
+		return []models.Field{}, "", err
+	}
+
+	fields, err := d.queryFields(d.db, `WHERE sk > ? ORDER BY sk LIMIT ?`, after, limit+1)
+	if err != nil || len(fields) <= limit {
+		return fields, "", err
+	}
+
+	fields = fields[:limit]
+	return fields, utils.CursorFor(pk, fields[limit-1].SK), nil
+}
+
+func (d *Database) ListFields() ([]models.Field, error) {
+	return d.listFields(d.db)
+}
+
+func (d *Database) GetField(name string) (models.Field, error) {
+	return d.getField(d.db, name)
+}
+
+func (d *Database) UpdateField(updatedField models.Field, name string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		old, err := d.getField(tx, name)
+		if err != nil {
+			return err
+		}
+		if old.Name == "" {
+			return utils.ErrFieldNotFound
+		}
+
+		// Version carries the If-Match version, 0 when the client sent none
+		if !utils.VersionMatches(updatedField.Version, old.Version) {
+			return utils.ErrVersionConflict
+		}
+
+		field, err := utils.UpdatedField(old, updatedField)
+		if err != nil {
+			return err
+		}
+
+		services, err := d.queryServices(tx, ``)
+		if err != nil {
+			return err
+		}
+		if refs := utils.BrokenConstraints(services, old, field); len(refs) > 0 {
+			return &utils.ConstraintError{Field: name, References: refs}
+		}
+
+		field.Version++
+		field.UpdatedAt = utils.DateString("datetime")
+		return d.putField(tx, field, old)
+	})
+}
+
+func (d *Database) DeleteField(name string, cascade bool, actor string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		old, err := d.getField(tx, name)
+		if err != nil || old.Name == "" {
+			return err
+		}
+
+		services, err := d.queryServices(tx, `WHERE attributes <> ''`)
+		if err != nil {
+			return err
+		}
+		rules, err := d.queryRules(tx, ``)
+		if err != nil {
+			return err
+		}
+
+		if refs := utils.FieldReferences(services, rules, name); !cascade && len(refs) > 0 {
+			return &utils.ReferencedError{Entity: "field " + name, References: refs}
+		}
+
+		for _, service := range services {
+			if _, ok := service.Attributes[name]; !ok {
+				continue
+			}
+			delete(service.Attributes, name)
+			service.Version++
+			service.UpdatedBy = utils.SYSTEM_ACTOR
+			if err := d.putService(tx, service); err != nil {
+				return err
+			}
+		}
+
+		for _, rule := range rules {
+			if !utils.ContainsField(rule, name) {
+				continue
+			}
+			if err := d.removeRule(tx, rule.RuleUUID, actor); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(d.rebind(`DELETE FROM fields WHERE sk = ?`), old.SK)
+		if err != nil {
+			return err
+		}
+		return d.recordRemove(tx, old.PK, old.SK, old, actor)
+	})
+}
+
+func (d *Database) SubscriberCount(serviceUUID string) (int, error) {
+	return d.subscriberCount(d.db, serviceUUID)
+}
+
+// subscriberCount returns the number of companies subscribed to serviceUUID
+func (d *Database) subscriberCount(q queryer, serviceUUID string) (int, error) {
+	count := 0
+	err := q.QueryRow(d.rebind(`SELECT COUNT(DISTINCT company_uuid) FROM company_services WHERE service_uuid = ?`), serviceUUID).Scan(&count)
+	return count, err
+}
+
+func (d *Database) MatchingRules(streamData models.StreamData, rules []models.RuleResponse) ([]models.RuleResponse, error) {
+	return d.matchingRules(d.db, streamData, rules)
+}
+
+// matchingRules evaluates the rule expressions on one env, the subscriber count is only queried when one reads it
+func (d *Database) matchingRules(q queryer, streamData models.StreamData, rules []models.RuleResponse) ([]models.RuleResponse, error) {
+	env := utils.ServiceFields(streamData, func() (int, error) {
+		return d.subscriberCount(q, streamData.UUID)
+	}, func() ([]models.Synonym, error) {
+		return d.listSynonyms(q)
+	}, func() ([]models.Field, error) {
+		return d.listFields(q)
+	})
+	return utils.MatchingRules(rules, env)
+}
+
+// execute when new service is created, here streamData contains service data
+func (d *Database) AttachTagWithService(streamData models.StreamData, rules []models.RuleResponse) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		return d.attachTagWithService(tx, streamData, rules)
+	})
+}
+
+func (d *Database) attachTagWithService(q queryer, streamData models.StreamData, rules []models.RuleResponse) error {
+	matched, err := d.matchingRules(q, streamData, rules)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range matched {
+		err = d.updateTagToService(q, streamData.UUID, rule)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateTagToService appends the rule tag to the stored service unless it is already present
+func (d *Database) updateTagToService(q queryer, serviceUUID string, rule models.RuleResponse) error {
+	service, err := d.getServiceByUUID(q, serviceUUID)
+	if err != nil || service.ServiceName == "" {
+		return err
+	}
+
+	cat := utils.RuleCategory(rule, utils.DateString("datetime"))
+	if utils.IsTagAlreadyPresent(service.Category, cat) {
+		return nil
+	}
+
+	service.Category = append(service.Category, cat)
+	service.Version++
+	service.UpdatedBy = utils.SYSTEM_ACTOR
+	return d.putService(q, service)
+}
+
+func (d *Database) SyncRuleTags(serviceUUID string, rules []models.RuleResponse) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		service, err := d.getServiceByUUID(tx, serviceUUID)
+		if err != nil || service.ServiceName == "" {
+			return err
+		}
+
+		matched, err := d.matchingRules(tx, utils.ServiceToStreamDataConversion(service), rules)
+		if err != nil {
+			return err
+		}
+		return d.applyRuleTags(tx, service, matched)
+	})
+}
+
+func (d *Database) ApplyRuleTags(service models.ServiceResponse, matched []models.RuleResponse) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		stored, err := d.getServiceByUUID(tx, service.ServiceUUID)
+		if err != nil || stored.ServiceName == "" {
+			return err
+		}
+
+		if stored.Version != service.Version {
+			fmt.Printf("service changed while syncing tags : %v\n", service.ServiceUUID)
+			return nil
+		}
+		return d.applyRuleTags(tx, stored, matched)
+	})
+}
+
+func (d *Database) applyRuleTags(q queryer, service models.ServiceResponse, matched []models.RuleResponse) error {
+	tags, err := d.listTags(q)
+	if err != nil {
+		return err
+	}
+
+	category, changed := utils.SyncServiceTags(service.Category, matched, utils.NewTagTree(tags))
+	if !changed {
+		return nil
+	}
+
+	service.Category = category
+	service.Version++
+	service.UpdatedBy = utils.SYSTEM_ACTOR
+	return d.putService(q, service)
+}
+
+// execute when new rule is created, here streamData contains rule
+func (d *Database) ProcessRuleForServices(streamData models.StreamData, services []models.ServiceResponse) error {
+	rule := utils.StreamDataToRuleConversion(streamData)
+	rules := []models.RuleResponse{rule}
+
+	return d.withTx(func(tx *sql.Tx) error {
+		for _, service := range services {
+			err := d.attachTagWithService(tx, utils.ServiceToStreamDataConversion(service), rules)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// here stream data contains company data
+func (d *Database) UpdateServiceTagForSubscriberCount(streamData models.StreamData, rules []models.RuleResponse) error {
+	subscriptionRules := make([]models.RuleResponse, 0)
+	for _, rule := range rules {
+		if rule.Operation == utils.SUBSCRIPTION_COUNT {
+			subscriptionRules = append(subscriptionRules, rule)
+		}
+	}
+
+	if len(subscriptionRules) == 0 {
+		return nil
+	}
+
+	return d.withTx(func(tx *sql.Tx) error {
+		for _, serviceUUID := range streamData.ServiceList {
+			// check if this service is subscribe for more than subscription threshold
+			matched, err := d.matchingRules(tx, models.StreamData{UUID: serviceUUID}, subscriptionRules)
+			if err != nil {
+				return err
+			}
+
+			for _, rule := range matched {
+				err = d.updateTagToService(tx, serviceUUID, rule)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (d *Database) RemoveServiceReferences(serviceUUID string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		companies, err := d.subscribedCompanies(tx, serviceUUID)
+		if err != nil {
+			return err
+		}
+		return d.detachService(tx, companies, serviceUUID)
+	})
+}
+
+func (d *Database) subscribedCompanies(q queryer, serviceUUID string) ([]models.Company, error) {
+	return d.queryCompanies(q, `WHERE uuid IN (SELECT company_uuid FROM company_services WHERE service_uuid = ?)`, serviceUUID)
+}
+
+// detachService drops the service from the service lists of its subscribed companies
+func (d *Database) detachService(q queryer, companies []models.Company, serviceUUID string) error {
+	for _, company := range companies {
+		company.ServiceList, _ = utils.RemoveServiceUUID(company.ServiceList, serviceUUID)
+		company.Version++
+		company.UpdatedBy = utils.SYSTEM_ACTOR
+		err := d.putCompany(q, company)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Database) RemoveTagReferences(key string, value string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		services, rules, children, err := d.tagReferences(tx, key, value)
+		if err != nil {
+			return err
+		}
+		return d.detachTag(tx, services, rules, children, key, value, utils.SYSTEM_ACTOR)
+	})
+}
+
+// tagReferences reads the services carrying key:value, the rules assigning it and the tags below or replaced by it
+func (d *Database) tagReferences(q queryer, key string, value string) ([]models.ServiceResponse, []models.RuleResponse, []models.TagResponse, error) {
+	services, err := d.queryServices(q, `WHERE uuid IN (SELECT service_uuid FROM service_tags WHERE LOWER(tag_key) = LOWER(?) AND LOWER(tag_value) = LOWER(?))`, key, value)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	rules, err := d.queryRules(q, `WHERE LOWER(tag_key) = LOWER(?) AND LOWER(tag_value) = LOWER(?)`, key, value)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	tags, err := d.listTags(q)
+	return services, rules, utils.NewTagTree(tags).Dependents(key, value), err
+}
+
+// detachTag untags the services, deletes the rules and unlinks the dependent tags found by tagReferences
+func (d *Database) detachTag(q queryer, services []models.ServiceResponse, rules []models.RuleResponse, dependents []models.TagResponse, key string, value string, actor string) error {
+	for _, tag := range dependents {
+		err := d.putTagFields(q, tag, utils.SYSTEM_ACTOR)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, service := range services {
+		service.Category, _ = utils.RemoveCategory(service.Category, key, value)
+		service.Version++
+		service.UpdatedBy = utils.SYSTEM_ACTOR
+		err := d.putService(q, service)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range rules {
+		err := d.removeRule(q, rule.RuleUUID, actor)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsUUIDInUse reports whether a service, company or rule is stored under uuid
+func (d *Database) IsUUIDInUse(uuid string) (bool, error) {
+	count := 0
+	err := d.db.QueryRow(d.rebind(`SELECT (SELECT COUNT(*) FROM services WHERE uuid = ?)
+		+ (SELECT COUNT(*) FROM companies WHERE uuid = ?)
+		+ (SELECT COUNT(*) FROM rules WHERE uuid = ?)`), uuid, uuid, uuid).Scan(&count)
+	return count > 0, err
+}
+
+// AddHistory stores a history item, a redelivered change is ignored.
+// History is not an entity change and is not recorded in the change feed.
+func (d *Database) AddHistory(history models.History) error {
+	before, err := imageJson(history.Before)
+	if err != nil {
+		return err
+	}
+
+	after, err := imageJson(history.After)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec(d.rebind(`INSERT INTO history (entity_uuid, sequence, entity, operation, actor, changed_at, before_image, after_image)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (entity_uuid, sequence) DO NOTHING`),
+		history.EntityUUID, history.Sequence, history.Entity, history.Operation, history.Actor, history.Timestamp, before, after)
+	return err
+}
+
+func (d *Database) GetHistory(entityUUID string, limit int, cursor string) ([]models.History, string, error) {
+	history := []models.History{}
+
+	pk := utils.GetPartitionKey(utils.HISTORY)
+	after, err := utils.CursorRangeKey(cursor, pk)
+	if err != nil {
+		return history, "", err
+	}
+	prefix := utils.GetRangeKey(utils.HISTORY, entityUUID, blank, blank)
+	afterSequence := strings.TrimPrefix(after, prefix)
+
+	// one extra row tells whether a next page exists
+	rows, err := d.db.Query(d.rebind(`SELECT entity_uuid, sequence, entity, operation, actor, changed_at, before_image, after_image
+		FROM history WHERE entity_uuid = ? AND sequence > ? ORDER BY sequence LIMIT ?`), entityUUID, afterSequence, limit+1)
+	if err != nil {
+		return history, "", err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		h := models.History{}
+		var before, after sql.NullString
+		err := rows.Scan(&h.EntityUUID, &h.Sequence, &h.Entity, &h.Operation, &h.Actor, &h.Timestamp, &before, &after)
+		if err != nil {
+			return history, "", err
+		}
+
+		if before.Valid {
+			if err := json.Unmarshal([]byte(before.String), &h.Before); err != nil {
+				return history, "", err
+			}
+		}
+		if after.Valid {
+			if err := json.Unmarshal([]byte(after.String), &h.After); err != nil {
+				return history, "", err
+			}
+		}
+
+		h.PK = pk
+		h.SK = utils.GetRangeKey(utils.HISTORY, h.EntityUUID, h.Sequence, blank)
+		history = append(history, h)
+	}
+	if err := rows.Err(); err != nil || len(history) <= limit {
+		return history, "", err
+	}
+
+	history = history[:limit]
+	return history, utils.CursorFor(pk, history[limit-1].SK), nil
+}
+
+// PutBackfillJob upserts the job while the stored one is still at job.Version, jobs are
+// not recorded in the change feed
+func (d *Database) PutBackfillJob(job models.BackfillJob) error {
+	changes, err := imageJson(job.Changes)
+	if err != nil {
+		return err
+	}
+
+	result, err := d.db.Exec(d.rebind(`INSERT INTO backfill_jobs (job_id, status, dry_run, checkpoint, processed, changed, changes, error,
+		lease_until, created_at, updated_at, version, updated_by) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (job_id) DO UPDATE SET status = excluded.status, checkpoint = excluded.checkpoint, processed = excluded.processed,
+		changed = excluded.changed, changes = excluded.changes, error = excluded.error, lease_until = excluded.lease_until,
+		updated_at = excluded.updated_at, version = excluded.version, updated_by = excluded.updated_by
+		WHERE backfill_jobs.version = ?`),
+		job.JobID, job.Status, job.DryRun, job.Cursor, job.Processed, job.Changed, changes, job.Error,
+		job.LeaseUntil, job.CreatedAt, job.UpdatedAt, job.Version+1, job.UpdatedBy, job.Version)
+	if err != nil {
+		return err
+	}
+
+	// the update is skipped when another save came first
+	saved, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if saved == 0 {
+		return utils.ErrVersionConflict
+	}
+	return nil
+}
+
+func (d *Database) GetBackfillJob(jobID string) (models.BackfillJob, error) {
+	job := models.BackfillJob{}
+	var changes sql.NullString
+
+	err := d.db.QueryRow(d.rebind(`SELECT job_id, status, dry_run, checkpoint, processed, changed, changes, error, lease_until,
+		created_at, updated_at, version, updated_by FROM backfill_jobs WHERE job_id = ?`), jobID).Scan(&job.JobID, &job.Status, &job.DryRun,
+		&job.Cursor, &job.Processed, &job.Changed, &changes, &job.Error, &job.LeaseUntil, &job.CreatedAt, &job.UpdatedAt, &job.Version,
+		&job.UpdatedBy)
+	if err == sql.ErrNoRows {
+		return models.BackfillJob{}, nil
+	}
+	if err != nil {
+		return job, err
+	}
+
+	if changes.Valid {
+		if err := json.Unmarshal([]byte(changes.String), &job.Changes); err != nil {
+			return job, err
+		}
+	}
+
+	job.PK = utils.GetPartitionKey(utils.BACKFILL)
+	job.SK = utils.GetRangeKey(utils.BACKFILL, blank, blank, job.JobID)
+	return job, nil
+}
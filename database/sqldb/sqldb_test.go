@@ -0,0 +1,138 @@
+package sqldb
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/auto-tagging-mds/database/models"
+	"github.com/auto-tagging-mds/utils"
+)
+
+// testDSNs returns the databases the tests run on, a PostgreSQL one when
+// SQLDB_TEST_POSTGRES_DSN is set. SQLite transactions of different connections
+// take the write lock when they begin, so that they wait for each other.
+func testDSNs(t *testing.T) map[string]string {
+	dsns := map[string]string{
+		"sqlite": "file:" + filepath.Join(t.TempDir(), "mds.db") + "?_pragma=busy_timeout(5000)&_txlock=immediate",
+	}
+	if dsn := os.Getenv("SQLDB_TEST_POSTGRES_DSN"); dsn != "" {
+		dsns["postgres"] = dsn
+	}
+	return dsns
+}
+
+func openTest(t *testing.T, driver, dsn string) *Database {
+	t.Helper()
+	db, err := New(driver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestChangeFeedWritersCommitOutOfOrder(t *testing.T) {
+	for driver, dsn := range testDSNs(t) {
+		t.Run(driver, func(t *testing.T) {
+			first := openTest(t, driver, dsn)
+			second := openTest(t, driver, dsn)
+			reader := openTest(t, driver, dsn)
+
+			_, start, err := reader.ChangeEvent(0, 1000000)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the first writer records its change and commits last
+			tx, err := first.db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+			err = first.recordChange(tx, "INSERT", "TG", "TG#first", map[string]string{"key": "first"}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				done <- second.withTx(func(tx *sql.Tx) error {
+					return second.recordChange(tx, "INSERT", "TG", "TG#second", map[string]string{"key": "second"}, nil)
+				})
+			}()
+
+			// the second writer may not commit a change the reader sees before the first one
+			select {
+			case err := <-done:
+				t.Fatalf("second writer committed before the first one, error %v", err)
+			case <-time.After(200 * time.Millisecond):
+			}
+			event, _, err := reader.ChangeEvent(start, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(event.Records) != 0 {
+				t.Fatalf("records %v visible before the first writer committed", event.Records)
+			}
+
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+
+			event, _, err = reader.ChangeEvent(start, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(event.Records) != 2 || *event.Records[0].Change.Keys[utils.GetRangeKeyName()].S != "TG#first" ||
+				*event.Records[1].Change.Keys[utils.GetRangeKeyName()].S != "TG#second" {
+				t.Errorf("records %v, want the first change then the second", event.Records)
+			}
+		})
+	}
+}
+
+func TestPutBackfillJobVersion(t *testing.T) {
+	for driver, dsn := range testDSNs(t) {
+		t.Run(driver, func(t *testing.T) {
+			db := openTest(t, driver, dsn)
+
+			job := models.BackfillJob{JobID: utils.GetUUID(), Status: "pending"}
+			if err := db.PutBackfillJob(job); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.PutBackfillJob(job); err != utils.ErrVersionConflict {
+				t.Fatalf("second save of a new job got %v, want a version conflict", err)
+			}
+
+			stored, err := db.GetBackfillJob(job.JobID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Version != 1 {
+				t.Fatalf("stored at version %v, want 1", stored.Version)
+			}
+
+			stored.Status = "running"
+			if err := db.PutBackfillJob(stored); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.PutBackfillJob(stored); err != utils.ErrVersionConflict {
+				t.Fatalf("save of a stale job got %v, want a version conflict", err)
+			}
+
+			stored, err = db.GetBackfillJob(job.JobID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Version != 2 || stored.Status != "running" {
+				t.Fatalf("stored %v at version %v, want running at 2", stored.Status, stored.Version)
+			}
+		})
+	}
+}
@@ -0,0 +1,359 @@
+package ruleexpr
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Type int
+
+const (
+	String Type = iota + 1
+	Number
+	Date
+)
+
+func (t Type) String() string {
+	switch t {
+	case String:
+		return "string"
+	case Number:
+		return "number"
+	case Date:
+		return "date"
+	}
+	return "unknown"
+}
+
+// Value is a field value or an operand, a date keeps its text in Str and its
+// seconds since the epoch in Num
+type Value struct {
+	Type Type
+	Str  string
+	Num  float64
+}
+
+func StringValue(s string) Value {
+	return Value{Type: String, Str: s}
+}
+
+func NumberValue(n float64) Value {
+	return Value{Type: Number, Num: n}
+}
+
+// dateLayouts are the formats ParseDate accepts. They carry no time zone, dates
+// compare as written.
+var dateLayouts = []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"}
+
+// ParseDate reads a date or a date and time
+func ParseDate(s string) (Value, error) {
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, strings.TrimSpace(s)); err == nil {
+			return DateValue(t), nil
+		}
+	}
+	return Value{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD or YYYY-MM-DD hh:mm:ss", s)
+}
+
+func DateValue(t time.Time) Value {
+	text := t.Format("2006-01-02 15:04:05")
+	if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 {
+		text = t.Format("2006-01-02")
+	}
+	return Value{Type: Date, Str: text, Num: float64(t.Unix())}
+}
+
+func (v Value) String() string {
+	if v.Type == Number {
+		return strconv.FormatFloat(v.Num, 'f', -1, 64)
+	}
+	// only \ and " need escaping for Parse to read it back
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v.Str) + `"`
+}
+
+// Schema maps the field names an expression may use to their type
+type Schema map[string]Type
+
+// Env supplies field values while an expression is evaluated
+type Env interface {
+	Field(name string) (Value, error)
+}
+
+// Compile parses src and checks it against schema
+func Compile(src string, schema Schema) (Node, error) {
+	node, err := Parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := Check(node, schema); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// Check verifies every field exists in schema and every operator is applied to
+// operands of the right type. The string operands of date fields become dates.
+func Check(node Node, schema Schema) error {
+	switch n := node.(type) {
+	case *Logical:
+		if err := Check(n.Left, schema); err != nil {
+			return err
+		}
+		return Check(n.Right, schema)
+
+	case *Not:
+		return Check(n.X, schema)
+
+	case *Literal:
+		return nil
+
+	case *Comparison:
+		fieldType, ok := schema[n.Field]
+		if !ok {
+			return errorAt(n.pos, fmt.Sprintf("unknown field %v", n.Field))
+		}
+
+		switch n.Op {
+		case "between", "in":
+			if n.Op == "between" && fieldType == String {
+				return errorAt(n.pos, fmt.Sprintf("operator between needs a number or date field, %v is a %v", n.Field, fieldType))
+			}
+			for i := range n.Values {
+				value, err := n.typed(n.Values[i], fieldType)
+				if err != nil {
+					return err
+				}
+				n.Values[i] = value
+			}
+			if n.Op == "between" && n.Values[0].Num > n.Values[1].Num {
+				return errorAt(n.pos, fmt.Sprintf("between %v and %v is empty, the low bound comes first", n.Values[0], n.Values[1]))
+			}
+			return nil
+		}
+
+		switch n.Op {
+		case "=", "!=":
+		case "<", "<=", ">", ">=":
+			if fieldType == String {
+				return errorAt(n.pos, fmt.Sprintf("operator %v needs a number or date field, %v is a %v", n.Op, n.Field, fieldType))
+			}
+		case "contains", "contains_word", "contains_phrase", "contains_prefix", "matches", "resembles":
+			if fieldType != String {
+				return errorAt(n.pos, fmt.Sprintf("operator %v needs a string field, %v is a %v", n.Op, n.Field, fieldType))
+			}
+			if n.Op == "matches" {
+				if _, err := CompileRegexp(n.Operand.Str); err != nil {
+					return errorAt(n.pos, fmt.Sprintf("invalid regular expression %v : %v", n.Operand, err))
+				}
+			}
+			if n.Op == "resembles" && (n.Threshold <= 0 || n.Threshold > 1) {
+				return errorAt(n.pos, fmt.Sprintf("threshold of resembles must be above 0 and at most 1, got %v", NumberValue(n.Threshold)))
+			}
+		default:
+			return errorAt(n.pos, fmt.Sprintf("unknown operator %v", n.Op))
+		}
+
+		operand, err := n.typed(n.Operand, fieldType)
+		if err != nil {
+			return err
+		}
+		n.Operand = operand
+		return nil
+	}
+	return errors.New("invalid expression")
+}
+
+// typed checks an operand against the type of the field, the string operand of a
+// date field is read as a date
+func (n *Comparison) typed(operand Value, fieldType Type) (Value, error) {
+	if fieldType == Date && operand.Type == String {
+		date, err := ParseDate(operand.Str)
+		if err != nil {
+			return operand, errorAt(n.pos, err.Error())
+		}
+		return date, nil
+	}
+	if operand.Type != fieldType {
+		return operand, errorAt(n.pos, fmt.Sprintf("%v is a %v, cannot compare it with %v", n.Field, fieldType, operand))
+	}
+	return operand, nil
+}
+
+// Eval evaluates a checked expression. and / or short-circuit, so fields on the other side are not read.
+func Eval(node Node, env Env) (bool, error) {
+	switch n := node.(type) {
+	case *Logical:
+		left, err := Eval(n.Left, env)
+		if err != nil {
+			return false, err
+		}
+		if n.Op == "and" && !left || n.Op == "or" && left {
+			return left, nil
+		}
+		return Eval(n.Right, env)
+
+	case *Not:
+		x, err := Eval(n.X, env)
+		return !x, err
+
+	case *Literal:
+		return n.Value, nil
+
+	case *Comparison:
+		_, result, err := n.eval(env)
+		return result, err
+	}
+	return false, errors.New("invalid expression")
+}
+
+// eval reads the field of a comparison and tests it against the operand, then
+// against the synonyms of the operand when env is a Thesaurus
+func (n *Comparison) eval(env Env) (Value, bool, error) {
+	value, err := env.Field(n.Field)
+	if err != nil {
+		return value, false, err
+	}
+
+	result, err := n.compare(value, n.Operand)
+	if err != nil || result {
+		return value, result, err
+	}
+
+	thesaurus, ok := env.(Thesaurus)
+	if !ok || value.Type != String || !textOperators[n.Op] || n.Op == "matches" {
+		return value, false, nil
+	}
+	synonyms, err := thesaurus.Synonyms(n.Operand.Str)
+	if err != nil {
+		return value, false, err
+	}
+	for _, synonym := range synonyms {
+		result, err := n.compare(value, StringValue(synonym))
+		if err != nil || result {
+			return value, result, err
+		}
+	}
+	return value, false, nil
+}
+
+// compare is Compare with the threshold of a resembles comparison and the
+// operand lists of between and in
+func (n *Comparison) compare(value Value, operand Value) (bool, error) {
+	switch n.Op {
+	case "resembles":
+		if value.Type == String && operand.Type == String {
+			return compareText(n.Op, value, operand, n.Threshold)
+		}
+	case "between":
+		low, err := Compare(value, ">=", n.Values[0])
+		if err != nil || !low {
+			return false, err
+		}
+		return Compare(value, "<=", n.Values[1])
+	case "in":
+		for _, v := range n.Values {
+			result, err := Compare(value, "=", v)
+			if err != nil || result {
+				return result, err
+			}
+		}
+		return false, nil
+	}
+	return Compare(value, n.Op, operand)
+}
+
+// Compare applies op to a field value and an operand, strings compare
+// case-insensitively and dates by their time
+func Compare(value Value, op string, operand Value) (bool, error) {
+	if value.Type != operand.Type {
+		return false, errors.New(fmt.Sprintf("cannot compare %v with %v", value.Type, operand.Type))
+	}
+
+	if value.Type == String {
+		if textOperators[op] {
+			return compareText(op, value, operand, DefaultThreshold)
+		}
+
+		v, o := strings.ToLower(value.Str), strings.ToLower(operand.Str)
+		switch op {
+		case "=":
+			return v == o, nil
+		case "!=":
+			return v != o, nil
+		}
+		return false, errors.New(fmt.Sprintf("operator %v is not defined on strings", op))
+	}
+
+	v, o := value.Num, operand.Num
+	switch op {
+	case "=":
+		return v == o, nil
+	case "!=":
+		return v != o, nil
+	case "<":
+		return v < o, nil
+	case "<=":
+		return v <= o, nil
+	case ">":
+		return v > o, nil
+	case ">=":
+		return v >= o, nil
+	}
+	return false, errors.New(fmt.Sprintf("operator %v is not defined on %vs", op, value.Type))
+}
+
+// Step is the outcome of one comparison of a traced evaluation
+type Step struct {
+	Field   string
+	Value   Value
+	Op      string
+	Operand Value
+	Values  []Value // operands of between and in
+	Result  bool
+}
+
+// Trace evaluates a checked expression like Eval but without short-circuiting,
+// returning the step of every comparison in source order
+func Trace(node Node, env Env) (bool, []Step, error) {
+	steps := make([]Step, 0)
+	result, err := trace(node, env, &steps)
+	return result, steps, err
+}
+
+func trace(node Node, env Env, steps *[]Step) (bool, error) {
+	switch n := node.(type) {
+	case *Logical:
+		left, err := trace(n.Left, env, steps)
+		if err != nil {
+			return false, err
+		}
+		right, err := trace(n.Right, env, steps)
+		if err != nil {
+			return false, err
+		}
+		if n.Op == "and" {
+			return left && right, nil
+		}
+		return left || right, nil
+
+	case *Not:
+		x, err := trace(n.X, env, steps)
+		return !x, err
+
+	case *Literal:
+		return n.Value, nil
+
+	case *Comparison:
+		value, result, err := n.eval(env)
+		if err != nil {
+			return false, err
+		}
+		*steps = append(*steps, Step{Field: n.Field, Value: value, Op: n.Op, Operand: n.Operand, Values: n.Values, Result: result})
+		return result, nil
+	}
+	return false, errors.New("invalid expression")
+}
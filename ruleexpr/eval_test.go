@@ -0,0 +1,199 @@
+package ruleexpr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fields is an Env reading a fixed set of values
+type fields map[string]Value
+
+func (f fields) Field(name string) (Value, error) {
+	value, ok := f[name]
+	if !ok {
+		return Value{}, fmt.Errorf("unknown field %v", name)
+	}
+	return value, nil
+}
+
+// thesaurusFields is fields with a synonym dictionary
+type thesaurusFields struct {
+	fields
+	groups map[string][]string
+}
+
+func (f thesaurusFields) Synonyms(term string) ([]string, error) {
+	return f.groups[term], nil
+}
+
+var testSchema = Schema{"description": String, "like": Number, "created_at": Date}
+
+func TestEval(t *testing.T) {
+	created, _ := ParseDate("2024-03-01")
+	env := fields{"description": StringValue("Managed Kubernetes on AWS"), "like": NumberValue(12), "created_at": created}
+
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{src: `description contains "kubernetes"`, want: true},
+		{src: `description contains "azure"`, want: false},
+		{src: `description contains_word "kube"`, want: false},
+		{src: `description contains_prefix "kube"`, want: true},
+		{src: `description contains_phrase "kubernetes on aws"`, want: true},
+		{src: `description matches "^kubernetes"`, want: false},
+		{src: `description matches "^managed\\s"`, want: true},
+		{src: `description resembles "kubernets"`, want: true},
+		{src: `description resembles "kubelet" 0.95`, want: false},
+		{src: `like > 10 and like <= 12`, want: true},
+		{src: `like = 3 or description contains "aws"`, want: true},
+		{src: `not like != 12`, want: true},
+		{src: `not (description contains "aws" and like < 20)`, want: false},
+		{src: `like between 1 and 5 or description contains "aws"`, want: true},
+		{src: `not like in (1, 2, 12)`, want: false},
+		{src: `created_at >= "2024-01-01"`, want: true},
+		{src: `created_at < "2024-03-01 00:00:00"`, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			node, err := Compile(tt.src, testSchema)
+			if err != nil {
+				t.Fatalf("compile: %v", err)
+			}
+			got, err := Eval(node, env)
+			if err != nil {
+				t.Fatalf("eval: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalSynonyms(t *testing.T) {
+	env := thesaurusFields{
+		fields: fields{"description": StringValue("Managed Kubernetes on AWS")},
+		groups: map[string][]string{"k8s": {"kubernetes"}},
+	}
+
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{src: `description contains "k8s"`, want: true},
+		{src: `description contains_word "k8s"`, want: true},
+		{src: `description matches "k8s"`, want: false},
+		{src: `description contains "eks"`, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			node, err := Compile(tt.src, testSchema)
+			if err != nil {
+				t.Fatalf("compile: %v", err)
+			}
+			got, err := Eval(node, env)
+			if err != nil {
+				t.Fatalf("eval: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []string{
+		`description contains`,
+		`unknown = "x"`,
+		`like contains "x"`,
+		`description > 3`,
+		`description matches "("`,
+		`description resembles "aws" 2`,
+		`(like > 1`,
+		`created_at = "yesterday"`,
+		`like in ("a")`,
+	}
+
+	for _, src := range tests {
+		t.Run(src, func(t *testing.T) {
+			if _, err := Compile(src, testSchema); err == nil {
+				t.Errorf("compiled, want an error")
+			}
+		})
+	}
+}
+
+func TestStringParsesBack(t *testing.T) {
+	tests := []string{
+		`description contains "say \"hi\"" or like != 3`,
+		`not (like < 1 or like > 9) and description matches "^a\\d+$"`,
+		`created_at between "2024-01-01" and "2024-12-31 23:59:59"`,
+	}
+
+	for _, src := range tests {
+		t.Run(src, func(t *testing.T) {
+			node, err := Compile(src, testSchema)
+			if err != nil {
+				t.Fatalf("compile: %v", err)
+			}
+			again, err := Compile(node.String(), testSchema)
+			if err != nil {
+				t.Fatalf("compile %v: %v", node.String(), err)
+			}
+			if again.String() != node.String() {
+				t.Errorf("%v reads back as %v", node.String(), again.String())
+			}
+		})
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	// identifiers may hold any letter
+	node, err := Parse(`déploiement contains "cloud"`)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if fields := Fields(node); len(fields) != 1 || fields[0] != "déploiement" {
+		t.Errorf("fields %v, want déploiement", fields)
+	}
+
+	nested := strings.Repeat("(", MaxDepth) + "like > 1" + strings.Repeat(")", MaxDepth)
+	if _, err := Parse(nested); err != nil {
+		t.Errorf("%v levels: %v", MaxDepth, err)
+	}
+	if _, err := Parse("(" + nested + ")"); err == nil {
+		t.Errorf("%v levels parsed, want an error", MaxDepth+1)
+	}
+	if _, err := Parse(strings.Repeat("not ", MaxDepth+1) + "like > 1"); err == nil {
+		t.Errorf("%v nots parsed, want an error", MaxDepth+1)
+	}
+}
+
+func TestRegexpCacheIsBounded(t *testing.T) {
+	first, err := CompileRegexp("^first$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2*MaxCachedRegexps; i++ {
+		if _, err := CompileRegexp("pattern" + strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+		// a pattern in use stays cached
+		if again, _ := CompileRegexp("^first$"); again != first {
+			t.Fatalf("^first$ compiled again after %v patterns", i)
+		}
+	}
+
+	regexps.mu.Lock()
+	cached := regexps.order.Len()
+	regexps.mu.Unlock()
+	if cached != MaxCachedRegexps {
+		t.Errorf("%v patterns cached, want %v", cached, MaxCachedRegexps)
+	}
+}
@@ -0,0 +1,156 @@
+package ruleexpr
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+	tokenLParen
+	tokenRParen
+	tokenComma
+)
+
+type token struct {
+	kind tokenKind
+	text string // identifier, operator, number text or unquoted string
+	pos  int    // byte offset in the source, used in error messages
+}
+
+// keywords are matched case-insensitively and cannot be used as field names
+var keywords = map[string]bool{
+	"and":             true,
+	"or":              true,
+	"not":             true,
+	"true":            true,
+	"false":           true,
+	"contains":        true,
+	"contains_word":   true,
+	"contains_phrase": true,
+	"contains_prefix": true,
+	"matches":         true,
+	"resembles":       true,
+	"between":         true,
+	"in":              true,
+}
+
+// IsKeyword reports whether name is reserved by the expression language
+func IsKeyword(name string) bool {
+	return keywords[strings.ToLower(name)]
+}
+
+func lex(src string) ([]token, error) {
+	tokens := make([]token, 0)
+	i := 0
+	for i < len(src) {
+		// identifiers and spaces may be any letter, the other tokens are ASCII
+		c, size := utf8.DecodeRuneInString(src[i:])
+		switch {
+		case unicode.IsSpace(c):
+			i += size
+
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "(", pos: i})
+			i++
+
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")", pos: i})
+			i++
+
+		case c == ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ",", pos: i})
+			i++
+
+		case c == '"' || c == '\'':
+			text, next, err := lexString(src, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenString, text: text, pos: i})
+			i = next
+
+		case c >= '0' && c <= '9' || c == '.' || c == '-':
+			start := i
+			i++
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: src[start:i], pos: start})
+
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(src) {
+				r, n := utf8.DecodeRuneInString(src[i:])
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				i += n
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: src[start:i], pos: start})
+
+		case strings.ContainsRune("=!<>", c):
+			start := i
+			i++
+			if i < len(src) && src[i] == '=' {
+				i++
+			}
+			op := src[start:i]
+			if op == "!" {
+				return nil, errorAt(start, "unknown operator !, use != or not")
+			}
+			if op == "==" {
+				op = "="
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: op, pos: start})
+
+		default:
+			return nil, errorAt(i, fmt.Sprintf("unexpected character %q", c))
+		}
+	}
+	tokens = append(tokens, token{kind: tokenEOF, pos: len(src)})
+	return tokens, nil
+}
+
+// lexString reads the quoted string starting at src[start], \ escapes the next character
+func lexString(src string, start int) (string, int, error) {
+	quote := src[start]
+	var b strings.Builder
+	for i := start + 1; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			if i+1 == len(src) {
+				return "", 0, errorAt(start, "unterminated string")
+			}
+			i++
+			b.WriteByte(src[i])
+		case quote:
+			return b.String(), i + 1, nil
+		default:
+			b.WriteByte(src[i])
+		}
+	}
+	return "", 0, errorAt(start, "unterminated string")
+}
+
+// Error is a syntax or type error at a byte offset of an expression
+type Error struct {
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("invalid expression : position %v : %v", e.Pos, e.Msg)
+}
+
+func errorAt(pos int, msg string) error {
+	return &Error{Pos: pos, Msg: msg}
+}
@@ -0,0 +1,324 @@
+package ruleexpr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Node is a parsed expression: *Logical, *Not, *Literal or *Comparison
+type Node interface {
+	String() string
+}
+
+// Logical joins two expressions with and / or
+type Logical struct {
+	Op    string // and|or
+	Left  Node
+	Right Node
+}
+
+type Not struct {
+	X Node
+}
+
+// Literal is the constant true or false
+type Literal struct {
+	Value bool
+}
+
+// Comparison tests a service field against a constant
+type Comparison struct {
+	Field     string
+	Op        string // =|!=|<|<=|>|>=|contains|contains_word|contains_phrase|contains_prefix|matches|resembles|between|in
+	Operand   Value
+	Values    []Value // low and high bound of between, candidates of in
+	Threshold float64 // similarity resembles needs, between 0 and 1
+	pos       int
+}
+
+func (n *Logical) String() string {
+	return "(" + n.Left.String() + " " + n.Op + " " + n.Right.String() + ")"
+}
+
+func (n *Not) String() string {
+	return "not " + n.X.String()
+}
+
+func (n *Literal) String() string {
+	return strconv.FormatBool(n.Value)
+}
+
+func (n *Comparison) String() string {
+	switch n.Op {
+	case "between":
+		return n.Field + " between " + n.Values[0].String() + " and " + n.Values[1].String()
+	case "in":
+		values := make([]string, len(n.Values))
+		for i, v := range n.Values {
+			values[i] = v.String()
+		}
+		return n.Field + " in (" + strings.Join(values, ", ") + ")"
+	case "resembles":
+		return n.Field + " " + n.Op + " " + n.Operand.String() + " " + NumberValue(n.Threshold).String()
+	}
+	return n.Field + " " + n.Op + " " + n.Operand.String()
+}
+
+// Fields returns the names of the fields node compares, in source order
+func Fields(node Node) []string {
+	switch n := node.(type) {
+	case *Logical:
+		return append(Fields(n.Left), Fields(n.Right)...)
+	case *Not:
+		return Fields(n.X)
+	case *Comparison:
+		return []string{n.Field}
+	}
+	return nil
+}
+
+// MaxDepth bounds the nesting of parentheses and not in an expression
+const MaxDepth = 64
+
+// Parse reads an expression, without checking it against a schema.
+//
+//	expr       := and ("or" and)*
+//	and        := unary ("and" unary)*
+//	unary      := "not" unary | primary
+//	primary    := "(" expr ")" | "true" | "false" | comparison
+//	comparison := field ("=" | "!=" | "<" | "<=" | ">" | ">=" | text) value
+//	            | field "resembles" string [number]
+//	            | field "between" value "and" value
+//	            | field "in" "(" value ("," value)* ")"
+//	text       := "contains" | "contains_word" | "contains_phrase" | "contains_prefix" | "matches"
+//	value      := string | number
+func Parse(src string) (Node, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, errorAt(tok.pos, fmt.Sprintf("unexpected %q", tok.text))
+	}
+	return node, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	depth  int // parentheses and not entered
+}
+
+// enter descends into a parenthesis or not at pos, leave has to be called when done
+func (p *parser) enter(pos int) error {
+	p.depth++
+	if p.depth > MaxDepth {
+		return errorAt(pos, fmt.Sprintf("expression nested deeper than %v", MaxDepth))
+	}
+	return nil
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// isKeyword reports whether the next token is the keyword kw
+func (p *parser) isKeyword(kw string) bool {
+	tok := p.peek()
+	return tok.kind == tokenIdent && strings.EqualFold(tok.text, kw)
+}
+
+func (p *parser) parseOr() (Node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &Logical{Op: "or", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("and") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &Logical{Op: "and", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (Node, error) {
+	if p.isKeyword("not") {
+		if err := p.enter(p.next().pos); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{X: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Node, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenLParen:
+		if err := p.enter(tok.pos); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRParen {
+			return nil, errorAt(closing.pos, "expected )")
+		}
+		return node, nil
+
+	case tokenIdent:
+		name := strings.ToLower(tok.text)
+		switch name {
+		case "true", "false":
+			return &Literal{Value: name == "true"}, nil
+		}
+		if keywords[name] {
+			return nil, errorAt(tok.pos, fmt.Sprintf("expected a field name, got %q", tok.text))
+		}
+		return p.parseComparison(name, tok.pos)
+
+	case tokenEOF:
+		return nil, errorAt(tok.pos, "unexpected end of expression")
+	}
+	return nil, errorAt(tok.pos, fmt.Sprintf("expected a condition, got %q", tok.text))
+}
+
+func (p *parser) parseComparison(field string, pos int) (Node, error) {
+	op := p.next()
+	switch {
+	case op.kind == tokenOperator:
+	case op.kind == tokenIdent && textOperators[strings.ToLower(op.text)]:
+		op.text = strings.ToLower(op.text)
+	case op.kind == tokenIdent && strings.EqualFold(op.text, "between"):
+		return p.parseBetween(field, pos)
+	case op.kind == tokenIdent && strings.EqualFold(op.text, "in"):
+		return p.parseIn(field, pos)
+	default:
+		return nil, errorAt(op.pos, fmt.Sprintf("expected an operator after %v", field))
+	}
+
+	operand, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	node := &Comparison{Field: field, Op: op.text, Operand: operand, pos: pos}
+
+	// the threshold of resembles is optional
+	if node.Op == "resembles" {
+		node.Threshold = DefaultThreshold
+		if p.peek().kind == tokenNumber {
+			threshold, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			node.Threshold = threshold.Num
+		}
+	}
+	return node, nil
+}
+
+// parseBetween reads the bounds of between, the and between them is not a logical and
+func (p *parser) parseBetween(field string, pos int) (Node, error) {
+	low, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	if !p.isKeyword("and") {
+		return nil, errorAt(p.peek().pos, "expected and after the low bound of between")
+	}
+	p.next()
+	high, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	return &Comparison{Field: field, Op: "between", Values: []Value{low, high}, pos: pos}, nil
+}
+
+func (p *parser) parseIn(field string, pos int) (Node, error) {
+	if open := p.next(); open.kind != tokenLParen {
+		return nil, errorAt(open.pos, "expected ( after in")
+	}
+
+	values := []Value{}
+	for {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		tok := p.next()
+		if tok.kind == tokenRParen {
+			break
+		}
+		if tok.kind != tokenComma {
+			return nil, errorAt(tok.pos, "expected , or )")
+		}
+	}
+	return &Comparison{Field: field, Op: "in", Values: values, pos: pos}, nil
+}
+
+func (p *parser) parseValue() (Value, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenString:
+		return StringValue(tok.text), nil
+	case tokenNumber:
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return Value{}, errorAt(tok.pos, fmt.Sprintf("invalid number %q", tok.text))
+		}
+		return NumberValue(n), nil
+	}
+	return Value{}, errorAt(tok.pos, "expected a string or a number")
+}
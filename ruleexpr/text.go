@@ -0,0 +1,226 @@
+package ruleexpr
+
+import (
+	"container/list"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// textOperators are the string operators spelled as words
+var textOperators = map[string]bool{
+	"contains":        true, // substring
+	"contains_word":   true, // whole words, the operand starts and ends at word boundaries
+	"contains_phrase": true, // the words of the operand in a row, punctuation between them ignored
+	"contains_prefix": true, // the operand starts at a word boundary
+	"matches":         true, // RE2 regular expression, case-insensitive
+	"resembles":       true, // words of the field as similar to the operand as the threshold
+}
+
+// DefaultThreshold is the similarity resembles needs when the expression gives none
+const DefaultThreshold = 0.8
+
+// Thesaurus is implemented by an Env whose text comparisons also accept the
+// synonyms of an operand, matches only takes the pattern itself
+type Thesaurus interface {
+	Synonyms(term string) ([]string, error)
+}
+
+// MaxCachedRegexps bounds the compiled patterns kept by CompileRegexp, the least
+// recently used one is dropped first
+const MaxCachedRegexps = 512
+
+// regexpCache keeps compiled patterns, rules are evaluated against many services.
+// The patterns come from users, so only the recently used ones are kept.
+type regexpCache struct {
+	mu      sync.Mutex
+	order   *list.List // most recently used first, of *cachedRegexp
+	entries map[string]*list.Element
+}
+
+type cachedRegexp struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+var regexps = &regexpCache{order: list.New(), entries: map[string]*list.Element{}}
+
+func (c *regexpCache) get(pattern string) (*regexp.Regexp, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[pattern]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cachedRegexp).re, true
+}
+
+func (c *regexpCache) put(pattern string, re *regexp.Regexp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[pattern]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[pattern] = c.order.PushFront(&cachedRegexp{pattern: pattern, re: re})
+
+	for c.order.Len() > MaxCachedRegexps {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedRegexp).pattern)
+	}
+}
+
+// CompileRegexp compiles the operand of matches
+func CompileRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := regexps.get(pattern); ok {
+		return re, nil
+	}
+
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexps.put(pattern, re)
+	return re, nil
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// words splits s into runs of letters and digits
+func words(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return !isWordRune(r) })
+}
+
+// containsAt reports whether s contains sub at a word boundary on the left
+// and, when right is set, on the right too. An edge of sub which is not a
+// letter or digit is a boundary by itself.
+func containsAt(s, sub string, right bool) bool {
+	if sub == "" {
+		return true
+	}
+	first, _ := utf8.DecodeRuneInString(sub)
+	last, _ := utf8.DecodeLastRuneInString(sub)
+
+	for offset := 0; offset <= len(s); {
+		i := strings.Index(s[offset:], sub)
+		if i < 0 {
+			return false
+		}
+		start, end := offset+i, offset+i+len(sub)
+
+		before, _ := utf8.DecodeLastRuneInString(s[:start])
+		after, _ := utf8.DecodeRuneInString(s[end:])
+		leftOK := start == 0 || !isWordRune(first) || !isWordRune(before)
+		rightOK := !right || end == len(s) || !isWordRune(last) || !isWordRune(after)
+		if leftOK && rightOK {
+			return true
+		}
+
+		_, size := utf8.DecodeRuneInString(s[start:])
+		offset = start + size
+	}
+	return false
+}
+
+// containsPhrase reports whether the words of phrase appear in a row among the words of s
+func containsPhrase(s, phrase string) bool {
+	want, have := words(phrase), words(s)
+	for i := 0; i+len(want) <= len(have); i++ {
+		match := true
+		for j := range want {
+			if have[i+j] != want[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// Similarity is one minus the edit distance of a and b over the length of the longer one
+func Similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	return 1 - float64(prev[len(rb)])/float64(longest)
+}
+
+// resembles reports whether as many consecutive words of s as phrase has are
+// at least threshold similar to it
+func resembles(s, phrase string, threshold float64) bool {
+	want, have := words(phrase), words(s)
+	if len(want) == 0 {
+		return true
+	}
+
+	target := strings.Join(want, " ")
+	for i := 0; i+len(want) <= len(have); i++ {
+		if Similarity(strings.Join(have[i:i+len(want)], " "), target) >= threshold {
+			return true
+		}
+	}
+	return false
+}
+
+// compareText applies a text operator to lowercased strings, matches reads the originals
+func compareText(op string, value, operand Value, threshold float64) (bool, error) {
+	v, o := strings.ToLower(value.Str), strings.ToLower(operand.Str)
+	switch op {
+	case "contains":
+		return strings.Contains(v, o), nil
+	case "contains_word":
+		return containsAt(v, o, true), nil
+	case "contains_prefix":
+		return containsAt(v, o, false), nil
+	case "contains_phrase":
+		return containsPhrase(v, o), nil
+	case "resembles":
+		return resembles(v, o, threshold), nil
+	}
+
+	re, err := CompileRegexp(operand.Str)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(value.Str), nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/auto-tagging-mds/database/sqldb"
+	"github.com/auto-tagging-mds/streams/processor"
+	"github.com/auto-tagging-mds/utils"
+)
+
+// consumer names the checkpoint of this reader in change_checkpoints
+const consumer = "tagging"
+
+type changeFeedSvc struct {
+	db           *sqldb.Database
+	processor    *processor.Processor
+	batchSize    int
+	pollInterval time.Duration
+}
+
+func initSvc() (*changeFeedSvc, error) {
+	fmt.Printf("change feed started : initSvc\n")
+
+	db, err := sqldb.New(os.Getenv("DB_BACKEND"), os.Getenv("DB_DSN"))
+	if err != nil {
+		fmt.Printf("database connection error : %v\n", err)
+		return nil, err
+	}
+
+	return &changeFeedSvc{
+		db:           db,
+		processor:    processor.New(db),
+		batchSize:    1000,
+		pollInterval: 2 * time.Second,
+	}, nil
+}
+
+// poll hands every change recorded after the checkpoint to the stream processor,
+// moving the checkpoint forward only after a batch was processed
+func (cf *changeFeedSvc) poll(ctx context.Context) (int, error) {
+	last, err := cf.db.Checkpoint(consumer)
+	if err != nil {
+		return 0, err
+	}
+
+	event, next, err := cf.db.ChangeEvent(last, cf.batchSize)
+	if err != nil || len(event.Records) == 0 {
+		return 0, err
+	}
+
+	err = cf.processor.Process(ctx, event)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(event.Records), cf.db.SaveCheckpoint(consumer, next)
+}
+
+func (cf *changeFeedSvc) run(ctx context.Context) error {
+	for {
+		count, err := cf.poll(ctx)
+		if err != nil {
+			return err
+		}
+
+		// drain without waiting while full batches keep coming
+		if count == cf.batchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(cf.pollInterval):
+		}
+	}
+}
+
+func main() {
+	// catch run time error
+	defer utils.Recover()
+
+	svc, err := initSvc()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = svc.run(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,430 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/auto-tagging-mds/database"
+	"github.com/auto-tagging-mds/database/models"
+	"github.com/auto-tagging-mds/utils"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Processor applies stream records of the MDS table to the database.
+// It is shared by the stream lambda and any backend producing the same
+// records, such as the in-memory database.
+type Processor struct {
+	db database.Database
+}
+
+func New(db database.Database) *Processor {
+	return &Processor{db: db}
+}
+
+// allRules reads every page of rules
+func (p *Processor) allRules() ([]models.RuleResponse, error) {
+	rules := []models.RuleResponse{}
+	cursor := ""
+	for {
+		page, next, err := p.db.GetAllRules(utils.MAX_PAGE_LIMIT, cursor)
+		if err != nil {
+			return rules, err
+		}
+		rules = append(rules, page...)
+
+		if next == "" {
+			return rules, nil
+		}
+		cursor = next
+	}
+}
+
+// allServices reads every page of services
+func (p *Processor) allServices() ([]models.ServiceResponse, error) {
+	services := []models.ServiceResponse{}
+	cursor := ""
+	for {
+		page, next, err := p.db.GetAllServices(utils.MAX_PAGE_LIMIT, cursor)
+		if err != nil {
+			return services, err
+		}
+		services = append(services, page...)
+
+		if next == "" {
+			return services, nil
+		}
+		cursor = next
+	}
+}
+
+// syncServices recomputes the rule-derived tags of every service once
+func (p *Processor) syncServices(uuids []string, rules []models.RuleResponse) error {
+	done := make(map[string]bool, len(uuids))
+	for _, uuid := range uuids {
+		if done[uuid] {
+			continue
+		}
+		done[uuid] = true
+
+		err := p.db.SyncRuleTags(uuid, rules)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withoutTag drops the rules assigning key:value, so later records of the batch do not put it back
+func withoutTag(rules []models.RuleResponse, key, value string) []models.RuleResponse {
+	kept := make([]models.RuleResponse, 0, len(rules))
+	for _, rule := range rules {
+		if !utils.IsSameTag(models.Category{Key: rule.TagKey, Value: rule.TagValue}, key, value) {
+			kept = append(kept, rule)
+		}
+	}
+	return kept
+}
+
+// ruleCandidates returns the services a new rule can match
+func (p *Processor) ruleCandidates(image map[string]*dynamodb.AttributeValue, services []models.ServiceResponse) ([]string, error) {
+	rule := models.RuleResponse{}
+	err := dynamodbattribute.UnmarshalMap(image, &rule)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := p.db.ListFields()
+	if err != nil {
+		return nil, err
+	}
+	schema := utils.FieldSchema(fields)
+
+	// a rule failing to compile is left to SyncRuleTags, which reports it
+	if _, err := utils.RuleExpression(rule, schema); err != nil {
+		return serviceUUIDs(services), nil
+	}
+
+	synonyms, err := p.db.ListSynonyms()
+	if err != nil {
+		return nil, err
+	}
+
+	uuids, indexed, err := utils.RuleCandidates(rule, func(prefix string) ([]models.ServiceTerm, error) {
+		return p.db.GetServiceTerms(prefix, true)
+	}, utils.NewThesaurus(synonyms), schema)
+	if err != nil {
+		return nil, err
+	}
+	if !indexed {
+		return serviceUUIDs(services), nil
+	}
+	fmt.Printf("rule candidates : %v of %v services\n", len(uuids), len(services))
+	return uuids, nil
+}
+
+func serviceUUIDs(services []models.ServiceResponse) []string {
+	uuids := make([]string, 0, len(services))
+	for _, service := range services {
+		uuids = append(uuids, service.ServiceUUID)
+	}
+	return uuids
+}
+
+// Process runs the tagging logic for every record of a stream event.
+func (p *Processor) Process(ctx context.Context, event models.DynamoDBEvent) error {
+
+	fmt.Printf(" %v stream started : streamHandler\n", strings.Repeat("*", 30))
+
+	// the batch is retried when the rules or services can't be read
+	rules, err := p.allRules()
+	if err != nil {
+		fmt.Println("rules error :", err)
+		return err
+	}
+
+	services, err := p.allServices()
+	if err != nil {
+		fmt.Println("services error :", err)
+		return err
+	}
+
+	fmt.Printf("rule count : %v service count : %v record count : %v\n", len(rules), len(services), len(event.Records))
+
+	for _, record := range event.Records {
+
+		change := record.Change
+		newImage := change.NewImage
+		oldImage := change.OldImage
+
+		var oldData models.StreamData
+		var newData models.StreamData
+
+		err := dynamodbattribute.UnmarshalMap(newImage, &newData)
+		if err != nil {
+			fmt.Println("UnmarshalMap error :", err)
+			return err
+		}
+
+		err = dynamodbattribute.UnmarshalMap(oldImage, &oldData)
+		if err != nil {
+			fmt.Println("UnmarshalMap error :", err)
+			return err
+		}
+
+		// a removed item only has an old image
+		pk := newData.PK
+		if record.EventName == "REMOVE" {
+			pk = oldData.PK
+		}
+
+		// history, backfill jobs and the service indexes are bookkeeping, not entities
+		entity := utils.GetEntityType(pk)
+		if entity == utils.HISTORY || entity == utils.BACKFILL || entity == utils.SERVICE_TAG || entity == utils.SERVICE_TERM {
+			continue
+		}
+
+		// the actor of a delete is written just before the item is removed, the REMOVE follows
+		if record.EventName == "MODIFY" && newData.Deleted && !oldData.Deleted {
+			continue
+		}
+
+		err = p.recordHistory(entity, record, newData, oldData, event.Records)
+		if err != nil {
+			return err
+		}
+
+		switch record.EventName {
+		case "MODIFY":
+			switch entity {
+			case utils.SERVICE:
+				if added, removed := utils.TagDiff(oldData.Category, newData.Category); len(added)+len(removed) > 0 {
+					err := p.db.IndexServiceTags(newData.UUID, oldData.Category)
+					if err != nil {
+						return err
+					}
+				}
+				if oldData.Description != newData.Description || oldData.MoreAbout != newData.MoreAbout {
+					err := p.db.IndexServiceTerms(newData.UUID, utils.ServiceTerms(oldData.Description, oldData.MoreAbout))
+					if err != nil {
+						return err
+					}
+				}
+
+				// do tag analysis when a field rules look at or a manual tag changed,
+				// tag only changes made by the sync itself stop here
+				if utils.IsMetadataChanged(oldData, newData) || utils.IsManualTagChanged(oldData, newData) {
+					err := p.db.SyncRuleTags(newData.UUID, rules)
+					if err != nil {
+						return err
+					}
+				}
+			case utils.RULE:
+				// the rule may now match other services
+				fmt.Println("Rule modified")
+				err := p.syncServices(serviceUUIDs(services), rules)
+				if err != nil {
+					return err
+				}
+			case utils.TAG:
+				// a moved tag changes the ancestors implied by it and its descendants
+				if oldData.ParentKey != newData.ParentKey || oldData.ParentValue != newData.ParentValue {
+					fmt.Println("Tag parent changed")
+					err := p.syncServices(serviceUUIDs(services), rules)
+					if err != nil {
+						return err
+					}
+				}
+			case utils.COMPANY:
+				// subscriber counts of old and new services changed
+				err := p.syncServices(append(oldData.ServiceList, newData.ServiceList...), rules)
+				if err != nil {
+					return err
+				}
+			case utils.SYNONYM:
+				// keywords of every rule may now match other words
+				fmt.Println("Synonym modified")
+				err := p.syncServices(serviceUUIDs(services), rules)
+				if err != nil {
+					return err
+				}
+			}
+		case "INSERT":
+			switch entity {
+			case utils.SERVICE:
+				// fetch rules and add tags in service
+				fmt.Println("New services created")
+				err := p.db.IndexServiceTags(newData.UUID, nil)
+				if err != nil {
+					return err
+				}
+				err = p.db.IndexServiceTerms(newData.UUID, nil)
+				if err != nil {
+					return err
+				}
+				err = p.db.SyncRuleTags(newData.UUID, rules)
+				if err != nil {
+					return err
+				}
+			case utils.RULE:
+				// may need to update services (tag analysys), only the ones the
+				// full-text index finds when the rule tests description keywords
+				fmt.Println("New rule created")
+				uuids, err := p.ruleCandidates(newImage, services)
+				if err != nil {
+					return err
+				}
+				err = p.syncServices(uuids, rules)
+				if err != nil {
+					return err
+				}
+			case utils.TAG:
+				// not in assignment scope; update service
+			case utils.COMPANY:
+				err := p.syncServices(newData.ServiceList, rules)
+				if err != nil {
+					return err
+				}
+			case utils.SYNONYM:
+				fmt.Println("New synonym created")
+				err := p.syncServices(serviceUUIDs(services), rules)
+				if err != nil {
+					return err
+				}
+			}
+		case "REMOVE":
+			switch entity {
+			case utils.SERVICE:
+				// drops the index entries of a deleted service, repoints the ones of a renamed one
+				err := p.db.IndexServiceTags(oldData.UUID, oldData.Category)
+				if err != nil {
+					return err
+				}
+				err = p.db.IndexServiceTerms(oldData.UUID, utils.ServiceTerms(oldData.Description, oldData.MoreAbout))
+				if err != nil {
+					return err
+				}
+
+				// a rename removes the old key only, the service is still subscribed
+				renamed, err := p.db.IsUUIDInUse(oldData.UUID)
+				if err != nil {
+					return err
+				}
+				if !renamed {
+					fmt.Println("Service removed")
+					err = p.db.RemoveServiceReferences(oldData.UUID)
+					if err != nil {
+						return err
+					}
+				}
+			case utils.RULE:
+				// rules holds the remaining rules, tags only the removed rule gave are dropped
+				fmt.Println("Rule removed")
+				err := p.syncServices(serviceUUIDs(services), rules)
+				if err != nil {
+					return err
+				}
+			case utils.TAG:
+				// untag services and delete the rules assigning the tag, their
+				// own REMOVE records resync the services
+				fmt.Println("Tag removed")
+				err := p.db.RemoveTagReferences(oldData.Key, oldData.Value)
+				if err != nil {
+					return err
+				}
+				rules = withoutTag(rules, oldData.Key, oldData.Value)
+			case utils.COMPANY:
+				// services lost a subscriber
+				err := p.syncServices(oldData.ServiceList, rules)
+				if err != nil {
+					return err
+				}
+			case utils.SYNONYM:
+				// tags only the removed group gave are dropped
+				fmt.Println("Synonym removed")
+				err := p.syncServices(serviceUUIDs(services), rules)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// recordHistory appends the history item of a stream record. A rename is
+// written as a REMOVE of the old key and an INSERT of the new one, both
+// carrying the same uuid; it is recorded once, as an update, on the INSERT.
+func (p *Processor) recordHistory(entity int, record models.DynamoDBEventRecord, newData, oldData models.StreamData, batch []models.DynamoDBEventRecord) error {
+	history := models.History{
+		Entity:    utils.GetEntityName(entity),
+		Timestamp: utils.HistoryTimestamp(record.Change.ApproximateCreationDateTime.Time),
+		Sequence:  utils.HistorySequence(record.Change.SequenceNumber),
+		Actor:     newData.UpdatedBy,
+	}
+
+	data := newData
+	before, after := record.Change.OldImage, record.Change.NewImage
+
+	switch record.EventName {
+	case "INSERT":
+		history.Operation = utils.HISTORY_CREATE
+		if newData.Version > 1 {
+			history.Operation = utils.HISTORY_UPDATE
+			before = renamedImage(newData.UUID, batch)
+		}
+	case "MODIFY":
+		history.Operation = utils.HISTORY_UPDATE
+	case "REMOVE":
+		data = oldData
+		history.Operation = utils.HISTORY_DELETE
+		// deletes write their actor on the removed item, TTL expirations carry the service principal
+		history.Actor = oldData.UpdatedBy
+		if record.UserIdentity != nil {
+			history.Actor = record.UserIdentity.PrincipalID
+		}
+
+		if oldData.UUID != "" {
+			renamed, err := p.db.IsUUIDInUse(oldData.UUID)
+			if err != nil || renamed {
+				return err
+			}
+		}
+	default:
+		return nil
+	}
+
+	history.EntityUUID = data.UUID
+	if entity == utils.TAG {
+		history.EntityUUID = utils.GetTagHistoryId(data.Key, data.Value)
+	}
+
+	err := dynamodbattribute.UnmarshalMap(before, &history.Before)
+	if err != nil {
+		return err
+	}
+	err = dynamodbattribute.UnmarshalMap(after, &history.After)
+	if err != nil {
+		return err
+	}
+
+	return p.db.AddHistory(history)
+}
+
+// renamedImage returns the old image of the REMOVE record of uuid in batch,
+// nil when the rename was delivered in another batch
+func renamedImage(uuid string, batch []models.DynamoDBEventRecord) map[string]*dynamodb.AttributeValue {
+	for _, record := range batch {
+		if record.EventName != "REMOVE" {
+			continue
+		}
+
+		var data models.StreamData
+		if err := dynamodbattribute.UnmarshalMap(record.Change.OldImage, &data); err == nil && data.UUID == uuid {
+			return record.Change.OldImage
+		}
+	}
+	return nil
+}
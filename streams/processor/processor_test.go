@@ -0,0 +1,156 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/auto-tagging-mds/database"
+	"github.com/auto-tagging-mds/database/memory"
+	"github.com/auto-tagging-mds/database/models"
+	"github.com/auto-tagging-mds/utils"
+)
+
+// drain processes the stream records of db until writing them produces no more
+func drain(t *testing.T, db *memory.Database) {
+	t.Helper()
+	p := New(db)
+	for i := 0; i < 10; i++ {
+		event := db.StreamEvent()
+		if len(event.Records) == 0 {
+			return
+		}
+		if err := p.Process(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Fatal("stream records keep coming")
+}
+
+func serviceTags(t *testing.T, db *memory.Database, name string) []string {
+	t.Helper()
+	service, err := db.GetService(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := []string{}
+	for _, category := range service.Category {
+		tags = append(tags, category.Key+":"+category.Value)
+	}
+	return tags
+}
+
+func TestRuleTagsServices(t *testing.T) {
+	db, err := memory.New(models.Tables{MDSTable: "mds"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateTag(models.TagCreateRequest{Key: "deployment", Value: "cloud"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, service := range []models.ServiceRequest{
+		{ServiceName: "alpha", Description: "runs on aws"},
+		{ServiceName: "beta", Description: "runs on premise"},
+	} {
+		if _, err := db.CreateService(service); err != nil {
+			t.Fatal(err)
+		}
+	}
+	drain(t, db)
+
+	rule, err := db.CreateRule(models.RuleRequest{Operation: utils.CONTAIN, TagKey: "deployment", TagValue: "cloud",
+		MetadataField: utils.DESCRIPTION, Keyword: "aws"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(t, db)
+
+	if tags := serviceTags(t, db, "alpha"); len(tags) != 1 || tags[0] != "deployment:cloud" {
+		t.Errorf("alpha tags %v, want deployment:cloud", tags)
+	}
+	if tags := serviceTags(t, db, "beta"); len(tags) != 0 {
+		t.Errorf("beta tags %v, want none", tags)
+	}
+
+	// a service created after the rule is tagged by its INSERT
+	if _, err := db.CreateService(models.ServiceRequest{ServiceName: "gamma", Description: "AWS marketplace"}); err != nil {
+		t.Fatal(err)
+	}
+	drain(t, db)
+	if tags := serviceTags(t, db, "gamma"); len(tags) != 1 {
+		t.Errorf("gamma tags %v, want deployment:cloud", tags)
+	}
+
+	// removing the rule drops the tags it gave
+	if err := db.DeleteRule(rule.RuleUUID, "tester"); err != nil {
+		t.Fatal(err)
+	}
+	drain(t, db)
+	for _, name := range []string{"alpha", "gamma"} {
+		if tags := serviceTags(t, db, name); len(tags) != 0 {
+			t.Errorf("%v tags %v, want none", name, tags)
+		}
+	}
+}
+
+func TestHistorySkipsDeleteMarker(t *testing.T) {
+	db, err := memory.New(models.Tables{MDSTable: "mds"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := db.CreateService(models.ServiceRequest{ServiceName: "alpha"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteService("alpha", false, "tester"); err != nil {
+		t.Fatal(err)
+	}
+	drain(t, db)
+
+	history, _, err := db.GetHistory(service.ServiceUUID, utils.MAX_PAGE_LIMIT, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("history %v, want the create and the delete", history)
+	}
+	deleted := false
+	for _, h := range history {
+		if h.Operation == "delete" {
+			deleted = true
+			if h.Actor != "tester" {
+				t.Errorf("delete by %v, want tester", h.Actor)
+			}
+		}
+	}
+	if !deleted {
+		t.Errorf("history %v has no delete", history)
+	}
+}
+
+// rulesDown fails to list the rules
+type rulesDown struct {
+	database.Database
+}
+
+var errRulesDown = errors.New("rules down")
+
+func (rulesDown) GetAllRules(limit int, cursor string) ([]models.RuleResponse, string, error) {
+	return nil, "", errRulesDown
+}
+
+func TestProcessRetriesWithoutRules(t *testing.T) {
+	db, err := memory.New(models.Tables{MDSTable: "mds"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateService(models.ServiceRequest{ServiceName: "alpha", Description: "runs on aws"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the records are not dropped, the batch fails and is delivered again
+	err = New(rulesDown{db}).Process(context.Background(), db.StreamEvent())
+	if err != errRulesDown {
+		t.Fatalf("error %v, want %v", err, errRulesDown)
+	}
+}
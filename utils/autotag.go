@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"reflect"
+
+	"github.com/auto-tagging-mds/database/models"
+)
+
+const (
+	SOURCE_MANUAL = "manual"
+	SOURCE_RULE   = "rule"
+)
+
+// RuleCategory returns the category a rule applies at datetime
+func RuleCategory(rule models.RuleResponse, datetime string) models.Category {
+	return models.Category{Key: rule.TagKey, Value: rule.TagValue, Source: SOURCE_RULE, RuleUUID: rule.RuleUUID, AppliedAt: datetime}
+}
+
+// StampCategories sets the provenance of a category list sent by a client.
+// Categories the service already had keep theirs, any other one is a manual
+// tag applied at datetime.
+func StampCategories(category, previous []models.Category, datetime string) []models.Category {
+	stamped := make([]models.Category, 0, len(category))
+	for _, cat := range category {
+		tag := models.Category{Key: cat.Key, Value: cat.Value, Source: SOURCE_MANUAL, AppliedAt: datetime}
+		for _, prev := range previous {
+			if prev.Key == cat.Key && prev.Value == cat.Value {
+				tag = prev
+				break
+			}
+		}
+
+		// categories stored before provenance was tracked
+		if tag.Source == "" {
+			tag.Source = SOURCE_MANUAL
+			if tag.RuleUUID != "" {
+				tag.Source = SOURCE_RULE
+			}
+		}
+		stamped = append(stamped, tag)
+	}
+	return stamped
+}
+
+// IsMetadataChanged reports whether a service field rules are evaluated on changed
+func IsMetadataChanged(oldData, newData models.StreamData) bool {
+	oldFields, newFields := ServiceFields(oldData, nil, nil, nil), ServiceFields(newData, nil, nil, nil)
+	for field := range RuleSchema {
+		// subscriptions are stored on the companies
+		if field == SUBSCRIBER_COUNT {
+			continue
+		}
+
+		oldValue, _ := oldFields.Field(field)
+		newValue, _ := newFields.Field(field)
+		if oldValue != newValue {
+			return true
+		}
+	}
+	// no attributes decode as nil or as an empty map
+	if len(oldData.Attributes) == 0 && len(newData.Attributes) == 0 {
+		return false
+	}
+	return !reflect.DeepEqual(oldData.Attributes, newData.Attributes)
+}
+
+// IsManualTagChanged reports whether the manual tags of a service changed, their ancestors may have
+func IsManualTagChanged(oldData, newData models.StreamData) bool {
+	manual := func(category []models.Category) []models.Category {
+		tags := make([]models.Category, 0, len(category))
+		for _, cat := range category {
+			if cat.RuleUUID == "" && cat.Source != SOURCE_ANCESTOR {
+				tags = append(tags, models.Category{Key: cat.Key, Value: cat.Value})
+			}
+		}
+		return tags
+	}
+
+	added, removed := TagDiff(manual(oldData.Category), manual(newData.Category))
+	return len(added)+len(removed) > 0
+}
+
+// SyncRuleTags recomputes the rule-derived part of a service category list
+// from the rules the service currently matches. Manual categories, the ones
+// without a rule uuid, are kept as they are; a rule-derived category no
+// matching rule gives any more is removed. It reports whether the list changed.
+func SyncRuleTags(category []models.Category, matched []models.RuleResponse) ([]models.Category, bool) {
+	derived := make(map[models.Category][]string)
+	for _, rule := range matched {
+		tag := models.Category{Key: rule.TagKey, Value: rule.TagValue}
+		derived[tag] = append(derived[tag], rule.RuleUUID)
+	}
+
+	changed := false
+	synced := make([]models.Category, 0, len(category)+len(matched))
+	for _, cat := range category {
+		if cat.RuleUUID == "" {
+			synced = append(synced, cat)
+			continue
+		}
+
+		ruleUUIDs, ok := derived[models.Category{Key: cat.Key, Value: cat.Value}]
+		if !ok {
+			changed = true
+			continue
+		}
+
+		// keep the applying rule while it still matches
+		if !contains(ruleUUIDs, cat.RuleUUID) {
+			cat.RuleUUID = ruleUUIDs[0]
+			cat.Source = SOURCE_RULE
+			changed = true
+		}
+		synced = append(synced, cat)
+	}
+
+	datetime := DateString("datetime")
+	for _, rule := range matched {
+		cat := RuleCategory(rule, datetime)
+		if !IsTagAlreadyPresent(synced, cat) {
+			synced = append(synced, cat)
+			changed = true
+		}
+	}
+	return synced, changed
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// TagDiff returns the tags of after missing from before and the tags of before missing from after
+func TagDiff(before, after []models.Category) (added, removed []models.Category) {
+	added, removed = make([]models.Category, 0), make([]models.Category, 0)
+	for _, cat := range after {
+		if !IsTagAlreadyPresent(before, cat) {
+			added = append(added, cat)
+		}
+	}
+	for _, cat := range before {
+		if !IsTagAlreadyPresent(after, cat) {
+			removed = append(removed, cat)
+		}
+	}
+	return added, removed
+}
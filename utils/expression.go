@@ -0,0 +1,511 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/auto-tagging-mds/database/models"
+	"github.com/auto-tagging-mds/ruleexpr"
+)
+
+const (
+	SERVICENAME      = "service_name"
+	MOREABOUT        = "more_about"
+	SUBSCRIBER_COUNT = "subscriber_count"
+	CREATED_AT       = "created_at"
+	UPDATED_AT       = "updated_at"
+)
+
+// RuleSchema lists the service fields a rule expression can test
+var RuleSchema = ruleexpr.Schema{
+	SERVICENAME:      ruleexpr.String,
+	DESCRIPTION:      ruleexpr.String,
+	MOREABOUT:        ruleexpr.String,
+	LOCATION:         ruleexpr.String,
+	TARGETSEGMENT:    ruleexpr.String,
+	PRICING:          ruleexpr.String,
+	BUSINESSMODEL:    ruleexpr.String,
+	DEPLOYMENT:       ruleexpr.String,
+	STAGE:            ruleexpr.String,
+	LIKE:             ruleexpr.Number,
+	SUBSCRIBER_COUNT: ruleexpr.Number,
+	CREATED_AT:       ruleexpr.Date,
+	UPDATED_AT:       ruleexpr.Date,
+}
+
+// match modes of the keywords of a CONTAIN or RELATION rule, SUBSTRING is stored empty
+const (
+	MATCH_SUBSTRING = "SUBSTRING"
+	MATCH_WORD      = "WORD"
+	MATCH_PHRASE    = "PHRASE"
+	MATCH_PREFIX    = "PREFIX"
+	MATCH_REGEX     = "REGEX"
+)
+
+// modes combining the conditions of a rule, ALL is stored empty
+const (
+	CONDITION_ALL  = "ALL"
+	CONDITION_ANY  = "ANY"
+	CONDITION_NONE = "NONE"
+)
+
+// matchOperators maps a stored match mode to its expression operator
+var matchOperators = map[string]string{
+	"":           "contains",
+	MATCH_WORD:   "contains_word",
+	MATCH_PHRASE: "contains_phrase",
+	MATCH_PREFIX: "contains_prefix",
+	MATCH_REGEX:  "matches",
+}
+
+var legacyRelationalOperators = map[string]string{
+	GREATER_THAN:       ">",
+	LESSER_THAN:        "<",
+	EQUAL:              "=",
+	GREATER_THAN_EQUAL: ">=",
+	LESSER_THAN_EQUAL:  "<=",
+}
+
+// serviceFields reads rule fields from a service, the subscriber count, the
+// synonym dictionary and the declared fields are looked up on first use only
+// since they need a query
+type serviceFields struct {
+	streamData  models.StreamData
+	subscribers func() (int, error)
+	count       *int
+	synonyms    func() ([]models.Synonym, error)
+	thesaurus   Thesaurus
+	fields      func() ([]models.Field, error)
+	declared    []models.Field
+	queryErr    error // the first lookup which failed
+}
+
+// ServiceFields returns the values rule expressions see for a service.
+// subscribers counts the companies subscribed to it; when nil, expressions
+// reading subscriber_count fail. synonyms lists the synonym dictionary, when
+// nil keywords only match themselves. fields lists the declared fields, when
+// nil only the built-in fields can be read.
+func ServiceFields(streamData models.StreamData, subscribers func() (int, error), synonyms func() ([]models.Synonym, error), fields func() ([]models.Field, error)) ruleexpr.Env {
+	return &serviceFields{streamData: streamData, subscribers: subscribers, synonyms: synonyms, fields: fields}
+}
+
+// schemaEnv is implemented by an Env knowing the declared fields, rules testing
+// them compile against its schema
+type schemaEnv interface {
+	Schema() (ruleexpr.Schema, error)
+}
+
+func (f *serviceFields) loadFields() ([]models.Field, error) {
+	if f.fields == nil || f.declared != nil {
+		return f.declared, nil
+	}
+	declared, err := f.fields()
+	if err != nil {
+		return nil, f.failed(err)
+	}
+	f.declared = append([]models.Field{}, declared...)
+	return f.declared, nil
+}
+
+// failed records the error of a lookup, see FailedQuery
+func (f *serviceFields) failed(err error) error {
+	if f.queryErr == nil {
+		f.queryErr = err
+	}
+	return err
+}
+
+// FailedQuery returns the error of the first lookup of env which failed, nil when
+// none did. A rule failing on it is not broken, it can be evaluated again later.
+func FailedQuery(env ruleexpr.Env) error {
+	if f, ok := env.(*serviceFields); ok {
+		return f.queryErr
+	}
+	return nil
+}
+
+// Schema returns RuleSchema with the declared fields added
+func (f *serviceFields) Schema() (ruleexpr.Schema, error) {
+	declared, err := f.loadFields()
+	if err != nil {
+		return nil, err
+	}
+	return FieldSchema(declared), nil
+}
+
+// Synonyms returns the words the dictionary groups with term
+func (f *serviceFields) Synonyms(term string) ([]string, error) {
+	if f.synonyms == nil {
+		return nil, nil
+	}
+	if f.thesaurus == nil {
+		groups, err := f.synonyms()
+		if err != nil {
+			return nil, f.failed(err)
+		}
+		f.thesaurus = NewThesaurus(groups)
+	}
+	return f.thesaurus.Synonyms(term)
+}
+
+func (f *serviceFields) Field(name string) (ruleexpr.Value, error) {
+	switch name {
+	case SERVICENAME:
+		return ruleexpr.StringValue(f.streamData.ServiceName), nil
+	case DESCRIPTION:
+		return ruleexpr.StringValue(f.streamData.Description), nil
+	case MOREABOUT:
+		return ruleexpr.StringValue(f.streamData.MoreAbout), nil
+	case LOCATION:
+		return ruleexpr.StringValue(f.streamData.Location), nil
+	case TARGETSEGMENT:
+		return ruleexpr.StringValue(f.streamData.TargetSegment), nil
+	case PRICING:
+		return ruleexpr.StringValue(f.streamData.Pricing), nil
+	case BUSINESSMODEL:
+		return ruleexpr.StringValue(f.streamData.BusinessModel), nil
+	case DEPLOYMENT:
+		return ruleexpr.StringValue(f.streamData.Deployment), nil
+	case STAGE:
+		return ruleexpr.StringValue(f.streamData.Stage), nil
+	case LIKE:
+		return ruleexpr.NumberValue(float64(f.streamData.Like)), nil
+	case SUBSCRIBER_COUNT:
+		if f.count == nil {
+			if f.subscribers == nil {
+				return ruleexpr.Value{}, errors.New("subscriber count is not available")
+			}
+			count, err := f.subscribers()
+			if err != nil {
+				return ruleexpr.Value{}, f.failed(err)
+			}
+			f.count = &count
+		}
+		return ruleexpr.NumberValue(float64(*f.count)), nil
+	case CREATED_AT:
+		return serviceDate(name, f.streamData.CreatedAt)
+	case UPDATED_AT:
+		return serviceDate(name, f.streamData.UpdatedAt)
+	}
+
+	declared, err := f.loadFields()
+	if err != nil {
+		return ruleexpr.Value{}, err
+	}
+	for _, field := range declared {
+		if field.Name == name {
+			return attributeValue(field, f.streamData.Attributes[name]), nil
+		}
+	}
+	return ruleexpr.Value{}, errors.New(fmt.Sprintf("unknown field %v", name))
+}
+
+// serviceDate reads a timestamp of a service, one saved without it cannot be compared
+func serviceDate(name string, date string) (ruleexpr.Value, error) {
+	if date == "" {
+		return ruleexpr.Value{}, fmt.Errorf("service has no %v", name)
+	}
+	return ruleexpr.ParseDate(date)
+}
+
+// SetRuleExpression validates a rule being saved and stores its canonical expression,
+// derived from the fields of every operation but EXPRESSION so that it never contradicts
+// them. fields are the declared fields the rule can test besides RuleSchema.
+func SetRuleExpression(rule *models.RuleRequest, fields []models.Field) error {
+	normalizeRule(rule)
+	if errs := ValidateRule(*rule, fields); len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+
+	schema := FieldSchema(fields)
+	if rule.Operation != EXPRESSION {
+		rule.Expression = LegacyExpression(models.RuleResponse(*rule), schema)
+	}
+
+	node, err := ruleexpr.Compile(rule.Expression, schema)
+	if err != nil {
+		return err
+	}
+
+	// store the canonical form so that equal expressions compare equal
+	rule.Expression = node.String()
+	return nil
+}
+
+// PlainKeywordRule reports whether a rule matches its keywords as substrings
+// without synonyms or a condition list, like the rules stored before expressions existed
+func PlainKeywordRule(rule models.RuleRequest) bool {
+	return rule.MatchMode == "" && len(rule.Synonyms) == 0 && rule.FuzzyThreshold == 0 && len(rule.Conditions) == 0
+}
+
+// RuleExpression compiles the expression of a stored rule against schema, RuleSchema
+// when nil. Rules saved before expressions existed are converted on the fly.
+func RuleExpression(rule models.RuleResponse, schema ruleexpr.Schema) (ruleexpr.Node, error) {
+	if schema == nil {
+		schema = RuleSchema
+	}
+	src := rule.Expression
+	if src == "" {
+		src = LegacyExpression(rule, schema)
+	}
+	return ruleexpr.Compile(src, schema)
+}
+
+// ruleSchema returns the schema a rule compiles against, the declared fields of
+// env are only loaded for a rule testing a field RuleSchema does not have
+func ruleSchema(rule models.RuleResponse, env ruleexpr.Env) (ruleexpr.Schema, error) {
+	if s, ok := env.(schemaEnv); ok && usesCustomField(rule) {
+		return s.Schema()
+	}
+	return RuleSchema, nil
+}
+
+// RuleMatches evaluates a rule against the fields of a service
+func RuleMatches(rule models.RuleResponse, env ruleexpr.Env) (bool, error) {
+	schema, err := ruleSchema(rule, env)
+	if err != nil {
+		return false, err
+	}
+	node, err := RuleExpression(rule, schema)
+	if err != nil {
+		return false, err
+	}
+	return ruleexpr.Eval(node, env)
+}
+
+// MatchingRules returns the rules matching the service of env. All of them are
+// evaluated on the one env, so the subscriber count, the synonyms and the
+// fields are queried at most once. A rule which can't be evaluated on the
+// service is logged and matches nothing, only a failed query fails them all.
+func MatchingRules(rules []models.RuleResponse, env ruleexpr.Env) ([]models.RuleResponse, error) {
+	matched := make([]models.RuleResponse, 0)
+	for _, rule := range rules {
+		eligible, err := RuleMatches(rule, env)
+		if queryErr := FailedQuery(env); queryErr != nil {
+			return nil, queryErr
+		}
+		if err != nil {
+			fmt.Printf("rule %v : skipped : %v\n", rule.RuleUUID, err)
+			continue
+		}
+
+		if eligible {
+			matched = append(matched, rule)
+		}
+	}
+	return matched, nil
+}
+
+// LegacyExpression converts the operation, metadata field, keyword and co-rule
+// fields of a rule into the expression matching the same services
+func LegacyExpression(rule models.RuleResponse, schema ruleexpr.Schema) string {
+	var node ruleexpr.Node
+	switch rule.Operation {
+	case SUBSCRIPTION_COUNT:
+		node = &ruleexpr.Comparison{Field: SUBSCRIBER_COUNT, Op: ">", Operand: ruleexpr.NumberValue(float64(rule.SubscriptionCount))}
+
+	case CONTAIN, RELATION:
+		if len(rule.Conditions) > 0 {
+			node = conditionList(rule, schema)
+			break
+		}
+		node = legacyCondition(models.RuleCondition{MetadataField: rule.MetadataField, Keyword: rule.Keyword,
+			RelationalOperator: rule.RelationalOperator, Operand: rule.Operand, RelationalValues: rule.RelationalValues}, rule.Synonyms, rule, schema)
+
+		// the co-rule only counts with a keyword operator, a missing one never matches
+		var coRule ruleexpr.Node = &ruleexpr.Literal{Value: false}
+		if rule.CoRuleMetadataField != "" && rule.KeywordOperator != "" {
+			coRule = legacyCondition(models.RuleCondition{MetadataField: rule.CoRuleMetadataField, Keyword: rule.CoRuleKeyword,
+				RelationalOperator: rule.RelationalOperator, Operand: rule.Operand, RelationalValues: rule.RelationalValues}, nil, rule, schema)
+		}
+
+		switch rule.KeywordOperator {
+		case AND:
+			node = &ruleexpr.Logical{Op: "and", Left: node, Right: coRule}
+		case OR:
+			node = &ruleexpr.Logical{Op: "or", Left: node, Right: coRule}
+		case "":
+		default:
+			node = &ruleexpr.Literal{Value: false}
+		}
+
+	default:
+		node = &ruleexpr.Literal{Value: false}
+	}
+	return node.String()
+}
+
+// conditionList combines the conditions of a rule with its condition mode, NONE
+// matches when no condition does
+func conditionList(rule models.RuleResponse, schema ruleexpr.Schema) ruleexpr.Node {
+	op := "and"
+	if rule.ConditionMode == CONDITION_ANY || rule.ConditionMode == CONDITION_NONE {
+		op = "or"
+	}
+
+	var node ruleexpr.Node
+	for _, cond := range rule.Conditions {
+		condition := legacyCondition(cond, nil, rule, schema)
+		if cond.Negate {
+			condition = &ruleexpr.Not{X: condition}
+		}
+
+		if node == nil {
+			node = condition
+		} else {
+			node = &ruleexpr.Logical{Op: op, Left: node, Right: condition}
+		}
+	}
+
+	if rule.ConditionMode == CONDITION_NONE {
+		return &ruleexpr.Not{X: node}
+	}
+	return node
+}
+
+// legacyCondition matches the keyword of a condition or one of its synonyms in a
+// metadata field, and words resembling them when the rule has a fuzzy threshold.
+// Number and date fields are compared with the relational operator instead.
+func legacyCondition(cond models.RuleCondition, synonyms []string, rule models.RuleResponse, schema ruleexpr.Schema) ruleexpr.Node {
+	field := metadataField(cond.MetadataField)
+	if relationalField(field, schema) {
+		return relationalCondition(field, cond)
+	}
+
+	if !keywordField(field, schema) {
+		// other fields read as empty, which only contains the empty keyword
+		return &ruleexpr.Literal{Value: cond.Keyword == ""}
+	}
+	var node ruleexpr.Node
+	for _, word := range append([]string{cond.Keyword}, synonyms...) {
+		// a pattern keeps its case, \W is not \w
+		if rule.MatchMode != MATCH_REGEX {
+			word = strings.ToLower(word)
+		}
+
+		var condition ruleexpr.Node = &ruleexpr.Comparison{Field: field, Op: matchOperators[rule.MatchMode], Operand: ruleexpr.StringValue(word)}
+		if rule.FuzzyThreshold > 0 {
+			condition = &ruleexpr.Logical{Op: "or", Left: condition, Right: &ruleexpr.Comparison{
+				Field: field, Op: "resembles", Operand: ruleexpr.StringValue(word), Threshold: rule.FuzzyThreshold,
+			}}
+		}
+
+		if node == nil {
+			node = condition
+		} else {
+			node = &ruleexpr.Logical{Op: "or", Left: node, Right: condition}
+		}
+	}
+	return node
+}
+
+// metadataField normalizes the metadata_field of a rule to a field name
+func metadataField(name string) string {
+	return strings.ReplaceAll(strings.ToLower(name), " ", "")
+}
+
+// relationalField reports whether a field is compared with a relational operator
+func relationalField(field string, schema ruleexpr.Schema) bool {
+	return schema[field] == ruleexpr.Number || schema[field] == ruleexpr.Date
+}
+
+// relationalOperands returns the relational_values of a condition, or its
+// relational_operand when it has none
+func relationalOperands(cond models.RuleCondition) []ruleexpr.Value {
+	if len(cond.RelationalValues) == 0 {
+		return []ruleexpr.Value{ruleexpr.NumberValue(cond.Operand)}
+	}
+
+	values := make([]ruleexpr.Value, 0, len(cond.RelationalValues))
+	for _, v := range cond.RelationalValues {
+		switch operand := v.(type) {
+		case float64:
+			values = append(values, ruleexpr.NumberValue(operand))
+		case int:
+			values = append(values, ruleexpr.NumberValue(float64(operand)))
+		default:
+			// dates are strings, anything else fails the type check of the expression
+			values = append(values, ruleexpr.StringValue(fmt.Sprint(operand)))
+		}
+	}
+	return values
+}
+
+// relationalCondition compares a number or date field with the operands of a
+// condition, a missing or unknown operator never matches
+func relationalCondition(field string, cond models.RuleCondition) ruleexpr.Node {
+	values := relationalOperands(cond)
+	switch cond.RelationalOperator {
+	case BETWEEN:
+		if len(values) == 2 {
+			return &ruleexpr.Comparison{Field: field, Op: "between", Values: values}
+		}
+	case IN:
+		return &ruleexpr.Comparison{Field: field, Op: "in", Values: values}
+	default:
+		if op, ok := legacyRelationalOperators[cond.RelationalOperator]; ok && len(values) == 1 {
+			return &ruleexpr.Comparison{Field: field, Op: op, Operand: values[0]}
+		}
+	}
+	return &ruleexpr.Literal{Value: false}
+}
+
+// ExplainRule evaluates a rule like RuleMatches and records the outcome of every condition.
+// An expression which cannot be evaluated is reported in the Error field.
+func ExplainRule(rule models.RuleResponse, env ruleexpr.Env) models.RuleExplain {
+	explain := models.RuleExplain{
+		RuleUUID:   rule.RuleUUID,
+		TagKey:     rule.TagKey,
+		TagValue:   rule.TagValue,
+		Expression: rule.Expression,
+		Conditions: []models.ConditionExplain{},
+	}
+
+	schema, err := ruleSchema(rule, env)
+	if err != nil {
+		explain.Error = err.Error()
+		return explain
+	}
+	node, err := RuleExpression(rule, schema)
+	if err != nil {
+		explain.Error = err.Error()
+		return explain
+	}
+	explain.Expression = node.String()
+
+	matched, steps, err := ruleexpr.Trace(node, env)
+	if err != nil {
+		explain.Error = err.Error()
+		return explain
+	}
+
+	explain.Matched = matched
+	for _, step := range steps {
+		operand := expressionValue(step.Operand)
+		if len(step.Values) > 0 {
+			values := make([]interface{}, len(step.Values))
+			for i, v := range step.Values {
+				values[i] = expressionValue(v)
+			}
+			operand = values
+		}
+
+		explain.Conditions = append(explain.Conditions, models.ConditionExplain{
+			Field:    step.Field,
+			Value:    expressionValue(step.Value),
+			Operator: step.Op,
+			Operand:  operand,
+			Result:   step.Result,
+		})
+	}
+	return explain
+}
+
+// expressionValue returns a number as such, strings and dates as text
+func expressionValue(v ruleexpr.Value) interface{} {
+	if v.Type == ruleexpr.Number {
+		return v.Num
+	}
+	return v.Str
+}
@@ -0,0 +1,259 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/auto-tagging-mds/database/models"
+)
+
+func TestRuleMatches(t *testing.T) {
+	service := models.StreamData{ServiceName: "kube", Deployment: "cloud", Description: "Managed Kubernetes on AWS", Like: 12}
+	subscribers := func() (int, error) { return 3, nil }
+
+	tests := []struct {
+		name string
+		rule models.RuleResponse
+		want bool
+	}{
+		{
+			name: "keyword",
+			rule: models.RuleResponse{Operation: CONTAIN, MetadataField: DESCRIPTION, Keyword: "kubernetes"},
+			want: true,
+		},
+		{
+			name: "co-rule with and",
+			rule: models.RuleResponse{Operation: CONTAIN, MetadataField: DESCRIPTION, Keyword: "aws",
+				KeywordOperator: AND, CoRuleMetadataField: DEPLOYMENT, CoRuleKeyword: "on-premise"},
+			want: false,
+		},
+		{
+			name: "co-rule with or",
+			rule: models.RuleResponse{Operation: CONTAIN, MetadataField: DESCRIPTION, Keyword: "gcp",
+				KeywordOperator: OR, CoRuleMetadataField: DEPLOYMENT, CoRuleKeyword: "cloud"},
+			want: true,
+		},
+		{
+			name: "word match",
+			rule: models.RuleResponse{Operation: CONTAIN, MetadataField: DESCRIPTION, Keyword: "kube", MatchMode: MATCH_WORD},
+			want: false,
+		},
+		{
+			name: "prefix match",
+			rule: models.RuleResponse{Operation: CONTAIN, MetadataField: DESCRIPTION, Keyword: "kube", MatchMode: MATCH_PREFIX},
+			want: true,
+		},
+		{
+			name: "subscription count",
+			rule: models.RuleResponse{Operation: SUBSCRIPTION_COUNT, SubscriptionCount: 2},
+			want: true,
+		},
+		{
+			name: "expression",
+			rule: models.RuleResponse{Operation: EXPRESSION, Expression: `like >= 10 and service_name contains "kube"`},
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RuleMatches(tt.rule, ServiceFields(service, subscribers, nil, nil))
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleMatchesSynonyms(t *testing.T) {
+	service := models.StreamData{Description: "Managed Kubernetes on AWS"}
+	dictionary := func() ([]models.Synonym, error) {
+		return []models.Synonym{{Term: "k8s", Synonyms: []string{"Kubernetes"}}}, nil
+	}
+
+	tests := []struct {
+		name string
+		rule models.RuleResponse
+		want bool
+	}{
+		{
+			name: "dictionary",
+			rule: models.RuleResponse{Operation: CONTAIN, MetadataField: DESCRIPTION, Keyword: "K8s"},
+			want: true,
+		},
+		{
+			name: "rule synonyms",
+			rule: models.RuleResponse{Operation: CONTAIN, MetadataField: DESCRIPTION, Keyword: "eks", Synonyms: []string{"aws"}},
+			want: true,
+		},
+		{
+			name: "fuzzy keyword",
+			rule: models.RuleResponse{Operation: CONTAIN, MetadataField: DESCRIPTION, Keyword: "managd", FuzzyThreshold: 0.8},
+			want: true,
+		},
+		{
+			name: "no match",
+			rule: models.RuleResponse{Operation: CONTAIN, MetadataField: DESCRIPTION, Keyword: "azure", Synonyms: []string{"gcp"}},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RuleMatches(tt.rule, ServiceFields(service, nil, dictionary, nil))
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleMatchesConditions(t *testing.T) {
+	service := models.StreamData{Description: "Managed Kubernetes on AWS", Deployment: "cloud", Like: 12}
+	conditions := []models.RuleCondition{
+		{MetadataField: DESCRIPTION, Keyword: "aws"},
+		{MetadataField: DEPLOYMENT, Keyword: "on-premise"},
+		{MetadataField: LIKE, RelationalOperator: GREATER_THAN, Operand: 20, Negate: true},
+	}
+
+	tests := []struct {
+		mode string
+		want bool
+	}{
+		{mode: "", want: false},
+		{mode: CONDITION_ANY, want: true},
+		{mode: CONDITION_NONE, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run("mode "+tt.mode, func(t *testing.T) {
+			rule := models.RuleResponse{Operation: CONTAIN, ConditionMode: tt.mode, Conditions: conditions}
+			got, err := RuleMatches(rule, ServiceFields(service, nil, nil, nil))
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// no condition holding matches NONE
+	rule := models.RuleResponse{Operation: CONTAIN, ConditionMode: CONDITION_NONE, Conditions: conditions[1:2]}
+	if got, err := RuleMatches(rule, ServiceFields(service, nil, nil, nil)); err != nil || !got {
+		t.Errorf("got %v %v, want a match", got, err)
+	}
+}
+
+func TestRuleMatchesRelational(t *testing.T) {
+	service := models.StreamData{Like: 12, CreatedAt: "2024-03-01 10:00:00"}
+
+	tests := []struct {
+		name string
+		cond models.RuleCondition
+		want bool
+	}{
+		{name: "float operand", cond: models.RuleCondition{MetadataField: LIKE, RelationalOperator: GREATER_THAN, Operand: 11.5}, want: true},
+		{name: "between", cond: models.RuleCondition{MetadataField: LIKE, RelationalOperator: BETWEEN, RelationalValues: []interface{}{10.0, 15.0}}, want: true},
+		{name: "in", cond: models.RuleCondition{MetadataField: LIKE, RelationalOperator: IN, RelationalValues: []interface{}{1.0, 2.0}}, want: false},
+		{name: "date", cond: models.RuleCondition{MetadataField: CREATED_AT, RelationalOperator: LESSER_THAN, RelationalValues: []interface{}{"2024-03-02"}}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := models.RuleResponse{Operation: RELATION, MetadataField: tt.cond.MetadataField, RelationalOperator: tt.cond.RelationalOperator,
+				Operand: tt.cond.Operand, RelationalValues: tt.cond.RelationalValues}
+			got, err := RuleMatches(rule, ServiceFields(service, nil, nil, nil))
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchingRulesQueriesOnce(t *testing.T) {
+	queries := 0
+	subscribers := func() (int, error) {
+		queries++
+		return 5, nil
+	}
+	rules := []models.RuleResponse{
+		{RuleUUID: "few", Operation: SUBSCRIPTION_COUNT, SubscriptionCount: 1},
+		{RuleUUID: "many", Operation: SUBSCRIPTION_COUNT, SubscriptionCount: 10},
+		{RuleUUID: "some", Operation: EXPRESSION, Expression: "subscriber_count between 2 and 8"},
+	}
+
+	matched, err := MatchingRules(rules, ServiceFields(models.StreamData{}, subscribers, nil, nil))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(matched) != 2 || matched[0].RuleUUID != "few" || matched[1].RuleUUID != "some" {
+		t.Errorf("matched %v, want few and some", matched)
+	}
+	if queries != 1 {
+		t.Errorf("subscribers counted %v times, want once", queries)
+	}
+}
+
+func TestMatchingRulesSkipsBrokenRules(t *testing.T) {
+	rules := []models.RuleResponse{
+		{RuleUUID: "dated", Operation: EXPRESSION, Expression: `created_at > "2020-01-01"`},
+		{RuleUUID: "cloud", Operation: EXPRESSION, Expression: "deployment = 'cloud'"},
+	}
+
+	// the service has no created_at, only that rule fails
+	matched, err := MatchingRules(rules, ServiceFields(models.StreamData{Deployment: "cloud"}, nil, nil, nil))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(matched) != 1 || matched[0].RuleUUID != "cloud" {
+		t.Errorf("matched %v, want cloud", matched)
+	}
+
+	// a failed query is not the fault of a rule, it fails the service
+	down := errors.New("database down")
+	rules = append(rules, models.RuleResponse{RuleUUID: "many", Operation: SUBSCRIPTION_COUNT, SubscriptionCount: 10})
+	_, err = MatchingRules(rules, ServiceFields(models.StreamData{Deployment: "cloud"}, func() (int, error) { return 0, down }, nil, nil))
+	if err != down {
+		t.Errorf("error %v, want %v", err, down)
+	}
+}
+
+func TestServiceFieldsErrors(t *testing.T) {
+	env := ServiceFields(models.StreamData{}, nil, nil, nil)
+	for _, name := range []string{SUBSCRIBER_COUNT, CREATED_AT, "unknown"} {
+		if _, err := env.Field(name); err == nil {
+			t.Errorf("field %v read, want an error", name)
+		}
+	}
+}
+
+func TestLegacyExpressionMatchesLegacyRule(t *testing.T) {
+	rule := models.RuleResponse{Operation: CONTAIN, MetadataField: DESCRIPTION, Keyword: "aws"}
+	stored := rule
+	stored.Expression = LegacyExpression(rule, RuleSchema)
+
+	for _, description := range []string{"runs on AWS", "runs on azure"} {
+		env := ServiceFields(models.StreamData{Description: description}, nil, nil, nil)
+		legacy, err := RuleMatches(rule, env)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		converted, err := RuleMatches(stored, env)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if legacy != converted {
+			t.Errorf("%q: legacy rule %v, expression %v", description, legacy, converted)
+		}
+	}
+}
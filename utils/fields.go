@@ -0,0 +1,341 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/auto-tagging-mds/database/models"
+	"github.com/auto-tagging-mds/ruleexpr"
+)
+
+var ErrFieldNotFound = errors.New("field not found")
+
+// types of the fields declared under /api/v1/fields
+const (
+	FIELD_STRING = "string"
+	FIELD_NUMBER = "number"
+	FIELD_ENUM   = "enum"
+	FIELD_LIST   = "list"
+	FIELD_URL    = "url"
+)
+
+// fieldTypes maps a declared type to the type rules compare it as, a list reads
+// as its items joined by commas
+var fieldTypes = map[string]ruleexpr.Type{
+	FIELD_STRING: ruleexpr.String,
+	FIELD_NUMBER: ruleexpr.Number,
+	FIELD_ENUM:   ruleexpr.String,
+	FIELD_LIST:   ruleexpr.String,
+	FIELD_URL:    ruleexpr.String,
+}
+
+var fieldName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// FieldSchema returns RuleSchema with the declared fields added
+func FieldSchema(fields []models.Field) ruleexpr.Schema {
+	schema := make(ruleexpr.Schema, len(RuleSchema)+len(fields))
+	for name, t := range RuleSchema {
+		schema[name] = t
+	}
+	for _, field := range fields {
+		schema[field.Name] = fieldTypes[field.Type]
+	}
+	return schema
+}
+
+// CheckField validates a field declaration about to be stored, its type is lowercased
+func CheckField(field *models.Field) error {
+	if !fieldName.MatchString(field.Name) {
+		return fmt.Errorf("field name %v must start with a lowercase letter followed by lowercase letters, digits or _", field.Name)
+	}
+	if _, ok := RuleSchema[field.Name]; ok {
+		return fmt.Errorf("%v is a built-in field", field.Name)
+	}
+	if ruleexpr.IsKeyword(field.Name) {
+		return fmt.Errorf("%v is a keyword of rule expressions", field.Name)
+	}
+
+	field.Type = strings.ToLower(field.Type)
+	if _, ok := fieldTypes[field.Type]; !ok {
+		return fmt.Errorf("type must be one of %v, %v, %v, %v or %v", FIELD_STRING, FIELD_NUMBER, FIELD_ENUM, FIELD_LIST, FIELD_URL)
+	}
+
+	if field.Type == FIELD_ENUM && len(field.Values) == 0 {
+		return errors.New("an enum needs values")
+	}
+	if len(field.Values) > 0 && field.Type != FIELD_ENUM && field.Type != FIELD_LIST {
+		return errors.New("values only apply to enum and list fields")
+	}
+	for i, value := range field.Values {
+		if strings.TrimSpace(value) == "" {
+			return errors.New("values cannot be empty")
+		}
+		for _, other := range field.Values[:i] {
+			if strings.EqualFold(value, other) {
+				return fmt.Errorf("value %v is given twice", value)
+			}
+		}
+	}
+
+	if field.Pattern != "" {
+		if field.Type != FIELD_STRING && field.Type != FIELD_URL && field.Type != FIELD_LIST {
+			return errors.New("pattern only applies to string, url and list fields")
+		}
+		if _, err := regexp.Compile(field.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern %v : %v", field.Pattern, err)
+		}
+	}
+
+	if (field.Min != nil || field.Max != nil) && field.Type != FIELD_NUMBER {
+		return errors.New("min and max only apply to number fields")
+	}
+	if field.Min != nil && field.Max != nil && *field.Min > *field.Max {
+		return errors.New("min cannot be above max")
+	}
+	return nil
+}
+
+// UpdatedField applies an update to a stored field, the name and type of a field never change
+func UpdatedField(old, update models.Field) (models.Field, error) {
+	if update.Type != "" && !strings.EqualFold(update.Type, old.Type) {
+		return old, fmt.Errorf("type of %v cannot change from %v, delete and declare it again", old.Name, old.Type)
+	}
+
+	field := old
+	field.Description = update.Description
+	field.Required = update.Required
+	field.Values = update.Values
+	field.Pattern = update.Pattern
+	field.Min, field.Max = update.Min, update.Max
+	field.UpdatedBy = update.UpdatedBy
+	return field, CheckField(&field)
+}
+
+// ConstraintError refuses a field update whose new constraints stored services break
+type ConstraintError struct {
+	Field      string
+	References []models.Reference
+}
+
+func (e *ConstraintError) Error() string {
+	return fmt.Sprintf("field %v : %v services do not meet the new constraints, update their attribute first", e.Field, len(e.References))
+}
+
+// BrokenConstraints lists the services whose attribute met the constraints of old but
+// not those of field, a missing attribute breaks a field becoming required. Services
+// already failing old are left to their next update.
+func BrokenConstraints(services []models.ServiceResponse, old, field models.Field) []models.Reference {
+	refs := []models.Reference{}
+	for _, service := range services {
+		if attributeMeets(service, old) && !attributeMeets(service, field) {
+			refs = append(refs, models.Reference{Entity: GetEntityName(SERVICE), UUID: service.ServiceUUID, Name: service.ServiceName})
+		}
+	}
+	return refs
+}
+
+// attributeMeets reports whether the attribute of a service passes its field
+func attributeMeets(service models.ServiceResponse, field models.Field) bool {
+	value, ok := service.Attributes[field.Name]
+	if !ok || value == nil {
+		return !field.Required
+	}
+	return checkAttribute(field, value) == nil
+}
+
+// CheckAttributes validates the custom attributes of a service being saved against
+// the declared fields, null attributes are dropped
+func CheckAttributes(attributes map[string]interface{}, fields []models.Field) error {
+	declared := make(map[string]models.Field, len(fields))
+	for _, field := range fields {
+		declared[field.Name] = field
+	}
+
+	names := make([]string, 0, len(attributes))
+	for name, value := range attributes {
+		if value == nil {
+			delete(attributes, name)
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		field, ok := declared[name]
+		if !ok {
+			return fmt.Errorf("unknown attribute %v, declare it under /api/v1/fields first", name)
+		}
+		if err := checkAttribute(field, attributes[name]); err != nil {
+			return fmt.Errorf("attribute %v : %v", name, err)
+		}
+	}
+
+	for _, field := range fields {
+		if _, ok := attributes[field.Name]; field.Required && !ok {
+			return fmt.Errorf("attribute %v required", field.Name)
+		}
+	}
+	return nil
+}
+
+func checkAttribute(field models.Field, value interface{}) error {
+	switch field.Type {
+	case FIELD_NUMBER:
+		n, ok := attributeNumber(value)
+		if !ok {
+			return errors.New("must be a number")
+		}
+		if field.Min != nil && n < *field.Min {
+			return fmt.Errorf("must be at least %v", *field.Min)
+		}
+		if field.Max != nil && n > *field.Max {
+			return fmt.Errorf("must be at most %v", *field.Max)
+		}
+		return nil
+
+	case FIELD_LIST:
+		items, ok := attributeList(value)
+		if !ok {
+			return errors.New("must be a list of strings")
+		}
+		for _, item := range items {
+			if err := checkText(field, item); err != nil {
+				return fmt.Errorf("item %v %v", item, err)
+			}
+		}
+		return nil
+	}
+
+	s, ok := value.(string)
+	if !ok {
+		return errors.New("must be a string")
+	}
+	if field.Type == FIELD_URL {
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("must be an http or https url")
+		}
+	}
+	return checkText(field, s)
+}
+
+// checkText checks a string, url, enum value or list item against the values and pattern of its field
+func checkText(field models.Field, s string) error {
+	if len(field.Values) > 0 {
+		found := false
+		for _, value := range field.Values {
+			found = found || strings.EqualFold(value, s)
+		}
+		if !found {
+			return fmt.Errorf("must be one of %v", strings.Join(field.Values, ", "))
+		}
+	}
+	if field.Pattern != "" {
+		re, err := regexp.Compile(field.Pattern)
+		if err != nil {
+			return err
+		}
+		if !re.MatchString(s) {
+			return fmt.Errorf("must match %v", field.Pattern)
+		}
+	}
+	return nil
+}
+
+// attributeNumber reads a number decoded from JSON or a stored item
+func attributeNumber(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// attributeList reads a list of strings decoded from JSON or a stored item
+func attributeList(value interface{}) ([]string, bool) {
+	switch list := value.(type) {
+	case []string:
+		return list, true
+	case []interface{}:
+		items := make([]string, 0, len(list))
+		for _, item := range list {
+			s, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+			items = append(items, s)
+		}
+		return items, true
+	}
+	return nil, false
+}
+
+// attributeValue returns a custom attribute as rules see it, a service without
+// it reads as the empty string or 0 like the built-in fields
+func attributeValue(field models.Field, value interface{}) ruleexpr.Value {
+	switch field.Type {
+	case FIELD_NUMBER:
+		n, _ := attributeNumber(value)
+		return ruleexpr.NumberValue(n)
+	case FIELD_LIST:
+		items, _ := attributeList(value)
+		return ruleexpr.StringValue(strings.Join(items, ", "))
+	}
+	s, _ := value.(string)
+	return ruleexpr.StringValue(s)
+}
+
+// RuleFields returns the metadata fields a rule tests
+func RuleFields(rule models.RuleResponse) []string {
+	if rule.Expression != "" {
+		node, err := ruleexpr.Parse(rule.Expression)
+		if err != nil {
+			return nil
+		}
+		return ruleexpr.Fields(node)
+	}
+
+	fields := []string{metadataField(rule.MetadataField), metadataField(rule.CoRuleMetadataField)}
+	for _, cond := range rule.Conditions {
+		fields = append(fields, metadataField(cond.MetadataField))
+	}
+	return fields
+}
+
+// ContainsField reports whether a rule tests the field name
+func ContainsField(rule models.RuleResponse, name string) bool {
+	return contains(RuleFields(rule), name)
+}
+
+// usesCustomField reports whether a rule tests a field RuleSchema does not have
+func usesCustomField(rule models.RuleResponse) bool {
+	for _, field := range RuleFields(rule) {
+		if _, ok := RuleSchema[field]; !ok && field != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// FieldReferences lists the services having a value for the field name and the rules testing it
+func FieldReferences(services []models.ServiceResponse, rules []models.RuleResponse, name string) []models.Reference {
+	refs := []models.Reference{}
+	for _, service := range services {
+		if _, ok := service.Attributes[name]; ok {
+			refs = append(refs, models.Reference{Entity: GetEntityName(SERVICE), UUID: service.ServiceUUID, Name: service.ServiceName})
+		}
+	}
+	for _, rule := range rules {
+		if ContainsField(rule, name) {
+			refs = append(refs, models.Reference{Entity: GetEntityName(RULE), UUID: rule.RuleUUID})
+		}
+	}
+	return refs
+}
@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/auto-tagging-mds/database/models"
+)
+
+func TestCheckField(t *testing.T) {
+	one, ten := 1.0, 10.0
+
+	tests := []struct {
+		name    string
+		field   models.Field
+		wantErr bool
+	}{
+		{name: "string", field: models.Field{Name: "region", Type: "String"}},
+		{name: "enum", field: models.Field{Name: "tier", Type: FIELD_ENUM, Values: []string{"free", "pro"}}},
+		{name: "bounded number", field: models.Field{Name: "seats", Type: FIELD_NUMBER, Min: &one, Max: &ten}},
+		{name: "uppercase name", field: models.Field{Name: "Region", Type: FIELD_STRING}, wantErr: true},
+		{name: "built-in name", field: models.Field{Name: DESCRIPTION, Type: FIELD_STRING}, wantErr: true},
+		{name: "keyword name", field: models.Field{Name: "between", Type: FIELD_STRING}, wantErr: true},
+		{name: "unknown type", field: models.Field{Name: "region", Type: "date"}, wantErr: true},
+		{name: "enum without values", field: models.Field{Name: "tier", Type: FIELD_ENUM}, wantErr: true},
+		{name: "repeated value", field: models.Field{Name: "tier", Type: FIELD_ENUM, Values: []string{"pro", "Pro"}}, wantErr: true},
+		{name: "bounds of a string", field: models.Field{Name: "region", Type: FIELD_STRING, Min: &one}, wantErr: true},
+		{name: "min above max", field: models.Field{Name: "seats", Type: FIELD_NUMBER, Min: &ten, Max: &one}, wantErr: true},
+		{name: "invalid pattern", field: models.Field{Name: "region", Type: FIELD_STRING, Pattern: "("}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckField(&tt.field)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckAttributes(t *testing.T) {
+	one := 1.0
+	fields := []models.Field{
+		{Name: "seats", Type: FIELD_NUMBER, Min: &one, Required: true},
+		{Name: "tier", Type: FIELD_ENUM, Values: []string{"free", "pro"}},
+		{Name: "regions", Type: FIELD_LIST, Pattern: "^[a-z]{2}$"},
+		{Name: "homepage", Type: FIELD_URL},
+	}
+
+	tests := []struct {
+		name       string
+		attributes map[string]interface{}
+		wantErr    bool
+	}{
+		{name: "valid", attributes: map[string]interface{}{"seats": 5.0, "tier": "Pro", "regions": []interface{}{"eu", "us"},
+			"homepage": "https://example.com"}},
+		{name: "null attribute dropped", attributes: map[string]interface{}{"seats": 5.0, "tier": nil}},
+		{name: "missing required", attributes: map[string]interface{}{"tier": "pro"}, wantErr: true},
+		{name: "unknown attribute", attributes: map[string]interface{}{"seats": 5.0, "color": "red"}, wantErr: true},
+		{name: "below min", attributes: map[string]interface{}{"seats": 0.0}, wantErr: true},
+		{name: "not a number", attributes: map[string]interface{}{"seats": "5"}, wantErr: true},
+		{name: "not a value", attributes: map[string]interface{}{"seats": 5.0, "tier": "team"}, wantErr: true},
+		{name: "item not matching", attributes: map[string]interface{}{"seats": 5.0, "regions": []interface{}{"eur"}}, wantErr: true},
+		{name: "not a url", attributes: map[string]interface{}{"seats": 5.0, "homepage": "example.com"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckAttributes(tt.attributes, fields)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRuleMatchesDeclaredField(t *testing.T) {
+	fields := func() ([]models.Field, error) {
+		return []models.Field{{Name: "seats", Type: FIELD_NUMBER}, {Name: "regions", Type: FIELD_LIST}}, nil
+	}
+	service := models.StreamData{Attributes: map[string]interface{}{"seats": 50.0, "regions": []interface{}{"eu", "us"}}}
+	rule := models.RuleResponse{Operation: EXPRESSION, Expression: `seats > 10 and regions contains_word "us"`}
+
+	matched, err := RuleMatches(rule, ServiceFields(service, nil, nil, fields))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !matched {
+		t.Error("rule does not match")
+	}
+}
+
+func TestBrokenConstraints(t *testing.T) {
+	one, ten := 1.0, 10.0
+	services := []models.ServiceResponse{
+		{ServiceUUID: "small", ServiceName: "small", Attributes: map[string]interface{}{"seats": 5.0}},
+		{ServiceUUID: "large", ServiceName: "large", Attributes: map[string]interface{}{"seats": 50.0}},
+		{ServiceUUID: "none", ServiceName: "none"},
+	}
+	old := models.Field{Name: "seats", Type: FIELD_NUMBER, Min: &one}
+
+	tests := []struct {
+		name  string
+		field models.Field
+		want  []string
+	}{
+		{name: "unchanged", field: old},
+		{name: "max", field: models.Field{Name: "seats", Type: FIELD_NUMBER, Min: &one, Max: &ten}, want: []string{"large"}},
+		{name: "required", field: models.Field{Name: "seats", Type: FIELD_NUMBER, Required: true}, want: []string{"none"}},
+		{name: "looser", field: models.Field{Name: "seats", Type: FIELD_NUMBER}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refs := BrokenConstraints(services, old, tt.field)
+			if len(refs) != len(tt.want) {
+				t.Fatalf("references %v, want %v", refs, tt.want)
+			}
+			for i, ref := range refs {
+				if ref.UUID != tt.want[i] || ref.Entity != GetEntityName(SERVICE) {
+					t.Errorf("reference %v, want service %v", ref, tt.want[i])
+				}
+			}
+		})
+	}
+
+	// a service already failing the old constraints is not reported
+	old.Max = &ten
+	if refs := BrokenConstraints(services, old, old); len(refs) != 0 {
+		t.Errorf("references %v, want none", refs)
+	}
+}
@@ -0,0 +1,271 @@
+package utils
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/auto-tagging-mds/database/models"
+	"github.com/auto-tagging-mds/ruleexpr"
+)
+
+// stopWords are too common to be indexed or searched
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "but": true,
+	"by": true, "for": true, "from": true, "has": true, "have": true, "if": true, "in": true, "into": true,
+	"is": true, "it": true, "its": true, "no": true, "not": true, "of": true, "on": true, "or": true,
+	"so": true, "such": true, "that": true, "the": true, "their": true, "then": true, "there": true,
+	"these": true, "they": true, "this": true, "to": true, "was": true, "were": true, "will": true,
+	"with": true,
+}
+
+// minStem is the shortest stem a suffix is stripped down to
+const minStem = 3
+
+// stemChange bounds how many trailing characters of a word Stem removes or replaces
+const stemChange = 7
+
+// Words splits text into lowercased runs of letters and digits
+func Words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Stem strips the plural and the common derivational suffix of a lowercased
+// word, so that payments, payment and pay share the term pay
+func Stem(word string) string {
+	strip := func(suffix, replacement string) bool {
+		if !strings.HasSuffix(word, suffix) || len(word)-len(suffix)+len(replacement) < minStem {
+			return false
+		}
+		word = strings.TrimSuffix(word, suffix) + replacement
+		return true
+	}
+
+	switch {
+	case strip("sses", "ss"), strip("ies", "i"):
+	case strings.HasSuffix(word, "ss"), strings.HasSuffix(word, "us"), strings.HasSuffix(word, "is"):
+	default:
+		strip("s", "")
+	}
+
+	for _, suffix := range []string{"ness", "ment", "ing", "ed", "ly"} {
+		if strip(suffix, "") {
+			break
+		}
+	}
+
+	if len(word) > minStem {
+		strip("y", "i")
+	}
+	return word
+}
+
+// Tokenize returns the distinct terms of text: its words without stop words, stemmed
+func Tokenize(text string) []string {
+	terms := []string{}
+	seen := map[string]bool{}
+	for _, word := range Words(text) {
+		if stopWords[word] {
+			continue
+		}
+		term := Stem(word)
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// ServiceTerms returns the terms a service is indexed under
+func ServiceTerms(description, moreAbout string) []string {
+	return Tokenize(description + " " + moreAbout)
+}
+
+// TermPrefix returns the prefix every term of a word starting with word begins
+// with, false when such a word may be a stop word and so not indexed
+func TermPrefix(word string) (string, bool) {
+	for stop := range stopWords {
+		if strings.HasPrefix(stop, word) {
+			return "", false
+		}
+	}
+
+	// Stem keeps all but the last stemChange characters, and at least minStem
+	n := len(word) - stemChange
+	if n < minStem {
+		n = minStem
+	}
+	if n >= len(word) {
+		return word, true
+	}
+	for !utf8.RuneStart(word[n]) {
+		n--
+	}
+	return word[:n], true
+}
+
+// wordOperators only match at word starts, where the terms of the index begin
+var wordOperators = map[string]bool{
+	matchOperators[MATCH_WORD]:   true,
+	matchOperators[MATCH_PHRASE]: true,
+	matchOperators[MATCH_PREFIX]: true,
+}
+
+// ServiceTermEntries returns the index entries of the stored service, empty for a
+// deleted one, and the range keys of the entries of oldTerms it no longer has
+func ServiceTermEntries(service models.ServiceResponse, serviceUUID string, oldTerms []string) ([]models.ServiceTerm, []string) {
+	entries := []models.ServiceTerm{}
+	current := map[string]bool{}
+	if service.ServiceName != "" {
+		for _, term := range ServiceTerms(service.Description, service.MoreAbout) {
+			current[term] = true
+			entries = append(entries, models.ServiceTerm{
+				PK:          GetPartitionKey(SERVICE_TERM),
+				SK:          GetRangeKey(SERVICE_TERM, term, "", serviceUUID),
+				Term:        term,
+				ServiceUUID: serviceUUID,
+				ServiceSK:   service.SK,
+			})
+		}
+	}
+
+	stale := []string{}
+	for _, term := range oldTerms {
+		if !current[term] {
+			stale = append(stale, GetRangeKey(SERVICE_TERM, term, "", serviceUUID))
+		}
+	}
+	return entries, stale
+}
+
+// TermRangeKey returns the range key prefix of the index entries of term, or of
+// all terms starting with term when prefix is set
+func TermRangeKey(term string, prefix bool) string {
+	rangeKey := GetRangeKey(SERVICE_TERM, term, "", "")
+	if prefix {
+		return strings.TrimSuffix(rangeKey, "#")
+	}
+	return rangeKey
+}
+
+// RuleCandidates returns the uuids of the services a rule can match, found through
+// the term index from its word, phrase and prefix conditions on description and
+// more_about and the synonyms thesaurus has for them. It returns false when the
+// rule needs other conditions, and every service is a candidate: a substring can
+// start inside a word, which has no term. schema is the one RuleExpression takes.
+func RuleCandidates(rule models.RuleResponse, lookup func(prefix string) ([]models.ServiceTerm, error), thesaurus ruleexpr.Thesaurus, schema ruleexpr.Schema) ([]string, bool, error) {
+	node, err := RuleExpression(rule, schema)
+	if err != nil {
+		return nil, false, err
+	}
+
+	set, ok, err := candidates(node, lookup, thesaurus)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+
+	uuids := make([]string, 0, len(set))
+	for uuid := range set {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	return uuids, true, nil
+}
+
+func candidates(node ruleexpr.Node, lookup func(prefix string) ([]models.ServiceTerm, error), thesaurus ruleexpr.Thesaurus) (map[string]bool, bool, error) {
+	switch n := node.(type) {
+	case *ruleexpr.Literal:
+		if n.Value {
+			return nil, false, nil
+		}
+		return map[string]bool{}, true, nil
+
+	case *ruleexpr.Comparison:
+		if !wordOperators[n.Op] || (n.Field != DESCRIPTION && n.Field != MOREABOUT) {
+			return nil, false, nil
+		}
+
+		synonyms, err := thesaurus.Synonyms(n.Operand.Str)
+		if err != nil {
+			return nil, false, err
+		}
+
+		// a service can match the operand or any of its synonyms
+		union := map[string]bool{}
+		for _, operand := range append([]string{n.Operand.Str}, synonyms...) {
+			set, ok, err := operandCandidates(operand, lookup)
+			if err != nil || !ok {
+				return nil, ok, err
+			}
+			for uuid := range set {
+				union[uuid] = true
+			}
+		}
+		return union, true, nil
+
+	case *ruleexpr.Logical:
+		left, leftOK, err := candidates(n.Left, lookup, thesaurus)
+		if err != nil {
+			return nil, false, err
+		}
+		right, rightOK, err := candidates(n.Right, lookup, thesaurus)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if n.Op == "or" {
+			if !leftOK || !rightOK {
+				return nil, false, nil
+			}
+			for uuid := range right {
+				left[uuid] = true
+			}
+			return left, true, nil
+		}
+
+		// both sides of an and have to match, either narrows the candidates
+		switch {
+		case leftOK && rightOK:
+			both := map[string]bool{}
+			for uuid := range left {
+				if right[uuid] {
+					both[uuid] = true
+				}
+			}
+			return both, true, nil
+		case leftOK:
+			return left, true, nil
+		}
+		return right, rightOK, nil
+	}
+	return nil, false, nil
+}
+
+// operandCandidates returns the services having every word of operand, false when
+// all its words may be stop words
+func operandCandidates(operand string, lookup func(prefix string) ([]models.ServiceTerm, error)) (map[string]bool, bool, error) {
+	var set map[string]bool
+	for _, word := range Words(operand) {
+		prefix, ok := TermPrefix(word)
+		if !ok {
+			continue
+		}
+		entries, err := lookup(prefix)
+		if err != nil {
+			return nil, false, err
+		}
+
+		found := map[string]bool{}
+		for _, entry := range entries {
+			if set == nil || set[entry.ServiceUUID] {
+				found[entry.ServiceUUID] = true
+			}
+		}
+		set = found
+	}
+	return set, set != nil, nil
+}
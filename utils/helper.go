@@ -2,6 +2,7 @@ package utils
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -20,6 +21,12 @@ const (
 	COMPANY
 	TAG
 	RULE
+	HISTORY
+	BACKFILL
+	SERVICE_TAG
+	SERVICE_TERM
+	SYNONYM
+	FIELD
 )
 
 const (
@@ -39,12 +46,15 @@ const (
 	EQUAL              = "EQUAL"
 	GREATER_THAN_EQUAL = "GREATER_THAN_EQUAL"
 	LESSER_THAN_EQUAL  = "LESSER_THAN_EQUAL"
+	BETWEEN            = "BETWEEN"
+	IN                 = "IN"
 )
 
 const (
 	CONTAIN            = "CONTAIN"
 	RELATION           = "RELATION"
 	SUBSCRIPTION_COUNT = "SUBSCRIPTION_COUNT"
+	EXPRESSION         = "EXPRESSION"
 )
 
 const (
@@ -62,6 +72,18 @@ func GetEntityType(pk string) int {
 		return TAG
 	case "CM":
 		return COMPANY
+	case "HS":
+		return HISTORY
+	case "BF":
+		return BACKFILL
+	case "ST":
+		return SERVICE_TAG
+	case "TM":
+		return SERVICE_TERM
+	case "SY":
+		return SYNONYM
+	case "FD":
+		return FIELD
 	}
 	return -1
 }
@@ -77,6 +99,18 @@ func GetPartitionKey(entity int) string {
 		partitionKey = "TG"
 	case RULE:
 		partitionKey = "RL"
+	case HISTORY:
+		partitionKey = "HS"
+	case BACKFILL:
+		partitionKey = "BF"
+	case SERVICE_TAG:
+		partitionKey = "ST"
+	case SERVICE_TERM:
+		partitionKey = "TM"
+	case SYNONYM:
+		partitionKey = "SY"
+	case FIELD:
+		partitionKey = "FD"
 	}
 	return partitionKey
 }
@@ -96,6 +130,22 @@ func GetRangeKey(entity int, name, value, uuid string) string {
 		}
 	case RULE:
 		rangeKey = "RL#" + uuid
+	case HISTORY:
+		// name is the entity id, value the change sequence
+		rangeKey = "HS#" + name + "#" + value
+	case BACKFILL:
+		rangeKey = "BF#" + uuid
+	case SERVICE_TAG:
+		// the services of a tag share the prefix without uuid
+		rangeKey = "ST#" + strings.ToLower(name) + "#" + strings.ToLower(value) + "#" + uuid
+	case SERVICE_TERM:
+		// name is the term, the services of a term share the prefix without uuid
+		rangeKey = "TM#" + name + "#" + uuid
+	case SYNONYM:
+		// the term as synonymKey compares it, terms differing in case or spacing are one group
+		rangeKey = "SY#" + synonymKey(name)
+	case FIELD:
+		rangeKey = "FD#" + strings.ToLower(name)
 	}
 	return EncodeSpace(rangeKey)
 }
@@ -123,10 +173,11 @@ func ApiResponse(status int, body interface{}) (events.APIGatewayProxyResponse,
 	resp := events.APIGatewayProxyResponse{}
 	resp.StatusCode = status
 	resp.Headers = map[string]string{
-		"Access-Control-Allow-Origin":  "*",
-		"Access-Control-Allow-Headers": "origin,Accept,Authorization,Content-Type,X-Amz-Date,X-Api-Key,X-Amz-Security-Token",
-		"Access-Control-Allow-Methods": "DELETE,GET,OPTIONS,POST,PUT",
-		"Content-Type":                 "application/json",
+		"Access-Control-Allow-Origin":   "*",
+		"Access-Control-Allow-Headers":  "origin,Accept,Authorization,Content-Type,If-Match,X-Amz-Date,X-Api-Key,X-Amz-Security-Token",
+		"Access-Control-Allow-Methods":  "DELETE,GET,OPTIONS,POST,PUT",
+		"Access-Control-Expose-Headers": "ETag",
+		"Content-Type":                  "application/json",
 	}
 
 	stringBody, _ := json.Marshal(body)
@@ -134,6 +185,63 @@ func ApiResponse(status int, body interface{}) (events.APIGatewayProxyResponse,
 	return resp, nil
 }
 
+// ErrVersionConflict is returned by updates whose expected version is not the stored one
+var ErrVersionConflict = errors.New("version conflict : entity was modified, fetch it again")
+
+// ETag formats an entity version as a strong entity tag
+func ETag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// ApiResponseWithETag is ApiResponse carrying the version of the returned entity
+func ApiResponseWithETag(status int, body interface{}, version int) (events.APIGatewayProxyResponse, error) {
+	resp, err := ApiResponse(status, body)
+	resp.Headers["ETag"] = ETag(version)
+	return resp, err
+}
+
+// UNVERSIONED is the expected version of an update sent with the ETag "0" of an
+// item stored before versions existed
+const UNVERSIONED = -1
+
+// GetIfMatchVersion returns the version sent in the If-Match header, 0 when the header is absent
+// or "*", which any stored version matches, and UNVERSIONED for "0"
+func GetIfMatchVersion(headers map[string]string) (int, error) {
+	for name, value := range headers {
+		if !strings.EqualFold(name, "If-Match") {
+			continue
+		}
+
+		// the entity only has to exist, as for every update
+		if strings.TrimSpace(value) == "*" {
+			return 0, nil
+		}
+
+		value = strings.TrimPrefix(strings.TrimSpace(value), "W/")
+		version, err := strconv.Atoi(strings.Trim(value, `"`))
+		if err != nil || version < 0 {
+			return 0, errors.New("If-Match must be an ETag returned by the API")
+		}
+		if version == 0 {
+			return UNVERSIONED, nil
+		}
+		return version, nil
+	}
+	return 0, nil
+}
+
+// VersionMatches reports whether an update expecting version may replace an item stored at
+// stored, 0 expects nothing
+func VersionMatches(expected, stored int) bool {
+	switch expected {
+	case 0:
+		return true
+	case UNVERSIONED:
+		return stored == 0
+	}
+	return expected == stored
+}
+
 func EncodeSpace(key string) string {
 	if strings.Contains(key, "%20") {
 		key = strings.ReplaceAll(key, "%20", DELIMITER)
@@ -191,123 +299,15 @@ func NilToEmptySlice(av map[string]*dynamodb.AttributeValue, field string) map[s
 	return av
 }
 
+// IsServiceEligibleForTag evaluates a rule on the service fields of streamData,
+// rules reading subscriber_count need the database and never match here
 func IsServiceEligibleForTag(streamData models.StreamData, rule models.RuleResponse) bool {
-
-	fmt.Println("IsTagAttachable start")
-
-	// ruleMetadataFieldList contains MetadataField and CoRuleMetadataField
-	ruleMetadataFieldList := make([]string, 0)
-	// ruleKeywordList contains Keyword and CoRuleKeyword
-	ruleKeywordList := make([]string, 0)
-
-	ruleMetadataFieldList = append(ruleMetadataFieldList, rule.MetadataField)
-	ruleKeywordList = append(ruleKeywordList, rule.Keyword)
-
-	if rule.CoRuleMetadataField != "" && rule.KeywordOperator != "" {
-		ruleMetadataFieldList = append(ruleMetadataFieldList, rule.CoRuleMetadataField)
-		ruleKeywordList = append(ruleKeywordList, rule.CoRuleKeyword)
-	}
-
-	if len(ruleMetadataFieldList) == 1 {
-		fmt.Println("single condition")
-	} else {
-		fmt.Println("composite condition")
-	}
-
-	var cond [2]bool
-	for i, ruleMetadataField := range ruleMetadataFieldList {
-		cond[i] = matchCondition(ruleMetadataField, streamData, ruleKeywordList[i], rule.Operand, rule.RelationalOperator)
-		fmt.Printf("Is :%v condition matched :%v\n", i, cond[i])
-	}
-
-	switch rule.KeywordOperator {
-	case AND:
-		fmt.Println("composite condition with AND: is true :", cond[0] && cond[1])
-		return cond[0] && cond[1]
-	case OR:
-		fmt.Println("composite condition with OR: is true :", cond[0] || cond[1])
-		return cond[0] || cond[1]
-	case "":
-		fmt.Println("single condition : is true :", cond[0])
-		return cond[0]
-	default:
-		fmt.Println("unknown keyword operator")
+	matched, err := RuleMatches(rule, ServiceFields(streamData, nil, nil, nil))
+	if err != nil {
+		fmt.Println("IsServiceEligibleForTag : ", err)
 		return false
 	}
-}
-
-func matchCondition(ruleMetadataField string, streamData models.StreamData, keyword string, operand int, relationalOperator string) bool {
-	// mdValue : description value, like value
-	mdValue := getMetaDataFieldValue(ruleMetadataField, streamData)
-	fmt.Println("matchCondition : metadata field value : ", mdValue)
-	fmt.Printf("matchCondition : ruleMetadataField : %v : relationalOperator : %v: Is like == like %v\n", ruleMetadataField, relationalOperator, strings.ToLower(ruleMetadataField) == LIKE)
-
-	if strings.ToLower(ruleMetadataField) == LIKE {
-		likeCount, _ := strconv.Atoi(mdValue)
-		switch relationalOperator {
-		case GREATER_THAN:
-			fmt.Printf("GREATER_THAN :Checking condition service_likeCount :%v rule like_count %v : matched : %v\n", likeCount, operand, likeCount > operand)
-			if likeCount > operand {
-				return true
-			}
-		case LESSER_THAN:
-			fmt.Printf("LESSER_THAN :Checking condition service_likeCount :%v rule like_count %v : matched : %v\n", likeCount, operand, likeCount < operand)
-			if likeCount < operand {
-				return true
-			}
-		case GREATER_THAN_EQUAL:
-			fmt.Printf("GREATER_THAN_EQUAL :Checking condition service_likeCount :%v rule like_count %v : matched : %v\n", likeCount, operand, likeCount >= operand)
-			if likeCount >= operand {
-				return true
-			}
-		case LESSER_THAN_EQUAL:
-			fmt.Printf("LESSER_THAN_EQUAL :Checking condition service_likeCount :%v rule like_count %v : matched : %v\n", likeCount, operand, likeCount <= operand)
-			if likeCount <= operand {
-				return true
-			}
-		case EQUAL:
-			fmt.Printf("EQUAL :Checking condition service_likeCount :%v rule like_count %v : matched : %v\n", likeCount, operand, likeCount == operand)
-			if likeCount == operand {
-				return true
-			}
-		}
-	} else {
-		keyword := strings.ToLower(keyword)
-		fmt.Printf("CONTAIN : keyword %v : mdValue : %v", keyword, mdValue)
-		if strings.Contains(mdValue, keyword) {
-			fmt.Println("CONTAIN : found keyword in metadata field value")
-			return true
-		}
-	}
-	return false
-}
-
-func getMetaDataFieldValue(md string, streamData models.StreamData) string {
-	value := ""
-	md = strings.ReplaceAll(strings.ToLower(md), " ", "")
-
-	switch md {
-	case DESCRIPTION:
-		value = streamData.Description
-	case LOCATION:
-		value = streamData.Location
-	case LIKE:
-		value = fmt.Sprint(streamData.Like)
-	case TARGETSEGMENT:
-		value = streamData.TargetSegment
-	case PRICING:
-		value = streamData.Pricing
-	case BUSINESSMODEL:
-		value = streamData.BusinessModel
-	case DEPLOYMENT:
-		value = streamData.Deployment
-	case STAGE:
-		value = streamData.Stage
-	default:
-		return ""
-	}
-
-	return strings.ToLower(value)
+	return matched
 }
 
 func IsTagAlreadyPresent(category []models.Category, cat models.Category) bool {
@@ -331,9 +331,11 @@ func StreamDataToRuleConversion(streamData models.StreamData) (rule models.RuleR
 	rule.KeywordOperator = streamData.KeywordOperator
 	rule.RelationalOperator = streamData.RelationalOperator
 	rule.Operand = streamData.Operand
+	rule.RelationalValues = streamData.RelationalValues
 	rule.SubscriptionCount = streamData.SubscriptionCount
 	rule.CoRuleMetadataField = streamData.CoRuleMetadataField
 	rule.CoRuleKeyword = streamData.CoRuleKeyword
+	rule.Expression = streamData.Expression
 
 	return rule
 }
@@ -353,6 +355,38 @@ func ServiceToStreamDataConversion(service models.ServiceResponse) (streamData m
 	streamData.BusinessModel = service.BusinessModel
 	streamData.Pricing = service.Pricing
 	streamData.Location = service.Location
+	streamData.Attributes = service.Attributes
+	streamData.CreatedAt = service.CreatedAt
+	streamData.UpdatedAt = service.UpdatedAt
 
 	return streamData
 }
+
+// CreateTagResponse groups tag items by key into one list entry per key
+func CreateTagResponse(tags []models.TagResponse, tagList []models.TagListResponse) []models.TagListResponse {
+	tagMap := make(map[string][]string, 0)
+	detailMap := make(map[string][]models.TagResponse, 0)
+	createdAt := ""
+	updatedAt := ""
+
+	for _, tag := range tags {
+		tagMap[tag.Key] = append(tagMap[tag.Key], tag.Value)
+		detailMap[tag.Key] = append(detailMap[tag.Key], tag)
+		// TODO: create logic to get oldest created_at and latest updated_at
+		createdAt = tag.CreatedAt
+		updatedAt = tag.UpdatedAt
+	}
+
+	for key, value := range tagMap {
+		temp := models.TagListResponse{
+			Key:       key,
+			Values:    value,
+			Tags:      detailMap[key],
+			CreatedAt: createdAt,
+			UpdatedAt: updatedAt,
+		}
+		tagList = append(tagList, temp)
+	}
+
+	return tagList
+}
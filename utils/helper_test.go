@@ -0,0 +1,38 @@
+package utils
+
+import "testing"
+
+func TestGetIfMatchVersion(t *testing.T) {
+	tests := []struct {
+		header  string
+		want    int
+		wantErr bool
+	}{
+		{header: `"3"`, want: 3},
+		{header: `W/"3"`, want: 3},
+		{header: `"0"`, want: UNVERSIONED},
+		{header: `*`, want: 0},
+		{header: ` * `, want: 0},
+		{header: `"*"`, wantErr: true},
+		{header: `"-1"`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			got, err := GetIfMatchVersion(map[string]string{"if-match": tt.header})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("version %v, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("got %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+
+	if got, err := GetIfMatchVersion(map[string]string{}); err != nil || got != 0 {
+		t.Errorf("without If-Match got %v, %v, want 0", got, err)
+	}
+}
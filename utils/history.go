@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	HISTORY_CREATE = "create"
+	HISTORY_UPDATE = "update"
+	HISTORY_DELETE = "delete"
+)
+
+// SYSTEM_ACTOR is recorded as updated_by for writes made by the stream processor
+const SYSTEM_ACTOR = "system:auto-tagging"
+
+const ANONYMOUS_ACTOR = "anonymous"
+
+// sequenceWidth pads change sequences so that range keys sort in change order
+const sequenceWidth = 40
+
+// GetActor returns who sent an API request, taken from the authorizer
+// principal or else the caller identity API Gateway resolved
+func GetActor(request events.APIGatewayProxyRequest) string {
+	if principal, ok := request.RequestContext.Authorizer["principalId"].(string); ok && principal != "" {
+		return principal
+	}
+
+	identity := request.RequestContext.Identity
+	for _, actor := range []string{identity.UserArn, identity.User, identity.CognitoIdentityID, identity.APIKeyID} {
+		if actor != "" {
+			return actor
+		}
+	}
+	return ANONYMOUS_ACTOR
+}
+
+// GetEntityName returns the name an entity is exposed with in history items
+func GetEntityName(entity int) string {
+	switch entity {
+	case SERVICE:
+		return "service"
+	case COMPANY:
+		return "company"
+	case TAG:
+		return "tag"
+	case RULE:
+		return "rule"
+	case SYNONYM:
+		return "synonym"
+	case FIELD:
+		return "field"
+	}
+	return ""
+}
+
+// HistorySequence pads a stream sequence number to a fixed width
+func HistorySequence(sequence string) string {
+	if len(sequence) >= sequenceWidth {
+		return sequence
+	}
+	return strings.Repeat("0", sequenceWidth-len(sequence)) + sequence
+}
+
+// GetTagHistoryId returns the id under which the history of a tag is kept,
+// tags have no uuid so their range key is used
+func GetTagHistoryId(key, value string) string {
+	return GetRangeKey(TAG, key, value, "")
+}
+
+// HistoryTimestamp formats the time of a change like DateString, falling
+// back to the current time when the stream record carries none
+func HistoryTimestamp(t time.Time) string {
+	loc, err := time.LoadLocation("Asia/Tokyo")
+	if t.IsZero() || err != nil {
+		return DateString("datetime")
+	}
+	return t.In(loc).Format("2006-01-02 15:04:05")
+}
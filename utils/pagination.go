@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/auto-tagging-mds/database/models"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	DEFAULT_PAGE_LIMIT = 100
+	MAX_PAGE_LIMIT     = 1000
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ListResponse is the body returned by every index handler
+type ListResponse struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// GetPageParameters reads the limit and cursor query parameters of a list request
+func GetPageParameters(query map[string]string) (int, string, error) {
+	limit := DEFAULT_PAGE_LIMIT
+	if value, ok := query["limit"]; ok && value != "" {
+		l, err := strconv.Atoi(value)
+		if err != nil || l < 1 || l > MAX_PAGE_LIMIT {
+			return 0, "", errors.New("limit must be a number between 1 and " + strconv.Itoa(MAX_PAGE_LIMIT))
+		}
+		limit = l
+	}
+	return limit, query["cursor"], nil
+}
+
+// EncodeCursor turns the LastEvaluatedKey of a query into an opaque cursor,
+// an empty key gives an empty cursor meaning there is no next page
+func EncodeCursor(key map[string]*dynamodb.AttributeValue) string {
+	if len(key) == 0 {
+		return ""
+	}
+
+	plain := make(map[string]string, len(key))
+	for name, av := range key {
+		if av != nil && av.S != nil {
+			plain[name] = *av.S
+		}
+	}
+
+	b, _ := json.Marshal(plain)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// CursorFor returns the cursor resuming a query of partition pk after range key sk
+func CursorFor(pk, sk string) string {
+	return EncodeCursor(map[string]*dynamodb.AttributeValue{
+		GetPartitionKeyName(): {S: aws.String(pk)},
+		GetRangeKeyName():     {S: aws.String(sk)},
+	})
+}
+
+// DecodeCursor returns the ExclusiveStartKey encoded in cursor, nil for an empty cursor.
+// The cursor must belong to partition pk.
+func DecodeCursor(cursor string, pk string) (map[string]*dynamodb.AttributeValue, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	plain := map[string]string{}
+	if err := json.Unmarshal(b, &plain); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	if plain[GetPartitionKeyName()] != pk || plain[GetRangeKeyName()] == "" {
+		return nil, ErrInvalidCursor
+	}
+
+	key := make(map[string]*dynamodb.AttributeValue, len(plain))
+	for name, value := range plain {
+		key[name] = &dynamodb.AttributeValue{S: aws.String(value)}
+	}
+	return key, nil
+}
+
+// CursorRangeKey returns the range key a cursor of partition pk resumes after, "" for an empty cursor
+func CursorRangeKey(cursor string, pk string) (string, error) {
+	key, err := DecodeCursor(cursor, pk)
+	if err != nil || key == nil {
+		return "", err
+	}
+	return *key[GetRangeKeyName()].S, nil
+}
+
+// TrimPartialTagGroup drops the trailing tags sharing the key of the last tag,
+// so that a tag key is not split between two pages. A page holding a single
+// key is kept as is.
+func TrimPartialTagGroup(tags []models.TagCreateRequest) []models.TagCreateRequest {
+	if len(tags) == 0 {
+		return tags
+	}
+
+	lastKey := tags[len(tags)-1].Key
+	i := len(tags)
+	for i > 0 && tags[i-1].Key == lastKey {
+		i--
+	}
+
+	if i == 0 {
+		return tags
+	}
+	return tags[:i]
+}
+
+func TagCreateToTagResponse(tags []models.TagCreateRequest) []models.TagResponse {
+	resp := make([]models.TagResponse, 0, len(tags))
+	for _, t := range tags {
+		resp = append(resp, models.TagResponse{Key: t.Key, Value: t.Value, ParentKey: t.ParentKey, ParentValue: t.ParentValue,
+			RenamedFromKey: t.RenamedFromKey, RenamedFromValue: t.RenamedFromValue, CreatedAt: t.CreatedAt, UpdatedAt: t.UpdatedAt, Version: t.Version, UpdatedBy: t.UpdatedBy, TagMetadata: t.TagMetadata})
+	}
+	return resp
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/auto-tagging-mds/database/models"
+)
+
+// IsSameTag compares tags the way their range keys do, ignoring case
+func IsSameTag(cat models.Category, key, value string) bool {
+	return strings.EqualFold(cat.Key, key) && strings.EqualFold(cat.Value, value)
+}
+
+// RemoveCategory drops the tag key:value from a category list, reporting whether it was there
+func RemoveCategory(category []models.Category, key, value string) ([]models.Category, bool) {
+	kept := make([]models.Category, 0, len(category))
+	for _, cat := range category {
+		if !IsSameTag(cat, key, value) {
+			kept = append(kept, cat)
+		}
+	}
+	return kept, len(kept) != len(category)
+}
+
+// RemoveServiceUUID drops a service from a company service list, reporting whether it was there
+func RemoveServiceUUID(serviceList []string, serviceUUID string) ([]string, bool) {
+	kept := make([]string, 0, len(serviceList))
+	for _, id := range serviceList {
+		if id != serviceUUID {
+			kept = append(kept, id)
+		}
+	}
+	return kept, len(kept) != len(serviceList)
+}
+
+// ReferencedError refuses the delete of a tag or service other entities still point at
+type ReferencedError struct {
+	Entity     string
+	References []models.Reference
+}
+
+func (e *ReferencedError) Error() string {
+	return fmt.Sprintf("%v is referenced by %v entities, delete with cascade=true to detach it", e.Entity, len(e.References))
+}
+
+// ServiceReferences lists the companies subscribed to a service
+func ServiceReferences(companies []models.Company, serviceUUID string) []models.Reference {
+	refs := []models.Reference{}
+	for _, company := range companies {
+		if _, found := RemoveServiceUUID(company.ServiceList, serviceUUID); found {
+			refs = append(refs, models.Reference{Entity: GetEntityName(COMPANY), UUID: company.CompanyUUID, Name: company.CompanyName})
+		}
+	}
+	return refs
+}
+
+// TagReferences lists the services carrying the tag key:value, the rules assigning it and
+// the tags below it or replaced by it
+func TagReferences(services []models.ServiceResponse, rules []models.RuleResponse, dependents []models.TagResponse, key, value string) []models.Reference {
+	refs := []models.Reference{}
+	for _, tag := range dependents {
+		refs = append(refs, models.Reference{Entity: GetEntityName(TAG), Name: tag.Key + ":" + tag.Value})
+	}
+	for _, service := range services {
+		if _, found := RemoveCategory(service.Category, key, value); found {
+			refs = append(refs, models.Reference{Entity: GetEntityName(SERVICE), UUID: service.ServiceUUID, Name: service.ServiceName})
+		}
+	}
+	for _, rule := range rules {
+		if IsSameTag(models.Category{Key: rule.TagKey, Value: rule.TagValue}, key, value) {
+			refs = append(refs, models.Reference{Entity: GetEntityName(RULE), UUID: rule.RuleUUID})
+		}
+	}
+	return refs
+}
+
+// GetCascade reads the cascade query parameter of a delete, false when absent
+func GetCascade(params map[string]string) (bool, error) {
+	cascade, ok := params["cascade"]
+	if !ok || cascade == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(cascade)
+	if err != nil {
+		return false, errors.New("cascade must be true or false")
+	}
+	return b, nil
+}
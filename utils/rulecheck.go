@@ -0,0 +1,358 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/auto-tagging-mds/database/models"
+	"github.com/auto-tagging-mds/ruleexpr"
+)
+
+// ValidationError rejects a rule with the defects of its fields
+type ValidationError struct {
+	Errors []models.FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, fe := range e.Errors {
+		msgs = append(msgs, fe.Field+" : "+fe.Message)
+	}
+	return "invalid rule : " + strings.Join(msgs, ", ")
+}
+
+// ruleErrors collects the defects of a rule, the first one of each field
+type ruleErrors []models.FieldError
+
+func (e *ruleErrors) add(field string, format string, args ...interface{}) {
+	for _, fe := range *e {
+		if fe.Field == field {
+			return
+		}
+	}
+	*e = append(*e, models.FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// operationFields lists the optional fields each operation reads, the others are ignored
+// when the rule is evaluated
+var operationFields = map[string][]string{
+	CONTAIN: {"metadata_field", "keyword", "keyword_operator", "corule_metadata_field", "corule_keyword",
+		"match_mode", "synonyms", "fuzzy_threshold", "condition_mode", "conditions"},
+	RELATION: {"metadata_field", "keyword_operator", "corule_metadata_field", "relational_operator",
+		"relational_operand", "relational_values", "match_mode", "fuzzy_threshold", "condition_mode", "conditions"},
+	SUBSCRIPTION_COUNT: {"subscription_count"},
+	EXPRESSION:         {"expression"},
+}
+
+// keywordFields are the built-in string fields keyword conditions read, service_name
+// and more_about are only read by expressions
+var keywordFields = map[string]bool{
+	DESCRIPTION:   true,
+	LOCATION:      true,
+	TARGETSEGMENT: true,
+	PRICING:       true,
+	BUSINESSMODEL: true,
+	DEPLOYMENT:    true,
+	STAGE:         true,
+}
+
+// keywordField reports whether keyword conditions can test a field, declared string fields included
+func keywordField(field string, schema ruleexpr.Schema) bool {
+	_, builtin := RuleSchema[field]
+	return keywordFields[field] || !builtin && schema[field] == ruleexpr.String
+}
+
+// normalizeRule uppercases the modes of a rule, the defaults are stored empty
+func normalizeRule(rule *models.RuleRequest) {
+	rule.MatchMode = strings.ToUpper(rule.MatchMode)
+	if rule.MatchMode == MATCH_SUBSTRING {
+		rule.MatchMode = ""
+	}
+	rule.ConditionMode = strings.ToUpper(rule.ConditionMode)
+	if rule.ConditionMode == CONDITION_ALL {
+		rule.ConditionMode = ""
+	}
+}
+
+// ValidateRule returns every defect of a rule for its operation: a missing or
+// misplaced field, a field keyword conditions cannot read, an operator or operand
+// not fitting the type of the field. fields are the declared fields it can test.
+func ValidateRule(rule models.RuleRequest, fields []models.Field) []models.FieldError {
+	normalizeRule(&rule)
+	schema := FieldSchema(fields)
+	errs := ruleErrors{}
+
+	allowed, ok := operationFields[rule.Operation]
+	if !ok {
+		if rule.Operation == "" {
+			errs.add("operation", "required")
+		} else {
+			errs.add("operation", "must be one of %v, %v, %v or %v", CONTAIN, RELATION, SUBSCRIPTION_COUNT, EXPRESSION)
+		}
+		return errs
+	}
+	for _, name := range setFields(rule) {
+		// the expression of the other operations is derived, GET returns it and a PUT may send it back
+		if !contains(allowed, name) && name != "expression" {
+			errs.add(name, "does not apply to %v rules", rule.Operation)
+		}
+	}
+
+	switch rule.Operation {
+	case CONTAIN:
+		validateKeywordRule(rule, schema, &errs, false)
+	case RELATION:
+		validateKeywordRule(rule, schema, &errs, true)
+	case SUBSCRIPTION_COUNT:
+		if rule.SubscriptionCount < 0 {
+			errs.add("subscription_count", "cannot be negative")
+		}
+	case EXPRESSION:
+		if rule.Expression == "" {
+			errs.add("expression", "required for operation %v", EXPRESSION)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	// the conditions passed, what is left is the expression saved: the one given for
+	// EXPRESSION, the one derived from the fields for the other operations
+	src := rule.Expression
+	if rule.Operation != EXPRESSION {
+		src = LegacyExpression(models.RuleResponse(rule), schema)
+	}
+	node, err := ruleexpr.Compile(src, schema)
+	if err != nil {
+		errs.add("expression", "%v", err)
+		return errs
+	}
+
+	// a stored rule whose expression disagrees with its fields is flagged the same way
+	if rule.Operation != EXPRESSION && rule.Expression != "" {
+		sent, err := ruleexpr.Compile(rule.Expression, schema)
+		if err != nil || sent.String() != node.String() {
+			errs.add("expression", "differs from %v, the expression of the fields of this %v rule; "+
+				"send it with operation %v or leave it out", node, rule.Operation, EXPRESSION)
+		}
+	}
+	return errs
+}
+
+// setFields returns the json names of the optional fields a rule sets
+func setFields(rule models.RuleRequest) []string {
+	set := []string{}
+	add := func(name string, ok bool) {
+		if ok {
+			set = append(set, name)
+		}
+	}
+	add("metadata_field", rule.MetadataField != "")
+	add("keyword", rule.Keyword != "")
+	add("keyword_operator", rule.KeywordOperator != "")
+	add("corule_metadata_field", rule.CoRuleMetadataField != "")
+	add("corule_keyword", rule.CoRuleKeyword != "")
+	add("match_mode", rule.MatchMode != "")
+	add("synonyms", len(rule.Synonyms) > 0)
+	add("fuzzy_threshold", rule.FuzzyThreshold != 0)
+	add("condition_mode", rule.ConditionMode != "")
+	add("conditions", len(rule.Conditions) > 0)
+	add("relational_operator", rule.RelationalOperator != "")
+	add("relational_operand", rule.Operand != 0)
+	add("relational_values", len(rule.RelationalValues) > 0)
+	add("subscription_count", rule.SubscriptionCount != 0)
+	add("expression", rule.Expression != "")
+	return set
+}
+
+// validateKeywordRule checks a CONTAIN rule, whose fields are strings matched with
+// keywords, or a RELATION rule, whose fields are numbers or dates compared with
+// relational_operator. Conditions may mix both.
+func validateKeywordRule(rule models.RuleRequest, schema ruleexpr.Schema, errs *ruleErrors, relation bool) {
+	if _, ok := matchOperators[rule.MatchMode]; !ok {
+		errs.add("match_mode", "must be one of %v, %v, %v, %v or %v", MATCH_SUBSTRING, MATCH_WORD, MATCH_PHRASE, MATCH_PREFIX, MATCH_REGEX)
+	}
+	for _, synonym := range rule.Synonyms {
+		if strings.TrimSpace(synonym) == "" {
+			errs.add("synonyms", "cannot be empty")
+			break
+		}
+	}
+	if rule.FuzzyThreshold < 0 || rule.FuzzyThreshold > 1 {
+		errs.add("fuzzy_threshold", "must be between 0 and 1")
+	} else if rule.FuzzyThreshold > 0 && rule.MatchMode == MATCH_REGEX {
+		errs.add("fuzzy_threshold", "does not apply to %v keywords", MATCH_REGEX)
+	}
+	if rule.KeywordOperator != "" && rule.KeywordOperator != AND && rule.KeywordOperator != OR {
+		errs.add("keyword_operator", "must be %v or %v", AND, OR)
+	}
+	if rule.ConditionMode != "" && rule.ConditionMode != CONDITION_ANY && rule.ConditionMode != CONDITION_NONE {
+		errs.add("condition_mode", "must be one of %v, %v or %v", CONDITION_ALL, CONDITION_ANY, CONDITION_NONE)
+	}
+
+	if len(rule.Conditions) > 0 {
+		// conditions replace the single condition and the co-rule
+		for _, name := range setFields(rule) {
+			switch name {
+			case "metadata_field", "keyword", "keyword_operator", "corule_metadata_field", "corule_keyword", "synonyms",
+				"relational_operator", "relational_operand", "relational_values":
+				errs.add(name, "replaced by conditions, send either")
+			}
+		}
+		for i, cond := range rule.Conditions {
+			checkCondition(fmt.Sprintf("conditions[%v].", i), cond, nil, rule, schema, errs, "")
+		}
+		return
+	}
+	if rule.ConditionMode != "" {
+		errs.add("condition_mode", "needs conditions")
+	}
+
+	kind := CONTAIN
+	if relation {
+		kind = RELATION
+		// without conditions nothing is matched with keywords
+		if rule.MatchMode != "" {
+			errs.add("match_mode", "only applies to keywords, a %v rule without conditions has none", RELATION)
+		}
+		if rule.FuzzyThreshold != 0 {
+			errs.add("fuzzy_threshold", "only applies to keywords, a %v rule without conditions has none", RELATION)
+		}
+	}
+	checkCondition("", models.RuleCondition{MetadataField: rule.MetadataField, Keyword: rule.Keyword, RelationalOperator: rule.RelationalOperator,
+		Operand: rule.Operand, RelationalValues: rule.RelationalValues}, rule.Synonyms, rule, schema, errs, kind)
+
+	// the co-rule compares with the relational operator of the rule, only its field is checked then
+	if rule.CoRuleMetadataField == "" && rule.CoRuleKeyword == "" {
+		if rule.KeywordOperator != "" {
+			errs.add("keyword_operator", "needs a co-rule, corule_metadata_field is missing")
+		}
+		return
+	}
+	if rule.KeywordOperator == "" {
+		errs.add("keyword_operator", "required with a co-rule, %v or %v, a co-rule without it never matches", AND, OR)
+	}
+	coRule := models.RuleCondition{MetadataField: rule.CoRuleMetadataField, Keyword: rule.CoRuleKeyword}
+	checkCondition("corule_", coRule, nil, rule, schema, errs, kind)
+}
+
+// checkCondition checks a field and its keyword or operands. kind restricts the
+// field to strings for CONTAIN and to numbers and dates for RELATION, empty for
+// the conditions of a list which take both. prefix names the condition in the errors.
+func checkCondition(prefix string, cond models.RuleCondition, synonyms []string, rule models.RuleRequest, schema ruleexpr.Schema, errs *ruleErrors, kind string) {
+	field := metadataField(cond.MetadataField)
+	fieldType, known := schema[field]
+	switch {
+	case cond.MetadataField == "":
+		errs.add(prefix+"metadata_field", "required")
+		return
+	case !known:
+		errs.add(prefix+"metadata_field", "unknown field %v, declare it under /api/v1/fields first", cond.MetadataField)
+		return
+	case !relationalField(field, schema) && !keywordField(field, schema):
+		errs.add(prefix+"metadata_field", "%v can only be tested in an expression", field)
+		return
+	case kind == CONTAIN && relationalField(field, schema):
+		errs.add(prefix+"metadata_field", "%v is a %v field, %v rules match keywords in string fields, use %v", field, fieldType, CONTAIN, RELATION)
+		return
+	case kind == RELATION && !relationalField(field, schema):
+		errs.add(prefix+"metadata_field", "%v is a string field, %v rules compare number and date fields, use %v", field, RELATION, CONTAIN)
+		return
+	}
+
+	before := len(*errs)
+	operandsField := prefix + "relational_operand"
+	if len(cond.RelationalValues) > 0 {
+		operandsField = prefix + "relational_values"
+	}
+	if relationalField(field, schema) {
+		if cond.Keyword != "" {
+			errs.add(prefix+"keyword", "does not apply to %v, a %v field compares with relational_operator", field, fieldType)
+		}
+		_, legacy := legacyRelationalOperators[cond.RelationalOperator]
+		switch {
+		case prefix == "corule_":
+			// the operator of the rule, checked with its condition
+		case cond.RelationalOperator == "":
+			errs.add(prefix+"relational_operator", "required for %v, a %v field", field, fieldType)
+		case !legacy && cond.RelationalOperator != BETWEEN && cond.RelationalOperator != IN:
+			errs.add(prefix+"relational_operator", "must be one of %v, %v, %v, %v, %v, %v or %v", GREATER_THAN, LESSER_THAN, EQUAL,
+				GREATER_THAN_EQUAL, LESSER_THAN_EQUAL, BETWEEN, IN)
+		default:
+			if err := checkRelationalValues(cond); err != nil {
+				errs.add(prefix+"relational_values", "%v", err)
+			}
+		}
+	} else {
+		if cond.Keyword == "" {
+			errs.add(prefix+"keyword", "required, an empty keyword matches every service")
+		}
+		if cond.RelationalOperator != "" {
+			errs.add(prefix+"relational_operator", "only applies to number and date fields, %v is a string", field)
+		}
+		if len(cond.RelationalValues) > 0 || cond.Operand != 0 {
+			errs.add(operandsField, "only applies to number and date fields, %v is a string", field)
+		}
+	}
+	if len(*errs) > before || prefix == "corule_" && relationalField(field, schema) {
+		return
+	}
+
+	// the operands are typed and the patterns compiled against the field
+	node := legacyCondition(cond, synonyms, models.RuleResponse(rule), schema)
+	if err := ruleexpr.Check(node, schema); err != nil {
+		name := prefix + "keyword"
+		if relationalField(field, schema) {
+			name = operandsField
+		}
+		errs.add(name, "%v", expressionMessage(err))
+	}
+}
+
+// checkRelationalValues validates the operand count of a condition on a number or date field
+func checkRelationalValues(cond models.RuleCondition) error {
+	count := len(cond.RelationalValues)
+	switch {
+	case count == 0:
+		if cond.RelationalOperator == BETWEEN {
+			return errors.New(BETWEEN + " needs relational_values, the low and the high bound")
+		}
+		if cond.RelationalOperator == IN {
+			return errors.New(IN + " needs relational_values")
+		}
+	case cond.RelationalOperator == BETWEEN && count != 2:
+		return fmt.Errorf("%v needs two relational_values, the low and the high bound, got %v", BETWEEN, count)
+	case cond.RelationalOperator != BETWEEN && cond.RelationalOperator != IN && count > 1:
+		return fmt.Errorf("%v compares with one value, got %v relational_values", cond.RelationalOperator, count)
+	}
+	return nil
+}
+
+// expressionMessage drops the position of an error of an expression built from the fields of a rule
+func expressionMessage(err error) string {
+	var exprErr *ruleexpr.Error
+	if errors.As(err, &exprErr) {
+		return exprErr.Msg
+	}
+	return err.Error()
+}
+
+// LintRules validates stored rules like a create would, rules without defects are left out
+func LintRules(rules []models.RuleResponse, fields []models.Field) []models.RuleLint {
+	defects := []models.RuleLint{}
+	for _, rule := range rules {
+		errs := ValidateRule(models.RuleRequest(rule), fields)
+		if len(errs) == 0 {
+			continue
+		}
+		defects = append(defects, models.RuleLint{
+			RuleUUID:  rule.RuleUUID,
+			Operation: rule.Operation,
+			TagKey:    rule.TagKey,
+			TagValue:  rule.TagValue,
+			Errors:    errs,
+		})
+	}
+	return defects
+}
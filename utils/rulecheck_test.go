@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/auto-tagging-mds/database/models"
+)
+
+func TestValidateRule(t *testing.T) {
+	tests := []struct {
+		name string
+		rule models.RuleRequest
+		want []string
+	}{
+		{
+			name: "contain",
+			rule: models.RuleRequest{Operation: CONTAIN, MetadataField: DESCRIPTION, Keyword: "aws"},
+		},
+		{
+			name: "missing operation",
+			rule: models.RuleRequest{MetadataField: DESCRIPTION, Keyword: "aws"},
+			want: []string{"operation"},
+		},
+		{
+			name: "empty keyword",
+			rule: models.RuleRequest{Operation: CONTAIN, MetadataField: DESCRIPTION},
+			want: []string{"keyword"},
+		},
+		{
+			name: "contain on a number field",
+			rule: models.RuleRequest{Operation: CONTAIN, MetadataField: LIKE, Keyword: "10"},
+			want: []string{"metadata_field"},
+		},
+		{
+			name: "field of another operation",
+			rule: models.RuleRequest{Operation: SUBSCRIPTION_COUNT, SubscriptionCount: 3, Keyword: "aws"},
+			want: []string{"keyword"},
+		},
+		{
+			name: "between with one bound",
+			rule: models.RuleRequest{Operation: RELATION, MetadataField: LIKE, RelationalOperator: BETWEEN,
+				RelationalValues: []interface{}{1.0}},
+			want: []string{"relational_values"},
+		},
+		{
+			name: "invalid regex",
+			rule: models.RuleRequest{Operation: CONTAIN, MetadataField: DESCRIPTION, Keyword: "(", MatchMode: MATCH_REGEX},
+			want: []string{"keyword"},
+		},
+		{
+			name: "co-rule without operator",
+			rule: models.RuleRequest{Operation: CONTAIN, MetadataField: DESCRIPTION, Keyword: "aws",
+				CoRuleMetadataField: DEPLOYMENT, CoRuleKeyword: "cloud"},
+			want: []string{"keyword_operator"},
+		},
+		{
+			name: "condition with an unknown field",
+			rule: models.RuleRequest{Operation: CONTAIN, Conditions: []models.RuleCondition{
+				{MetadataField: DESCRIPTION, Keyword: "aws"}, {MetadataField: "color", Keyword: "red"}}},
+			want: []string{"conditions[1].metadata_field"},
+		},
+		{
+			name: "expression without one",
+			rule: models.RuleRequest{Operation: EXPRESSION},
+			want: []string{"expression"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := ValidateRule(tt.rule, nil)
+			if len(errs) != len(tt.want) {
+				t.Fatalf("errors %v, want on %v", errs, tt.want)
+			}
+			for i, err := range errs {
+				if err.Field != tt.want[i] {
+					t.Errorf("error %v, want on %v", err, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLintRules(t *testing.T) {
+	rules := []models.RuleResponse{
+		{RuleUUID: "valid", Operation: CONTAIN, TagKey: "deployment", TagValue: "cloud",
+			MetadataField: DESCRIPTION, Keyword: "aws"},
+		{RuleUUID: "stale", Operation: EXPRESSION, TagKey: "deployment", TagValue: "cloud",
+			Expression: `seats > 10`},
+	}
+
+	defects := LintRules(rules, nil)
+	if len(defects) != 1 || defects[0].RuleUUID != "stale" {
+		t.Fatalf("defects %v, want the stale rule only", defects)
+	}
+
+	// the rule is valid again once its field is declared
+	defects = LintRules(rules, []models.Field{{Name: "seats", Type: FIELD_NUMBER}})
+	if len(defects) != 0 {
+		t.Errorf("defects %v, want none", defects)
+	}
+}
+
+func TestValidateRuleExpressionOfFields(t *testing.T) {
+	rule := models.RuleRequest{Operation: CONTAIN, TagKey: "deployment", TagValue: "cloud",
+		MetadataField: "description", Keyword: "aws"}
+	derived := LegacyExpression(models.RuleResponse(rule), RuleSchema)
+
+	tests := []struct {
+		name       string
+		expression string
+		wantErr    bool
+	}{
+		{name: "no expression"},
+		{name: "expression of the fields", expression: derived},
+		{name: "other expression", expression: `description contains "azure"`, wantErr: true},
+		{name: "invalid expression", expression: `description contains`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := rule
+			r.Expression = tt.expression
+			errs := ValidateRule(r, nil)
+			if !tt.wantErr {
+				if len(errs) > 0 {
+					t.Fatalf("unexpected errors %v", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || errs[0].Field != "expression" {
+				t.Fatalf("errors %v, want one on expression", errs)
+			}
+		})
+	}
+}
+
+func TestLintRulesStoredExpression(t *testing.T) {
+	rules := []models.RuleResponse{
+		{RuleUUID: "legacy", Operation: CONTAIN, TagKey: "deployment", TagValue: "cloud",
+			MetadataField: "description", Keyword: "aws"},
+		{RuleUUID: "stale", Operation: CONTAIN, TagKey: "deployment", TagValue: "cloud",
+			MetadataField: "description", Keyword: "aws", Expression: `description contains "azure"`},
+	}
+
+	defects := LintRules(rules, nil)
+	if len(defects) != 1 || defects[0].RuleUUID != "stale" {
+		t.Fatalf("defects %v, want the stale rule only", defects)
+	}
+}
@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/auto-tagging-mds/database/models"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// SearchFields are the service fields GET /services filters on by exact value
+var SearchFields = []string{STAGE, TARGETSEGMENT, DEPLOYMENT, BUSINESSMODEL, PRICING, LOCATION}
+
+// GetServiceSearch reads the search of a GET /services request, tag is given
+// repeated or comma separated as key:value. It reports whether any filter was given.
+func GetServiceSearch(request events.APIGatewayProxyRequest) (models.ServiceSearch, bool, error) {
+	params := request.QueryStringParameters
+	search := models.ServiceSearch{TagMode: AND, Fields: map[string]string{}}
+
+	tagParams := request.MultiValueQueryStringParameters["tag"]
+	if len(tagParams) == 0 && params["tag"] != "" {
+		tagParams = []string{params["tag"]}
+	}
+	for _, param := range tagParams {
+		for _, tag := range strings.Split(param, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(tag), ":")
+			if !ok || key == "" || value == "" {
+				return search, false, errors.New("tag must be given as key:value")
+			}
+			search.Tags = append(search.Tags, models.Category{Key: key, Value: value})
+		}
+	}
+
+	if mode := strings.ToUpper(params["tag_mode"]); mode != "" {
+		if mode != AND && mode != OR {
+			return search, false, errors.New("tag_mode must be " + AND + " or " + OR)
+		}
+		search.TagMode = mode
+	}
+
+	for _, field := range SearchFields {
+		if value := strings.TrimSpace(params[field]); value != "" {
+			search.Fields[field] = value
+		}
+	}
+	search.Query = strings.TrimSpace(params["q"])
+
+	return search, len(search.Tags) > 0 || len(search.Fields) > 0 || search.Query != "", nil
+}
+
+// ServiceMatches applies a search to a service, tags and fields compare ignoring case
+func ServiceMatches(service models.ServiceResponse, search models.ServiceSearch) bool {
+	if len(search.Tags) > 0 {
+		found := 0
+		for _, tag := range search.Tags {
+			if _, ok := RemoveCategory(service.Category, tag.Key, tag.Value); ok {
+				found++
+			}
+		}
+		if found == 0 || (search.TagMode != OR && found < len(search.Tags)) {
+			return false
+		}
+	}
+
+	fields := ServiceFields(ServiceToStreamDataConversion(service), nil, nil, nil)
+	for name, want := range search.Fields {
+		value, err := fields.Field(name)
+		if err != nil || !strings.EqualFold(value.Str, want) {
+			return false
+		}
+	}
+
+	terms := map[string]bool{}
+	for _, term := range ServiceTerms(service.Description, service.MoreAbout) {
+		terms[term] = true
+	}
+	for _, term := range Tokenize(search.Query) {
+		if !terms[term] {
+			return false
+		}
+	}
+	return true
+}
+
+// SearchPage filters the candidates of a search and returns the page after cursor,
+// ordered by range key like GetAllServices, with the cursor of the next page
+func SearchPage(candidates []models.ServiceResponse, search models.ServiceSearch, limit int, cursor string) ([]models.ServiceResponse, string, error) {
+	after, err := CursorRangeKey(cursor, GetPartitionKey(SERVICE))
+	if err != nil {
+		return []models.ServiceResponse{}, "", err
+	}
+
+	matched := []models.ServiceResponse{}
+	for _, service := range candidates {
+		if service.SK > after && ServiceMatches(service, search) {
+			matched = append(matched, service)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].SK < matched[j].SK })
+
+	if len(matched) <= limit {
+		return matched, "", nil
+	}
+	matched = matched[:limit]
+	return matched, CursorFor(GetPartitionKey(SERVICE), matched[limit-1].SK), nil
+}
+
+// SearchCandidates returns the range keys of the services indexed under all the
+// searched tags, or any of them for OR, and all the terms of the query. tagEntries
+// and termEntries read the index of one tag and one term. It returns false when
+// the search has neither, and every service is a candidate.
+func SearchCandidates(search models.ServiceSearch, tagEntries func(key, value string) ([]models.ServiceTag, error),
+	termEntries func(term string) ([]models.ServiceTerm, error)) ([]string, bool, error) {
+	sets := []map[string]bool{}
+
+	var tagged map[string]bool
+	for _, tag := range search.Tags {
+		entries, err := tagEntries(tag.Key, tag.Value)
+		if err != nil {
+			return nil, false, err
+		}
+
+		found := map[string]bool{}
+		for _, entry := range entries {
+			found[entry.ServiceSK] = true
+		}
+		if search.TagMode == OR {
+			if tagged == nil {
+				tagged = map[string]bool{}
+				sets = append(sets, tagged)
+			}
+			for sk := range found {
+				tagged[sk] = true
+			}
+		} else {
+			sets = append(sets, found)
+		}
+	}
+
+	for _, term := range Tokenize(search.Query) {
+		entries, err := termEntries(term)
+		if err != nil {
+			return nil, false, err
+		}
+
+		found := map[string]bool{}
+		for _, entry := range entries {
+			found[entry.ServiceSK] = true
+		}
+		sets = append(sets, found)
+	}
+
+	if len(sets) == 0 {
+		return nil, false, nil
+	}
+	sks := []string{}
+	for sk := range sets[0] {
+		all := true
+		for _, set := range sets[1:] {
+			all = all && set[sk]
+		}
+		if all {
+			sks = append(sks, sk)
+		}
+	}
+	sort.Strings(sks)
+	return sks, true, nil
+}
+
+// ServiceTagEntries returns the index entries of the stored service, empty for a
+// deleted one, and the range keys of the entries of oldCategory it no longer has
+func ServiceTagEntries(service models.ServiceResponse, serviceUUID string, oldCategory []models.Category) ([]models.ServiceTag, []string) {
+	entries := []models.ServiceTag{}
+	if service.ServiceName != "" {
+		for _, cat := range service.Category {
+			entries = append(entries, models.ServiceTag{
+				PK:          GetPartitionKey(SERVICE_TAG),
+				SK:          GetRangeKey(SERVICE_TAG, cat.Key, cat.Value, serviceUUID),
+				ServiceUUID: serviceUUID,
+				ServiceSK:   service.SK,
+			})
+		}
+	}
+
+	stale := []string{}
+	for _, cat := range oldCategory {
+		if _, kept := RemoveCategory(service.Category, cat.Key, cat.Value); !kept {
+			stale = append(stale, GetRangeKey(SERVICE_TAG, cat.Key, cat.Value, serviceUUID))
+		}
+	}
+	return entries, stale
+}
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/auto-tagging-mds/database/models"
+)
+
+var ErrSynonymNotFound = errors.New("synonym not found")
+
+// Thesaurus maps every word of the synonym dictionary to the other words of its group
+type Thesaurus map[string][]string
+
+// synonymKey compares words ignoring case and repeated spaces
+func synonymKey(word string) string {
+	return strings.Join(strings.Fields(strings.ToLower(word)), " ")
+}
+
+// synonymWords returns the term of a group followed by its synonyms
+func synonymWords(group models.Synonym) []string {
+	return append([]string{group.Term}, group.Synonyms...)
+}
+
+// NewThesaurus builds the lookup of the stored synonym groups
+func NewThesaurus(groups []models.Synonym) Thesaurus {
+	t := Thesaurus{}
+	for _, group := range groups {
+		words := synonymWords(group)
+		for i, word := range words {
+			for j, other := range words {
+				if i != j {
+					t[synonymKey(word)] = append(t[synonymKey(word)], synonymKey(other))
+				}
+			}
+		}
+	}
+	return t
+}
+
+// Synonyms returns the other words of the group of term
+func (t Thesaurus) Synonyms(term string) ([]string, error) {
+	return t[synonymKey(term)], nil
+}
+
+// CheckSynonym validates a group about to be stored, a word belongs to one group only
+func CheckSynonym(group models.Synonym, groups []models.Synonym) error {
+	words := synonymWords(group)
+	for i, word := range words {
+		if synonymKey(word) == "" {
+			return errors.New("synonyms cannot be empty")
+		}
+		for _, other := range words[:i] {
+			if synonymKey(word) == synonymKey(other) {
+				return fmt.Errorf("%v is given twice", word)
+			}
+		}
+	}
+
+	for _, stored := range groups {
+		if synonymKey(stored.Term) == synonymKey(group.Term) {
+			continue
+		}
+		for _, word := range words {
+			for _, other := range synonymWords(stored) {
+				if synonymKey(word) == synonymKey(other) {
+					return fmt.Errorf("%v is already a synonym of %v", word, stored.Term)
+				}
+			}
+		}
+	}
+	return nil
+}
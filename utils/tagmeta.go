@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/auto-tagging-mds/database/models"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// tagFields are the attributes of a tag besides its key, set by SET_PARENT and SET_METADATA
+var tagFields = []string{"parent_key", "parent_value", "description", "label", "color", "aliases",
+	"deprecated", "replaced_by_key", "replaced_by_value"}
+
+// TagFieldAttributes returns the parent and metadata attributes of a tag for a
+// partial write, an empty field is nil so that the write removes it
+func TagFieldAttributes(tag models.TagResponse) (map[string]*dynamodb.AttributeValue, error) {
+	av, err := dynamodbattribute.MarshalMap(tag)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string]*dynamodb.AttributeValue, len(tagFields))
+	for _, name := range tagFields {
+		attrs[name] = av[name]
+	}
+	return attrs, nil
+}
+
+// alias returns the stored tag of key having value among its aliases
+func (t TagTree) alias(key, value string) (models.TagResponse, bool) {
+	for _, tag := range t {
+		if !strings.EqualFold(tag.Key, key) {
+			continue
+		}
+		for _, alias := range tag.Aliases {
+			if strings.EqualFold(alias, value) {
+				return tag, true
+			}
+		}
+	}
+	return models.TagResponse{}, false
+}
+
+// Resolve returns the canonical tag saved for key:value. An alias resolves to its
+// tag and a deprecated tag to its replacement, a deprecated tag without one is rejected.
+func (t TagTree) Resolve(key, value string) (models.TagResponse, error) {
+	tag, ok := t.Get(key, value)
+	if !ok {
+		tag, ok = t.alias(key, value)
+	}
+	if !ok {
+		return tag, fmt.Errorf("Invalid tag : (%v:%v)", key, value)
+	}
+
+	seen := map[string]bool{}
+	for tag.Deprecated {
+		seen[tagID(tag.Key, tag.Value)] = true
+		if tag.ReplacedByKey == "" {
+			return tag, fmt.Errorf("tag %v:%v is deprecated", tag.Key, tag.Value)
+		}
+
+		next, ok := t.Get(tag.ReplacedByKey, tag.ReplacedByValue)
+		if !ok || seen[tagID(next.Key, next.Value)] {
+			return tag, fmt.Errorf("tag %v:%v is deprecated, its replacement %v:%v is not valid", tag.Key, tag.Value, tag.ReplacedByKey, tag.ReplacedByValue)
+		}
+		tag = next
+	}
+	return tag, nil
+}
+
+// ResolveTags rewrites a category list to canonical tags, dropping a tag the
+// list already holds after resolving
+func ResolveTags(category []models.Category, tree TagTree) ([]models.Category, error) {
+	resolved := make([]models.Category, 0, len(category))
+	for _, cat := range category {
+		tag, err := tree.Resolve(cat.Key, cat.Value)
+		if err != nil {
+			return category, err
+		}
+		if _, present := RemoveCategory(resolved, tag.Key, tag.Value); present {
+			continue
+		}
+
+		cat.Key, cat.Value = tag.Key, tag.Value
+		resolved = append(resolved, cat)
+	}
+	return resolved, nil
+}
+
+// CheckMetadata validates the metadata of key:value, stored or about to be
+func (t TagTree) CheckMetadata(key, value string, meta models.TagMetadata) error {
+	for i, alias := range meta.Aliases {
+		if strings.TrimSpace(alias) == "" {
+			return errors.New("aliases cannot be empty")
+		}
+		if strings.EqualFold(alias, value) {
+			return fmt.Errorf("alias %v is the value of the tag", alias)
+		}
+		for _, other := range meta.Aliases[:i] {
+			if strings.EqualFold(alias, other) {
+				return fmt.Errorf("alias %v is given twice", alias)
+			}
+		}
+		if _, ok := t.Get(key, alias); ok {
+			return fmt.Errorf("alias %v is the tag %v:%v", alias, key, alias)
+		}
+		if tag, ok := t.alias(key, alias); ok && !strings.EqualFold(tag.Value, value) {
+			return fmt.Errorf("alias %v is already an alias of %v:%v", alias, tag.Key, tag.Value)
+		}
+	}
+	if tag, ok := t.alias(key, value); ok {
+		return fmt.Errorf("%v is an alias of %v:%v", value, tag.Key, tag.Value)
+	}
+
+	if meta.ReplacedByKey == "" && meta.ReplacedByValue == "" {
+		return nil
+	}
+	if !meta.Deprecated {
+		return errors.New("only a deprecated tag has a replacement")
+	}
+	if meta.ReplacedByKey == "" || meta.ReplacedByValue == "" {
+		return errors.New("replacement needs both replaced_by_key and replaced_by_value")
+	}
+	if strings.EqualFold(key, meta.ReplacedByKey) && strings.EqualFold(value, meta.ReplacedByValue) {
+		return errors.New("tag cannot replace itself")
+	}
+
+	// the replacement chain must not lead back to the tag
+	next, ok := t.Get(meta.ReplacedByKey, meta.ReplacedByValue)
+	if !ok {
+		return fmt.Errorf("Invalid replacement tag : (%v:%v)", meta.ReplacedByKey, meta.ReplacedByValue)
+	}
+	seen := map[string]bool{}
+	for next.Deprecated && next.ReplacedByKey != "" && !seen[tagID(next.Key, next.Value)] {
+		seen[tagID(next.Key, next.Value)] = true
+		if strings.EqualFold(key, next.ReplacedByKey) && strings.EqualFold(value, next.ReplacedByValue) {
+			return fmt.Errorf("tag %v:%v replaces %v:%v, the replacement would create a cycle", key, value, meta.ReplacedByKey, meta.ReplacedByValue)
+		}
+		next, _ = t.Get(next.ReplacedByKey, next.ReplacedByValue)
+	}
+	return nil
+}
+
+// Dependents returns the tags whose parent or replacement is key:value, with
+// those links cleared as they are stored once key:value is deleted
+func (t TagTree) Dependents(key, value string) []models.TagResponse {
+	dependents := []models.TagResponse{}
+	for _, tag := range t {
+		child := tag.ParentKey != "" && strings.EqualFold(tag.ParentKey, key) && strings.EqualFold(tag.ParentValue, value)
+		replaced := tag.ReplacedByKey != "" && strings.EqualFold(tag.ReplacedByKey, key) && strings.EqualFold(tag.ReplacedByValue, value)
+		if !child && !replaced {
+			continue
+		}
+
+		if child {
+			tag.ParentKey, tag.ParentValue = "", ""
+		}
+		if replaced {
+			tag.ReplacedByKey, tag.ReplacedByValue = "", ""
+		}
+		dependents = append(dependents, tag)
+	}
+	sortTags(dependents)
+	return dependents
+}
@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/auto-tagging-mds/database/models"
+)
+
+// SOURCE_ANCESTOR marks a category implied by a child tag of the service
+const SOURCE_ANCESTOR = "ancestor"
+
+// TagTree indexes the stored tags by key and value, ignoring case like the range keys
+type TagTree map[string]models.TagResponse
+
+func tagID(key, value string) string {
+	return strings.ToLower(key) + "#" + strings.ToLower(value)
+}
+
+func NewTagTree(tags []models.TagResponse) TagTree {
+	tree := make(TagTree, len(tags))
+	for _, tag := range tags {
+		tree[tagID(tag.Key, tag.Value)] = tag
+	}
+	return tree
+}
+
+// Get returns the stored tag key:value
+func (t TagTree) Get(key, value string) (models.TagResponse, bool) {
+	tag, ok := t[tagID(key, value)]
+	return tag, ok
+}
+
+// Ancestors returns the parent of key:value, its parent and so on. A cycle
+// stored before it could be detected ends the walk.
+func (t TagTree) Ancestors(key, value string) []models.Category {
+	ancestors := []models.Category{}
+	seen := map[string]bool{tagID(key, value): true}
+	for {
+		tag, ok := t.Get(key, value)
+		if !ok || tag.ParentKey == "" || seen[tagID(tag.ParentKey, tag.ParentValue)] {
+			return ancestors
+		}
+
+		key, value = tag.ParentKey, tag.ParentValue
+		seen[tagID(key, value)] = true
+		ancestors = append(ancestors, models.Category{Key: key, Value: value})
+	}
+}
+
+// IsAncestor reports whether ancestorKey:ancestorValue is above key:value in the tree
+func (t TagTree) IsAncestor(ancestorKey, ancestorValue, key, value string) bool {
+	for _, cat := range t.Ancestors(key, value) {
+		if IsSameTag(cat, ancestorKey, ancestorValue) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckParent validates parentKey:parentValue as the parent of key:value, an
+// empty parent makes the tag a root
+func (t TagTree) CheckParent(key, value, parentKey, parentValue string) error {
+	if parentKey == "" && parentValue == "" {
+		return nil
+	}
+	if parentKey == "" || parentValue == "" {
+		return errors.New("parent needs both parent_key and parent_value")
+	}
+	if strings.EqualFold(key, parentKey) && strings.EqualFold(value, parentValue) {
+		return errors.New("tag cannot be its own parent")
+	}
+	if _, ok := t.Get(parentKey, parentValue); !ok {
+		return fmt.Errorf("Invalid parent tag : (%v:%v)", parentKey, parentValue)
+	}
+	if t.IsAncestor(key, value, parentKey, parentValue) {
+		return fmt.Errorf("tag %v:%v is an ancestor of %v:%v, the parent would create a cycle", key, value, parentKey, parentValue)
+	}
+	return nil
+}
+
+// Children returns the tags whose parent is key:value
+func (t TagTree) Children(key, value string) []models.TagResponse {
+	children := []models.TagResponse{}
+	for _, tag := range t {
+		if tag.ParentKey != "" && strings.EqualFold(tag.ParentKey, key) && strings.EqualFold(tag.ParentValue, value) {
+			children = append(children, tag)
+		}
+	}
+	sortTags(children)
+	return children
+}
+
+func sortTags(tags []models.TagResponse) {
+	sort.Slice(tags, func(i, j int) bool {
+		return tagID(tags[i].Key, tags[i].Value) < tagID(tags[j].Key, tags[j].Value)
+	})
+}
+
+// Nodes returns the tree below the root tags, the ones without a stored parent
+func (t TagTree) Nodes() []models.TagNode {
+	roots := []models.TagResponse{}
+	for _, tag := range t {
+		if _, ok := t.Get(tag.ParentKey, tag.ParentValue); tag.ParentKey == "" || !ok {
+			roots = append(roots, tag)
+		}
+	}
+	sortTags(roots)
+
+	nodes := make([]models.TagNode, 0, len(roots))
+	for _, root := range roots {
+		nodes = append(nodes, t.node(root, map[string]bool{}))
+	}
+	return nodes
+}
+
+func (t TagTree) node(tag models.TagResponse, seen map[string]bool) models.TagNode {
+	seen[tagID(tag.Key, tag.Value)] = true
+	node := models.TagNode{Key: tag.Key, Value: tag.Value, TagMetadata: tag.TagMetadata}
+	for _, child := range t.Children(tag.Key, tag.Value) {
+		if !seen[tagID(child.Key, child.Value)] {
+			node.Children = append(node.Children, t.node(child, seen))
+		}
+	}
+	return node
+}
+
+// SyncAncestorTags adds the ancestors of every other tag of a service and removes
+// ancestor categories no tag implies any more. It reports whether the list changed.
+func SyncAncestorTags(category []models.Category, tree TagTree) ([]models.Category, bool) {
+	synced := make([]models.Category, 0, len(category))
+	for _, cat := range category {
+		if cat.Source != SOURCE_ANCESTOR {
+			synced = append(synced, cat)
+		}
+	}
+
+	explicit := len(synced)
+	datetime := DateString("datetime")
+	for i := 0; i < explicit; i++ {
+		for _, ancestor := range tree.Ancestors(synced[i].Key, synced[i].Value) {
+			if _, present := RemoveCategory(synced, ancestor.Key, ancestor.Value); present {
+				continue
+			}
+
+			// an ancestor the service had before keeps its applied_at
+			ancestor.Source, ancestor.AppliedAt = SOURCE_ANCESTOR, datetime
+			for _, cat := range category {
+				if cat.Source == SOURCE_ANCESTOR && IsSameTag(cat, ancestor.Key, ancestor.Value) {
+					ancestor.AppliedAt = cat.AppliedAt
+				}
+			}
+			synced = append(synced, ancestor)
+		}
+	}
+
+	if len(synced) != len(category) {
+		return synced, true
+	}
+	for i := range synced {
+		if synced[i] != category[i] {
+			return synced, true
+		}
+	}
+	return synced, false
+}
+
+// SyncServiceTags recomputes the rule-derived tags of a service, then the ancestors of all its tags
+func SyncServiceTags(category []models.Category, matched []models.RuleResponse, tree TagTree) ([]models.Category, bool) {
+	category, rulesChanged := SyncRuleTags(category, matched)
+	category, ancestorsChanged := SyncAncestorTags(category, tree)
+	return category, rulesChanged || ancestorsChanged
+}
@@ -0,0 +1,247 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/auto-tagging-mds/database/models"
+	"github.com/auto-tagging-mds/ruleexpr"
+)
+
+const (
+	TAG_RENAME_VALUE = "RENAME_VALUE"
+	TAG_RENAME_KEY   = "RENAME_KEY"
+	TAG_MERGE        = "MERGE"
+	TAG_SET_PARENT   = "SET_PARENT"
+	TAG_SET_METADATA = "SET_METADATA"
+)
+
+var ErrTagNotFound = errors.New("tag not found")
+
+// TagRenames resolves a tag update of key:value, or of every value of key for
+// RENAME_KEY, into the tags to rewrite. tags holds every stored tag.
+func TagRenames(tags []models.TagResponse, key, value string, update models.TagUpdateRequest) ([]models.TagRename, error) {
+	renames := []models.TagRename{}
+	tree := NewTagTree(tags)
+	tagExists := func(key, value string) bool {
+		_, ok := tree.Get(key, value)
+		return ok
+	}
+	// a new tag left by a rename which stopped before it was done, renaming again resumes it
+	renamedFrom := func(to models.TagRename) bool {
+		tag, ok := tree.Get(to.ToKey, to.ToValue)
+		return ok && IsSameTag(models.Category{Key: tag.RenamedFromKey, Value: tag.RenamedFromValue}, to.FromKey, to.FromValue)
+	}
+
+	switch update.Operation {
+	case TAG_RENAME_VALUE, TAG_MERGE:
+		if value == "" {
+			return renames, errors.New("parameter required : tag_value")
+		}
+		if !tagExists(key, value) {
+			return renames, ErrTagNotFound
+		}
+
+		to := models.TagRename{FromKey: key, FromValue: value, ToKey: key, ToValue: update.Value}
+		if update.Operation == TAG_MERGE {
+			to.ToKey = update.Key
+		}
+		if to.ToKey == "" || to.ToValue == "" {
+			return renames, errors.New(update.Operation + " needs the new tag in key and value")
+		}
+		// like on create, # separates the parts of range keys
+		if update.Operation == TAG_RENAME_VALUE && strings.Contains(to.ToValue, "#") {
+			return renames, errors.New("tag value cannot contain #")
+		}
+		if strings.EqualFold(to.FromKey, to.ToKey) && strings.EqualFold(to.FromValue, to.ToValue) {
+			return renames, errors.New("tag " + key + ":" + value + " is unchanged")
+		}
+
+		exists := tagExists(to.ToKey, to.ToValue)
+		if update.Operation == TAG_RENAME_VALUE && exists && !renamedFrom(to) {
+			return renames, fmt.Errorf("tag %v:%v already exists, use %v", to.ToKey, to.ToValue, TAG_MERGE)
+		}
+		if tag, ok := tree.alias(to.ToKey, to.ToValue); ok && update.Operation == TAG_RENAME_VALUE && !IsSameTag(models.Category{Key: tag.Key, Value: tag.Value}, key, value) {
+			return renames, fmt.Errorf("%v is an alias of %v:%v", to.ToValue, tag.Key, tag.Value)
+		}
+		if update.Operation == TAG_MERGE && !exists {
+			return renames, fmt.Errorf("tag %v:%v not found, use %v", to.ToKey, to.ToValue, TAG_RENAME_VALUE)
+		}
+		// the children of the merged tag move to the target
+		if update.Operation == TAG_MERGE && tree.IsAncestor(key, value, to.ToKey, to.ToValue) {
+			return renames, fmt.Errorf("tag %v:%v is below %v:%v, merging would create a cycle", to.ToKey, to.ToValue, key, value)
+		}
+		renames = append(renames, to)
+	case TAG_RENAME_KEY:
+		if update.Key == "" {
+			return renames, errors.New(TAG_RENAME_KEY + " needs the new key in key")
+		}
+		if strings.Contains(update.Key, "#") {
+			return renames, errors.New("tag key cannot contain #")
+		}
+		if strings.EqualFold(key, update.Key) {
+			return renames, errors.New("tag key " + key + " is unchanged")
+		}
+
+		for _, tag := range tags {
+			if !strings.EqualFold(tag.Key, key) {
+				continue
+			}
+			to := models.TagRename{FromKey: tag.Key, FromValue: tag.Value, ToKey: update.Key, ToValue: tag.Value}
+			if tagExists(to.ToKey, to.ToValue) && !renamedFrom(to) {
+				return renames, fmt.Errorf("tag %v:%v already exists, use %v", update.Key, tag.Value, TAG_MERGE)
+			}
+			renames = append(renames, to)
+		}
+		if len(renames) == 0 {
+			return renames, ErrTagNotFound
+		}
+	default:
+		return renames, errors.New("operation must be one of " + TAG_RENAME_VALUE + ", " + TAG_RENAME_KEY + ", " + TAG_MERGE + ", " + TAG_SET_PARENT + ", " + TAG_SET_METADATA)
+	}
+	return renames, nil
+}
+
+func renamedTag(key, value string, renames []models.TagRename) (models.TagRename, bool) {
+	for _, rename := range renames {
+		if strings.EqualFold(rename.FromKey, key) && strings.EqualFold(rename.FromValue, value) {
+			return rename, true
+		}
+	}
+	return models.TagRename{}, false
+}
+
+// renameLinks points the parent and the replacement of a tag at their renamed
+// tags, reporting whether one of them was renamed
+func renameLinks(tag *models.TagResponse, renames []models.TagRename) bool {
+	changed := false
+	if parent, ok := renamedTag(tag.ParentKey, tag.ParentValue, renames); ok {
+		tag.ParentKey, tag.ParentValue = parent.ToKey, parent.ToValue
+		changed = true
+	}
+	if replacement, ok := renamedTag(tag.ReplacedByKey, tag.ReplacedByValue, renames); ok {
+		tag.ReplacedByKey, tag.ReplacedByValue = replacement.ToKey, replacement.ToValue
+		changed = true
+	}
+	return changed
+}
+
+// RenameTagItems returns the tags a rename creates, each with the metadata and the
+// renamed parent of the tag it replaces and marked as renamed from it, and the
+// stored tags whose parent or replacement is renamed. A resumed rename does not
+// create the tags created before it stopped again.
+func RenameTagItems(tags []models.TagResponse, renames []models.TagRename, merge bool) (created []models.TagResponse, reparented []models.TagResponse) {
+	tree := NewTagTree(tags)
+	for _, rename := range renames {
+		if merge {
+			continue
+		}
+		if _, ok := tree.Get(rename.ToKey, rename.ToValue); ok {
+			continue
+		}
+
+		old, _ := tree.Get(rename.FromKey, rename.FromValue)
+		tag := models.TagResponse{Key: rename.ToKey, Value: rename.ToValue, ParentKey: old.ParentKey, ParentValue: old.ParentValue,
+			RenamedFromKey: rename.FromKey, RenamedFromValue: rename.FromValue, TagMetadata: old.TagMetadata}
+		renameLinks(&tag, renames)
+		created = append(created, tag)
+	}
+
+	for _, tag := range tags {
+		if _, ok := renamedTag(tag.Key, tag.Value, renames); ok {
+			continue
+		}
+		if renameLinks(&tag, renames) {
+			reparented = append(reparented, tag)
+		}
+	}
+	return created, reparented
+}
+
+// RenamedTags returns the stored tags created by renames which still carry their
+// renamed-from marker, cleared once the old tags are deleted
+func RenamedTags(tags []models.TagResponse, renames []models.TagRename) []models.TagResponse {
+	renamed := []models.TagResponse{}
+	for _, tag := range tags {
+		if tag.RenamedFromKey == "" {
+			continue
+		}
+		if rename, ok := renamedTag(tag.RenamedFromKey, tag.RenamedFromValue, renames); ok && IsSameTag(models.Category{Key: tag.Key, Value: tag.Value}, rename.ToKey, rename.ToValue) {
+			renamed = append(renamed, tag)
+		}
+	}
+	return renamed
+}
+
+// RenameCategory rewrites the renamed tags of a category list, a tag merged
+// into one the service already has is dropped
+func RenameCategory(category []models.Category, renames []models.TagRename) ([]models.Category, bool) {
+	changed := false
+	kept := make([]models.Category, 0, len(category))
+	for _, cat := range category {
+		if rename, ok := renamedTag(cat.Key, cat.Value, renames); ok {
+			cat.Key, cat.Value = rename.ToKey, rename.ToValue
+			changed = true
+		}
+
+		duplicate := false
+		for _, k := range kept {
+			if IsSameTag(k, cat.Key, cat.Value) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			kept = append(kept, cat)
+		}
+	}
+	return kept, changed
+}
+
+// RenameRules rewrites the tag of the rules assigning a renamed tag. A rewritten
+// rule matching like a rule already assigning the new tag is returned in duplicates,
+// the rules are compared by expression, compiled against the declared fields.
+func RenameRules(rules []models.RuleResponse, renames []models.TagRename, fields []models.Field) (updated []models.RuleResponse, duplicates []models.RuleResponse) {
+	schema := FieldSchema(fields)
+	kept := []models.RuleResponse{}
+	renamed := []models.RuleResponse{}
+	for _, rule := range rules {
+		if rename, ok := renamedTag(rule.TagKey, rule.TagValue, renames); ok {
+			rule.TagKey, rule.TagValue = rename.ToKey, rename.ToValue
+			renamed = append(renamed, rule)
+			continue
+		}
+		kept = append(kept, rule)
+	}
+
+	for _, rule := range renamed {
+		duplicate := false
+		expression := canonicalExpression(rule, schema)
+		for _, k := range kept {
+			if IsSameTag(models.Category{Key: k.TagKey, Value: k.TagValue}, rule.TagKey, rule.TagValue) &&
+				expression != "" && canonicalExpression(k, schema) == expression {
+				duplicate = true
+				break
+			}
+		}
+
+		if duplicate {
+			duplicates = append(duplicates, rule)
+			continue
+		}
+		kept = append(kept, rule)
+		updated = append(updated, rule)
+	}
+	return updated, duplicates
+}
+
+// canonicalExpression returns the compiled expression of a rule, derived from its fields
+// when it was stored before expressions existed, empty when it does not compile
+func canonicalExpression(rule models.RuleResponse, schema ruleexpr.Schema) string {
+	node, err := RuleExpression(rule, schema)
+	if err != nil {
+		return ""
+	}
+	return node.String()
+}
@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/auto-tagging-mds/database/models"
+)
+
+func TestTagRenames(t *testing.T) {
+	tags := []models.TagResponse{
+		{Key: "deployment", Value: "cloud"},
+		{Key: "deployment", Value: "saas"},
+		{Key: "hosting", Value: "saas"},
+		{Key: "deployment", Value: "hosted", RenamedFromKey: "deployment", RenamedFromValue: "saas"},
+	}
+
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		update  models.TagUpdateRequest
+		want    []models.TagRename
+		wantErr bool
+	}{
+		{
+			name: "rename value",
+			key:  "deployment", value: "saas",
+			update: models.TagUpdateRequest{Operation: TAG_RENAME_VALUE, Value: "onprem"},
+			want:   []models.TagRename{{FromKey: "deployment", FromValue: "saas", ToKey: "deployment", ToValue: "onprem"}},
+		},
+		{
+			name: "rename value onto a stored tag",
+			key:  "deployment", value: "saas",
+			update:  models.TagUpdateRequest{Operation: TAG_RENAME_VALUE, Value: "Cloud"},
+			wantErr: true,
+		},
+		{
+			name: "resume a rename",
+			key:  "deployment", value: "saas",
+			update: models.TagUpdateRequest{Operation: TAG_RENAME_VALUE, Value: "hosted"},
+			want:   []models.TagRename{{FromKey: "deployment", FromValue: "saas", ToKey: "deployment", ToValue: "hosted"}},
+		},
+		{
+			name: "rename onto a tag renamed from another",
+			key:  "deployment", value: "cloud",
+			update:  models.TagUpdateRequest{Operation: TAG_RENAME_VALUE, Value: "hosted"},
+			wantErr: true,
+		},
+		{
+			name: "merge",
+			key:  "deployment", value: "saas",
+			update: models.TagUpdateRequest{Operation: TAG_MERGE, Key: "deployment", Value: "cloud"},
+			want:   []models.TagRename{{FromKey: "deployment", FromValue: "saas", ToKey: "deployment", ToValue: "cloud"}},
+		},
+		{
+			name: "merge into a missing tag",
+			key:  "deployment", value: "saas",
+			update:  models.TagUpdateRequest{Operation: TAG_MERGE, Key: "deployment", Value: "edge"},
+			wantErr: true,
+		},
+		{
+			name:    "rename key onto a stored tag",
+			key:     "deployment",
+			update:  models.TagUpdateRequest{Operation: TAG_RENAME_KEY, Key: "hosting"},
+			wantErr: true,
+		},
+		{
+			name:   "rename key",
+			key:    "hosting",
+			update: models.TagUpdateRequest{Operation: TAG_RENAME_KEY, Key: "host"},
+			want:   []models.TagRename{{FromKey: "hosting", FromValue: "saas", ToKey: "host", ToValue: "saas"}},
+		},
+		{
+			name: "missing tag",
+			key:  "stage", value: "beta",
+			update:  models.TagUpdateRequest{Operation: TAG_RENAME_VALUE, Value: "ga"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			renames, err := TagRenames(tags, tt.key, tt.value, tt.update)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("renames %v, want an error", renames)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if len(renames) != len(tt.want) {
+				t.Fatalf("renames %v, want %v", renames, tt.want)
+			}
+			for i := range renames {
+				if renames[i] != tt.want[i] {
+					t.Errorf("rename %v, want %v", renames[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRenameCategoryMerge(t *testing.T) {
+	merge := []models.TagRename{{FromKey: "deployment", FromValue: "saas", ToKey: "deployment", ToValue: "cloud"}}
+	category := []models.Category{{Key: "deployment", Value: "cloud"}, {Key: "Deployment", Value: "SaaS"}, {Key: "stage", Value: "ga"}}
+
+	renamed, changed := RenameCategory(category, merge)
+	if !changed {
+		t.Error("category unchanged")
+	}
+	if len(renamed) != 2 || renamed[0].Value != "cloud" || renamed[1].Key != "stage" {
+		t.Errorf("category %v, want deployment:cloud and stage:ga", renamed)
+	}
+}
+
+func TestRenameRulesDuplicates(t *testing.T) {
+	merge := []models.TagRename{{FromKey: "deployment", FromValue: "saas", ToKey: "deployment", ToValue: "cloud"}}
+	target := models.RuleResponse{RuleUUID: "target", Operation: CONTAIN, TagKey: "deployment", TagValue: "cloud",
+		MetadataField: "description", Keyword: "aws"}
+
+	tests := []struct {
+		name       string
+		rule       models.RuleResponse
+		duplicated bool
+	}{
+		{
+			name: "legacy rules with different keywords",
+			rule: models.RuleResponse{RuleUUID: "merged", Operation: CONTAIN, TagKey: "deployment", TagValue: "saas",
+				MetadataField: "description", Keyword: "azure"},
+		},
+		{
+			name: "legacy rules with the same keyword",
+			rule: models.RuleResponse{RuleUUID: "merged", Operation: CONTAIN, TagKey: "deployment", TagValue: "saas",
+				MetadataField: "description", Keyword: "aws"},
+			duplicated: true,
+		},
+		{
+			name: "expression of the legacy rule",
+			rule: models.RuleResponse{RuleUUID: "merged", Operation: EXPRESSION, TagKey: "deployment", TagValue: "saas",
+				Expression: LegacyExpression(target, RuleSchema)},
+			duplicated: true,
+		},
+		{
+			name: "rule failing to compile",
+			rule: models.RuleResponse{RuleUUID: "merged", Operation: EXPRESSION, TagKey: "deployment", TagValue: "saas",
+				Expression: "description contains"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updated, duplicates := RenameRules([]models.RuleResponse{target, tt.rule}, merge, nil)
+
+			renamed := updated
+			if tt.duplicated {
+				renamed = duplicates
+			}
+			if len(updated)+len(duplicates) != 1 || len(renamed) != 1 || renamed[0].RuleUUID != "merged" {
+				t.Fatalf("updated %v, duplicates %v", updated, duplicates)
+			}
+			if renamed[0].TagValue != "cloud" {
+				t.Errorf("tag value %v, want cloud", renamed[0].TagValue)
+			}
+		})
+	}
+}